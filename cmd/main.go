@@ -1,18 +1,31 @@
 package main
 
 import (
+	"context"
+	"filippo.io/age"
 	"flag"
 	"fmt"
 	"github.com/BurntSushi/toml"
 	"github.com/sirupsen/logrus"
 	"github.com/threetoes/peeper/internal/config"
+	"github.com/threetoes/peeper/internal/inbound"
+	"github.com/threetoes/peeper/internal/logging"
+	"github.com/threetoes/peeper/internal/secrets"
 	"github.com/threetoes/peeper/internal/service"
+	"github.com/threetoes/peeper/internal/vault"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
 	"sort"
+	"strings"
+	"time"
 )
 
 type opts struct {
 	ConfigFile *string
 	LogFormat  *string
+	LogLevel   *string
 }
 
 func (o *opts) verify() error {
@@ -39,6 +52,19 @@ func (e endpointSorter) Swap(i, j int) {
 }
 
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == "encrypt" {
+		if err := encrypt(os.Args[2:]); err != nil {
+			logrus.Fatalf("could not encrypt value: %v", err)
+		}
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "sign" {
+		if err := sign(os.Args[2:]); err != nil {
+			logrus.Fatalf("could not sign URL: %v", err)
+		}
+		return
+	}
+
 	opts, err := parseOpts()
 	if err != nil {
 		logrus.Fatalf("error parsing command line options: %v", err)
@@ -51,6 +77,12 @@ func main() {
 	if *opts.LogFormat == "json" {
 		logrus.SetFormatter(&logrus.JSONFormatter{})
 	}
+	level, err := logrus.ParseLevel(*opts.LogLevel)
+	if err != nil {
+		logrus.Fatalf("error parsing command line options: %v", err)
+	}
+	logrus.SetLevel(level)
+	logrus.AddHook(logging.RedactionHook{})
 
 	var conf config.AppOptions
 
@@ -60,7 +92,36 @@ func main() {
 		logrus.Fatalf("could not decode config file: %v", err)
 	}
 
-	svr := service.New(fmt.Sprintf("%s:%d", conf.Network.BindInterface, conf.Network.BindPort))
+	if conf.Logging != nil {
+		logging.AddRedactedHeaders(conf.Logging.RedactHeaders...)
+	}
+
+	if conf.Network == nil && len(conf.Listeners) == 0 {
+		logrus.Fatalf("config needs a network block or at least one listener")
+	}
+	addr := ""
+	if conf.Network != nil {
+		addr = conf.Network.Address()
+	}
+	svr := service.New(addr)
+
+	ageResolver, err := newAgeResolver(&conf)
+	if err != nil {
+		logrus.Fatalf("%v", err)
+	}
+	resolvers := secrets.Chain{ageResolver}
+	provider, err := newVaultProvider(&conf, ageResolver)
+	if err != nil {
+		logrus.Fatalf("%v", err)
+	}
+	if provider != nil {
+		resolvers = append(resolvers, provider)
+	}
+	svr.SetSecretResolver(resolvers)
+
+	if err := svr.Configure(&conf); err != nil {
+		logrus.Fatalf("could not configure service: %v", err)
+	}
 
 	sorter := endpointSorter{}
 
@@ -72,21 +133,177 @@ func main() {
 
 	for _, e := range sorter {
 		logrus.Infof("Mapping local endpoint %s to remote endpoint %s", e.LocalPath, e.RemotePath)
-		svr.RegisterEndpoint(e)
+		if err := svr.RegisterEndpoint(e); err != nil {
+			logrus.Fatalf("could not register endpoint %s: %v", e.LocalPath, err)
+		}
+	}
+
+	// Secrets are only refreshed once every endpoint is registered, so a change never sees half of them
+	ctx, cancel := context.WithCancel(context.Background())
+	if provider != nil {
+		provider.OnChange(func() error {
+			if err := svr.RefreshCredentials(); err != nil {
+				return err
+			}
+			logrus.Infof("refreshed credentials after a vault secret changed")
+			return nil
+		})
+		go provider.Run(ctx)
 	}
 
-	logrus.Infof("binding to %s:%d", conf.Network.BindInterface, conf.Network.BindPort)
-	if err := svr.Start(); err != nil {
+	err = svr.Start()
+	cancel()
+	if err != nil {
 		logrus.Infof("error while serving: %v", err)
 	}
 }
 
+// newAgeResolver returns the resolver for age encrypted values in conf
+func newAgeResolver(conf *config.AppOptions) (*secrets.AgeResolver, error) {
+	identityFile := ""
+	if conf.Secrets != nil {
+		identityFile = conf.Secrets.AgeIdentityFile
+	}
+	resolver, err := secrets.NewAgeResolver(identityFile)
+	if err != nil {
+		return nil, fmt.Errorf("could not load age identities: %v", err)
+	}
+	return resolver, nil
+}
+
+// newVaultProvider returns the vault provider if vault is configured. The provider is logged in but not yet running
+func newVaultProvider(conf *config.AppOptions, ageResolver *secrets.AgeResolver) (*vault.Provider, error) {
+	if conf.Vault == nil {
+		return nil, nil
+	}
+	if conf.Vault.AppRole != nil {
+		var err error
+		if conf.Vault.AppRole.SecretId, err = ageResolver.Resolve(conf.Vault.AppRole.SecretId); err != nil {
+			return nil, fmt.Errorf("could not decrypt vault secret ID: %v", err)
+		}
+	}
+	provider, err := vault.NewProvider(conf.Vault)
+	if err != nil {
+		return nil, fmt.Errorf("could not configure vault: %v", err)
+	}
+	if err := provider.Login(); err != nil {
+		return nil, fmt.Errorf("could not log in to vault: %v", err)
+	}
+	return provider, nil
+}
+
 func parseOpts() (*opts, error) {
 	var options opts
 	options.ConfigFile = flag.String("config", "", "Path to TOML config file")
 	options.LogFormat = flag.String("logformat", "text", "The log format to use. Supported formats: json, text")
+	options.LogLevel = flag.String("loglevel", "info", "The minimum level to log at, for example debug or info")
 
 	flag.Parse()
 
 	return &options, nil
 }
+
+// encrypt implements the `peeper encrypt` subcommand, which prints a value encrypted for pasting into a config file.
+// The value is read from stdin if it isn't passed as an argument
+func encrypt(args []string) error {
+	fs := flag.NewFlagSet("encrypt", flag.ExitOnError)
+	recipient := fs.String("recipient", "", "age public key to encrypt to")
+	identityFile := fs.String("identity", "", "age identity file to encrypt to, instead of -recipient")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	var recipients []age.Recipient
+	if *recipient != "" {
+		r, err := age.ParseX25519Recipient(*recipient)
+		if err != nil {
+			return err
+		}
+		recipients = append(recipients, r)
+	}
+	if *identityFile != "" {
+		f, err := os.Open(*identityFile)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		identities, err := age.ParseIdentities(f)
+		if err != nil {
+			return err
+		}
+		for _, i := range identities {
+			if x, ok := i.(*age.X25519Identity); ok {
+				recipients = append(recipients, x.Recipient())
+			}
+		}
+	}
+	if len(recipients) == 0 {
+		return fmt.Errorf("one of -recipient or -identity must be set")
+	}
+
+	var value string
+	if fs.NArg() > 0 {
+		value = fs.Arg(0)
+	} else {
+		stdin, err := ioutil.ReadAll(os.Stdin)
+		if err != nil {
+			return err
+		}
+		value = strings.TrimRight(string(stdin), "\r\n")
+	}
+
+	encrypted, err := secrets.EncryptAge(value, recipients...)
+	if err != nil {
+		return err
+	}
+	fmt.Println(encrypted)
+	return nil
+}
+
+// sign implements the `peeper sign` subcommand, which prints a pre-signed version of a URL using the signed_urls key
+// from the config file
+func sign(args []string) error {
+	fs := flag.NewFlagSet("sign", flag.ExitOnError)
+	configFile := fs.String("config", "", "Path to TOML config file")
+	method := fs.String("method", http.MethodGet, "The method the URL may be used with")
+	expiresIn := fs.Duration("expires", time.Hour, "How long the URL is valid for")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if *configFile == "" || fs.NArg() != 1 {
+		return fmt.Errorf("usage: peeper sign -config <file> [-method GET] [-expires 1h] <url>")
+	}
+
+	var conf config.AppOptions
+	if _, err := toml.DecodeFile(*configFile, &conf); err != nil {
+		return fmt.Errorf("could not decode config file: %v", err)
+	}
+	if conf.SignedURLs == nil {
+		return fmt.Errorf("signed_urls is not configured")
+	}
+	if strings.HasPrefix(conf.SignedURLs.Key, vault.ReferencePrefix) {
+		return fmt.Errorf("signed_urls key is a vault reference, which peeper sign doesn't resolve")
+	}
+	ageResolver, err := newAgeResolver(&conf)
+	if err != nil {
+		return err
+	}
+	key, err := ageResolver.Resolve(conf.SignedURLs.Key)
+	if err != nil {
+		return err
+	}
+	signer, err := inbound.NewURLSigner(conf.SignedURLs, secrets.NewSecret(key))
+	if err != nil {
+		return err
+	}
+	u, err := url.Parse(fs.Arg(0))
+	if err != nil {
+		return err
+	}
+	signed, err := signer.Sign(u, strings.ToUpper(*method), time.Now().Add(*expiresIn))
+	if err != nil {
+		return err
+	}
+	fmt.Println(signed)
+	return nil
+}
@@ -0,0 +1,237 @@
+package assertion
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/golang-jwt/jwt/v4"
+	"github.com/threetoes/peeper/internal/config"
+	"github.com/threetoes/peeper/internal/inbound"
+	"github.com/threetoes/peeper/internal/tenant"
+)
+
+const (
+	defaultIssuer   = "peeper"
+	defaultTTL      = time.Minute
+	defaultJWKSPath = "/.well-known/jwks.json"
+	defaultHeader   = "X-Peeper-Identity"
+)
+
+// Signer mints short-lived JWTs describing the caller of a request, so that upstreams can tell who the original
+// caller was without trusting plain headers
+type Signer struct {
+	key      crypto.Signer
+	method   jwt.SigningMethod
+	keyId    string
+	issuer   string
+	ttl      time.Duration
+	jwksPath string
+	// jwks is the published key set, which never changes
+	jwks []byte
+	now  func() time.Time
+}
+
+// Assert returns a signed assertion of identity, which belongs to tenant if the endpoint has tenants, for audience
+func (s *Signer) Assert(identity *inbound.Identity, tenant, audience string) (string, error) {
+	id := make([]byte, 16)
+	if _, err := io.ReadFull(rand.Reader, id); err != nil {
+		return "", err
+	}
+	now := s.now()
+	claims := jwt.MapClaims{
+		"iss":         s.issuer,
+		"sub":         identity.Subject,
+		"iat":         now.Unix(),
+		"nbf":         now.Unix(),
+		"exp":         now.Add(s.ttl).Unix(),
+		"jti":         base64.RawURLEncoding.EncodeToString(id),
+		"auth_method": identity.Method,
+	}
+	if audience != "" {
+		claims["aud"] = audience
+	}
+	if tenant != "" {
+		claims["tenant"] = tenant
+	}
+	if identity.Method == "api_key" {
+		claims["api_key"] = identity.Subject
+	}
+	if len(identity.Scopes) > 0 {
+		claims["scope"] = strings.Join(identity.Scopes, " ")
+	}
+	if cert := identity.Certificate; cert != nil {
+		thumbprint := sha256.Sum256(cert.Raw)
+		// The certificate is identified the way RFC 8705 binds tokens to certificates
+		claims["cnf"] = map[string]string{"x5t#S256": base64.RawURLEncoding.EncodeToString(thumbprint[:])}
+		claims["cert"] = inbound.CertificateName(cert)
+	}
+	token := jwt.NewWithClaims(s.method, claims)
+	token.Header["kid"] = s.keyId
+	token.Header["typ"] = "JWT"
+	return token.SignedString(s.key)
+}
+
+// Register adds the JWKS route to mux
+func (s *Signer) Register(mux *http.ServeMux) {
+	mux.HandleFunc(s.jwksPath, func(rw http.ResponseWriter, req *http.Request) {
+		if req.Method != http.MethodGet && req.Method != http.MethodHead {
+			rw.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		rw.Header().Set("Content-Type", "application/json")
+		rw.Header().Set("Cache-Control", "public, max-age=300")
+		rw.Write(s.jwks)
+	})
+}
+
+// Injector returns an injector adding assertions to forwarded requests as configured by conf
+func (s *Signer) Injector(conf *config.IdentityAssertionConfig) *Injector {
+	header := conf.Header
+	if header == "" {
+		header = defaultHeader
+	}
+	return &Injector{signer: s, header: header, audience: conf.Audience}
+}
+
+// Injector adds an assertion of the caller's identity, carried in the request's context, to forwarded requests.
+// Any assertion header sent by the caller is removed, so it can't be forged
+type Injector struct {
+	signer   *Signer
+	header   string
+	audience string
+}
+
+func (i *Injector) InjectCredentials(req *http.Request) error {
+	req.Header.Del(i.header)
+	identity := inbound.IdentityFrom(req.Context())
+	if identity == nil {
+		return nil
+	}
+	token, err := i.signer.Assert(identity, tenant.From(req.Context()), i.audience)
+	if err != nil {
+		return fmt.Errorf("could not sign identity assertion: %v", err)
+	}
+	req.Header.Set(i.header, token)
+	return nil
+}
+
+// parsePrivateKey reads a PEM encoded private key, returning it with the algorithm it signs with
+func parsePrivateKey(contents []byte) (crypto.Signer, jwt.SigningMethod, error) {
+	block, _ := pem.Decode(contents)
+	if block == nil {
+		return nil, nil, fmt.Errorf("identity assertion key file is not PEM encoded")
+	}
+	var key interface{}
+	var err error
+	switch block.Type {
+	case "PRIVATE KEY":
+		key, err = x509.ParsePKCS8PrivateKey(block.Bytes)
+	case "RSA PRIVATE KEY":
+		key, err = x509.ParsePKCS1PrivateKey(block.Bytes)
+	case "EC PRIVATE KEY":
+		key, err = x509.ParseECPrivateKey(block.Bytes)
+	default:
+		return nil, nil, fmt.Errorf("unsupported PEM block '%s' in identity assertion key file", block.Type)
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	switch k := key.(type) {
+	case *rsa.PrivateKey:
+		return k, jwt.SigningMethodRS256, nil
+	case *ecdsa.PrivateKey:
+		if k.Curve != elliptic.P256() {
+			return nil, nil, fmt.Errorf("only P-256 ECDSA keys are supported")
+		}
+		return k, jwt.SigningMethodES256, nil
+	case ed25519.PrivateKey:
+		return k, jwt.SigningMethodEdDSA, nil
+	}
+	return nil, nil, fmt.Errorf("unsupported identity assertion key type %T", key)
+}
+
+// publicJWK returns the members of the JWK for key that are used in its RFC 7638 thumbprint
+func publicJWK(key crypto.PublicKey) map[string]string {
+	encode := base64.RawURLEncoding.EncodeToString
+	switch k := key.(type) {
+	case *rsa.PublicKey:
+		return map[string]string{"kty": "RSA", "n": encode(k.N.Bytes()), "e": encode(big.NewInt(int64(k.E)).Bytes())}
+	case *ecdsa.PublicKey:
+		x, y := make([]byte, 32), make([]byte, 32)
+		return map[string]string{"kty": "EC", "crv": "P-256", "x": encode(k.X.FillBytes(x)), "y": encode(k.Y.FillBytes(y))}
+	case ed25519.PublicKey:
+		return map[string]string{"kty": "OKP", "crv": "Ed25519", "x": encode(k)}
+	}
+	return nil
+}
+
+// thumbprint returns the RFC 7638 thumbprint of jwk. Maps are marshalled with sorted keys and no whitespace, as
+// the thumbprint needs
+func thumbprint(jwk map[string]string) (string, error) {
+	canonical, err := json.Marshal(jwk)
+	if err != nil {
+		return "", err
+	}
+	sum := sha256.Sum256(canonical)
+	return base64.RawURLEncoding.EncodeToString(sum[:]), nil
+}
+
+// NewSigner returns a Signer using the key in conf
+func NewSigner(conf *config.IdentityAssertionsConfig) (*Signer, error) {
+	if conf.KeyFile == "" {
+		return nil, fmt.Errorf("identity_assertions needs key_file to be set")
+	}
+	contents, err := ioutil.ReadFile(conf.KeyFile)
+	if err != nil {
+		return nil, fmt.Errorf("could not read identity assertion key file: %v", err)
+	}
+	key, method, err := parsePrivateKey(contents)
+	if err != nil {
+		return nil, err
+	}
+	jwk := publicJWK(key.Public())
+	s := &Signer{
+		key:      key,
+		method:   method,
+		keyId:    conf.KeyId,
+		issuer:   conf.Issuer,
+		ttl:      conf.TTL.Or(defaultTTL),
+		jwksPath: conf.JWKSPath,
+		now:      time.Now,
+	}
+	if s.keyId == "" {
+		if s.keyId, err = thumbprint(jwk); err != nil {
+			return nil, err
+		}
+	}
+	if s.issuer == "" {
+		s.issuer = defaultIssuer
+	}
+	if s.jwksPath == "" {
+		s.jwksPath = defaultJWKSPath
+	}
+	published := map[string]string{"kid": s.keyId, "alg": method.Alg(), "use": "sig"}
+	for k, v := range jwk {
+		published[k] = v
+	}
+	if s.jwks, err = json.Marshal(map[string]interface{}{"keys": []map[string]string{published}}); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
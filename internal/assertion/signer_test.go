@@ -0,0 +1,145 @@
+package assertion
+
+import (
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/threetoes/peeper/internal/config"
+	"github.com/threetoes/peeper/internal/inbound"
+	"github.com/threetoes/peeper/internal/tenant"
+)
+
+func writeKey(t *testing.T, key interface{}) string {
+	t.Helper()
+	der, err := x509.MarshalPKCS8PrivateKey(key)
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	file := filepath.Join(t.TempDir(), "key.pem")
+	if err := ioutil.WriteFile(file, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return file
+}
+
+// verifier returns a validator using the JWKS published by signer, as an upstream would
+func verifier(t *testing.T, signer *Signer, audience string) *inbound.JWTValidator {
+	t.Helper()
+	mux := http.NewServeMux()
+	signer.Register(mux)
+	server := httptest.NewServer(mux)
+	t.Cleanup(server.Close)
+	jwks, err := inbound.NewJWKSFromURL(server.URL+defaultJWKSPath, 0)
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	return inbound.NewJWTValidator(jwks, &config.JWTAuthConfig{Issuer: "peeper", Audiences: []string{audience}})
+}
+
+func TestSigner_KeyTypes(t *testing.T) {
+	rsaKey, _ := rsa.GenerateKey(rand.Reader, 2048)
+	ecKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	_, edKey, _ := ed25519.GenerateKey(rand.Reader)
+	keys := map[string]interface{}{"RS256": rsaKey, "ES256": ecKey, "EdDSA": edKey}
+	for alg, key := range keys {
+		t.Run(alg, func(t *testing.T) {
+			signer, err := NewSigner(&config.IdentityAssertionsConfig{KeyFile: writeKey(t, key)})
+			if !assert.NoError(t, err) {
+				t.FailNow()
+			}
+			assert.Equal(t, alg, signer.method.Alg())
+			token, err := signer.Assert(&inbound.Identity{Subject: "alice", Method: "jwt"}, "", "orders")
+			if !assert.NoError(t, err) {
+				t.FailNow()
+			}
+			claims, err := verifier(t, signer, "orders").Validate(token)
+			if assert.NoError(t, err) {
+				assert.Equal(t, "alice", claims["sub"])
+				assert.Equal(t, "jwt", claims["auth_method"])
+			}
+		})
+	}
+}
+
+func TestSigner_UnsupportedKey(t *testing.T) {
+	key, _ := ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
+	_, err := NewSigner(&config.IdentityAssertionsConfig{KeyFile: writeKey(t, key)})
+	assert.Error(t, err)
+}
+
+func TestInjector(t *testing.T) {
+	key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	signer, err := NewSigner(&config.IdentityAssertionsConfig{KeyFile: writeKey(t, key)})
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	validator := verifier(t, signer, "billing")
+	injector := signer.Injector(&config.IdentityAssertionConfig{Audience: "billing"})
+	cert := &x509.Certificate{Raw: []byte("certificate")}
+
+	tests := []struct {
+		name       string
+		identity   *inbound.Identity
+		tenant     string
+		wantClaims map[string]interface{}
+	}{
+		{name: "anonymous"},
+		{
+			name:       "api key",
+			identity:   &inbound.Identity{Subject: "reporting", Method: "api_key"},
+			tenant:     "acme",
+			wantClaims: map[string]interface{}{"sub": "reporting", "api_key": "reporting", "tenant": "acme", "aud": "billing"},
+		},
+		{
+			name:     "certificate",
+			identity: &inbound.Identity{Subject: "alice", Method: "jwt", Scopes: []string{"read", "write"}, Certificate: cert},
+			wantClaims: map[string]interface{}{
+				"sub":   "alice",
+				"scope": "read write",
+				"cnf":   map[string]interface{}{"x5t#S256": "A9Zt0Ig1wco_EozOrNHzGslBYwlrIPRFroQoW8CDLXI"},
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest("GET", "/", nil)
+			req.Header.Set(defaultHeader, "forged")
+			ctx := req.Context()
+			if tt.identity != nil {
+				ctx = inbound.WithIdentity(ctx, tt.identity)
+			}
+			if tt.tenant != "" {
+				ctx = tenant.WithTenant(ctx, tt.tenant)
+			}
+			req = req.WithContext(ctx)
+			if !assert.NoError(t, injector.InjectCredentials(req)) {
+				return
+			}
+			if tt.identity == nil {
+				assert.Empty(t, req.Header.Get(defaultHeader), "callers can't forge an assertion")
+				return
+			}
+			claims, err := validator.Validate(req.Header.Get(defaultHeader))
+			if !assert.NoError(t, err) {
+				return
+			}
+			for k, v := range tt.wantClaims {
+				assert.Equal(t, v, claims[k], k)
+			}
+			if tt.tenant == "" {
+				assert.NotContains(t, claims, "tenant")
+			}
+		})
+	}
+}
@@ -1,22 +1,27 @@
 package auth
 
 import (
+	"github.com/threetoes/peeper/internal/secrets"
 	"net/http"
 )
 
 type BasicAuth struct {
 	username string
-	password string
+	password secrets.Secret
 }
 
 func (b *BasicAuth) InjectCredentials(req *http.Request) error {
-	req.SetBasicAuth(b.username, b.password)
+	req.SetBasicAuth(b.username, b.password.Reveal())
 	return nil
 }
 
+func (b *BasicAuth) Zero() {
+	b.password.Zero()
+}
+
 func NewBasicAuth(username string, password string) *BasicAuth {
 	return &BasicAuth{
 		username: username,
-		password: password,
+		password: secrets.NewSecret(password),
 	}
 }
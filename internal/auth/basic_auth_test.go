@@ -14,5 +14,5 @@ func TestBasicAuth_InjectCredentials(t *testing.T) {
 	actualUsername, actualPassword, ok := req.BasicAuth()
 	assert.True(t, ok)
 	assert.Equal(t, b.username, actualUsername)
-	assert.Equal(t, b.password, actualPassword)
+	assert.Equal(t, b.password.Reveal(), actualPassword)
 }
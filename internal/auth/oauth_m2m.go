@@ -5,6 +5,7 @@ package auth
 import (
 	"encoding/json"
 	"fmt"
+	"github.com/threetoes/peeper/internal/secrets"
 	"io/ioutil"
 	"net/http"
 	"net/url"
@@ -21,7 +22,7 @@ type token struct {
 // workflow
 type OAuthM2MCredentialInjector struct {
 	clientId        string
-	clientSecret    string
+	clientSecret    secrets.Secret
 	tokenEndpoint   string
 	extraFormValues map[string]string
 }
@@ -47,7 +48,7 @@ func (o *OAuthM2MCredentialInjector) getToken(extraFormValues map[string]string)
 		return nil, err
 	}
 	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
-	req.SetBasicAuth(o.clientId, o.clientSecret)
+	req.SetBasicAuth(o.clientId, o.clientSecret.Reveal())
 	form := url.Values{}
 	form.Set("grant_type", "client_credentials")
 	form.Set("client_id", o.clientId)
@@ -71,16 +72,21 @@ func (o *OAuthM2MCredentialInjector) getToken(extraFormValues map[string]string)
 	var tok token
 	err = json.Unmarshal(body, &tok)
 	if err != nil {
-		return nil, err
+		// Don't wrap the decoder error, which could quote part of the token response
+		return nil, fmt.Errorf("could not decode token response")
 	}
 
 	return &tok, nil
 }
 
+func (o *OAuthM2MCredentialInjector) Zero() {
+	o.clientSecret.Zero()
+}
+
 func NewOAuthInjector(tokenEndpoint, clientId, clientSecret string, extraFormValues map[string]string) *OAuthM2MCredentialInjector {
 	return &OAuthM2MCredentialInjector{
 		clientId:        clientId,
-		clientSecret:    clientSecret,
+		clientSecret:    secrets.NewSecret(clientSecret),
 		tokenEndpoint:   tokenEndpoint,
 		extraFormValues: extraFormValues,
 	}
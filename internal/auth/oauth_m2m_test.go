@@ -3,6 +3,7 @@ package auth
 import (
 	"encoding/json"
 	"github.com/stretchr/testify/assert"
+	"github.com/threetoes/peeper/internal/secrets"
 	"net"
 	"net/http"
 	"net/http/httptest"
@@ -13,7 +14,7 @@ func TestOAuthM2MCredentialInjector_InjectCredentials(t *testing.T) {
 	t.Run("get token success", func(t *testing.T) {
 		o := &OAuthM2MCredentialInjector{
 			clientId:      "fakeId",
-			clientSecret:  "fakeSecret",
+			clientSecret:  secrets.NewSecret("fakeSecret"),
 			tokenEndpoint: "http://localhost:9092/oauth/token",
 			extraFormValues: map[string]string{
 				"test-extra": "extra value",
@@ -95,7 +96,7 @@ func TestOAuthM2MCredentialInjector_InjectCredentials(t *testing.T) {
 	t.Run("get token failure", func(t *testing.T) {
 		o := &OAuthM2MCredentialInjector{
 			clientId:      "fakeId",
-			clientSecret:  "fakeSecret",
+			clientSecret:  secrets.NewSecret("fakeSecret"),
 			tokenEndpoint: "http://localhost:9092/oauth/token",
 			extraFormValues: map[string]string{
 				"test-extra": "extra value",
@@ -1,24 +1,35 @@
 package auth
 
 import (
+	"github.com/threetoes/peeper/internal/secrets"
 	"net/http"
 )
 
 type StaticKeyInjector struct {
-	headers map[string]string
+	headers map[string]secrets.Secret
 }
 
 func (s *StaticKeyInjector) InjectCredentials(req *http.Request) error {
 	for k, v := range s.headers {
-		req.Header.Set(k, v)
+		req.Header.Set(k, v.Reveal())
 	}
 	return nil
 }
 
+func (s *StaticKeyInjector) Zero() {
+	for _, v := range s.headers {
+		v.Zero()
+	}
+}
+
 // NewStaticKeyInjector will return a pointer to a StaticKeyInjector. The map headers is a collection of key-value
 // pairs, where the key is the header name and the value is what it should be set to
 func NewStaticKeyInjector(headers map[string]string) *StaticKeyInjector {
+	secretHeaders := make(map[string]secrets.Secret, len(headers))
+	for k, v := range headers {
+		secretHeaders[k] = secrets.NewSecret(v)
+	}
 	return &StaticKeyInjector{
-		headers: headers,
+		headers: secretHeaders,
 	}
 }
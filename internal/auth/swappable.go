@@ -0,0 +1,62 @@
+package auth
+
+import (
+	"net/http"
+	"sync"
+	"sync/atomic"
+)
+
+// Zeroer is implemented by injectors holding secrets that can be wiped once the injector is no longer in use
+type Zeroer interface {
+	Zero()
+}
+
+type injectorHolder struct {
+	injector CredentialInjector
+	// lock is held for reading while the injector is in use, and for writing while it is retired
+	lock    sync.RWMutex
+	retired bool
+}
+
+// SwappableInjector wraps another CredentialInjector so that it can be replaced, for example after a secret is
+// rotated, without blocking or dropping requests that are in flight
+type SwappableInjector struct {
+	current atomic.Value
+}
+
+func (s *SwappableInjector) InjectCredentials(req *http.Request) error {
+	for {
+		holder := s.current.Load().(*injectorHolder)
+		holder.lock.RLock()
+		if holder.retired {
+			// Swapped out between loading and locking, so pick up the replacement
+			holder.lock.RUnlock()
+			continue
+		}
+		err := holder.injector.InjectCredentials(req)
+		holder.lock.RUnlock()
+		return err
+	}
+}
+
+// Swap replaces the wrapped injector. Requests already using the old injector finish with it, after which any
+// secrets it holds are zeroed
+func (s *SwappableInjector) Swap(injector CredentialInjector) {
+	old, _ := s.current.Load().(*injectorHolder)
+	s.current.Store(&injectorHolder{injector: injector})
+	if old == nil {
+		return
+	}
+	old.lock.Lock()
+	old.retired = true
+	if z, ok := old.injector.(Zeroer); ok {
+		z.Zero()
+	}
+	old.lock.Unlock()
+}
+
+func NewSwappableInjector(injector CredentialInjector) *SwappableInjector {
+	s := &SwappableInjector{}
+	s.Swap(injector)
+	return s
+}
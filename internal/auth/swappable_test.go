@@ -0,0 +1,32 @@
+package auth
+
+import (
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSwappableInjector_Swap(t *testing.T) {
+	s := NewSwappableInjector(NewStaticKeyInjector(map[string]string{"x-api-key": "old"}))
+	req := httptest.NewRequest("GET", "/test", nil)
+	assert.NoError(t, s.InjectCredentials(req))
+	assert.Equal(t, "old", req.Header.Get("x-api-key"))
+
+	s.Swap(NewStaticKeyInjector(map[string]string{"x-api-key": "new"}))
+	req = httptest.NewRequest("GET", "/test", nil)
+	assert.NoError(t, s.InjectCredentials(req))
+	assert.Equal(t, "new", req.Header.Get("x-api-key"))
+}
+
+func TestSwappableInjector_ZeroesOldInjector(t *testing.T) {
+	old := NewBasicAuth("bigboss", "sn@ke3ateR")
+	s := NewSwappableInjector(old)
+	s.Swap(NewBasicAuth("bigboss", "new password"))
+	assert.Equal(t, "\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00", old.password.Reveal())
+
+	req := httptest.NewRequest("GET", "/test", nil)
+	assert.NoError(t, s.InjectCredentials(req))
+	_, password, _ := req.BasicAuth()
+	assert.Equal(t, "new password", password)
+}
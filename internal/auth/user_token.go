@@ -0,0 +1,39 @@
+package auth
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+)
+
+type userTokenKey struct{}
+
+// WithUserToken returns a copy of ctx carrying the access token of the logged in user
+func WithUserToken(ctx context.Context, token string) context.Context {
+	return context.WithValue(ctx, userTokenKey{}, token)
+}
+
+// UserTokenInjector injects the access token of the user making the request, which is carried in the request's
+// context
+type UserTokenInjector struct {
+	header string
+}
+
+func (u *UserTokenInjector) InjectCredentials(req *http.Request) error {
+	token, _ := req.Context().Value(userTokenKey{}).(string)
+	if token == "" {
+		return fmt.Errorf("no user is logged in")
+	}
+	if u.header == "" {
+		req.Header.Set("Authorization", fmt.Sprintf("Bearer %s", token))
+	} else {
+		req.Header.Set(u.header, token)
+	}
+	return nil
+}
+
+// NewUserTokenInjector returns a UserTokenInjector. The token is sent as a bearer token unless header is set, in
+// which case it is sent as is in that header
+func NewUserTokenInjector(header string) *UserTokenInjector {
+	return &UserTokenInjector{header: header}
+}
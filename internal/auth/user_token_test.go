@@ -0,0 +1,23 @@
+package auth
+
+import (
+	"github.com/stretchr/testify/assert"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestUserTokenInjector_InjectCredentials(t *testing.T) {
+	req := httptest.NewRequest("GET", "/test", nil)
+	req = req.WithContext(WithUserToken(req.Context(), "user-token"))
+
+	err := NewUserTokenInjector("").InjectCredentials(req)
+	assert.NoError(t, err)
+	assert.Equal(t, "Bearer user-token", req.Header.Get("Authorization"))
+
+	err = NewUserTokenInjector("X-User-Token").InjectCredentials(req)
+	assert.NoError(t, err)
+	assert.Equal(t, "user-token", req.Header.Get("X-User-Token"))
+
+	err = NewUserTokenInjector("").InjectCredentials(httptest.NewRequest("GET", "/test", nil))
+	assert.Error(t, err, "there's no token without a session")
+}
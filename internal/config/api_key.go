@@ -0,0 +1,15 @@
+package config
+
+// APIKeysConfig configures the store of API keys that callers can use to authenticate to peeper
+type APIKeysConfig struct {
+	// KeyFile is a TOML file of hashed keys. It is reloaded when it changes
+	KeyFile string `toml:"key_file"`
+	// ReloadInterval is how often KeyFile is checked for changes
+	ReloadInterval Duration `toml:"reload_interval"`
+}
+
+// APIKeyAuthConfig requires callers of an endpoint to present an API key from the key file
+type APIKeyAuthConfig struct {
+	// Header is the header callers put their key in. It is removed before the request is forwarded
+	Header string `toml:"header"`
+}
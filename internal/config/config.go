@@ -1,8 +1,23 @@
 package config
 
 type AppOptions struct {
-	Network   *NetworkConfig       `toml:"network"`
-	Endpoints map[string]*Endpoint `toml:"endpoints"`
+	// Network is the listener called `default`. It can be left out when Listeners are set
+	Network *NetworkConfig `toml:"network"`
+	// Listeners are more listeners by name, each configured like Network
+	Listeners map[string]*NetworkConfig `toml:"listeners"`
+	Endpoints map[string]*Endpoint      `toml:"endpoints"`
+	Vault     *VaultConfig              `toml:"vault"`
+	Secrets   *SecretsConfig            `toml:"secrets"`
+	Logging   *LoggingConfig            `toml:"logging"`
+	APIKeys   *APIKeysConfig            `toml:"api_keys"`
+	// SignedURLs is needed by endpoints with signed_url set
+	SignedURLs *SignedURLsConfig `toml:"signed_urls"`
+	// OIDC is needed by endpoints with user_session set
+	OIDC *OIDCConfig `toml:"oidc"`
+	// ForwardProxy is needed when the network's mode is `forward_proxy`
+	ForwardProxy *ForwardProxyConfig `toml:"forward_proxy"`
+	// IdentityAssertions is needed by endpoints with identity_assertion set
+	IdentityAssertions *IdentityAssertionsConfig `toml:"identity_assertions"`
 }
 
 type Endpoint struct {
@@ -13,9 +28,63 @@ type Endpoint struct {
 	BasicAuth     *BasicAuthConfig     `toml:"basic_auth"`
 	OAuthConfig   *OAuthConfig         `toml:"oauth"`
 	StaticKeyAuth *StaticKeyAuthConfig `toml:"static_key"`
+	UserToken     *UserTokenConfig     `toml:"user_token"`
+	Tenants       *TenantsConfig       `toml:"tenants"`
+	APIKeyAuth    *APIKeyAuthConfig    `toml:"api_key"`
+	JWTAuth       *JWTAuthConfig       `toml:"jwt"`
+	Introspection *IntrospectionConfig `toml:"introspection"`
+	Webhook       *WebhookConfig       `toml:"webhook"`
+	ClientCert    *ClientCertConfig    `toml:"client_cert"`
+	Policy        *PolicyConfig        `toml:"policy"`
+	ExtAuthz      *ExtAuthzConfig      `toml:"ext_authz"`
+	// IdentityAssertion tells the upstream who the caller is
+	IdentityAssertion *IdentityAssertionConfig `toml:"identity_assertion"`
+	// SignedURL lets callers without credentials in with a pre-signed link made by `peeper sign`. A valid link takes
+	// the place of the endpoint's other credentials, so it can't be used with UserSession or UserToken
+	SignedURL bool `toml:"signed_url"`
+	// UserSession requires callers to have logged in through the oidc login flow
+	UserSession bool `toml:"user_session"`
+	// Listeners names the listeners the endpoint is exposed on. It must be set when there is more than one listener
+	Listeners []string `toml:"listeners"`
+	// AllowCIDRs and DenyCIDRs restrict the client IPs that can call the endpoint, on top of the network's lists
+	AllowCIDRs []string `toml:"allow_cidrs"`
+	DenyCIDRs  []string `toml:"deny_cidrs"`
+	// UpstreamProtocol is the protocol used to reach the upstream: `auto` (the default) negotiates HTTP/2 over TLS
+	// and uses HTTP/1.1 otherwise, `http1` always uses HTTP/1.1, `h2` requires HTTP/2 over TLS and `h2c` uses
+	// cleartext HTTP/2 with prior knowledge
+	UpstreamProtocol string `toml:"upstream_protocol"`
+	// GRPC proxies gRPC calls, forwarding them to their /package.Service/Method path under the remote path. The
+	// upstream protocol defaults to h2, or h2c for http remote paths
+	GRPC bool `toml:"grpc"`
+	// UpgradeIdleTimeout is how long an upgraded connection, such as a WebSocket, can be idle before it is closed
+	UpgradeIdleTimeout Duration `toml:"upgrade_idle_timeout"`
+}
+
+// Credentials returns the endpoint's own credentials, used when no tenants are configured
+func (e *Endpoint) Credentials() *Credentials {
+	return &Credentials{
+		BasicAuth:     e.BasicAuth,
+		OAuthConfig:   e.OAuthConfig,
+		StaticKeyAuth: e.StaticKeyAuth,
+		UserToken:     e.UserToken,
+	}
 }
 
 type NetworkConfig struct {
-	BindInterface string `toml:"bind_interface"`
-	BindPort      uint32 `toml:"bind_port"`
+	// BindInterface may also be a Unix socket such as `unix:///run/peeper/peeper.sock`, when BindPort is ignored
+	BindInterface string            `toml:"bind_interface"`
+	BindPort      uint32            `toml:"bind_port"`
+	Socket        *UnixSocketConfig `toml:"socket"`
+	TLS           *TLSConfig        `toml:"tls"`
+	HTTP2         *HTTP2Config      `toml:"http2"`
+	// Mode is `reverse_proxy` (the default), serving endpoints, or `forward_proxy`, which also serves requests
+	// for any destination as configured by forward_proxy
+	Mode string `toml:"mode"`
+	// AllowCIDRs and DenyCIDRs restrict the client IPs that can call any endpoint. Denies take precedence, and an
+	// empty allow list allows everything not denied
+	AllowCIDRs []string `toml:"allow_cidrs"`
+	DenyCIDRs  []string `toml:"deny_cidrs"`
+	// TrustedProxies are the CIDRs of proxies in front of peeper. For requests from them the client IP is taken from
+	// X-Forwarded-For instead of the connection
+	TrustedProxies []string `toml:"trusted_proxies"`
 }
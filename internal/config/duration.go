@@ -0,0 +1,23 @@
+package config
+
+import "time"
+
+// Duration is a time.Duration that can be decoded from TOML strings such as "30s" or "5m"
+type Duration time.Duration
+
+func (d *Duration) UnmarshalText(text []byte) error {
+	parsed, err := time.ParseDuration(string(text))
+	if err != nil {
+		return err
+	}
+	*d = Duration(parsed)
+	return nil
+}
+
+// Or returns the duration, or def if the duration has not been set
+func (d Duration) Or(def time.Duration) time.Duration {
+	if d == 0 {
+		return def
+	}
+	return time.Duration(d)
+}
@@ -0,0 +1,20 @@
+package config
+
+// ExtAuthzConfig has an endpoint ask an external HTTP authorization service whether to let each request through,
+// in the spirit of Envoy's ext_authz filter
+type ExtAuthzConfig struct {
+	// URL is where checks are POSTed
+	URL string `toml:"url"`
+	// Timeout bounds each check, and defaults to 1s
+	Timeout Duration `toml:"timeout"`
+	// FailOpen lets requests through when the service can't be reached or gives an invalid answer. Requests are
+	// rejected with a 503 by default
+	FailOpen bool `toml:"fail_open"`
+	// CacheDuration is how long a decision is reused for identical requests. Decisions aren't cached by default, and
+	// caching needs Headers set
+	CacheDuration Duration `toml:"cache_duration"`
+	// CacheSize bounds the number of cached decisions
+	CacheSize int `toml:"cache_size"`
+	// Headers limits the request headers sent to the service. All headers are sent when empty
+	Headers []string `toml:"headers"`
+}
@@ -0,0 +1,41 @@
+package config
+
+// ForwardProxyConfig configures the forward proxy served when the network's mode is `forward_proxy`. Apps send
+// their requests through it, for example by setting HTTP_PROXY, and credentials are added by destination host
+type ForwardProxyConfig struct {
+	// Rules pick the credentials for a request by its destination host. The first matching rule is used
+	Rules []*ForwardProxyRule `toml:"rules"`
+	// AllowUnknownHosts lets requests to hosts no rule matches through without credentials. They are denied by
+	// default
+	AllowUnknownHosts bool `toml:"allow_unknown_hosts"`
+	// ConnectPorts are the ports CONNECT tunnels can be opened to. Only 443 is allowed by default
+	ConnectPorts []int `toml:"connect_ports"`
+	// TunnelIdleTimeout is how long a CONNECT tunnel can be idle before it is closed, and defaults to 10m
+	TunnelIdleTimeout Duration `toml:"tunnel_idle_timeout"`
+	// InterceptCA issues the certificates for hosts whose rule has intercept set
+	InterceptCA *InterceptCAConfig `toml:"intercept_ca"`
+}
+
+// InterceptCAConfig is a local CA that peeper issues certificates from to decrypt intercepted HTTPS requests. Apps
+// must trust it
+type InterceptCAConfig struct {
+	CertFile string `toml:"cert_file"`
+	KeyFile  string `toml:"key_file"`
+	// CertTTL is how long issued certificates are valid for, and defaults to 24h
+	CertTTL Duration `toml:"cert_ttl"`
+	// CacheSize is how many issued certificates are kept for reuse, and defaults to 1000
+	CacheSize int `toml:"cache_size"`
+}
+
+// ForwardProxyRule adds credentials to requests to some hosts
+type ForwardProxyRule struct {
+	// Hosts are patterns such as `api.vendor.com` or `*.vendor.com`, which matches subdomains only. A pattern with
+	// a port, such as `api.vendor.com:8443`, only matches that port
+	Hosts []string `toml:"hosts"`
+	// Credentials are added to plain HTTP requests, and HTTPS requests if Intercept is set. Other CONNECT tunnels
+	// are end to end, so are passed through as they are
+	Credentials *Credentials `toml:"credentials"`
+	// Intercept decrypts CONNECT tunnels to the hosts with a certificate from intercept_ca, so credentials can be
+	// added to the requests in them before they are encrypted again for the real host
+	Intercept bool `toml:"intercept"`
+}
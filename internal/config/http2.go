@@ -0,0 +1,11 @@
+package config
+
+// HTTP2Config configures HTTP/2 on the listener, which is offered to TLS clients with ALPN unless disabled
+type HTTP2Config struct {
+	// Disabled limits the listener to HTTP/1.1
+	Disabled bool `toml:"disabled"`
+	// H2C accepts cleartext HTTP/2, both from clients with prior knowledge and by upgrading HTTP/1.1 connections
+	H2C bool `toml:"h2c"`
+	// MaxConcurrentStreams limits the requests a client can have in flight on one connection. It defaults to 250
+	MaxConcurrentStreams uint32 `toml:"max_concurrent_streams"`
+}
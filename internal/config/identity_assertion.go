@@ -0,0 +1,27 @@
+package config
+
+// IdentityAssertionsConfig is the key peeper signs identity assertions with, needed by endpoints with
+// identity_assertion set
+type IdentityAssertionsConfig struct {
+	// KeyFile is a PEM encoded RSA, ECDSA P-256 or Ed25519 private key
+	KeyFile string `toml:"key_file"`
+	// KeyId is the key's `kid`. It defaults to the key's RFC 7638 thumbprint
+	KeyId string `toml:"key_id"`
+	// Issuer is the `iss` of assertions, and defaults to `peeper`
+	Issuer string `toml:"issuer"`
+	// TTL is how long an assertion is valid for, and defaults to 1m
+	TTL Duration `toml:"ttl"`
+	// JWKSPath is the local route the public key is published at, and defaults to `/.well-known/jwks.json`
+	JWKSPath string `toml:"jwks_path"`
+	// Listeners names the listeners the public key is published on. It must be set when there is more than one
+	// listener
+	Listeners []string `toml:"listeners"`
+}
+
+// IdentityAssertionConfig forwards a signed JWT describing the authenticated caller
+type IdentityAssertionConfig struct {
+	// Header carries the assertion, and defaults to `X-Peeper-Identity`
+	Header string `toml:"header"`
+	// Audience is the `aud` of assertions, typically naming the upstream
+	Audience string `toml:"audience"`
+}
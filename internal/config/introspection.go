@@ -0,0 +1,23 @@
+package config
+
+// IntrospectionConfig requires callers of an endpoint to present a bearer token that an RFC 7662 introspection
+// endpoint reports as active. It suits opaque tokens, which can't be validated locally like JWTs
+type IntrospectionConfig struct {
+	Endpoint string `toml:"endpoint"`
+	// ClientId and ClientSecret authenticate peeper to the introspection endpoint with HTTP Basic auth
+	ClientId     string `toml:"client_id"`
+	ClientSecret string `toml:"client_secret"`
+	// CacheDuration is how long an active token is trusted before it is introspected again. It is never trusted
+	// past its exp
+	CacheDuration Duration `toml:"cache_duration"`
+	// NegativeCacheDuration is how long an inactive token is rejected without asking again
+	NegativeCacheDuration Duration `toml:"negative_cache_duration"`
+	// CacheSize bounds the number of cached results
+	CacheSize int `toml:"cache_size"`
+	// RequiredScopes must all be in the token's scope
+	RequiredScopes []string `toml:"required_scopes"`
+	// AllowedClientIds limits the OAuth clients whose tokens are accepted. Any client is accepted when empty
+	AllowedClientIds []string `toml:"allowed_client_ids"`
+	// ForwardToken keeps the caller's Authorization header on the forwarded request. It is removed by default
+	ForwardToken bool `toml:"forward_token"`
+}
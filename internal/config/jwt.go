@@ -0,0 +1,22 @@
+package config
+
+// JWTAuthConfig requires callers of an endpoint to present a bearer JWT signed by a key in a JWKS
+type JWTAuthConfig struct {
+	// JWKSURL is fetched for the signing keys. It is cached, and re-fetched when a token uses an unknown key ID
+	JWKSURL string `toml:"jwks_url"`
+	// JWKSFile is a local JWKS, used instead of JWKSURL
+	JWKSFile string `toml:"jwks_file"`
+	// JWKSCacheDuration is how long a fetched JWKS is used before it is fetched again
+	JWKSCacheDuration Duration `toml:"jwks_cache_duration"`
+	Issuer            string   `toml:"issuer"`
+	// Audiences lists the accepted audiences. The token's aud must contain at least one of them
+	Audiences []string `toml:"audiences"`
+	// RequiredClaims are claims the token must have with the given value. Array claims must contain the value
+	RequiredClaims map[string]string `toml:"required_claims"`
+	// RequiredScopes must all be present in the token's `scope` or `scp` claim
+	RequiredScopes []string `toml:"required_scopes"`
+	// Leeway allows for clock skew when checking exp and nbf
+	Leeway Duration `toml:"leeway"`
+	// ForwardToken keeps the caller's Authorization header on the forwarded request. It is removed by default
+	ForwardToken bool `toml:"forward_token"`
+}
@@ -0,0 +1,8 @@
+package config
+
+// LoggingConfig configures what is kept out of the logs
+type LoggingConfig struct {
+	// RedactHeaders are extra header names whose values are never logged, on top of Authorization, Cookie and the
+	// headers set by static key credentials
+	RedactHeaders []string `toml:"redact_headers"`
+}
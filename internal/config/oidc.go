@@ -0,0 +1,39 @@
+package config
+
+// OIDCConfig configures browser login against an OpenID Connect provider. Logged in users get a session cookie,
+// and endpoints can forward their access token upstream
+type OIDCConfig struct {
+	// Issuer is the provider's issuer URL. Its endpoints are found with OpenID Connect discovery
+	Issuer       string `toml:"issuer"`
+	ClientId     string `toml:"client_id"`
+	ClientSecret string `toml:"client_secret"`
+	// RedirectURL is the full URL of the callback route, as registered with the provider
+	RedirectURL string   `toml:"redirect_url"`
+	Scopes      []string `toml:"scopes"`
+	// LoginPath, CallbackPath and LogoutPath are the local routes of the login flow. They default to
+	// `/auth/login`, `/auth/callback` and `/auth/logout`
+	LoginPath    string `toml:"login_path"`
+	CallbackPath string `toml:"callback_path"`
+	LogoutPath   string `toml:"logout_path"`
+	// Listeners names the listeners the login flow's routes are added to. It must be set when there is more than
+	// one listener
+	Listeners []string `toml:"listeners"`
+	// PostLogoutRedirect is where users are sent after logging out. It is passed to the provider if it supports
+	// RP-initiated logout
+	PostLogoutRedirect string `toml:"post_logout_redirect"`
+	// CookieName names the session cookie
+	CookieName string `toml:"cookie_name"`
+	// CookieKey encrypts session cookies. It must be at least 32 bytes long
+	CookieKey string `toml:"cookie_key"`
+	// InsecureCookies drops the Secure attribute from cookies, for local development over plain HTTP
+	InsecureCookies bool `toml:"insecure_cookies"`
+	// SessionDuration is how long a session lasts before the user has to log in again, however often the access
+	// token is refreshed
+	SessionDuration Duration `toml:"session_duration"`
+}
+
+// UserTokenConfig injects the access token of the logged in user
+type UserTokenConfig struct {
+	// Header is the header the token is sent in. It defaults to Authorization, as a bearer token
+	Header string `toml:"header"`
+}
@@ -0,0 +1,19 @@
+package config
+
+// PolicyConfig authorizes requests to an endpoint with expressions over the caller, the request and the time. Rules
+// are checked in order after the caller has authenticated, and a request must pass every one of them
+type PolicyConfig struct {
+	// Timezone is the IANA time zone the `time` variables are given in, UTC by default
+	Timezone string        `toml:"timezone"`
+	Rules    []*PolicyRule `toml:"rules"`
+}
+
+// PolicyRule is a single named rule. Exactly one of Allow or Deny must be set
+type PolicyRule struct {
+	// Name is logged when the rule denies a request
+	Name string `toml:"name"`
+	// Allow is an expression that must be true for the request to go through
+	Allow string `toml:"allow"`
+	// Deny is an expression that rejects the request when true
+	Deny string `toml:"deny"`
+}
@@ -0,0 +1,8 @@
+package config
+
+// SecretsConfig configures how encrypted config values are decrypted
+type SecretsConfig struct {
+	// AgeIdentityFile is an age identity file used to decrypt `enc:age:` values. An identity can also be passed in
+	// the PEEPER_AGE_IDENTITY environment variable
+	AgeIdentityFile string `toml:"age_identity_file"`
+}
@@ -0,0 +1,9 @@
+package config
+
+// SignedURLsConfig configures the key used to sign and verify pre-signed URLs
+type SignedURLsConfig struct {
+	// Key is the HMAC key, at least 32 bytes long
+	Key string `toml:"key"`
+	// MaxExpiry is the longest a signed URL may be valid for. Links expiring further in the future are rejected
+	MaxExpiry Duration `toml:"max_expiry"`
+}
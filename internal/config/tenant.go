@@ -0,0 +1,31 @@
+package config
+
+// Credentials is a set of credentials to inject into forwarded requests. Only one kind should be set
+type Credentials struct {
+	BasicAuth     *BasicAuthConfig     `toml:"basic_auth"`
+	OAuthConfig   *OAuthConfig         `toml:"oauth"`
+	StaticKeyAuth *StaticKeyAuthConfig `toml:"static_key"`
+	UserToken     *UserTokenConfig     `toml:"user_token"`
+}
+
+// IsEmpty reports whether c has no credentials set
+func (c *Credentials) IsEmpty() bool {
+	return c == nil || (c.BasicAuth == nil && c.OAuthConfig == nil && c.StaticKeyAuth == nil && c.UserToken == nil)
+}
+
+// TenantsConfig selects which credentials to inject based on the tenant making the request
+type TenantsConfig struct {
+	// Source is where the tenant is read from: `header`, `client_cert` or `jwt_claim`
+	Source string `toml:"source"`
+	// Header is the inbound header holding the tenant when Source is `header`
+	Header string `toml:"header"`
+	// SubjectField is the client certificate subject field holding the tenant when Source is `client_cert`. One of
+	// `cn` (the default), `o` or `ou`
+	SubjectField string `toml:"subject_field"`
+	// Claim is the JWT claim holding the tenant when Source is `jwt_claim`. The token is the one verified by the
+	// endpoint's jwt auth, which has to be set
+	Claim string `toml:"claim"`
+	// Credentials maps each known tenant to its credentials, which may be empty to forward the tenant's requests
+	// without any. Requests from any other tenant are rejected
+	Credentials map[string]*Credentials `toml:"credentials"`
+}
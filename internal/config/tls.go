@@ -0,0 +1,42 @@
+package config
+
+// TLSConfig configures TLS termination on the listener
+type TLSConfig struct {
+	// CertFile and KeyFile are the certificate served to callers that no other certificate matches. CertFile may
+	// hold the certificate's chain after it
+	CertFile string `toml:"cert_file"`
+	KeyFile  string `toml:"key_file"`
+	// Certificates are served to callers asking for one of their names with SNI
+	Certificates []*CertificateConfig `toml:"certificates"`
+	// MinVersion is `1.2` (the default) or `1.3`
+	MinVersion string `toml:"min_version"`
+	// CipherSuites limits the cipher suites used with TLS 1.2, by their names such as
+	// `TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256`. TLS 1.3 suites can't be configured
+	CipherSuites []string `toml:"cipher_suites"`
+	// OCSPStapling staples OCSP responses fetched from the certificates' issuers to handshakes
+	OCSPStapling bool `toml:"ocsp_stapling"`
+	// ReloadInterval is how often certificate files are checked for changes, and defaults to 30s
+	ReloadInterval Duration `toml:"reload_interval"`
+	// ClientCAFile is a PEM bundle of CAs that client certificates must be signed by. Setting it turns on mutual TLS
+	ClientCAFile string `toml:"client_ca_file"`
+	// ClientAuth is `require` (the default) to reject connections without a client certificate, or `optional` to
+	// leave it to each endpoint's client_cert settings
+	ClientAuth string `toml:"client_auth"`
+}
+
+// CertificateConfig is a certificate and key served by the listener
+type CertificateConfig struct {
+	CertFile string `toml:"cert_file"`
+	KeyFile  string `toml:"key_file"`
+}
+
+// ClientCertConfig limits an endpoint to callers with a verified client certificate. If no allowlists are set any
+// verified certificate is accepted, otherwise the certificate must match at least one entry
+type ClientCertConfig struct {
+	// AllowedSubjects are subject DNs, for example `CN=billing,O=Acme`
+	AllowedSubjects []string `toml:"allowed_subjects"`
+	// AllowedSPIFFEIDs are SPIFFE IDs, which may use `*` wildcards within a path segment
+	AllowedSPIFFEIDs []string `toml:"allowed_spiffe_ids"`
+	// AllowedSANs are patterns matched against DNS, email and URI SANs, for example `*.billing.internal`
+	AllowedSANs []string `toml:"allowed_sans"`
+}
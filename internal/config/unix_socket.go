@@ -0,0 +1,23 @@
+package config
+
+import (
+	"fmt"
+	"strings"
+)
+
+// UnixSocketConfig sets who can use the listener's Unix socket, when bind_interface is a `unix://` path
+type UnixSocketConfig struct {
+	// Mode is the socket file's permissions in octal, such as `0660`
+	Mode string `toml:"mode"`
+	// Owner and Group own the socket file, and may be names or numeric IDs
+	Owner string `toml:"owner"`
+	Group string `toml:"group"`
+}
+
+// Address is the address the listener binds to, either `host:port` or a `unix://` socket path
+func (n *NetworkConfig) Address() string {
+	if strings.HasPrefix(n.BindInterface, "unix://") {
+		return n.BindInterface
+	}
+	return fmt.Sprintf("%s:%d", n.BindInterface, n.BindPort)
+}
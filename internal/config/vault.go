@@ -0,0 +1,22 @@
+package config
+
+// VaultConfig configures the HashiCorp Vault secret provider. Config values of the form
+// `vault:<path>#<field>` are read from Vault when this is set
+type VaultConfig struct {
+	Address   string `toml:"address"`
+	Namespace string `toml:"namespace"`
+	// TokenFile is a file containing a Vault token, such as one written by Vault Agent. The file is re-read
+	// whenever the token needs to be refreshed
+	TokenFile string              `toml:"token_file"`
+	AppRole   *VaultAppRoleConfig `toml:"approle"`
+	// KVRefreshInterval is how often KV secrets, which have no lease, are re-read to pick up new versions
+	KVRefreshInterval Duration `toml:"kv_refresh_interval"`
+}
+
+// VaultAppRoleConfig configures an AppRole login
+type VaultAppRoleConfig struct {
+	MountPath    string `toml:"mount_path"`
+	RoleId       string `toml:"role_id"`
+	SecretId     string `toml:"secret_id"`
+	SecretIdFile string `toml:"secret_id_file"`
+}
@@ -0,0 +1,29 @@
+package config
+
+// WebhookConfig requires requests to an endpoint to be signed webhooks, verifying the signature before the request
+// is forwarded
+type WebhookConfig struct {
+	// Provider is the signature scheme: `github`, `stripe`, `slack` or `hmac`
+	Provider string `toml:"provider"`
+	// Secret is the shared signing secret
+	Secret string `toml:"secret"`
+	// Tolerance is how far a signed timestamp may be from now. Signatures are remembered for twice as long to stop
+	// replays
+	Tolerance Duration `toml:"tolerance"`
+	// ReplayWindow is how long signatures of deliveries without a signed timestamp are remembered, after which the
+	// same delivery is accepted again, as a provider's redelivery would be. Defaults to twice Tolerance
+	ReplayWindow Duration `toml:"replay_window"`
+	// MaxBodySize is the largest body, in bytes, that will be buffered for verification
+	MaxBodySize int64 `toml:"max_body_size"`
+	// SignatureHeader, TimestampHeader, Algorithm, Encoding and Prefix configure the `hmac` provider
+	SignatureHeader string `toml:"signature_header"`
+	// TimestampHeader holds a unix timestamp. When set it is checked against Tolerance and the signed content is
+	// `<timestamp>.<body>` instead of just the body
+	TimestampHeader string `toml:"timestamp_header"`
+	// Algorithm is `sha256` (the default), `sha512` or `sha1`
+	Algorithm string `toml:"algorithm"`
+	// Encoding is how the signature is written, `hex` (the default) or `base64`
+	Encoding string `toml:"encoding"`
+	// Prefix comes before the signature in its header, for example `sha256=`
+	Prefix string `toml:"prefix"`
+}
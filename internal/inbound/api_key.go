@@ -0,0 +1,307 @@
+package inbound
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/BurntSushi/toml"
+	"github.com/sirupsen/logrus"
+	"github.com/threetoes/peeper/internal/config"
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/bcrypt"
+)
+
+const (
+	defaultAPIKeyHeader         = "X-Api-Key"
+	defaultAPIKeyReloadInterval = 30 * time.Second
+	maxVerifiedKeys             = 1024
+)
+
+type apiKeyFile struct {
+	Keys map[string]struct {
+		// Hash is `sha256:<hex>`, a bcrypt hash or an argon2id/argon2i PHC string
+		Hash string `toml:"hash"`
+		// Prefix is the non-secret start of the key. Slow hashes need one, so each lookup checks at most one of them
+		Prefix    string    `toml:"prefix"`
+		Endpoints []string  `toml:"endpoints"`
+		Methods   []string  `toml:"methods"`
+		Expires   time.Time `toml:"expires"`
+	} `toml:"keys"`
+}
+
+type apiKey struct {
+	name      string
+	hash      string
+	prefix    string
+	sha256    []byte
+	endpoints []string
+	methods   []string
+	expires   time.Time
+}
+
+func (k *apiKey) expired(now time.Time) bool {
+	return !k.expires.IsZero() && now.After(k.expires)
+}
+
+func (k *apiKey) allows(localPath, method string) bool {
+	return allowed(k.endpoints, localPath) && allowed(k.methods, method)
+}
+
+func allowed(list []string, value string) bool {
+	if len(list) == 0 {
+		return true
+	}
+	for _, v := range list {
+		if strings.EqualFold(v, value) {
+			return true
+		}
+	}
+	return false
+}
+
+func (k *apiKey) verify(presented string) bool {
+	switch {
+	case strings.HasPrefix(k.hash, "$2"):
+		return bcrypt.CompareHashAndPassword([]byte(k.hash), []byte(presented)) == nil
+	case strings.HasPrefix(k.hash, "$argon2"):
+		return verifyArgon2(k.hash, presented)
+	}
+	return false
+}
+
+// verifyArgon2 checks presented against a PHC string such as `$argon2id$v=19$m=65536,t=3,p=4$<salt>$<hash>`
+func verifyArgon2(phc, presented string) bool {
+	parts := strings.Split(phc, "$")
+	if len(parts) != 6 {
+		return false
+	}
+	var memory, iterations uint32
+	var threads uint8
+	if _, err := fmt.Sscanf(parts[3], "m=%d,t=%d,p=%d", &memory, &iterations, &threads); err != nil {
+		return false
+	}
+	salt, err := base64.RawStdEncoding.DecodeString(parts[4])
+	if err != nil {
+		return false
+	}
+	want, err := base64.RawStdEncoding.DecodeString(parts[5])
+	if err != nil {
+		return false
+	}
+	var got []byte
+	switch parts[1] {
+	case "argon2id":
+		got = argon2.IDKey([]byte(presented), salt, iterations, memory, threads, uint32(len(want)))
+	case "argon2i":
+		got = argon2.Key([]byte(presented), salt, iterations, memory, threads, uint32(len(want)))
+	default:
+		return false
+	}
+	return subtle.ConstantTimeCompare(got, want) == 1
+}
+
+func parseAPIKeys(path string) ([]*apiKey, error) {
+	var file apiKeyFile
+	if _, err := toml.DecodeFile(path, &file); err != nil {
+		return nil, fmt.Errorf("could not decode API key file: %v", err)
+	}
+	keys := make([]*apiKey, 0, len(file.Keys))
+	for name, k := range file.Keys {
+		key := &apiKey{
+			name:      name,
+			hash:      k.Hash,
+			prefix:    k.Prefix,
+			endpoints: k.Endpoints,
+			methods:   k.Methods,
+			expires:   k.Expires,
+		}
+		switch {
+		case strings.HasPrefix(k.Hash, "sha256:"):
+			digest, err := hex.DecodeString(strings.TrimPrefix(k.Hash, "sha256:"))
+			if err != nil || len(digest) != sha256.Size {
+				return nil, fmt.Errorf("API key '%s' has an invalid sha256 hash", name)
+			}
+			key.sha256 = digest
+		case strings.HasPrefix(k.Hash, "$2"), strings.HasPrefix(k.Hash, "$argon2id$"), strings.HasPrefix(k.Hash, "$argon2i$"):
+			if k.Prefix == "" {
+				return nil, fmt.Errorf("API key '%s' needs a prefix, as its hash is slow to check", name)
+			}
+		default:
+			return nil, fmt.Errorf("API key '%s' has an unsupported hash", name)
+		}
+		keys = append(keys, key)
+	}
+	for _, a := range keys {
+		for _, b := range keys {
+			if a != b && a.sha256 == nil && b.sha256 == nil && strings.HasPrefix(a.prefix, b.prefix) {
+				return nil, fmt.Errorf("API keys '%s' and '%s' have overlapping prefixes", a.name, b.name)
+			}
+		}
+	}
+	return keys, nil
+}
+
+func slowKeyFor(keys []*apiKey, presented string) *apiKey {
+	for _, k := range keys {
+		if k.sha256 == nil && strings.HasPrefix(presented, k.prefix) {
+			return k
+		}
+	}
+	return nil
+}
+
+// APIKeyStore holds the hashed API keys callers can authenticate with. Keys are never stored in plaintext
+type APIKeyStore struct {
+	path           string
+	reloadInterval time.Duration
+
+	lock       sync.RWMutex
+	modTime    time.Time
+	generation int
+	keys       []*apiKey
+	bySha256   map[[sha256.Size]byte]*apiKey
+	// verified caches keys that passed a slow hash check, by the sha256 of the presented key
+	verified map[[sha256.Size]byte]*apiKey
+}
+
+// Reload re-reads the key file if it has changed since it was last read. The old keys stay in place if the new
+// file can't be read
+func (s *APIKeyStore) Reload() error {
+	info, err := os.Stat(s.path)
+	if err != nil {
+		return fmt.Errorf("could not stat API key file: %v", err)
+	}
+	s.lock.RLock()
+	unchanged := info.ModTime().Equal(s.modTime)
+	s.lock.RUnlock()
+	if unchanged {
+		return nil
+	}
+	keys, err := parseAPIKeys(s.path)
+	if err != nil {
+		return err
+	}
+	bySha256 := map[[sha256.Size]byte]*apiKey{}
+	for _, k := range keys {
+		if k.sha256 != nil {
+			var digest [sha256.Size]byte
+			copy(digest[:], k.sha256)
+			bySha256[digest] = k
+		}
+	}
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.modTime = info.ModTime()
+	s.generation++
+	s.keys = keys
+	s.bySha256 = bySha256
+	s.verified = map[[sha256.Size]byte]*apiKey{}
+	return nil
+}
+
+// Run reloads the key file whenever it changes until ctx is cancelled
+func (s *APIKeyStore) Run(ctx context.Context) {
+	ticker := time.NewTicker(s.reloadInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := s.Reload(); err != nil {
+				logrus.Errorf("could not reload API keys: %v", err)
+			}
+		}
+	}
+}
+
+func (s *APIKeyStore) lookup(presented string) *apiKey {
+	digest := sha256.Sum256([]byte(presented))
+	s.lock.RLock()
+	if k, ok := s.bySha256[digest]; ok {
+		s.lock.RUnlock()
+		return k
+	}
+	if k, ok := s.verified[digest]; ok {
+		s.lock.RUnlock()
+		return k
+	}
+	keys, generation := s.keys, s.generation
+	s.lock.RUnlock()
+
+	k := slowKeyFor(keys, presented)
+	if k == nil || !k.verify(presented) {
+		return nil
+	}
+	s.lock.Lock()
+	// Only cache against the key set the match was made with, in case the file was reloaded meanwhile
+	if generation == s.generation && len(s.verified) < maxVerifiedKeys {
+		s.verified[digest] = k
+	}
+	s.lock.Unlock()
+	return k
+}
+
+// NewAPIKeyStore loads the key file described by conf
+func NewAPIKeyStore(conf *config.APIKeysConfig) (*APIKeyStore, error) {
+	if conf.KeyFile == "" {
+		return nil, fmt.Errorf("api_keys needs key_file to be set")
+	}
+	s := &APIKeyStore{
+		path:           conf.KeyFile,
+		reloadInterval: conf.ReloadInterval.Or(defaultAPIKeyReloadInterval),
+	}
+	if err := s.Reload(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// APIKeyAuth returns middleware that only lets through callers presenting a key from store in header that is
+// allowed to call method on the endpoint at localPath. The key is removed from the request before it is forwarded
+func APIKeyAuth(store *APIKeyStore, header, localPath, method string) Middleware {
+	if header == "" {
+		header = defaultAPIKeyHeader
+	}
+	challenge := fmt.Sprintf(`APIKey header="%s"`, header)
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+			presented := req.Header.Get(header)
+			req.Header.Del(header)
+			if presented == "" {
+				rw.Header().Set("WWW-Authenticate", challenge)
+				rw.WriteHeader(http.StatusUnauthorized)
+				return
+			}
+			key := store.lookup(presented)
+			if key == nil {
+				logrus.Warnf("rejecting %s %s: unknown API key", req.Method, req.URL.Path)
+				rw.Header().Set("WWW-Authenticate", challenge)
+				rw.WriteHeader(http.StatusUnauthorized)
+				return
+			}
+			if key.expired(time.Now()) {
+				logrus.Warnf("rejecting %s %s: API key '%s' has expired", req.Method, req.URL.Path, key.name)
+				rw.Header().Set("WWW-Authenticate", challenge)
+				rw.WriteHeader(http.StatusUnauthorized)
+				return
+			}
+			if !key.allows(localPath, method) {
+				logrus.Warnf("rejecting %s %s: API key '%s' is not allowed to call it", req.Method, req.URL.Path, key.name)
+				rw.WriteHeader(http.StatusForbidden)
+				return
+			}
+			identity := &Identity{Subject: key.name, Method: "api_key"}
+			next.ServeHTTP(rw, withCaller(req, identity))
+		})
+	}
+}
@@ -0,0 +1,171 @@
+package inbound
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/threetoes/peeper/internal/config"
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/bcrypt"
+)
+
+func writeKeyFile(t *testing.T, path, contents string, modTime time.Time) {
+	if !assert.NoError(t, os.WriteFile(path, []byte(contents), 0600)) {
+		t.FailNow()
+	}
+	assert.NoError(t, os.Chtimes(path, modTime, modTime))
+}
+
+func testKeyFile() string {
+	bcryptHash, _ := bcrypt.GenerateFromPassword([]byte("bcrypt-key"), bcrypt.MinCost)
+	salt := []byte("0123456789abcdef")
+	argonHash := argon2.IDKey([]byte("argon-key"), salt, 1, 1024, 1, 32)
+	return fmt.Sprintf(`
+[keys.sha]
+hash = "sha256:%x"
+
+[keys.bcrypt]
+hash = "%s"
+prefix = "bcrypt-"
+
+[keys.argon]
+prefix = "argon-"
+hash = "$argon2id$v=19$m=1024,t=1,p=1$%s$%s"
+
+[keys.scoped]
+hash = "sha256:%x"
+endpoints = ["/cats"]
+methods = ["GET"]
+
+[keys.expired]
+hash = "sha256:%x"
+expires = 2020-01-01T00:00:00Z
+`, sha256.Sum256([]byte("sha-key")), bcryptHash,
+		base64.RawStdEncoding.EncodeToString(salt), base64.RawStdEncoding.EncodeToString(argonHash),
+		sha256.Sum256([]byte("scoped-key")), sha256.Sum256([]byte("expired-key")))
+}
+
+func TestAPIKeyAuth(t *testing.T) {
+	keyFile := filepath.Join(t.TempDir(), "keys.toml")
+	writeKeyFile(t, keyFile, testKeyFile(), time.Now())
+	store, err := NewAPIKeyStore(&config.APIKeysConfig{KeyFile: keyFile})
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+
+	tests := []struct {
+		name        string
+		key         string
+		localPath   string
+		method      string
+		wantCode    int
+		wantSubject string
+	}{
+		{name: "sha256 key", key: "sha-key", localPath: "/dogs", method: "POST", wantCode: http.StatusOK, wantSubject: "sha"},
+		{name: "bcrypt key", key: "bcrypt-key", localPath: "/dogs", method: "POST", wantCode: http.StatusOK, wantSubject: "bcrypt"},
+		{name: "argon2id key", key: "argon-key", localPath: "/dogs", method: "POST", wantCode: http.StatusOK, wantSubject: "argon"},
+		{name: "scoped key in scope", key: "scoped-key", localPath: "/cats", method: "GET", wantCode: http.StatusOK, wantSubject: "scoped"},
+		{name: "scoped key wrong endpoint", key: "scoped-key", localPath: "/dogs", method: "GET", wantCode: http.StatusForbidden},
+		{name: "scoped key wrong method", key: "scoped-key", localPath: "/cats", method: "POST", wantCode: http.StatusForbidden},
+		{name: "expired key", key: "expired-key", localPath: "/cats", method: "GET", wantCode: http.StatusUnauthorized},
+		{name: "unknown key", key: "guess", localPath: "/cats", method: "GET", wantCode: http.StatusUnauthorized},
+		{name: "wrong key with a known prefix", key: "bcrypt-guess", localPath: "/cats", method: "GET", wantCode: http.StatusUnauthorized},
+		{name: "no key", localPath: "/cats", method: "GET", wantCode: http.StatusUnauthorized},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var forwarded *http.Request
+			handler := APIKeyAuth(store, "", tt.localPath, tt.method)(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+				forwarded = req
+			}))
+			req := httptest.NewRequest(tt.method, tt.localPath, nil)
+			if tt.key != "" {
+				req.Header.Set("X-Api-Key", tt.key)
+			}
+			rw := httptest.NewRecorder()
+			handler.ServeHTTP(rw, req)
+			assert.Equal(t, tt.wantCode, rw.Code)
+			if tt.wantCode == http.StatusUnauthorized {
+				assert.Equal(t, `APIKey header="X-Api-Key"`, rw.Header().Get("WWW-Authenticate"))
+			}
+			if tt.wantCode != http.StatusOK {
+				assert.Nil(t, forwarded)
+				return
+			}
+			if assert.NotNil(t, forwarded) {
+				assert.Empty(t, forwarded.Header.Get("X-Api-Key"), "the key must not be forwarded")
+				assert.Equal(t, tt.wantSubject, IdentityFrom(forwarded.Context()).Subject)
+			}
+		})
+	}
+}
+
+func TestAPIKeyStore_Reload(t *testing.T) {
+	keyFile := filepath.Join(t.TempDir(), "keys.toml")
+	writeKeyFile(t, keyFile, fmt.Sprintf("[keys.old]\nhash = \"sha256:%x\"\n", sha256.Sum256([]byte("old-key"))), time.Now().Add(-time.Hour))
+	store, err := NewAPIKeyStore(&config.APIKeysConfig{KeyFile: keyFile})
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	assert.NotNil(t, store.lookup("old-key"))
+
+	writeKeyFile(t, keyFile, "not valid toml [", time.Now().Add(-30*time.Minute))
+	assert.Error(t, store.Reload())
+	assert.NotNil(t, store.lookup("old-key"), "a broken file must not drop the loaded keys")
+
+	writeKeyFile(t, keyFile, fmt.Sprintf("[keys.new]\nhash = \"sha256:%x\"\n", sha256.Sum256([]byte("new-key"))), time.Now())
+	assert.NoError(t, store.Reload())
+	assert.Nil(t, store.lookup("old-key"))
+	assert.NotNil(t, store.lookup("new-key"))
+}
+
+func TestParseAPIKeys(t *testing.T) {
+	bcryptHash, _ := bcrypt.GenerateFromPassword([]byte("pk_1234-secret"), bcrypt.MinCost)
+	tests := []struct {
+		name     string
+		contents string
+		wantErr  bool
+	}{
+		{name: "slow hash with a prefix", contents: fmt.Sprintf("[keys.a]\nhash = %q\nprefix = \"pk_1234-\"\n", bcryptHash)},
+		{name: "slow hash without a prefix", contents: fmt.Sprintf("[keys.a]\nhash = %q\n", bcryptHash), wantErr: true},
+		{
+			name: "overlapping prefixes",
+			contents: fmt.Sprintf("[keys.a]\nhash = %q\nprefix = \"pk_\"\n[keys.b]\nhash = %q\nprefix = \"pk_1234-\"\n",
+				bcryptHash, bcryptHash),
+			wantErr: true,
+		},
+		{name: "unsupported hash", contents: "[keys.a]\nhash = \"md5:abc\"\n", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			keyFile := filepath.Join(t.TempDir(), "keys.toml")
+			writeKeyFile(t, keyFile, tt.contents, time.Now())
+			_, err := parseAPIKeys(keyFile)
+			if tt.wantErr {
+				assert.Error(t, err)
+			} else {
+				assert.NoError(t, err)
+			}
+		})
+	}
+}
+
+func TestSlowKeyFor(t *testing.T) {
+	keys := []*apiKey{
+		{name: "sha", sha256: make([]byte, sha256.Size)},
+		{name: "billing", prefix: "pk_billing_"},
+		{name: "reports", prefix: "pk_reports_"},
+	}
+	assert.Nil(t, slowKeyFor(keys, "guess"), "keys without a known prefix aren't checked against any slow hash")
+	if k := slowKeyFor(keys, "pk_reports_guess"); assert.NotNil(t, k) {
+		assert.Equal(t, "reports", k.name)
+	}
+}
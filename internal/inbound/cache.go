@@ -0,0 +1,59 @@
+package inbound
+
+import (
+	"crypto/sha256"
+	"sync"
+	"time"
+)
+
+type ttlEntry struct {
+	value   interface{}
+	expires time.Time
+}
+
+// ttlCache is a bounded cache of values that expire. Keys are hashes, so tokens used as keys aren't kept in memory
+type ttlCache struct {
+	lock    sync.Mutex
+	entries map[[sha256.Size]byte]ttlEntry
+	size    int
+}
+
+func (c *ttlCache) get(key [sha256.Size]byte, now time.Time) (interface{}, bool) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	e, ok := c.entries[key]
+	if !ok || !now.Before(e.expires) {
+		return nil, false
+	}
+	return e.value, true
+}
+
+// put stores value until expires. A full cache drops expired entries first, then any
+func (c *ttlCache) put(key [sha256.Size]byte, value interface{}, expires, now time.Time) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if len(c.entries) >= c.size {
+		for k, e := range c.entries {
+			if !now.Before(e.expires) {
+				delete(c.entries, k)
+			}
+		}
+	}
+	for k := range c.entries {
+		if len(c.entries) < c.size {
+			break
+		}
+		delete(c.entries, k)
+	}
+	c.entries[key] = ttlEntry{value: value, expires: expires}
+}
+
+func (c *ttlCache) len() int {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return len(c.entries)
+}
+
+func newTTLCache(size int) *ttlCache {
+	return &ttlCache{entries: map[[sha256.Size]byte]ttlEntry{}, size: size}
+}
@@ -0,0 +1,106 @@
+package inbound
+
+import (
+	"crypto/x509"
+	"net/http"
+	"path"
+	"strings"
+
+	"github.com/sirupsen/logrus"
+	"github.com/threetoes/peeper/internal/config"
+)
+
+// VerifiedCertificate returns the client certificate that was verified during the TLS handshake, if any
+func VerifiedCertificate(req *http.Request) *x509.Certificate {
+	if req.TLS == nil || len(req.TLS.VerifiedChains) == 0 || len(req.TLS.VerifiedChains[0]) == 0 {
+		return nil
+	}
+	return req.TLS.VerifiedChains[0][0]
+}
+
+// SPIFFEID returns the certificate's SPIFFE ID, or an empty string if it doesn't have one
+func SPIFFEID(cert *x509.Certificate) string {
+	for _, uri := range cert.URIs {
+		if uri.Scheme == "spiffe" {
+			return uri.String()
+		}
+	}
+	return ""
+}
+
+// CertificateName names the holder of cert by its SPIFFE ID, falling back to its subject DN
+func CertificateName(cert *x509.Certificate) string {
+	if id := SPIFFEID(cert); id != "" {
+		return id
+	}
+	return cert.Subject.String()
+}
+
+// matchPattern matches value against a pattern that may use `*` wildcards
+func matchPattern(pattern, value string) bool {
+	if pattern == value {
+		return true
+	}
+	matched, err := path.Match(pattern, value)
+	return err == nil && matched
+}
+
+// certificateAllowed reports whether cert matches any of the allowlists in conf. An empty config allows any
+// verified certificate
+func certificateAllowed(conf *config.ClientCertConfig, cert *x509.Certificate) bool {
+	if len(conf.AllowedSubjects) == 0 && len(conf.AllowedSPIFFEIDs) == 0 && len(conf.AllowedSANs) == 0 {
+		return true
+	}
+	subject := cert.Subject.String()
+	for _, s := range conf.AllowedSubjects {
+		if strings.EqualFold(s, subject) {
+			return true
+		}
+	}
+	if id := SPIFFEID(cert); id != "" {
+		for _, pattern := range conf.AllowedSPIFFEIDs {
+			if matchPattern(pattern, id) {
+				return true
+			}
+		}
+	}
+	sans := append([]string{}, cert.DNSNames...)
+	sans = append(sans, cert.EmailAddresses...)
+	for _, uri := range cert.URIs {
+		sans = append(sans, uri.String())
+	}
+	for _, pattern := range conf.AllowedSANs {
+		for _, san := range sans {
+			if matchPattern(pattern, san) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// ClientCertAuth returns middleware that only lets through callers whose verified client certificate matches the
+// allowlists in conf
+func ClientCertAuth(conf *config.ClientCertConfig) Middleware {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+			cert := VerifiedCertificate(req)
+			if cert == nil {
+				logrus.Warnf("rejecting %s %s: no verified client certificate", req.Method, req.URL.Path)
+				rw.WriteHeader(http.StatusUnauthorized)
+				return
+			}
+			if !certificateAllowed(conf, cert) {
+				logrus.Warnf("rejecting %s %s: client certificate '%s' is not allowed", req.Method, req.URL.Path, CertificateName(cert))
+				rw.WriteHeader(http.StatusForbidden)
+				return
+			}
+			identity := &Identity{
+				Subject:     CertificateName(cert),
+				Method:      "mtls",
+				Certificate: cert,
+			}
+			next.ServeHTTP(rw, withCaller(req, identity))
+		})
+	}
+}
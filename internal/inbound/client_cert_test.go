@@ -0,0 +1,69 @@
+package inbound
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/threetoes/peeper/internal/config"
+)
+
+func TestClientCertAuth(t *testing.T) {
+	spiffe, _ := url.Parse("spiffe://cluster.local/ns/billing/sa/payments")
+	billing := &x509.Certificate{
+		Subject:  pkix.Name{CommonName: "payments", Organization: []string{"Acme"}},
+		URIs:     []*url.URL{spiffe},
+		DNSNames: []string{"payments.billing.internal"},
+	}
+	other := &x509.Certificate{
+		Subject:  pkix.Name{CommonName: "reports", Organization: []string{"Acme"}},
+		DNSNames: []string{"reports.analytics.internal"},
+	}
+
+	tests := []struct {
+		name        string
+		conf        *config.ClientCertConfig
+		cert        *x509.Certificate
+		wantCode    int
+		wantSubject string
+	}{
+		{name: "any certificate", conf: &config.ClientCertConfig{}, cert: other, wantCode: http.StatusOK, wantSubject: "CN=reports,O=Acme"},
+		{name: "no certificate", conf: &config.ClientCertConfig{}, wantCode: http.StatusUnauthorized},
+		{name: "subject allowed", conf: &config.ClientCertConfig{AllowedSubjects: []string{"CN=reports,O=Acme"}}, cert: other, wantCode: http.StatusOK},
+		{name: "subject not allowed", conf: &config.ClientCertConfig{AllowedSubjects: []string{"CN=reports,O=Acme"}}, cert: billing, wantCode: http.StatusForbidden},
+		{name: "spiffe id allowed", conf: &config.ClientCertConfig{AllowedSPIFFEIDs: []string{"spiffe://cluster.local/ns/billing/sa/*"}}, cert: billing, wantCode: http.StatusOK,
+			wantSubject: "spiffe://cluster.local/ns/billing/sa/payments"},
+		{name: "spiffe id not allowed", conf: &config.ClientCertConfig{AllowedSPIFFEIDs: []string{"spiffe://cluster.local/ns/billing/sa/*"}}, cert: other, wantCode: http.StatusForbidden},
+		{name: "san pattern allowed", conf: &config.ClientCertConfig{AllowedSANs: []string{"*.billing.internal"}}, cert: billing, wantCode: http.StatusOK},
+		{name: "san pattern not allowed", conf: &config.ClientCertConfig{AllowedSANs: []string{"*.billing.internal"}}, cert: other, wantCode: http.StatusForbidden},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var forwarded *http.Request
+			handler := ClientCertAuth(tt.conf)(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+				forwarded = req
+			}))
+			req := httptest.NewRequest("GET", "/payroll", nil)
+			if tt.cert != nil {
+				req.TLS = &tls.ConnectionState{VerifiedChains: [][]*x509.Certificate{{tt.cert}}}
+			}
+			rw := httptest.NewRecorder()
+			handler.ServeHTTP(rw, req)
+			assert.Equal(t, tt.wantCode, rw.Code)
+			if tt.wantCode != http.StatusOK {
+				assert.Nil(t, forwarded)
+				return
+			}
+			identity := IdentityFrom(forwarded.Context())
+			assert.Equal(t, tt.cert, identity.Certificate)
+			if tt.wantSubject != "" {
+				assert.Equal(t, tt.wantSubject, identity.Subject)
+			}
+		})
+	}
+}
@@ -0,0 +1,211 @@
+package inbound
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/threetoes/peeper/internal/config"
+)
+
+const (
+	defaultExtAuthzTimeout   = time.Second
+	defaultExtAuthzCacheSize = 10000
+	maxExtAuthzResponseSize  = 1 << 20
+)
+
+type extAuthzIdentity struct {
+	Subject string                 `json:"subject"`
+	Method  string                 `json:"method"`
+	Claims  map[string]interface{} `json:"claims,omitempty"`
+	Scopes  []string               `json:"scopes,omitempty"`
+}
+
+type extAuthzCheck struct {
+	Method   string            `json:"method"`
+	Path     string            `json:"path"`
+	Query    string            `json:"query"`
+	Headers  map[string]string `json:"headers"`
+	ClientIP string            `json:"client_ip"`
+	Identity *extAuthzIdentity `json:"identity"`
+}
+
+// ExtAuthzDecision is the authorization service's answer to a check. Allowed requests are forwarded with Headers
+// set and RemoveHeaders removed, and denied ones get Status, or a 403 if it isn't an error status
+type ExtAuthzDecision struct {
+	Allow         bool              `json:"allow"`
+	Status        int               `json:"status"`
+	Reason        string            `json:"reason"`
+	Headers       map[string]string `json:"headers"`
+	RemoveHeaders []string          `json:"remove_headers"`
+}
+
+// ExtAuthz asks an external authorization service whether to let requests through
+type ExtAuthz struct {
+	url       string
+	client    *http.Client
+	failOpen  bool
+	headers   []string
+	clientIPs *ClientIPResolver
+	cacheTTL  time.Duration
+	cache     *ttlCache
+	now       func() time.Time
+}
+
+func (a *ExtAuthz) checkFor(req *http.Request) *extAuthzCheck {
+	check := &extAuthzCheck{
+		Method:  req.Method,
+		Path:    req.URL.Path,
+		Query:   req.URL.RawQuery,
+		Headers: map[string]string{},
+	}
+	if len(a.headers) == 0 {
+		for name, values := range req.Header {
+			check.Headers[strings.ToLower(name)] = strings.Join(values, ", ")
+		}
+	} else {
+		for _, name := range a.headers {
+			if values := req.Header.Values(name); len(values) > 0 {
+				check.Headers[strings.ToLower(name)] = strings.Join(values, ", ")
+			}
+		}
+	}
+	if ip := resolverFor(req, a.clientIPs).ClientIP(req); ip != nil {
+		check.ClientIP = ip.String()
+	}
+	if identity := IdentityFrom(req.Context()); identity != nil {
+		check.Identity = &extAuthzIdentity{
+			Subject: identity.Subject,
+			Method:  identity.Method,
+			Claims:  identity.Claims,
+			Scopes:  identity.Scopes,
+		}
+	}
+	return check
+}
+
+// Check returns the authorization service's decision for req. Identical requests share a decision while it is
+// cached. An error means the service couldn't give a decision, and is not cached
+func (a *ExtAuthz) Check(req *http.Request) (*ExtAuthzDecision, error) {
+	body, err := json.Marshal(a.checkFor(req))
+	if err != nil {
+		return nil, err
+	}
+	// Maps are marshalled with sorted keys, so identical requests have identical bodies. Only the listed headers are
+	// in the body when caching, so per-request headers such as trace IDs don't keep requests from sharing a decision
+	key := sha256.Sum256(body)
+	now := a.now()
+	if a.cacheTTL > 0 {
+		if cached, ok := a.cache.get(key, now); ok {
+			return cached.(*ExtAuthzDecision), nil
+		}
+	}
+	decision, err := a.ask(body)
+	if err != nil {
+		return nil, err
+	}
+	if a.cacheTTL > 0 {
+		a.cache.put(key, decision, now.Add(a.cacheTTL), now)
+	}
+	return decision, nil
+}
+
+func (a *ExtAuthz) ask(body []byte) (*ExtAuthzDecision, error) {
+	resp, err := a.client.Post(a.url, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("authorization service returned status code %d", resp.StatusCode)
+	}
+	respBody, err := ioutil.ReadAll(io.LimitReader(resp.Body, maxExtAuthzResponseSize))
+	if err != nil {
+		return nil, err
+	}
+	var decision ExtAuthzDecision
+	if err := json.Unmarshal(respBody, &decision); err != nil {
+		return nil, fmt.Errorf("could not decode authorization decision")
+	}
+	return &decision, nil
+}
+
+// Middleware returns middleware that forwards requests the authorization service allows, with the header changes
+// it asks for. Denied requests get an audit log line naming scope. When the service fails requests are let
+// through unchanged if failing open, and get a 503 otherwise
+func (a *ExtAuthz) Middleware(scope string) Middleware {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+			decision, err := a.Check(req)
+			if err != nil {
+				if a.failOpen {
+					logrus.Warnf("letting %s %s through without authorization: %v", req.Method, req.URL.Path, err)
+					next.ServeHTTP(rw, req)
+					return
+				}
+				logrus.Errorf("could not authorize %s %s: %v", req.Method, req.URL.Path, err)
+				rw.WriteHeader(http.StatusServiceUnavailable)
+				return
+			}
+			if !decision.Allow {
+				subject := ""
+				if identity := IdentityFrom(req.Context()); identity != nil {
+					subject = identity.Subject
+				}
+				logrus.WithFields(logrus.Fields{
+					"audit":   true,
+					"scope":   scope,
+					"subject": subject,
+					"method":  req.Method,
+					"path":    req.URL.Path,
+					"reason":  decision.Reason,
+				}).Warn("denied request by authorization service")
+				status := decision.Status
+				if status < 400 || status > 599 {
+					status = http.StatusForbidden
+				}
+				rw.WriteHeader(status)
+				return
+			}
+			for _, name := range decision.RemoveHeaders {
+				req.Header.Del(name)
+			}
+			for name, value := range decision.Headers {
+				req.Header.Set(name, value)
+			}
+			next.ServeHTTP(rw, req)
+		})
+	}
+}
+
+// NewExtAuthz returns an ExtAuthz for the service in conf, finding client IPs with clientIPs, or the resolver each
+// request carries if it is nil
+func NewExtAuthz(conf *config.ExtAuthzConfig, clientIPs *ClientIPResolver) (*ExtAuthz, error) {
+	if conf.URL == "" {
+		return nil, fmt.Errorf("ext_authz needs url to be set")
+	}
+	if conf.CacheDuration > 0 && len(conf.Headers) == 0 {
+		return nil, fmt.Errorf("ext_authz needs headers to list the headers decisions depend on to cache them")
+	}
+	cacheSize := conf.CacheSize
+	if cacheSize <= 0 {
+		cacheSize = defaultExtAuthzCacheSize
+	}
+	return &ExtAuthz{
+		url:       conf.URL,
+		client:    &http.Client{Timeout: conf.Timeout.Or(defaultExtAuthzTimeout)},
+		failOpen:  conf.FailOpen,
+		headers:   conf.Headers,
+		clientIPs: clientIPs,
+		cacheTTL:  time.Duration(conf.CacheDuration),
+		cache:     newTTLCache(cacheSize),
+		now:       time.Now,
+	}, nil
+}
@@ -0,0 +1,202 @@
+package inbound
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"github.com/threetoes/peeper/internal/config"
+)
+
+// authzServer allows callers with the admin role, adding a header with their subject, and counts the checks it gets
+type authzServer struct {
+	lock   sync.Mutex
+	checks []extAuthzCheck
+	delay  time.Duration
+}
+
+func (s *authzServer) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
+	var check extAuthzCheck
+	if err := json.NewDecoder(req.Body).Decode(&check); err != nil {
+		rw.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	s.lock.Lock()
+	s.checks = append(s.checks, check)
+	delay := s.delay
+	s.lock.Unlock()
+	time.Sleep(delay)
+
+	if check.Headers["x-role"] != "admin" {
+		json.NewEncoder(rw).Encode(&ExtAuthzDecision{Allow: false, Status: http.StatusNotFound, Reason: "not an admin"})
+		return
+	}
+	decision := &ExtAuthzDecision{Allow: true, Headers: map[string]string{"X-Role": "verified-admin"}, RemoveHeaders: []string{"Cookie"}}
+	if check.Identity != nil {
+		decision.Headers["X-Subject"] = check.Identity.Subject
+	}
+	json.NewEncoder(rw).Encode(decision)
+}
+
+func (s *authzServer) count() int {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return len(s.checks)
+}
+
+func serveAuthz(t *testing.T, authz *ExtAuthz, req *http.Request) (*httptest.ResponseRecorder, *http.Request) {
+	t.Helper()
+	var forwarded *http.Request
+	handler := authz.Middleware("/admin")(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		forwarded = req
+	}))
+	rw := httptest.NewRecorder()
+	handler.ServeHTTP(rw, req)
+	return rw, forwarded
+}
+
+func TestExtAuthz_Middleware(t *testing.T) {
+	svc := &authzServer{}
+	server := httptest.NewServer(svc)
+	defer server.Close()
+	authz, err := NewExtAuthz(&config.ExtAuthzConfig{URL: server.URL}, nil)
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+
+	t.Run("allowed", func(t *testing.T) {
+		req := httptest.NewRequest("POST", "/admin/users?page=2", nil)
+		req.Header.Set("X-Role", "admin")
+		req.Header.Set("Cookie", "session=abc")
+		req = req.WithContext(WithIdentity(req.Context(), &Identity{Subject: "alice", Method: "jwt", Scopes: []string{"admin"}}))
+		rw, forwarded := serveAuthz(t, authz, req)
+		assert.Equal(t, http.StatusOK, rw.Code)
+		if assert.NotNil(t, forwarded) {
+			assert.Equal(t, "verified-admin", forwarded.Header.Get("X-Role"))
+			assert.Equal(t, "alice", forwarded.Header.Get("X-Subject"))
+			assert.Empty(t, forwarded.Header.Get("Cookie"))
+		}
+		check := svc.checks[len(svc.checks)-1]
+		assert.Equal(t, "POST", check.Method)
+		assert.Equal(t, "/admin/users", check.Path)
+		assert.Equal(t, "page=2", check.Query)
+		assert.Equal(t, "192.0.2.1", check.ClientIP)
+		if assert.NotNil(t, check.Identity) {
+			assert.Equal(t, "jwt", check.Identity.Method)
+			assert.Equal(t, []string{"admin"}, check.Identity.Scopes)
+		}
+	})
+
+	t.Run("denied", func(t *testing.T) {
+		var buf bytes.Buffer
+		logrus.SetOutput(&buf)
+		defer logrus.SetOutput(os.Stderr)
+		rw, forwarded := serveAuthz(t, authz, httptest.NewRequest("GET", "/admin/users", nil))
+		assert.Equal(t, http.StatusNotFound, rw.Code, "the service chooses the status")
+		assert.Nil(t, forwarded)
+		assert.Contains(t, buf.String(), "not an admin")
+		assert.Contains(t, buf.String(), "scope=/admin")
+	})
+}
+
+func TestExtAuthz_Headers(t *testing.T) {
+	svc := &authzServer{}
+	server := httptest.NewServer(svc)
+	defer server.Close()
+	authz, _ := NewExtAuthz(&config.ExtAuthzConfig{URL: server.URL, Headers: []string{"X-Role"}}, nil)
+
+	req := httptest.NewRequest("GET", "/admin", nil)
+	req.Header.Set("X-Role", "admin")
+	req.Header.Set("Authorization", "Bearer secret")
+	serveAuthz(t, authz, req)
+	if assert.Equal(t, 1, svc.count()) {
+		assert.Equal(t, map[string]string{"x-role": "admin"}, svc.checks[0].Headers)
+	}
+}
+
+func TestExtAuthz_Cache(t *testing.T) {
+	svc := &authzServer{}
+	server := httptest.NewServer(svc)
+	defer server.Close()
+	authz, err := NewExtAuthz(&config.ExtAuthzConfig{
+		URL:           server.URL,
+		CacheDuration: config.Duration(time.Minute),
+		Headers:       []string{"X-Role"},
+	}, nil)
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	now := time.Now()
+	authz.now = func() time.Time { return now }
+
+	admin := func() *http.Request {
+		req := httptest.NewRequest("GET", "/admin", nil)
+		req.Header.Set("X-Role", "admin")
+		req.Header.Set("Traceparent", fmt.Sprintf("00-%032x-%016x-01", time.Now().UnixNano(), time.Now().UnixNano()))
+		return req
+	}
+	for i := 0; i < 3; i++ {
+		rw, forwarded := serveAuthz(t, authz, admin())
+		assert.Equal(t, http.StatusOK, rw.Code)
+		if assert.NotNil(t, forwarded) {
+			assert.Equal(t, "verified-admin", forwarded.Header.Get("X-Role"), "cached decisions change headers too")
+		}
+	}
+	assert.Equal(t, 1, svc.count(), "requests differing only in unlisted headers share a decision")
+
+	serveAuthz(t, authz, httptest.NewRequest("GET", "/admin", nil))
+	assert.Equal(t, 2, svc.count(), "other requests are checked")
+
+	now = now.Add(2 * time.Minute)
+	serveAuthz(t, authz, admin())
+	assert.Equal(t, 3, svc.count(), "expired decisions are checked again")
+
+	_, err = NewExtAuthz(&config.ExtAuthzConfig{URL: server.URL, CacheDuration: config.Duration(time.Minute)}, nil)
+	assert.Error(t, err, "caching needs the headers decisions depend on")
+}
+
+func TestExtAuthz_Failure(t *testing.T) {
+	svc := &authzServer{delay: 200 * time.Millisecond}
+	server := httptest.NewServer(svc)
+	defer server.Close()
+	down := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		rw.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer down.Close()
+
+	tests := []struct {
+		name     string
+		conf     *config.ExtAuthzConfig
+		wantCode int
+	}{
+		{name: "timeout fails closed", conf: &config.ExtAuthzConfig{URL: server.URL, Timeout: config.Duration(50 * time.Millisecond)}, wantCode: http.StatusServiceUnavailable},
+		{name: "timeout fails open", conf: &config.ExtAuthzConfig{URL: server.URL, Timeout: config.Duration(50 * time.Millisecond), FailOpen: true}, wantCode: http.StatusOK},
+		{name: "error fails closed", conf: &config.ExtAuthzConfig{URL: down.URL}, wantCode: http.StatusServiceUnavailable},
+		{name: "error fails open", conf: &config.ExtAuthzConfig{URL: down.URL, FailOpen: true}, wantCode: http.StatusOK},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			authz, _ := NewExtAuthz(tt.conf, nil)
+			req := httptest.NewRequest("GET", "/admin", nil)
+			req.Header.Set("Cookie", "session=abc")
+			rw, forwarded := serveAuthz(t, authz, req)
+			assert.Equal(t, tt.wantCode, rw.Code)
+			if tt.wantCode == http.StatusOK && assert.NotNil(t, forwarded) {
+				assert.Equal(t, "session=abc", forwarded.Header.Get("Cookie"), "requests let through are unchanged")
+			}
+		})
+	}
+}
+
+func TestNewExtAuthz_NoURL(t *testing.T) {
+	_, err := NewExtAuthz(&config.ExtAuthzConfig{}, nil)
+	assert.Error(t, err)
+}
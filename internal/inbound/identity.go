@@ -0,0 +1,45 @@
+package inbound
+
+import (
+	"context"
+	"crypto/x509"
+	"net/http"
+)
+
+// Identity describes a caller that has authenticated to peeper
+type Identity struct {
+	// Subject names the caller, for example an API key's name or a token's subject
+	Subject string
+	// Method is how the caller authenticated, for example `api_key`
+	Method string
+	// Claims holds any claims or attributes that came with the caller's credentials
+	Claims map[string]interface{}
+	// Scopes are the OAuth scopes granted to the caller
+	Scopes []string
+	// Certificate is the caller's verified client certificate, if they presented one
+	Certificate *x509.Certificate
+}
+
+type identityKey struct{}
+
+// WithIdentity returns a copy of ctx carrying identity
+func WithIdentity(ctx context.Context, identity *Identity) context.Context {
+	return context.WithValue(ctx, identityKey{}, identity)
+}
+
+// IdentityFrom returns the identity stored in ctx, or nil if the caller hasn't authenticated
+func IdentityFrom(ctx context.Context) *Identity {
+	identity, _ := ctx.Value(identityKey{}).(*Identity)
+	return identity
+}
+
+// withCaller returns req carrying identity, keeping any client certificate identified earlier in the chain
+func withCaller(req *http.Request, identity *Identity) *http.Request {
+	if previous := IdentityFrom(req.Context()); previous != nil && identity.Certificate == nil {
+		identity.Certificate = previous.Certificate
+	}
+	return req.WithContext(WithIdentity(req.Context(), identity))
+}
+
+// Middleware wraps an endpoint's handler, typically to check the caller before the request is forwarded
+type Middleware func(next http.Handler) http.Handler
@@ -0,0 +1,174 @@
+package inbound
+
+import (
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/threetoes/peeper/internal/config"
+	"github.com/threetoes/peeper/internal/secrets"
+)
+
+const (
+	defaultIntrospectionCacheDuration         = time.Minute
+	defaultIntrospectionNegativeCacheDuration = 10 * time.Second
+	defaultIntrospectionCacheSize             = 10000
+)
+
+// Introspector checks bearer tokens with an RFC 7662 introspection endpoint, caching the results
+type Introspector struct {
+	endpoint     string
+	clientId     string
+	clientSecret secrets.Secret
+	client       *http.Client
+	positiveTTL  time.Duration
+	negativeTTL  time.Duration
+	now          func() time.Time
+	// cache holds the claims of active tokens, and nil for inactive ones
+	cache *ttlCache
+}
+
+// Introspect returns the claims of token if it is active, or nil if it isn't. An error means the introspection
+// endpoint couldn't be asked, and is not cached
+func (i *Introspector) Introspect(token string) (map[string]interface{}, error) {
+	key := sha256.Sum256([]byte(token))
+	now := i.now()
+	if cached, ok := i.cache.get(key, now); ok {
+		claims, _ := cached.(map[string]interface{})
+		return claims, nil
+	}
+
+	claims, err := i.introspect(token)
+	if err != nil {
+		return nil, err
+	}
+	if active, _ := claims["active"].(bool); !active {
+		i.cache.put(key, nil, now.Add(i.negativeTTL), now)
+		return nil, nil
+	}
+	expires := now.Add(i.positiveTTL)
+	if exp, ok := numericClaim(claims, "exp"); ok && exp.Before(expires) {
+		expires = exp
+	}
+	i.cache.put(key, claims, expires, now)
+	return claims, nil
+}
+
+func (i *Introspector) introspect(token string) (map[string]interface{}, error) {
+	form := url.Values{}
+	form.Set("token", token)
+	form.Set("token_type_hint", "access_token")
+	req, err := http.NewRequest(http.MethodPost, i.endpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+	req.SetBasicAuth(i.clientId, i.clientSecret.Reveal())
+	resp, err := i.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("introspection endpoint returned status code %d", resp.StatusCode)
+	}
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	claims := map[string]interface{}{}
+	if err := json.Unmarshal(body, &claims); err != nil {
+		return nil, fmt.Errorf("could not decode introspection response")
+	}
+	return claims, nil
+}
+
+// NewIntrospector returns an Introspector for the endpoint in conf, authenticating with clientSecret
+func NewIntrospector(conf *config.IntrospectionConfig, clientSecret secrets.Secret) (*Introspector, error) {
+	if conf.Endpoint == "" {
+		return nil, fmt.Errorf("introspection needs endpoint to be set")
+	}
+	i := &Introspector{
+		endpoint:     conf.Endpoint,
+		clientId:     conf.ClientId,
+		clientSecret: clientSecret,
+		client:       &http.Client{Timeout: 10 * time.Second},
+		positiveTTL:  conf.CacheDuration.Or(defaultIntrospectionCacheDuration),
+		negativeTTL:  conf.NegativeCacheDuration.Or(defaultIntrospectionNegativeCacheDuration),
+		now:          time.Now,
+	}
+	cacheSize := conf.CacheSize
+	if cacheSize <= 0 {
+		cacheSize = defaultIntrospectionCacheSize
+	}
+	i.cache = newTTLCache(cacheSize)
+	return i, nil
+}
+
+func checkIntrospected(claims map[string]interface{}, conf *config.IntrospectionConfig) *tokenError {
+	if len(conf.AllowedClientIds) > 0 {
+		clientId, _ := claims["client_id"].(string)
+		if !contains(conf.AllowedClientIds, clientId) {
+			return &tokenError{code: "insufficient_scope", description: fmt.Sprintf("client '%s' is not allowed", clientId)}
+		}
+	}
+	scopes := TokenScopes(claims)
+	for _, want := range conf.RequiredScopes {
+		if !contains(scopes, want) {
+			return &tokenError{code: "insufficient_scope", description: fmt.Sprintf("token is missing scope '%s'", want)}
+		}
+	}
+	return nil
+}
+
+// IntrospectionAuth returns middleware that only lets through callers with a bearer token the introspector reports
+// as active and that meets the requirements in conf. Failures are reported like JWTAuth's, and a 503 is returned if
+// the introspection endpoint can't be reached
+func IntrospectionAuth(introspector *Introspector, conf *config.IntrospectionConfig) Middleware {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+			token := bearerToken(req)
+			if token == "" {
+				rw.Header().Set("WWW-Authenticate", `Bearer realm="peeper"`)
+				rw.WriteHeader(http.StatusUnauthorized)
+				return
+			}
+			claims, err := introspector.Introspect(token)
+			if err != nil {
+				logrus.Errorf("could not introspect token for %s %s: %v", req.Method, req.URL.Path, err)
+				rw.WriteHeader(http.StatusServiceUnavailable)
+				return
+			}
+			tokErr := invalidToken("token is not active")
+			if claims != nil {
+				tokErr = checkIntrospected(claims, conf)
+			}
+			if tokErr != nil {
+				logrus.Warnf("rejecting %s %s: %v", req.Method, req.URL.Path, tokErr)
+				writeTokenError(rw, tokErr, conf.RequiredScopes)
+				return
+			}
+			if !conf.ForwardToken {
+				req.Header.Del("Authorization")
+			}
+			subject, _ := claims["sub"].(string)
+			if subject == "" {
+				subject, _ = claims["client_id"].(string)
+			}
+			identity := &Identity{
+				Subject: subject,
+				Method:  "introspection",
+				Claims:  claims,
+				Scopes:  TokenScopes(claims),
+			}
+			next.ServeHTTP(rw, withCaller(req, identity))
+		})
+	}
+}
@@ -0,0 +1,174 @@
+package inbound
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/threetoes/peeper/internal/config"
+	"github.com/threetoes/peeper/internal/secrets"
+)
+
+// introspectionServer answers introspection requests from a fixed set of tokens, counting how often it's asked
+type introspectionServer struct {
+	lock     sync.Mutex
+	tokens   map[string]map[string]interface{}
+	requests int
+	status   int
+}
+
+func (s *introspectionServer) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.requests++
+	if s.status != 0 {
+		rw.WriteHeader(s.status)
+		return
+	}
+	if id, secret, ok := req.BasicAuth(); !ok || id != "peeper" || secret != "introspection-secret" {
+		rw.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+	claims, ok := s.tokens[req.PostFormValue("token")]
+	if !ok {
+		claims = map[string]interface{}{"active": false}
+	}
+	json.NewEncoder(rw).Encode(claims)
+}
+
+func (s *introspectionServer) count() int {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.requests
+}
+
+func (s *introspectionServer) setStatus(status int) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.status = status
+}
+
+func TestIntrospectionAuth(t *testing.T) {
+	exp := time.Now().Add(time.Hour).Unix()
+	svc := &introspectionServer{tokens: map[string]map[string]interface{}{
+		"partner-token":  {"active": true, "sub": "partner", "client_id": "partner-app", "scope": "orders:read orders:write", "exp": exp},
+		"other-client":   {"active": true, "client_id": "other-app", "scope": "orders:write", "exp": exp},
+		"missing-scope":  {"active": true, "client_id": "partner-app", "scope": "orders:read", "exp": exp},
+		"revoked-token":  {"active": false},
+		"no-scope-token": {"active": true, "client_id": "partner-app", "exp": exp},
+	}}
+	svr := httptest.NewServer(svc)
+	defer svr.Close()
+
+	conf := &config.IntrospectionConfig{
+		Endpoint:         svr.URL,
+		ClientId:         "peeper",
+		RequiredScopes:   []string{"orders:write"},
+		AllowedClientIds: []string{"partner-app"},
+	}
+	introspector, err := NewIntrospector(conf, secrets.NewSecret("introspection-secret"))
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+
+	tests := []struct {
+		name        string
+		token       string
+		wantCode    int
+		wantSubject string
+	}{
+		{name: "active token", token: "partner-token", wantCode: http.StatusOK, wantSubject: "partner"},
+		{name: "client not allowed", token: "other-client", wantCode: http.StatusForbidden},
+		{name: "missing scope", token: "missing-scope", wantCode: http.StatusForbidden},
+		{name: "no scopes", token: "no-scope-token", wantCode: http.StatusForbidden},
+		{name: "inactive token", token: "revoked-token", wantCode: http.StatusUnauthorized},
+		{name: "unknown token", token: "made-up", wantCode: http.StatusUnauthorized},
+		{name: "no token", wantCode: http.StatusUnauthorized},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var forwarded *http.Request
+			handler := IntrospectionAuth(introspector, conf)(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+				forwarded = req
+			}))
+			req := httptest.NewRequest("GET", "/orders", nil)
+			if tt.token != "" {
+				req.Header.Set("Authorization", "Bearer "+tt.token)
+			}
+			rw := httptest.NewRecorder()
+			handler.ServeHTTP(rw, req)
+			assert.Equal(t, tt.wantCode, rw.Code)
+			if tt.wantCode != http.StatusOK {
+				assert.Nil(t, forwarded)
+				assert.NotEmpty(t, rw.Header().Get("WWW-Authenticate"))
+				return
+			}
+			if assert.NotNil(t, forwarded) {
+				assert.Empty(t, forwarded.Header.Get("Authorization"))
+				identity := IdentityFrom(forwarded.Context())
+				assert.Equal(t, tt.wantSubject, identity.Subject)
+				assert.Equal(t, "introspection", identity.Method)
+			}
+		})
+	}
+}
+
+func TestNewIntrospector_NoEndpoint(t *testing.T) {
+	_, err := NewIntrospector(&config.IntrospectionConfig{ClientId: "peeper"}, secrets.NewSecret("introspection-secret"))
+	assert.Error(t, err)
+}
+
+func TestIntrospector_Cache(t *testing.T) {
+	svc := &introspectionServer{tokens: map[string]map[string]interface{}{
+		"good": {"active": true, "exp": time.Now().Add(time.Hour).Unix()},
+		// Expires before the cache duration is up
+		"short": {"active": true, "exp": time.Now().Add(30 * time.Second).Unix()},
+	}}
+	svr := httptest.NewServer(svc)
+	defer svr.Close()
+
+	introspector, _ := NewIntrospector(&config.IntrospectionConfig{
+		Endpoint:              svr.URL,
+		ClientId:              "peeper",
+		CacheDuration:         config.Duration(time.Minute),
+		NegativeCacheDuration: config.Duration(10 * time.Second),
+		CacheSize:             2,
+	}, secrets.NewSecret("introspection-secret"))
+	now := time.Now()
+	introspector.now = func() time.Time { return now }
+
+	introspect := func(token string) bool {
+		claims, err := introspector.Introspect(token)
+		assert.NoError(t, err)
+		return claims != nil
+	}
+
+	assert.True(t, introspect("good"))
+	assert.True(t, introspect("good"))
+	assert.False(t, introspect("bad"))
+	assert.False(t, introspect("bad"))
+	assert.Equal(t, 2, svc.count(), "positive and negative results are cached")
+
+	now = now.Add(15 * time.Second)
+	assert.True(t, introspect("good"))
+	assert.False(t, introspect("bad"))
+	assert.Equal(t, 3, svc.count(), "negative results expire first")
+
+	assert.True(t, introspect("short"))
+	assert.LessOrEqual(t, introspector.cache.len(), 2, "the cache is bounded")
+
+	now = now.Add(20 * time.Second)
+	assert.True(t, introspect("short"))
+	assert.Equal(t, 5, svc.count(), "results aren't cached past the token's expiry")
+
+	svc.setStatus(http.StatusInternalServerError)
+	_, err := introspector.Introspect("new")
+	assert.Error(t, err)
+	svc.setStatus(0)
+	assert.False(t, introspect("new"))
+	assert.Equal(t, 7, svc.count(), "failures aren't cached")
+}
@@ -0,0 +1,182 @@
+package inbound
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+
+	"github.com/sirupsen/logrus"
+)
+
+// parseCIDRs parses a list of CIDRs. Bare IPs are treated as single host networks
+func parseCIDRs(cidrs []string) ([]*net.IPNet, error) {
+	nets := make([]*net.IPNet, 0, len(cidrs))
+	for _, c := range cidrs {
+		if !strings.Contains(c, "/") {
+			ip := net.ParseIP(c)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid IP '%s'", c)
+			}
+			bits := 8 * net.IPv6len
+			if ip.To4() != nil {
+				ip, bits = ip.To4(), 8*net.IPv4len
+			}
+			nets = append(nets, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, n, err := net.ParseCIDR(c)
+		if err != nil {
+			return nil, fmt.Errorf("invalid CIDR '%s': %v", c, err)
+		}
+		nets = append(nets, n)
+	}
+	return nets, nil
+}
+
+// findNet returns the first network in nets containing ip
+func findNet(nets []*net.IPNet, ip net.IP) *net.IPNet {
+	for _, n := range nets {
+		if n.Contains(ip) {
+			return n
+		}
+	}
+	return nil
+}
+
+// ClientIPResolver finds the real client IP of a request, looking through X-Forwarded-For when the connection comes
+// from a trusted proxy
+type ClientIPResolver struct {
+	trusted []*net.IPNet
+}
+
+// peerIP returns the IP of the other end of req's connection, or nil if it isn't known
+func peerIP(req *http.Request) net.IP {
+	host, _, err := net.SplitHostPort(req.RemoteAddr)
+	if err != nil {
+		host = req.RemoteAddr
+	}
+	return net.ParseIP(host)
+}
+
+// FromTrustedProxy reports whether req's connection comes from a trusted proxy, whose forwarding headers can be
+// believed
+func (c *ClientIPResolver) FromTrustedProxy(req *http.Request) bool {
+	ip := peerIP(req)
+	return ip != nil && findNet(c.trusted, ip) != nil
+}
+
+// ClientIP returns the client's IP, or nil if it can't be worked out
+func (c *ClientIPResolver) ClientIP(req *http.Request) net.IP {
+	ip := peerIP(req)
+	if ip == nil || findNet(c.trusted, ip) == nil {
+		return ip
+	}
+	// Walk back from the proxy closest to us, stopping at the first address we don't trust to have set the header
+	var hops []string
+	for _, h := range req.Header.Values("X-Forwarded-For") {
+		hops = append(hops, strings.Split(h, ",")...)
+	}
+	for i := len(hops) - 1; i >= 0; i-- {
+		hop := net.ParseIP(strings.TrimSpace(hops[i]))
+		if hop == nil {
+			return ip
+		}
+		ip = hop
+		if findNet(c.trusted, hop) == nil {
+			break
+		}
+	}
+	return ip
+}
+
+type clientIPResolverKey struct{}
+
+// WithClientIPResolver returns a copy of ctx carrying resolver, which middleware created without a resolver of its
+// own finds client IPs with. This lets listeners with different trusted proxies share an endpoint's middleware
+func WithClientIPResolver(ctx context.Context, resolver *ClientIPResolver) context.Context {
+	return context.WithValue(ctx, clientIPResolverKey{}, resolver)
+}
+
+// resolverFor returns resolver if it is set, or else the resolver req carries. Without either no proxies are
+// trusted
+func resolverFor(req *http.Request, resolver *ClientIPResolver) *ClientIPResolver {
+	if resolver != nil {
+		return resolver
+	}
+	if r, ok := req.Context().Value(clientIPResolverKey{}).(*ClientIPResolver); ok && r != nil {
+		return r
+	}
+	return &ClientIPResolver{}
+}
+
+func NewClientIPResolver(trustedProxies []string) (*ClientIPResolver, error) {
+	trusted, err := parseCIDRs(trustedProxies)
+	if err != nil {
+		return nil, err
+	}
+	return &ClientIPResolver{trusted: trusted}, nil
+}
+
+// IPFilter allows or denies requests by client IP. Denies take precedence, and an empty allow list allows
+// everything that isn't denied
+type IPFilter struct {
+	allow    []*net.IPNet
+	deny     []*net.IPNet
+	resolver *ClientIPResolver
+}
+
+// check returns the reason ip is denied, or an empty string if it is allowed
+func (f *IPFilter) check(ip net.IP) string {
+	if ip == nil {
+		return "client IP is unknown"
+	}
+	if n := findNet(f.deny, ip); n != nil {
+		return fmt.Sprintf("deny_cidrs %s", n)
+	}
+	if len(f.allow) > 0 && findNet(f.allow, ip) == nil {
+		return "not in allow_cidrs"
+	}
+	return ""
+}
+
+// Middleware returns middleware applying the filter. Denied requests get a 403 and an audit log line naming scope
+// and the rule that matched
+func (f *IPFilter) Middleware(scope string) Middleware {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+			ip := resolverFor(req, f.resolver).ClientIP(req)
+			if reason := f.check(ip); reason != "" {
+				logrus.WithFields(logrus.Fields{
+					"audit":     true,
+					"scope":     scope,
+					"client_ip": ip.String(),
+					"method":    req.Method,
+					"path":      req.URL.Path,
+					"rule":      reason,
+				}).Warn("denied request by client IP")
+				rw.WriteHeader(http.StatusForbidden)
+				return
+			}
+			next.ServeHTTP(rw, req)
+		})
+	}
+}
+
+// NewIPFilter returns an IPFilter for the allow and deny CIDRs, finding client IPs with resolver, or the resolver
+// each request carries if it is nil. A nil filter is returned if both lists are empty
+func NewIPFilter(allowCIDRs, denyCIDRs []string, resolver *ClientIPResolver) (*IPFilter, error) {
+	if len(allowCIDRs) == 0 && len(denyCIDRs) == 0 {
+		return nil, nil
+	}
+	allow, err := parseCIDRs(allowCIDRs)
+	if err != nil {
+		return nil, err
+	}
+	deny, err := parseCIDRs(denyCIDRs)
+	if err != nil {
+		return nil, err
+	}
+	return &IPFilter{allow: allow, deny: deny, resolver: resolver}, nil
+}
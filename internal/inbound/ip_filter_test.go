@@ -0,0 +1,88 @@
+package inbound
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestClientIPResolver_ClientIP(t *testing.T) {
+	resolver, err := NewClientIPResolver([]string{"10.0.0.0/8", "192.168.1.1"})
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	tests := []struct {
+		name         string
+		remoteAddr   string
+		forwardedFor []string
+		want         string
+	}{
+		{name: "direct", remoteAddr: "203.0.113.7:5555", want: "203.0.113.7"},
+		{name: "untrusted peer can't spoof", remoteAddr: "203.0.113.7:5555", forwardedFor: []string{"10.1.1.1"}, want: "203.0.113.7"},
+		{name: "trusted proxy", remoteAddr: "10.0.0.2:5555", forwardedFor: []string{"198.51.100.4"}, want: "198.51.100.4"},
+		{name: "chain of trusted proxies", remoteAddr: "10.0.0.2:5555", forwardedFor: []string{"1.2.3.4, 198.51.100.4, 192.168.1.1"}, want: "198.51.100.4"},
+		{name: "multiple headers", remoteAddr: "10.0.0.2:5555", forwardedFor: []string{"1.2.3.4", "198.51.100.4"}, want: "198.51.100.4"},
+		{name: "trusted proxy without header", remoteAddr: "10.0.0.2:5555", want: "10.0.0.2"},
+		{name: "ipv6", remoteAddr: "[2001:db8::1]:5555", want: "2001:db8::1"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest("GET", "/", nil)
+			req.RemoteAddr = tt.remoteAddr
+			for _, h := range tt.forwardedFor {
+				req.Header.Add("X-Forwarded-For", h)
+			}
+			assert.Equal(t, tt.want, resolver.ClientIP(req).String())
+		})
+	}
+}
+
+func TestIPFilter_Middleware(t *testing.T) {
+	var buf bytes.Buffer
+	logrus.SetOutput(&buf)
+	defer logrus.SetOutput(os.Stderr)
+
+	resolver, _ := NewClientIPResolver(nil)
+	filter, err := NewIPFilter([]string{"10.0.0.0/8", "2001:db8::/32"}, []string{"10.66.0.0/16", "10.1.2.3"}, resolver)
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	tests := []struct {
+		name       string
+		remoteAddr string
+		wantCode   int
+		wantRule   string
+	}{
+		{name: "allowed", remoteAddr: "10.1.1.1:1234", wantCode: http.StatusOK},
+		{name: "allowed ipv6", remoteAddr: "[2001:db8::5]:1234", wantCode: http.StatusOK},
+		{name: "not allowed", remoteAddr: "203.0.113.7:1234", wantCode: http.StatusForbidden, wantRule: "not in allow_cidrs"},
+		{name: "denied subnet", remoteAddr: "10.66.3.4:1234", wantCode: http.StatusForbidden, wantRule: "deny_cidrs 10.66.0.0/16"},
+		{name: "denied host", remoteAddr: "10.1.2.3:1234", wantCode: http.StatusForbidden, wantRule: "deny_cidrs 10.1.2.3/32"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			buf.Reset()
+			handler := filter.Middleware("/payroll")(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {}))
+			req := httptest.NewRequest("GET", "/payroll", nil)
+			req.RemoteAddr = tt.remoteAddr
+			rw := httptest.NewRecorder()
+			handler.ServeHTTP(rw, req)
+			assert.Equal(t, tt.wantCode, rw.Code)
+			if tt.wantRule != "" {
+				assert.Contains(t, buf.String(), "audit=true")
+				assert.Contains(t, buf.String(), tt.wantRule)
+			}
+		})
+	}
+
+	_, err = NewIPFilter([]string{"not a cidr"}, nil, resolver)
+	assert.Error(t, err)
+	empty, err := NewIPFilter(nil, nil, resolver)
+	assert.NoError(t, err)
+	assert.Nil(t, empty)
+}
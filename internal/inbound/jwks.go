@@ -0,0 +1,258 @@
+package inbound
+
+// Referred to here for the key format https://datatracker.ietf.org/doc/html/rfc7517
+
+import (
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	defaultJWKSCacheDuration = time.Hour
+	// jwksMinRefetchInterval stops tokens with made up key IDs from hammering the JWKS endpoint
+	jwksMinRefetchInterval = 30 * time.Second
+	jwksFetchTimeout       = 10 * time.Second
+)
+
+type jsonWebKey struct {
+	Kid string `json:"kid"`
+	Kty string `json:"kty"`
+	Alg string `json:"alg"`
+	Use string `json:"use"`
+	Crv string `json:"crv"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+}
+
+type jsonWebKeySet struct {
+	Keys []jsonWebKey `json:"keys"`
+}
+
+// verificationKey is a public key from a JWKS
+type verificationKey struct {
+	key interface{}
+	// alg is the algorithm the key is restricted to, if the JWKS says
+	alg string
+}
+
+func (k *jsonWebKey) publicKey() (interface{}, error) {
+	decode := base64.RawURLEncoding.DecodeString
+	switch k.Kty {
+	case "RSA":
+		n, err := decode(k.N)
+		if err != nil {
+			return nil, err
+		}
+		e, err := decode(k.E)
+		if err != nil {
+			return nil, err
+		}
+		return &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(new(big.Int).SetBytes(e).Int64())}, nil
+	case "EC":
+		var curve elliptic.Curve
+		switch k.Crv {
+		case "P-256":
+			curve = elliptic.P256()
+		case "P-384":
+			curve = elliptic.P384()
+		case "P-521":
+			curve = elliptic.P521()
+		default:
+			return nil, fmt.Errorf("unsupported curve '%s'", k.Crv)
+		}
+		x, err := decode(k.X)
+		if err != nil {
+			return nil, err
+		}
+		y, err := decode(k.Y)
+		if err != nil {
+			return nil, err
+		}
+		key := &ecdsa.PublicKey{Curve: curve, X: new(big.Int).SetBytes(x), Y: new(big.Int).SetBytes(y)}
+		if !curve.IsOnCurve(key.X, key.Y) {
+			return nil, fmt.Errorf("point is not on curve %s", k.Crv)
+		}
+		return key, nil
+	case "OKP":
+		if k.Crv != "Ed25519" {
+			return nil, fmt.Errorf("unsupported curve '%s'", k.Crv)
+		}
+		x, err := decode(k.X)
+		if err != nil {
+			return nil, err
+		}
+		if len(x) != ed25519.PublicKeySize {
+			return nil, fmt.Errorf("invalid Ed25519 key size")
+		}
+		return ed25519.PublicKey(x), nil
+	}
+	return nil, fmt.Errorf("unsupported key type '%s'", k.Kty)
+}
+
+func parseJWKS(body []byte) (map[string]*verificationKey, error) {
+	var set jsonWebKeySet
+	if err := json.Unmarshal(body, &set); err != nil {
+		return nil, fmt.Errorf("could not decode JWKS: %v", err)
+	}
+	keys := map[string]*verificationKey{}
+	for _, k := range set.Keys {
+		if k.Use != "" && k.Use != "sig" {
+			continue
+		}
+		key, err := k.publicKey()
+		if err != nil {
+			// Skip keys we can't use rather than failing the whole set
+			continue
+		}
+		keys[k.Kid] = &verificationKey{key: key, alg: k.Alg}
+	}
+	if len(keys) == 0 {
+		return nil, fmt.Errorf("JWKS has no usable signing keys")
+	}
+	return keys, nil
+}
+
+// JWKS is a set of JSON web keys, fetched from a URL or read from a file. Fetched sets are cached, and fetched
+// again early when a token is signed with a key ID that isn't in the set, which picks up key rotation
+type JWKS struct {
+	url           string
+	cacheDuration time.Duration
+	client        *http.Client
+
+	lock      sync.Mutex
+	keys      map[string]*verificationKey
+	fetchedAt time.Time
+	// fetching is closed when the fetch in flight finishes, nil when there isn't one
+	fetching chan struct{}
+}
+
+// key returns the key with the given ID. An empty kid is allowed if the set only has one key
+func (j *JWKS) key(kid string) (*verificationKey, error) {
+	now := time.Now()
+	j.lock.Lock()
+	fetchedAt := j.fetchedAt
+	j.lock.Unlock()
+	stale := j.url != "" && now.Sub(fetchedAt) > j.cacheDuration
+	if stale {
+		j.refetch(fetchedAt, now)
+	}
+	if k := j.find(kid); k != nil {
+		return k, nil
+	}
+	if j.url != "" && !stale && now.Sub(fetchedAt) > jwksMinRefetchInterval {
+		// The issuer may have rotated to a key we haven't seen yet
+		j.refetch(fetchedAt, now)
+		if k := j.find(kid); k != nil {
+			return k, nil
+		}
+	}
+	return nil, fmt.Errorf("no key with ID '%s' in the JWKS", kid)
+}
+
+func (j *JWKS) find(kid string) *verificationKey {
+	j.lock.Lock()
+	defer j.lock.Unlock()
+	if kid == "" && len(j.keys) == 1 {
+		for _, k := range j.keys {
+			return k
+		}
+	}
+	return j.keys[kid]
+}
+
+// refetch fetches the set again unless it has been fetched since lastFetch. The lock isn't held during the fetch so
+// tokens signed with cached keys aren't held up by a slow JWKS endpoint; callers arriving while a fetch is in flight
+// wait for it rather than starting their own
+func (j *JWKS) refetch(lastFetch, now time.Time) {
+	j.lock.Lock()
+	if wait := j.fetching; wait != nil {
+		j.lock.Unlock()
+		<-wait
+		return
+	}
+	if !j.fetchedAt.Equal(lastFetch) {
+		j.lock.Unlock()
+		return
+	}
+	done := make(chan struct{})
+	j.fetching = done
+	j.fetchedAt = now
+	j.lock.Unlock()
+
+	keys, err := j.fetch()
+
+	j.lock.Lock()
+	if err == nil {
+		j.keys = keys
+	}
+	j.fetching = nil
+	j.lock.Unlock()
+	close(done)
+	if err != nil {
+		logrus.Warnf("could not refresh JWKS from %s, keeping the cached keys: %v", j.url, err)
+	}
+}
+
+// fetch gets the set from its URL
+func (j *JWKS) fetch() (map[string]*verificationKey, error) {
+	resp, err := j.client.Get(j.url)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("received status code %d fetching JWKS", resp.StatusCode)
+	}
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	return parseJWKS(body)
+}
+
+// NewJWKSFromURL returns a JWKS fetched from url. The first fetch happens straight away so that a bad URL is caught
+// at startup
+func NewJWKSFromURL(url string, cacheDuration time.Duration) (*JWKS, error) {
+	if cacheDuration <= 0 {
+		cacheDuration = defaultJWKSCacheDuration
+	}
+	j := &JWKS{
+		url:           url,
+		cacheDuration: cacheDuration,
+		client:        &http.Client{Timeout: jwksFetchTimeout},
+		fetchedAt:     time.Now(),
+	}
+	keys, err := j.fetch()
+	if err != nil {
+		return nil, fmt.Errorf("could not fetch JWKS from %s: %v", url, err)
+	}
+	j.keys = keys
+	return j, nil
+}
+
+// NewJWKSFromFile returns the JWKS in file
+func NewJWKSFromFile(file string) (*JWKS, error) {
+	contents, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, fmt.Errorf("could not read JWKS file: %v", err)
+	}
+	keys, err := parseJWKS(contents)
+	if err != nil {
+		return nil, err
+	}
+	return &JWKS{keys: keys}, nil
+}
@@ -0,0 +1,261 @@
+package inbound
+
+import (
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/golang-jwt/jwt/v4"
+	"github.com/sirupsen/logrus"
+	"github.com/threetoes/peeper/internal/config"
+)
+
+// asymmetricMethods are the only signing algorithms accepted. Symmetric algorithms and `none` make no sense with a
+// JWKS of public keys
+var asymmetricMethods = []string{"RS256", "RS384", "RS512", "PS256", "PS384", "PS512", "ES256", "ES384", "ES512", "EdDSA"}
+
+// tokenError is a validation failure, with the RFC 6750 error code to report it with
+type tokenError struct {
+	code        string
+	description string
+	// detail is logged but not sent to the caller
+	detail error
+}
+
+func (e *tokenError) Error() string {
+	if e.detail != nil {
+		return fmt.Sprintf("%s: %v", e.description, e.detail)
+	}
+	return e.description
+}
+
+func invalidToken(format string, args ...interface{}) *tokenError {
+	return &tokenError{code: "invalid_token", description: fmt.Sprintf(format, args...)}
+}
+
+// JWTValidator checks JWTs against a JWKS and the issuer, audience, expiry, claim and scope requirements of an
+// endpoint
+type JWTValidator struct {
+	jwks           *JWKS
+	issuer         string
+	audiences      []string
+	requiredClaims map[string]string
+	requiredScopes []string
+	leeway         time.Duration
+	parser         *jwt.Parser
+}
+
+// Validate checks token and returns its claims
+func (v *JWTValidator) Validate(token string) (jwt.MapClaims, error) {
+	claims, err := v.validate(token, time.Now())
+	if err != nil {
+		return nil, err
+	}
+	return claims, nil
+}
+
+func (v *JWTValidator) validate(token string, now time.Time) (jwt.MapClaims, *tokenError) {
+	claims := jwt.MapClaims{}
+	_, err := v.parser.ParseWithClaims(token, claims, func(t *jwt.Token) (interface{}, error) {
+		kid, _ := t.Header["kid"].(string)
+		k, err := v.jwks.key(kid)
+		if err != nil {
+			return nil, err
+		}
+		alg := t.Method.Alg()
+		if k.alg != "" && k.alg != alg {
+			return nil, fmt.Errorf("key '%s' can't be used with %s", kid, alg)
+		}
+		if !algorithmMatchesKey(alg, k.key) {
+			return nil, fmt.Errorf("algorithm %s doesn't match the key type", alg)
+		}
+		return k.key, nil
+	})
+	if err != nil {
+		return nil, &tokenError{code: "invalid_token", description: "token could not be verified", detail: err}
+	}
+
+	exp, ok := numericClaim(claims, "exp")
+	if !ok {
+		return nil, invalidToken("token has no expiry")
+	}
+	if now.After(exp.Add(v.leeway)) {
+		return nil, invalidToken("token has expired")
+	}
+	if nbf, ok := numericClaim(claims, "nbf"); ok && now.Add(v.leeway).Before(nbf) {
+		return nil, invalidToken("token is not valid yet")
+	}
+	if v.issuer != "" {
+		if iss, _ := claims["iss"].(string); iss != v.issuer {
+			return nil, invalidToken("token has the wrong issuer")
+		}
+	}
+	if len(v.audiences) > 0 {
+		matched := false
+		for _, aud := range v.audiences {
+			if claimContains(claims["aud"], aud) {
+				matched = true
+				break
+			}
+		}
+		if !matched {
+			return nil, invalidToken("token has the wrong audience")
+		}
+	}
+	for name, want := range v.requiredClaims {
+		if !claimContains(claims[name], want) {
+			return nil, invalidToken("token is missing required claim '%s'", name)
+		}
+	}
+	scopes := TokenScopes(claims)
+	for _, want := range v.requiredScopes {
+		if !contains(scopes, want) {
+			return nil, &tokenError{code: "insufficient_scope", description: fmt.Sprintf("token is missing scope '%s'", want)}
+		}
+	}
+	return claims, nil
+}
+
+func algorithmMatchesKey(alg string, key interface{}) bool {
+	switch k := key.(type) {
+	case *rsa.PublicKey:
+		return strings.HasPrefix(alg, "RS") || strings.HasPrefix(alg, "PS")
+	case *ecdsa.PublicKey:
+		switch k.Curve.Params().BitSize {
+		case 256:
+			return alg == "ES256"
+		case 384:
+			return alg == "ES384"
+		case 521:
+			return alg == "ES512"
+		}
+	case ed25519.PublicKey:
+		return alg == "EdDSA"
+	}
+	return false
+}
+
+func numericClaim(claims jwt.MapClaims, name string) (time.Time, bool) {
+	switch v := claims[name].(type) {
+	case float64:
+		return time.Unix(int64(v), 0), true
+	case int64:
+		return time.Unix(v, 0), true
+	}
+	return time.Time{}, false
+}
+
+// claimContains reports whether a string claim equals want, or an array claim contains it
+func claimContains(claim interface{}, want string) bool {
+	switch v := claim.(type) {
+	case string:
+		return v == want
+	case []interface{}:
+		for _, item := range v {
+			if s, ok := item.(string); ok && s == want {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// TokenScopes returns the scopes in a space separated `scope` claim or an array `scp` claim
+func TokenScopes(claims map[string]interface{}) []string {
+	var scopes []string
+	if scope, ok := claims["scope"].(string); ok {
+		scopes = append(scopes, strings.Fields(scope)...)
+	}
+	if scp, ok := claims["scp"].([]interface{}); ok {
+		for _, s := range scp {
+			if str, ok := s.(string); ok {
+				scopes = append(scopes, str)
+			}
+		}
+	}
+	return scopes
+}
+
+// contains reports whether list contains value. Unlike allowed, matching is case sensitive as scopes and client
+// IDs are
+func contains(list []string, value string) bool {
+	for _, v := range list {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
+// NewJWTValidator returns a JWTValidator checking tokens against jwks and the requirements in conf
+func NewJWTValidator(jwks *JWKS, conf *config.JWTAuthConfig) *JWTValidator {
+	return &JWTValidator{
+		jwks:           jwks,
+		issuer:         conf.Issuer,
+		audiences:      conf.Audiences,
+		requiredClaims: conf.RequiredClaims,
+		requiredScopes: conf.RequiredScopes,
+		leeway:         time.Duration(conf.Leeway),
+		// Time based claims are checked by validate, with leeway
+		parser: jwt.NewParser(jwt.WithValidMethods(asymmetricMethods), jwt.WithoutClaimsValidation()),
+	}
+}
+
+// bearerToken returns the token from a `Bearer` Authorization header
+func bearerToken(req *http.Request) string {
+	authz := req.Header.Get("Authorization")
+	if len(authz) < 7 || !strings.EqualFold(authz[:7], "bearer ") {
+		return ""
+	}
+	return strings.TrimSpace(authz[7:])
+}
+
+func writeTokenError(rw http.ResponseWriter, tokErr *tokenError, requiredScopes []string) {
+	challenge := fmt.Sprintf(`Bearer realm="peeper", error="%s", error_description="%s"`, tokErr.code, tokErr.description)
+	if tokErr.code == "insufficient_scope" {
+		if len(requiredScopes) > 0 {
+			challenge += fmt.Sprintf(`, scope="%s"`, strings.Join(requiredScopes, " "))
+		}
+		rw.Header().Set("WWW-Authenticate", challenge)
+		rw.WriteHeader(http.StatusForbidden)
+		return
+	}
+	rw.Header().Set("WWW-Authenticate", challenge)
+	rw.WriteHeader(http.StatusUnauthorized)
+}
+
+// JWTAuth returns middleware that only lets through callers with a bearer token accepted by validator. Failures
+// get a 401, or a 403 when the token lacks a required scope, with a WWW-Authenticate header as per RFC 6750
+func JWTAuth(validator *JWTValidator, forwardToken bool) Middleware {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+			token := bearerToken(req)
+			if token == "" {
+				rw.Header().Set("WWW-Authenticate", `Bearer realm="peeper"`)
+				rw.WriteHeader(http.StatusUnauthorized)
+				return
+			}
+			claims, tokErr := validator.validate(token, time.Now())
+			if tokErr != nil {
+				logrus.Warnf("rejecting %s %s: %v", req.Method, req.URL.Path, tokErr)
+				writeTokenError(rw, tokErr, validator.requiredScopes)
+				return
+			}
+			if !forwardToken {
+				req.Header.Del("Authorization")
+			}
+			subject, _ := claims["sub"].(string)
+			identity := &Identity{
+				Subject: subject,
+				Method:  "jwt",
+				Claims:  claims,
+				Scopes:  TokenScopes(claims),
+			}
+			next.ServeHTTP(rw, withCaller(req, identity))
+		})
+	}
+}
@@ -0,0 +1,261 @@
+package inbound
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v4"
+	"github.com/stretchr/testify/assert"
+	"github.com/threetoes/peeper/internal/config"
+)
+
+func rsaJWK(kid string, key *rsa.PublicKey) map[string]string {
+	return map[string]string{
+		"kid": kid,
+		"kty": "RSA",
+		"use": "sig",
+		"n":   base64.RawURLEncoding.EncodeToString(key.N.Bytes()),
+		"e":   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(key.E)).Bytes()),
+	}
+}
+
+func ecJWK(kid string, key *ecdsa.PublicKey) map[string]string {
+	return map[string]string{
+		"kid": kid,
+		"kty": "EC",
+		"crv": "P-256",
+		"x":   base64.RawURLEncoding.EncodeToString(key.X.FillBytes(make([]byte, 32))),
+		"y":   base64.RawURLEncoding.EncodeToString(key.Y.FillBytes(make([]byte, 32))),
+	}
+}
+
+// jwksServer serves whichever keys it currently holds
+type jwksServer struct {
+	lock    sync.Mutex
+	keys    []map[string]string
+	fetches int
+}
+
+func (j *jwksServer) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
+	j.lock.Lock()
+	defer j.lock.Unlock()
+	j.fetches++
+	json.NewEncoder(rw).Encode(map[string]interface{}{"keys": j.keys})
+}
+
+func signToken(t *testing.T, method jwt.SigningMethod, kid string, key crypto.Signer, claims jwt.MapClaims) string {
+	tok := jwt.NewWithClaims(method, claims)
+	if kid != "" {
+		tok.Header["kid"] = kid
+	}
+	signed, err := tok.SignedString(key)
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	return signed
+}
+
+func TestJWTAuth(t *testing.T) {
+	rsaKey, _ := rsa.GenerateKey(rand.Reader, 2048)
+	ecKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	otherKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	jwksSvc := &jwksServer{keys: []map[string]string{rsaJWK("rsa-1", &rsaKey.PublicKey), ecJWK("ec-1", &ecKey.PublicKey)}}
+	svr := httptest.NewServer(jwksSvc)
+	defer svr.Close()
+
+	jwks, err := NewJWKSFromURL(svr.URL, 0)
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	validator := NewJWTValidator(jwks, &config.JWTAuthConfig{
+		Issuer:         "https://idp.internal",
+		Audiences:      []string{"peeper"},
+		RequiredClaims: map[string]string{"role": "billing"},
+		RequiredScopes: []string{"payments:write"},
+		Leeway:         config.Duration(time.Minute),
+	})
+
+	now := time.Now()
+	claims := func(overrides jwt.MapClaims) jwt.MapClaims {
+		c := jwt.MapClaims{
+			"sub":   "billing-service",
+			"iss":   "https://idp.internal",
+			"aud":   []string{"other", "peeper"},
+			"exp":   now.Add(time.Hour).Unix(),
+			"role":  []string{"billing", "reader"},
+			"scope": "payments:read payments:write",
+		}
+		for k, v := range overrides {
+			if v == nil {
+				delete(c, k)
+			} else {
+				c[k] = v
+			}
+		}
+		return c
+	}
+
+	tests := []struct {
+		name          string
+		token         string
+		wantCode      int
+		wantChallenge string
+	}{
+		{name: "valid rsa token", token: signToken(t, jwt.SigningMethodRS256, "rsa-1", rsaKey, claims(nil)), wantCode: http.StatusOK},
+		{name: "valid ec token", token: signToken(t, jwt.SigningMethodES256, "ec-1", ecKey, claims(nil)), wantCode: http.StatusOK},
+		{name: "expired within leeway", token: signToken(t, jwt.SigningMethodES256, "ec-1", ecKey, claims(jwt.MapClaims{"exp": now.Add(-30 * time.Second).Unix()})), wantCode: http.StatusOK},
+		{name: "expired", token: signToken(t, jwt.SigningMethodES256, "ec-1", ecKey, claims(jwt.MapClaims{"exp": now.Add(-time.Hour).Unix()})), wantCode: http.StatusUnauthorized, wantChallenge: `Bearer realm="peeper", error="invalid_token", error_description="token has expired"`},
+		{name: "no expiry", token: signToken(t, jwt.SigningMethodES256, "ec-1", ecKey, claims(jwt.MapClaims{"exp": nil})), wantCode: http.StatusUnauthorized},
+		{name: "not valid yet", token: signToken(t, jwt.SigningMethodES256, "ec-1", ecKey, claims(jwt.MapClaims{"nbf": now.Add(time.Hour).Unix()})), wantCode: http.StatusUnauthorized},
+		{name: "wrong issuer", token: signToken(t, jwt.SigningMethodES256, "ec-1", ecKey, claims(jwt.MapClaims{"iss": "https://evil"})), wantCode: http.StatusUnauthorized},
+		{name: "wrong audience", token: signToken(t, jwt.SigningMethodES256, "ec-1", ecKey, claims(jwt.MapClaims{"aud": "other"})), wantCode: http.StatusUnauthorized},
+		{name: "missing claim", token: signToken(t, jwt.SigningMethodES256, "ec-1", ecKey, claims(jwt.MapClaims{"role": "reader"})), wantCode: http.StatusUnauthorized},
+		{name: "missing scope", token: signToken(t, jwt.SigningMethodES256, "ec-1", ecKey, claims(jwt.MapClaims{"scope": "payments:read"})), wantCode: http.StatusForbidden,
+			wantChallenge: `Bearer realm="peeper", error="insufficient_scope", error_description="token is missing scope 'payments:write'", scope="payments:write"`},
+		{name: "no scopes", token: signToken(t, jwt.SigningMethodES256, "ec-1", ecKey, claims(jwt.MapClaims{"scope": nil})), wantCode: http.StatusForbidden},
+		{name: "scopes are case sensitive", token: signToken(t, jwt.SigningMethodES256, "ec-1", ecKey, claims(jwt.MapClaims{"scope": "payments:read PAYMENTS:WRITE"})), wantCode: http.StatusForbidden,
+			wantChallenge: `Bearer realm="peeper", error="insufficient_scope", error_description="token is missing scope 'payments:write'", scope="payments:write"`},
+		{name: "signed by unknown key", token: signToken(t, jwt.SigningMethodES256, "ec-1", otherKey, claims(nil)), wantCode: http.StatusUnauthorized},
+		{name: "algorithm doesn't match key", token: signToken(t, jwt.SigningMethodPS256, "ec-1", rsaKey, claims(nil)), wantCode: http.StatusUnauthorized},
+		{name: "no token", wantCode: http.StatusUnauthorized, wantChallenge: `Bearer realm="peeper"`},
+		{name: "garbage token", token: "not.a.jwt", wantCode: http.StatusUnauthorized},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var forwarded *http.Request
+			handler := JWTAuth(validator, false)(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+				forwarded = req
+			}))
+			req := httptest.NewRequest("GET", "/payments", nil)
+			if tt.token != "" {
+				req.Header.Set("Authorization", "Bearer "+tt.token)
+			}
+			rw := httptest.NewRecorder()
+			handler.ServeHTTP(rw, req)
+			assert.Equal(t, tt.wantCode, rw.Code)
+			if tt.wantChallenge != "" {
+				assert.Equal(t, tt.wantChallenge, rw.Header().Get("WWW-Authenticate"))
+			}
+			if tt.wantCode != http.StatusOK {
+				assert.Nil(t, forwarded)
+				assert.NotEmpty(t, rw.Header().Get("WWW-Authenticate"))
+				return
+			}
+			if assert.NotNil(t, forwarded) {
+				assert.Empty(t, forwarded.Header.Get("Authorization"))
+				identity := IdentityFrom(forwarded.Context())
+				assert.Equal(t, "billing-service", identity.Subject)
+				assert.Contains(t, identity.Scopes, "payments:write")
+			}
+		})
+	}
+}
+
+func TestJWKS_KeyRotation(t *testing.T) {
+	oldKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	newKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	jwksSvc := &jwksServer{keys: []map[string]string{ecJWK("old", &oldKey.PublicKey)}}
+	svr := httptest.NewServer(jwksSvc)
+	defer svr.Close()
+
+	jwks, err := NewJWKSFromURL(svr.URL, time.Hour)
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	validator := NewJWTValidator(jwks, &config.JWTAuthConfig{})
+	exp := jwt.MapClaims{"exp": time.Now().Add(time.Hour).Unix()}
+
+	_, err = validator.Validate(signToken(t, jwt.SigningMethodES256, "old", oldKey, exp))
+	assert.NoError(t, err)
+
+	jwksSvc.lock.Lock()
+	jwksSvc.keys = append(jwksSvc.keys, ecJWK("new", &newKey.PublicKey))
+	jwksSvc.lock.Unlock()
+
+	// Unknown key IDs don't trigger a fetch straight after the last one
+	_, err = validator.Validate(signToken(t, jwt.SigningMethodES256, "new", newKey, exp))
+	assert.Error(t, err)
+	assert.Equal(t, 1, jwksSvc.fetches)
+
+	jwks.fetchedAt = time.Now().Add(-jwksMinRefetchInterval - time.Second)
+	_, err = validator.Validate(signToken(t, jwt.SigningMethodES256, "new", newKey, exp))
+	assert.NoError(t, err)
+	assert.Equal(t, 2, jwksSvc.fetches)
+}
+
+func TestJWKS_SlowRefetch(t *testing.T) {
+	cachedKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	jwksSvc := &jwksServer{keys: []map[string]string{ecJWK("cached", &cachedKey.PublicKey)}}
+	release := make(chan struct{})
+	var fetches int
+	svr := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		jwksSvc.lock.Lock()
+		fetches++
+		refetch := fetches > 1
+		jwksSvc.lock.Unlock()
+		if refetch {
+			<-release
+		}
+		jwksSvc.ServeHTTP(rw, req)
+	}))
+	defer svr.Close()
+
+	jwks, err := NewJWKSFromURL(svr.URL, time.Hour)
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	jwks.fetchedAt = time.Now().Add(-jwksMinRefetchInterval - time.Second)
+
+	// Several unknown key IDs at once share a single fetch, which is held up by the server
+	var wg sync.WaitGroup
+	for i := 0; i < 3; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, err := jwks.key("unknown")
+			assert.Error(t, err)
+		}()
+	}
+	assert.Eventually(t, func() bool {
+		jwks.lock.Lock()
+		defer jwks.lock.Unlock()
+		return jwks.fetching != nil
+	}, time.Second, time.Millisecond)
+
+	// Cached keys are still served while the fetch is in flight
+	key, err := jwks.key("cached")
+	assert.NoError(t, err)
+	assert.NotNil(t, key)
+
+	close(release)
+	wg.Wait()
+	assert.Equal(t, 2, jwksSvc.fetches)
+}
+
+func TestNewJWKSFromFile(t *testing.T) {
+	key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	contents, _ := json.Marshal(map[string]interface{}{"keys": []map[string]string{ecJWK("", &key.PublicKey)}})
+	file := filepath.Join(t.TempDir(), "jwks.json")
+	assert.NoError(t, os.WriteFile(file, contents, 0600))
+
+	jwks, err := NewJWKSFromFile(file)
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	validator := NewJWTValidator(jwks, &config.JWTAuthConfig{})
+	_, err = validator.Validate(signToken(t, jwt.SigningMethodES256, "", key, jwt.MapClaims{"exp": time.Now().Add(time.Hour).Unix()}))
+	assert.NoError(t, err, "a key without an ID is used when it's the only one")
+}
@@ -0,0 +1,202 @@
+package inbound
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"reflect"
+	"strings"
+	"time"
+
+	"github.com/antonmedv/expr"
+	"github.com/antonmedv/expr/checker"
+	"github.com/antonmedv/expr/conf"
+	"github.com/antonmedv/expr/parser"
+	"github.com/antonmedv/expr/vm"
+	"github.com/sirupsen/logrus"
+	"github.com/threetoes/peeper/internal/config"
+)
+
+// policyRule is a compiled config.PolicyRule
+type policyRule struct {
+	name    string
+	deny    bool
+	program *vm.Program
+}
+
+// Policy authorizes requests with rules written as expressions. Rules are compiled and type checked against the
+// variables available to them when the policy is created, so mistakes are caught at startup
+type Policy struct {
+	rules     []*policyRule
+	location  *time.Location
+	clientIPs *ClientIPResolver
+	now       func() time.Time
+}
+
+// policyEnv returns the variables rules are evaluated with
+func (p *Policy) policyEnv(req *http.Request) map[string]interface{} {
+	headers := make(map[string]string, len(req.Header))
+	for name, values := range req.Header {
+		headers[strings.ToLower(name)] = strings.Join(values, ", ")
+	}
+	clientIP := ""
+	if ip := resolverFor(req, p.clientIPs).ClientIP(req); ip != nil {
+		clientIP = ip.String()
+	}
+	now := p.now().In(p.location)
+	return map[string]interface{}{
+		"identity":  identityEnv(IdentityFrom(req.Context())),
+		"method":    req.Method,
+		"path":      req.URL.Path,
+		"headers":   headers,
+		"client_ip": clientIP,
+		"time": map[string]interface{}{
+			"weekday": now.Weekday().String(),
+			"hour":    now.Hour(),
+			"minute":  now.Minute(),
+			"date":    now.Format("2006-01-02"),
+			"unix":    now.Unix(),
+		},
+	}
+}
+
+// identityEnv describes identity to rules. Unauthenticated callers get empty values rather than nil, so that rules
+// don't have to guard every field access
+func identityEnv(identity *Identity) map[string]interface{} {
+	env := map[string]interface{}{
+		"authenticated": false,
+		"subject":       "",
+		"method":        "",
+		"claims":        map[string]interface{}{},
+		"scopes":        []string{},
+		"certificate":   map[string]interface{}{},
+	}
+	if identity == nil {
+		return env
+	}
+	env["authenticated"] = true
+	env["subject"] = identity.Subject
+	env["method"] = identity.Method
+	if identity.Claims != nil {
+		env["claims"] = identity.Claims
+	}
+	if identity.Scopes != nil {
+		env["scopes"] = identity.Scopes
+	}
+	if cert := identity.Certificate; cert != nil {
+		sans := append([]string{}, cert.DNSNames...)
+		sans = append(sans, cert.EmailAddresses...)
+		for _, uri := range cert.URIs {
+			sans = append(sans, uri.String())
+		}
+		env["certificate"] = map[string]interface{}{
+			"subject":   cert.Subject.String(),
+			"spiffe_id": SPIFFEID(cert),
+			"sans":      sans,
+		}
+	}
+	return env
+}
+
+// check returns the name of the rule denying req, or an empty string if it is allowed. Rules that fail to evaluate
+// deny the request
+func (p *Policy) check(req *http.Request) (string, error) {
+	env := p.policyEnv(req)
+	for _, rule := range p.rules {
+		out, err := expr.Run(rule.program, env)
+		if err != nil {
+			return rule.name, err
+		}
+		matched, ok := out.(bool)
+		if !ok {
+			return rule.name, fmt.Errorf("expected a boolean, but got %T", out)
+		}
+		if matched == rule.deny {
+			return rule.name, nil
+		}
+	}
+	return "", nil
+}
+
+// Middleware returns middleware applying the policy. Denied requests get a 403 and an audit log line naming scope
+// and the rule that denied them
+func (p *Policy) Middleware(scope string) Middleware {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+			rule, err := p.check(req)
+			if rule == "" {
+				next.ServeHTTP(rw, req)
+				return
+			}
+			subject := ""
+			if identity := IdentityFrom(req.Context()); identity != nil {
+				subject = identity.Subject
+			}
+			entry := logrus.WithFields(logrus.Fields{
+				"audit":   true,
+				"scope":   scope,
+				"subject": subject,
+				"method":  req.Method,
+				"path":    req.URL.Path,
+				"rule":    rule,
+			})
+			if err != nil {
+				entry = entry.WithError(err)
+			}
+			entry.Warn("denied request by policy")
+			rw.WriteHeader(http.StatusForbidden)
+		})
+	}
+}
+
+// compileRule compiles an expression, checking that it can produce a boolean. Fields of maps such as claims aren't
+// known until a request comes in, so expressions of an unknown type are allowed and checked when they run
+func compileRule(source string, env map[string]interface{}) (*vm.Program, error) {
+	tree, err := parser.Parse(source)
+	if err != nil {
+		return nil, err
+	}
+	t, err := checker.Check(tree, conf.New(env))
+	if err != nil {
+		return nil, err
+	}
+	if t != nil && t.Kind() != reflect.Bool && t.Kind() != reflect.Interface {
+		return nil, fmt.Errorf("expected a boolean expression, but got %s", t)
+	}
+	return expr.Compile(source, expr.Env(env))
+}
+
+// NewPolicy compiles the rules in conf, finding client IPs with clientIPs, or the resolver each request carries if it
+// is nil
+func NewPolicy(conf *config.PolicyConfig, clientIPs *ClientIPResolver) (*Policy, error) {
+	location := time.UTC
+	if conf.Timezone != "" {
+		var err error
+		location, err = time.LoadLocation(conf.Timezone)
+		if err != nil {
+			return nil, fmt.Errorf("invalid policy timezone '%s': %v", conf.Timezone, err)
+		}
+	}
+	p := &Policy{location: location, clientIPs: clientIPs, now: time.Now}
+	// Rules are type checked against the variables of an example request
+	sampleEnv := p.policyEnv(&http.Request{Header: http.Header{}, URL: &url.URL{}})
+	for i, r := range conf.Rules {
+		name := r.Name
+		if name == "" {
+			name = fmt.Sprintf("rule %d", i+1)
+		}
+		if (r.Allow == "") == (r.Deny == "") {
+			return nil, fmt.Errorf("policy rule %s needs exactly one of allow or deny", name)
+		}
+		source := r.Allow
+		if r.Deny != "" {
+			source = r.Deny
+		}
+		program, err := compileRule(source, sampleEnv)
+		if err != nil {
+			return nil, fmt.Errorf("policy rule %s is invalid: %v", name, err)
+		}
+		p.rules = append(p.rules, &policyRule{name: name, deny: r.Deny != "", program: program})
+	}
+	return p, nil
+}
@@ -0,0 +1,124 @@
+package inbound
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"github.com/threetoes/peeper/internal/config"
+)
+
+func TestPolicy_Middleware(t *testing.T) {
+	var buf bytes.Buffer
+	logrus.SetOutput(&buf)
+	defer logrus.SetOutput(os.Stderr)
+
+	policy, err := NewPolicy(&config.PolicyConfig{
+		Timezone: "Europe/London",
+		Rules: []*config.PolicyRule{
+			{Name: "authenticated", Allow: `identity.authenticated`},
+			{Name: "billing team", Allow: `method != "POST" || "billing" in identity.claims.team`},
+			{Name: "weekdays", Allow: `time.weekday not in ["Saturday", "Sunday"]`},
+			{Name: "no debug", Deny: `headers["x-debug"] != ""`},
+		},
+	}, nil)
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	// A Wednesday
+	now := time.Date(2022, 6, 1, 12, 0, 0, 0, time.UTC)
+	policy.now = func() time.Time { return now }
+
+	billing := &Identity{Subject: "alice", Method: "jwt", Claims: map[string]interface{}{"team": []interface{}{"billing"}}}
+	reports := &Identity{Subject: "bob", Method: "jwt", Claims: map[string]interface{}{"team": []interface{}{"reports"}}}
+	tests := []struct {
+		name     string
+		method   string
+		identity *Identity
+		headers  map[string]string
+		weekend  bool
+		wantRule string
+	}{
+		{name: "billing can post", method: "POST", identity: billing},
+		{name: "others can read", method: "GET", identity: reports},
+		{name: "others can't post", method: "POST", identity: reports, wantRule: "billing team"},
+		{name: "unauthenticated", method: "GET", wantRule: "authenticated"},
+		{name: "weekend", method: "POST", identity: billing, weekend: true, wantRule: "weekdays"},
+		{name: "deny rule", method: "GET", identity: billing, headers: map[string]string{"X-Debug": "1"}, wantRule: "no debug"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			buf.Reset()
+			now = time.Date(2022, 6, 1, 12, 0, 0, 0, time.UTC)
+			if tt.weekend {
+				now = time.Date(2022, 6, 4, 12, 0, 0, 0, time.UTC)
+			}
+			called := false
+			handler := policy.Middleware("/payments")(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+				called = true
+			}))
+			req := httptest.NewRequest(tt.method, "/payments", nil)
+			for k, v := range tt.headers {
+				req.Header.Set(k, v)
+			}
+			if tt.identity != nil {
+				req = req.WithContext(WithIdentity(req.Context(), tt.identity))
+			}
+			rw := httptest.NewRecorder()
+			handler.ServeHTTP(rw, req)
+			if tt.wantRule == "" {
+				assert.True(t, called)
+				assert.Equal(t, http.StatusOK, rw.Code)
+				return
+			}
+			assert.False(t, called)
+			assert.Equal(t, http.StatusForbidden, rw.Code)
+			assert.Contains(t, buf.String(), "audit=true")
+			assert.Contains(t, buf.String(), tt.wantRule)
+		})
+	}
+}
+
+func TestPolicy_Timezone(t *testing.T) {
+	policy, err := NewPolicy(&config.PolicyConfig{
+		Timezone: "America/New_York",
+		Rules:    []*config.PolicyRule{{Allow: `time.hour >= 9 && time.hour < 17`}},
+	}, nil)
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	// 14:00 UTC is 10:00 in New York
+	policy.now = func() time.Time { return time.Date(2022, 6, 1, 14, 0, 0, 0, time.UTC) }
+	rule, err := policy.check(httptest.NewRequest("GET", "/", nil))
+	assert.NoError(t, err)
+	assert.Empty(t, rule)
+
+	policy.now = func() time.Time { return time.Date(2022, 6, 1, 23, 0, 0, 0, time.UTC) }
+	rule, _ = policy.check(httptest.NewRequest("GET", "/", nil))
+	assert.Equal(t, "rule 1", rule)
+}
+
+func TestNewPolicy_Invalid(t *testing.T) {
+	tests := []struct {
+		name string
+		conf *config.PolicyConfig
+	}{
+		{name: "syntax error", conf: &config.PolicyConfig{Rules: []*config.PolicyRule{{Allow: `method ==`}}}},
+		{name: "unknown variable", conf: &config.PolicyConfig{Rules: []*config.PolicyRule{{Allow: `verb == "GET"`}}}},
+		{name: "not a boolean", conf: &config.PolicyConfig{Rules: []*config.PolicyRule{{Allow: `method`}}}},
+		{name: "allow and deny", conf: &config.PolicyConfig{Rules: []*config.PolicyRule{{Allow: `true`, Deny: `false`}}}},
+		{name: "neither allow nor deny", conf: &config.PolicyConfig{Rules: []*config.PolicyRule{{Name: "empty"}}}},
+		{name: "bad timezone", conf: &config.PolicyConfig{Timezone: "Mars/Olympus_Mons"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := NewPolicy(tt.conf, nil)
+			assert.Error(t, err)
+		})
+	}
+}
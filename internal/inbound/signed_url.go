@@ -0,0 +1,117 @@
+package inbound
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/threetoes/peeper/internal/config"
+	"github.com/threetoes/peeper/internal/secrets"
+)
+
+const (
+	// SignedURLExpiresParam and SignedURLSignatureParam are the query parameters added to signed URLs
+	SignedURLExpiresParam   = "peeper_expires"
+	SignedURLSignatureParam = "peeper_signature"
+	minSignedURLKeyLength   = 32
+)
+
+// URLSigner signs URLs so they can be used without other credentials until they expire. A signature covers the
+// method, path and query, but not the host, so links keep working behind any name peeper is reached by
+type URLSigner struct {
+	key       secrets.Secret
+	maxExpiry time.Duration
+	now       func() time.Time
+}
+
+// signature returns the signature of a request for method and path with query, which mustn't include the
+// signature itself
+func (s *URLSigner) signature(method, path string, query url.Values) string {
+	m := hmac.New(sha256.New, []byte(s.key.Reveal()))
+	// Encode sorts the query, so the signature doesn't depend on parameter order
+	fmt.Fprintf(m, "%s\n%s\n%s", method, path, query.Encode())
+	return base64.RawURLEncoding.EncodeToString(m.Sum(nil))
+}
+
+// Sign returns a copy of u that can be used to make method requests until expires
+func (s *URLSigner) Sign(u *url.URL, method string, expires time.Time) (*url.URL, error) {
+	if s.maxExpiry > 0 && expires.Sub(s.now()) > s.maxExpiry {
+		return nil, fmt.Errorf("signed URLs can't be valid for longer than %s", s.maxExpiry)
+	}
+	signed := *u
+	query := signed.Query()
+	query.Del(SignedURLSignatureParam)
+	query.Set(SignedURLExpiresParam, strconv.FormatInt(expires.Unix(), 10))
+	query.Set(SignedURLSignatureParam, s.signature(method, signed.EscapedPath(), query))
+	signed.RawQuery = query.Encode()
+	return &signed, nil
+}
+
+// verify checks the signature and expiry of req
+func (s *URLSigner) verify(req *http.Request) error {
+	query := req.URL.Query()
+	signature := query.Get(SignedURLSignatureParam)
+	if signature == "" {
+		return fmt.Errorf("no signature")
+	}
+	query.Del(SignedURLSignatureParam)
+	want := s.signature(req.Method, req.URL.EscapedPath(), query)
+	if !hmac.Equal([]byte(signature), []byte(want)) {
+		return fmt.Errorf("invalid signature")
+	}
+	expires, err := strconv.ParseInt(query.Get(SignedURLExpiresParam), 10, 64)
+	if err != nil {
+		return fmt.Errorf("invalid expiry")
+	}
+	now := s.now()
+	if now.After(time.Unix(expires, 0)) {
+		return fmt.Errorf("link has expired")
+	}
+	if s.maxExpiry > 0 && time.Unix(expires, 0).Sub(now) > s.maxExpiry {
+		return fmt.Errorf("link expires too far in the future")
+	}
+	return nil
+}
+
+// Middleware returns middleware that lets through requests with a valid, unexpired signature in place of the
+// credentials checked by others. Requests without a signature have to get through others instead, and get a 401 if
+// there aren't any. The signature parameters are removed before the request is forwarded
+func (s *URLSigner) Middleware(others ...Middleware) Middleware {
+	return func(next http.Handler) http.Handler {
+		unsigned := next
+		for i := len(others) - 1; i >= 0; i-- {
+			unsigned = others[i](unsigned)
+		}
+		return http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+			if len(others) > 0 && !req.URL.Query().Has(SignedURLSignatureParam) {
+				unsigned.ServeHTTP(rw, req)
+				return
+			}
+			if err := s.verify(req); err != nil {
+				logrus.Warnf("rejecting %s %s: signed URL: %v", req.Method, req.URL.Path, err)
+				rw.WriteHeader(http.StatusUnauthorized)
+				return
+			}
+			query := req.URL.Query()
+			query.Del(SignedURLSignatureParam)
+			query.Del(SignedURLExpiresParam)
+			req.URL.RawQuery = query.Encode()
+			identity := &Identity{Subject: "signed-url", Method: "signed_url"}
+			next.ServeHTTP(rw, withCaller(req, identity))
+		})
+	}
+}
+
+// NewURLSigner returns a URLSigner using key, with the expiry limit in conf
+func NewURLSigner(conf *config.SignedURLsConfig, key secrets.Secret) (*URLSigner, error) {
+	if len(key.Reveal()) < minSignedURLKeyLength {
+		return nil, fmt.Errorf("signed URL key must be at least %d bytes long", minSignedURLKeyLength)
+	}
+	return &URLSigner{key: key, maxExpiry: time.Duration(conf.MaxExpiry), now: time.Now}, nil
+}
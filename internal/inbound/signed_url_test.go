@@ -0,0 +1,134 @@
+package inbound
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/threetoes/peeper/internal/config"
+	"github.com/threetoes/peeper/internal/secrets"
+)
+
+func TestURLSigner_Middleware(t *testing.T) {
+	signer, err := NewURLSigner(&config.SignedURLsConfig{MaxExpiry: config.Duration(24 * time.Hour)}, secrets.NewSecret(strings.Repeat("k", 32)))
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	now := time.Now()
+	signer.now = func() time.Time { return now }
+
+	sign := func(rawURL, method string, expires time.Time) string {
+		u, _ := url.Parse(rawURL)
+		signed, err := signer.Sign(u, method, expires)
+		if !assert.NoError(t, err) {
+			t.FailNow()
+		}
+		return signed.String()
+	}
+	valid := sign("https://peeper.internal/reports?quarter=q3", "GET", now.Add(time.Hour))
+
+	tests := []struct {
+		name      string
+		method    string
+		url       string
+		wantCode  int
+		wantQuery string
+	}{
+		{name: "valid", method: "GET", url: valid, wantCode: http.StatusOK, wantQuery: "quarter=q3"},
+		{name: "other host", method: "GET", url: strings.Replace(valid, "peeper.internal", "localhost:8080", 1), wantCode: http.StatusOK, wantQuery: "quarter=q3"},
+		{name: "other method", method: "DELETE", url: valid, wantCode: http.StatusUnauthorized},
+		{name: "other path", method: "GET", url: strings.Replace(valid, "/reports", "/payroll", 1), wantCode: http.StatusUnauthorized},
+		{name: "tampered query", method: "GET", url: strings.Replace(valid, "quarter=q3", "quarter=q4", 1), wantCode: http.StatusUnauthorized},
+		{name: "added query", method: "GET", url: valid + "&admin=true", wantCode: http.StatusUnauthorized},
+		{name: "extended expiry", method: "GET", url: strings.Replace(valid, "peeper_expires=", "peeper_expires=9", 1), wantCode: http.StatusUnauthorized},
+		{name: "expired", method: "GET", url: sign("https://peeper.internal/reports", "GET", now.Add(-time.Second)), wantCode: http.StatusUnauthorized},
+		{name: "unsigned", method: "GET", url: "https://peeper.internal/reports", wantCode: http.StatusUnauthorized},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var forwarded *http.Request
+			handler := signer.Middleware()(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+				forwarded = req
+			}))
+			rw := httptest.NewRecorder()
+			handler.ServeHTTP(rw, httptest.NewRequest(tt.method, tt.url, nil))
+			assert.Equal(t, tt.wantCode, rw.Code)
+			if tt.wantCode != http.StatusOK {
+				assert.Nil(t, forwarded)
+				return
+			}
+			if assert.NotNil(t, forwarded) {
+				assert.Equal(t, tt.wantQuery, forwarded.URL.RawQuery, "signature parameters are removed")
+				assert.Equal(t, "signed_url", IdentityFrom(forwarded.Context()).Method)
+			}
+		})
+	}
+}
+
+func TestURLSigner_MiddlewareWithOtherCredentials(t *testing.T) {
+	signer, err := NewURLSigner(&config.SignedURLsConfig{}, secrets.NewSecret(strings.Repeat("k", 32)))
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	u, _ := url.Parse("https://peeper.internal/reports")
+	signed, _ := signer.Sign(u, "GET", time.Now().Add(time.Hour))
+	requireKey := func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+			if req.Header.Get("X-Key") != "secret" {
+				rw.WriteHeader(http.StatusUnauthorized)
+				return
+			}
+			next.ServeHTTP(rw, req)
+		})
+	}
+	handler := signer.Middleware(requireKey)(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {}))
+
+	tests := []struct {
+		name     string
+		url      string
+		key      string
+		wantCode int
+	}{
+		{name: "signed", url: signed.String(), wantCode: http.StatusOK},
+		{name: "other credentials", url: u.String(), key: "secret", wantCode: http.StatusOK},
+		{name: "neither", url: u.String(), wantCode: http.StatusUnauthorized},
+		{name: "bad signature", url: u.String() + "?peeper_signature=nope", key: "secret", wantCode: http.StatusUnauthorized},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest("GET", tt.url, nil)
+			if tt.key != "" {
+				req.Header.Set("X-Key", tt.key)
+			}
+			rw := httptest.NewRecorder()
+			handler.ServeHTTP(rw, req)
+			assert.Equal(t, tt.wantCode, rw.Code)
+		})
+	}
+}
+
+func TestURLSigner_MaxExpiry(t *testing.T) {
+	signer, err := NewURLSigner(&config.SignedURLsConfig{MaxExpiry: config.Duration(time.Hour)}, secrets.NewSecret(strings.Repeat("k", 32)))
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	u, _ := url.Parse("https://peeper.internal/reports")
+	_, err = signer.Sign(u, "GET", time.Now().Add(48*time.Hour))
+	assert.Error(t, err)
+
+	// A link signed by a peeper with a longer limit is still rejected
+	unlimited, _ := NewURLSigner(&config.SignedURLsConfig{}, secrets.NewSecret(strings.Repeat("k", 32)))
+	signed, err := unlimited.Sign(u, "GET", time.Now().Add(48*time.Hour))
+	if assert.NoError(t, err) {
+		assert.Error(t, signer.verify(httptest.NewRequest("GET", signed.String(), nil)))
+	}
+}
+
+func TestNewURLSigner_ShortKey(t *testing.T) {
+	_, err := NewURLSigner(&config.SignedURLsConfig{}, secrets.NewSecret("too-short"))
+	assert.Error(t, err)
+}
@@ -0,0 +1,297 @@
+package inbound
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/threetoes/peeper/internal/config"
+	"github.com/threetoes/peeper/internal/secrets"
+)
+
+const (
+	defaultWebhookTolerance       = 5 * time.Minute
+	defaultWebhookMaxBodySize     = 1 << 20
+	defaultWebhookSignatureHeader = "X-Signature"
+	maxWebhookNonces              = 100000
+)
+
+var errBodyTooLarge = errors.New("body is too large")
+
+// nonceCache remembers values until they expire, to spot replayed deliveries
+type nonceCache struct {
+	lock   sync.Mutex
+	nonces map[string]time.Time
+	order  []string
+	size   int
+}
+
+// add records nonce until expires, reporting false if it was already recorded
+func (c *nonceCache) add(nonce string, expires, now time.Time) bool {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if e, ok := c.nonces[nonce]; ok && now.Before(e) {
+		return false
+	}
+	if len(c.nonces) >= c.size {
+		kept := c.order[:0]
+		for _, n := range c.order {
+			if !now.Before(c.nonces[n]) {
+				delete(c.nonces, n)
+				continue
+			}
+			kept = append(kept, n)
+		}
+		c.order = kept
+	}
+	for len(c.nonces) >= c.size {
+		delete(c.nonces, c.order[0])
+		c.order = c.order[1:]
+	}
+	if _, ok := c.nonces[nonce]; !ok {
+		c.order = append(c.order, nonce)
+	}
+	c.nonces[nonce] = expires
+	return true
+}
+
+// WebhookVerifier checks the signatures of webhooks from a provider
+type WebhookVerifier struct {
+	provider     string
+	secret       secrets.Secret
+	tolerance    time.Duration
+	replayWindow time.Duration
+	maxBody      int64
+	nonces       *nonceCache
+	now          func() time.Time
+	newHash      func() hash.Hash
+
+	// Settings for the generic hmac provider
+	signatureHeader string
+	timestampHeader string
+	base64          bool
+	prefix          string
+}
+
+func (v *WebhookVerifier) mac(parts ...[]byte) []byte {
+	m := hmac.New(v.newHash, []byte(v.secret.Reveal()))
+	for _, p := range parts {
+		m.Write(p)
+	}
+	return m.Sum(nil)
+}
+
+func (v *WebhookVerifier) checkTimestamp(value string) error {
+	if value == "" {
+		return fmt.Errorf("no timestamp")
+	}
+	ts, err := strconv.ParseInt(value, 10, 64)
+	if err != nil {
+		return fmt.Errorf("invalid timestamp")
+	}
+	age := v.now().Sub(time.Unix(ts, 0))
+	if age > v.tolerance || age < -v.tolerance {
+		return fmt.Errorf("timestamp is outside the tolerance")
+	}
+	return nil
+}
+
+func checkHex(signature string, want []byte) bool {
+	got, err := hex.DecodeString(signature)
+	return err == nil && hmac.Equal(got, want)
+}
+
+// verify checks the signature of req and returns a nonce for the delivery, and whether it has a signed timestamp.
+// The nonce is the expected MAC, so unsigned headers and the signature's encoding can't make a replay look new
+func (v *WebhookVerifier) verify(req *http.Request, body []byte) (string, bool, error) {
+	switch v.provider {
+	case "github":
+		signature := req.Header.Get("X-Hub-Signature-256")
+		want := v.mac(body)
+		if !strings.HasPrefix(signature, "sha256=") || !checkHex(strings.TrimPrefix(signature, "sha256="), want) {
+			return "", false, fmt.Errorf("invalid signature")
+		}
+		// GitHub doesn't sign a timestamp or the delivery ID
+		return hex.EncodeToString(want), false, nil
+	case "stripe":
+		var timestamp string
+		var signatures []string
+		for _, part := range strings.Split(req.Header.Get("Stripe-Signature"), ",") {
+			kv := strings.SplitN(strings.TrimSpace(part), "=", 2)
+			if len(kv) != 2 {
+				continue
+			}
+			switch kv[0] {
+			case "t":
+				timestamp = kv[1]
+			case "v1":
+				signatures = append(signatures, kv[1])
+			}
+		}
+		if err := v.checkTimestamp(timestamp); err != nil {
+			return "", false, err
+		}
+		want := v.mac([]byte(timestamp), []byte("."), body)
+		for _, s := range signatures {
+			if checkHex(s, want) {
+				return hex.EncodeToString(want), true, nil
+			}
+		}
+		return "", false, fmt.Errorf("invalid signature")
+	case "slack":
+		timestamp := req.Header.Get("X-Slack-Request-Timestamp")
+		if err := v.checkTimestamp(timestamp); err != nil {
+			return "", false, err
+		}
+		signature := req.Header.Get("X-Slack-Signature")
+		want := v.mac([]byte("v0:"+timestamp+":"), body)
+		if !strings.HasPrefix(signature, "v0=") || !checkHex(strings.TrimPrefix(signature, "v0="), want) {
+			return "", false, fmt.Errorf("invalid signature")
+		}
+		return hex.EncodeToString(want), true, nil
+	default:
+		parts := [][]byte{body}
+		if v.timestampHeader != "" {
+			timestamp := req.Header.Get(v.timestampHeader)
+			if err := v.checkTimestamp(timestamp); err != nil {
+				return "", false, err
+			}
+			parts = [][]byte{[]byte(timestamp), []byte("."), body}
+		}
+		signature := req.Header.Get(v.signatureHeader)
+		if !strings.HasPrefix(signature, v.prefix) {
+			return "", false, fmt.Errorf("invalid signature")
+		}
+		encoded := strings.TrimPrefix(signature, v.prefix)
+		want := v.mac(parts...)
+		valid := false
+		if v.base64 {
+			got, err := base64.StdEncoding.DecodeString(encoded)
+			valid = err == nil && hmac.Equal(got, want)
+		} else {
+			valid = checkHex(encoded, want)
+		}
+		if !valid {
+			return "", false, fmt.Errorf("invalid signature")
+		}
+		return hex.EncodeToString(want), v.timestampHeader != "", nil
+	}
+}
+
+func readBody(req *http.Request, max int64) ([]byte, error) {
+	if req.Body == nil {
+		return nil, nil
+	}
+	body, err := ioutil.ReadAll(io.LimitReader(req.Body, max+1))
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(body)) > max {
+		return nil, errBodyTooLarge
+	}
+	return body, nil
+}
+
+// Middleware returns middleware that buffers the body of each request and only lets through those with a valid
+// signature that haven't been seen before. The buffered body is forwarded in place of the original
+func (v *WebhookVerifier) Middleware() Middleware {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+			body, err := readBody(req, v.maxBody)
+			if err == errBodyTooLarge {
+				logrus.Warnf("rejecting %s %s: webhook body is larger than %d bytes", req.Method, req.URL.Path, v.maxBody)
+				rw.WriteHeader(http.StatusRequestEntityTooLarge)
+				return
+			} else if err != nil {
+				logrus.Warnf("rejecting %s %s: could not read webhook body: %v", req.Method, req.URL.Path, err)
+				rw.WriteHeader(http.StatusBadRequest)
+				return
+			}
+			nonce, timestamped, err := v.verify(req, body)
+			if err != nil {
+				logrus.Warnf("rejecting %s %s: %s webhook: %v", req.Method, req.URL.Path, v.provider, err)
+				rw.WriteHeader(http.StatusUnauthorized)
+				return
+			}
+			// A timestamp can be accepted for up to twice the tolerance after it is first seen
+			now := v.now()
+			expires := now.Add(v.replayWindow)
+			if timestamped {
+				expires = now.Add(2 * v.tolerance)
+			}
+			if !v.nonces.add(nonce, expires, now) {
+				logrus.Warnf("rejecting %s %s: %s webhook has already been delivered", req.Method, req.URL.Path, v.provider)
+				rw.WriteHeader(http.StatusUnauthorized)
+				return
+			}
+			req.Body = ioutil.NopCloser(bytes.NewReader(body))
+			req.ContentLength = int64(len(body))
+			identity := &Identity{Subject: v.provider, Method: "webhook"}
+			next.ServeHTTP(rw, withCaller(req, identity))
+		})
+	}
+}
+
+// NewWebhookVerifier returns a WebhookVerifier for the provider in conf, signing with secret
+func NewWebhookVerifier(conf *config.WebhookConfig, secret secrets.Secret) (*WebhookVerifier, error) {
+	if secret.Empty() {
+		return nil, fmt.Errorf("webhook needs a secret")
+	}
+	v := &WebhookVerifier{
+		provider:  conf.Provider,
+		secret:    secret,
+		tolerance: conf.Tolerance.Or(defaultWebhookTolerance),
+		maxBody:   conf.MaxBodySize,
+		nonces:    &nonceCache{nonces: map[string]time.Time{}, size: maxWebhookNonces},
+		now:       time.Now,
+		newHash:   sha256.New,
+	}
+	v.replayWindow = conf.ReplayWindow.Or(2 * v.tolerance)
+	if v.maxBody <= 0 {
+		v.maxBody = defaultWebhookMaxBodySize
+	}
+	switch conf.Provider {
+	case "github", "stripe", "slack":
+	case "hmac":
+		v.signatureHeader = conf.SignatureHeader
+		if v.signatureHeader == "" {
+			v.signatureHeader = defaultWebhookSignatureHeader
+		}
+		v.timestampHeader = conf.TimestampHeader
+		v.prefix = conf.Prefix
+		switch conf.Algorithm {
+		case "", "sha256":
+		case "sha512":
+			v.newHash = sha512.New
+		case "sha1":
+			v.newHash = sha1.New
+		default:
+			return nil, fmt.Errorf("unknown webhook algorithm '%s'", conf.Algorithm)
+		}
+		switch conf.Encoding {
+		case "", "hex":
+		case "base64":
+			v.base64 = true
+		default:
+			return nil, fmt.Errorf("unknown webhook signature encoding '%s'", conf.Encoding)
+		}
+	default:
+		return nil, fmt.Errorf("unknown webhook provider '%s'", conf.Provider)
+	}
+	return v, nil
+}
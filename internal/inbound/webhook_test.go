@@ -0,0 +1,242 @@
+package inbound
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/threetoes/peeper/internal/config"
+	"github.com/threetoes/peeper/internal/secrets"
+)
+
+func hmacHex(secret string, parts ...string) string {
+	m := hmac.New(sha256.New, []byte(secret))
+	for _, p := range parts {
+		m.Write([]byte(p))
+	}
+	return hex.EncodeToString(m.Sum(nil))
+}
+
+func TestWebhookVerifier_Middleware(t *testing.T) {
+	const secret = "whsec_test"
+	const body = `{"event":"payment.succeeded"}`
+	now := time.Unix(1650000000, 0)
+	ts := strconv.FormatInt(now.Unix(), 10)
+	stale := strconv.FormatInt(now.Add(-10*time.Minute).Unix(), 10)
+
+	tests := []struct {
+		name     string
+		conf     *config.WebhookConfig
+		headers  map[string]string
+		body     string
+		wantCode int
+	}{
+		{
+			name:     "github",
+			conf:     &config.WebhookConfig{Provider: "github"},
+			headers:  map[string]string{"X-Hub-Signature-256": "sha256=" + hmacHex(secret, body), "X-GitHub-Delivery": "72d3162e"},
+			wantCode: http.StatusOK,
+		},
+		{
+			name:     "github tampered body",
+			conf:     &config.WebhookConfig{Provider: "github"},
+			headers:  map[string]string{"X-Hub-Signature-256": "sha256=" + hmacHex(secret, body)},
+			body:     `{"event":"payment.refunded"}`,
+			wantCode: http.StatusUnauthorized,
+		},
+		{
+			name:     "github without signature",
+			conf:     &config.WebhookConfig{Provider: "github"},
+			wantCode: http.StatusUnauthorized,
+		},
+		{
+			name:     "stripe",
+			conf:     &config.WebhookConfig{Provider: "stripe"},
+			headers:  map[string]string{"Stripe-Signature": fmt.Sprintf("t=%s,v1=%s,v0=ignored", ts, hmacHex(secret, ts, ".", body))},
+			wantCode: http.StatusOK,
+		},
+		{
+			name:     "stripe with a rotated secret",
+			conf:     &config.WebhookConfig{Provider: "stripe"},
+			headers:  map[string]string{"Stripe-Signature": fmt.Sprintf("t=%s,v1=%s,v1=%s", ts, hmacHex("old", ts, ".", body), hmacHex(secret, ts, ".", body))},
+			wantCode: http.StatusOK,
+		},
+		{
+			name:     "stripe outside tolerance",
+			conf:     &config.WebhookConfig{Provider: "stripe"},
+			headers:  map[string]string{"Stripe-Signature": fmt.Sprintf("t=%s,v1=%s", stale, hmacHex(secret, stale, ".", body))},
+			wantCode: http.StatusUnauthorized,
+		},
+		{
+			name:     "stripe with a longer tolerance",
+			conf:     &config.WebhookConfig{Provider: "stripe", Tolerance: config.Duration(time.Hour)},
+			headers:  map[string]string{"Stripe-Signature": fmt.Sprintf("t=%s,v1=%s", stale, hmacHex(secret, stale, ".", body))},
+			wantCode: http.StatusOK,
+		},
+		{
+			name:     "stripe signature for another timestamp",
+			conf:     &config.WebhookConfig{Provider: "stripe"},
+			headers:  map[string]string{"Stripe-Signature": fmt.Sprintf("t=%s,v1=%s", ts, hmacHex(secret, stale, ".", body))},
+			wantCode: http.StatusUnauthorized,
+		},
+		{
+			name:     "slack",
+			conf:     &config.WebhookConfig{Provider: "slack"},
+			headers:  map[string]string{"X-Slack-Request-Timestamp": ts, "X-Slack-Signature": "v0=" + hmacHex(secret, "v0:", ts, ":", body)},
+			wantCode: http.StatusOK,
+		},
+		{
+			name:     "slack outside tolerance",
+			conf:     &config.WebhookConfig{Provider: "slack"},
+			headers:  map[string]string{"X-Slack-Request-Timestamp": stale, "X-Slack-Signature": "v0=" + hmacHex(secret, "v0:", stale, ":", body)},
+			wantCode: http.StatusUnauthorized,
+		},
+		{
+			name:     "hmac",
+			conf:     &config.WebhookConfig{Provider: "hmac"},
+			headers:  map[string]string{"X-Signature": hmacHex(secret, body)},
+			wantCode: http.StatusOK,
+		},
+		{
+			name: "hmac with timestamp, prefix and base64",
+			conf: &config.WebhookConfig{Provider: "hmac", SignatureHeader: "X-Sig", TimestampHeader: "X-Sig-Timestamp", Prefix: "sha512=", Algorithm: "sha512", Encoding: "base64"},
+			headers: func() map[string]string {
+				m := hmac.New(sha512.New, []byte(secret))
+				m.Write([]byte(ts + "." + body))
+				return map[string]string{"X-Sig": "sha512=" + base64.StdEncoding.EncodeToString(m.Sum(nil)), "X-Sig-Timestamp": ts}
+			}(),
+			wantCode: http.StatusOK,
+		},
+		{
+			name:     "hmac with the wrong algorithm",
+			conf:     &config.WebhookConfig{Provider: "hmac", Algorithm: "sha512"},
+			headers:  map[string]string{"X-Signature": hmacHex(secret, body)},
+			wantCode: http.StatusUnauthorized,
+		},
+		{
+			name:     "body too large",
+			conf:     &config.WebhookConfig{Provider: "hmac", MaxBodySize: 8},
+			headers:  map[string]string{"X-Signature": hmacHex(secret, body)},
+			wantCode: http.StatusRequestEntityTooLarge,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			verifier, err := NewWebhookVerifier(tt.conf, secrets.NewSecret(secret))
+			if !assert.NoError(t, err) {
+				t.FailNow()
+			}
+			verifier.now = func() time.Time { return now }
+			var forwardedBody string
+			handler := verifier.Middleware()(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+				b, _ := ioutil.ReadAll(req.Body)
+				forwardedBody = string(b)
+			}))
+			send := func() int {
+				reqBody := body
+				if tt.body != "" {
+					reqBody = tt.body
+				}
+				req := httptest.NewRequest("POST", "/hooks", strings.NewReader(reqBody))
+				for k, v := range tt.headers {
+					req.Header.Set(k, v)
+				}
+				rw := httptest.NewRecorder()
+				handler.ServeHTTP(rw, req)
+				return rw.Code
+			}
+			assert.Equal(t, tt.wantCode, send())
+			if tt.wantCode != http.StatusOK {
+				assert.Empty(t, forwardedBody)
+				return
+			}
+			assert.Equal(t, body, forwardedBody, "the verified body is forwarded")
+			assert.Equal(t, http.StatusUnauthorized, send(), "replays are rejected")
+		})
+	}
+}
+
+func TestWebhookVerifier_ReplayWithChangedHeaders(t *testing.T) {
+	const secret = "whsec_test"
+	const body = `{"action":"opened"}`
+	verifier, err := NewWebhookVerifier(&config.WebhookConfig{
+		Provider:     "github",
+		ReplayWindow: config.Duration(time.Hour),
+	}, secrets.NewSecret(secret))
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	start := time.Unix(1650000000, 0)
+	now := start
+	verifier.now = func() time.Time { return now }
+	handler := verifier.Middleware()(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {}))
+	send := func(signature, delivery string) int {
+		req := httptest.NewRequest("POST", "/hooks", strings.NewReader(body))
+		req.Header.Set("X-Hub-Signature-256", signature)
+		req.Header.Set("X-GitHub-Delivery", delivery)
+		rw := httptest.NewRecorder()
+		handler.ServeHTTP(rw, req)
+		return rw.Code
+	}
+
+	signature := "sha256=" + hmacHex(secret, body)
+	assert.Equal(t, http.StatusOK, send(signature, "72d3162e"))
+	assert.Equal(t, http.StatusUnauthorized, send(signature, "8a1b2c3d"), "the delivery ID isn't signed")
+	assert.Equal(t, http.StatusUnauthorized, send("sha256="+strings.ToUpper(hmacHex(secret, body)), "72d3162e"),
+		"re-encoding the signature doesn't make it new")
+	now = start.Add(59 * time.Minute)
+	assert.Equal(t, http.StatusUnauthorized, send(signature, "72d3162e"), "replays are rejected for the replay window")
+	now = start.Add(time.Hour)
+	assert.Equal(t, http.StatusOK, send(signature, "72d3162e"), "a redelivery after the replay window is accepted")
+}
+
+func TestNonceCache(t *testing.T) {
+	cache := &nonceCache{nonces: map[string]time.Time{}, size: 2}
+	now := time.Now()
+	assert.True(t, cache.add("a", now.Add(time.Minute), now))
+	assert.False(t, cache.add("a", now.Add(time.Minute), now))
+	assert.True(t, cache.add("b", now.Add(time.Minute), now))
+	assert.True(t, cache.add("c", now.Add(time.Minute), now))
+	assert.Len(t, cache.nonces, 2)
+	assert.True(t, cache.add("a", now.Add(time.Minute), now), "the oldest nonce is forgotten when the cache is full")
+	assert.False(t, cache.add("c", now.Add(time.Minute), now))
+
+	later := now.Add(2 * time.Minute)
+	assert.True(t, cache.add("c", later.Add(time.Minute), later), "nonces are forgotten once they expire")
+
+	cache = &nonceCache{nonces: map[string]time.Time{}, size: 2}
+	assert.True(t, cache.add("a", now.Add(time.Hour), now))
+	assert.True(t, cache.add("b", now.Add(time.Minute), now))
+	assert.True(t, cache.add("c", now.Add(time.Minute), later), "expired nonces are forgotten before older ones")
+	assert.False(t, cache.add("a", now.Add(time.Hour), later))
+}
+
+func TestNewWebhookVerifier_Invalid(t *testing.T) {
+	tests := []struct {
+		name   string
+		conf   *config.WebhookConfig
+		secret string
+	}{
+		{name: "unknown provider", conf: &config.WebhookConfig{Provider: "gitlab"}, secret: "s"},
+		{name: "no secret", conf: &config.WebhookConfig{Provider: "github"}},
+		{name: "unknown algorithm", conf: &config.WebhookConfig{Provider: "hmac", Algorithm: "md5"}, secret: "s"},
+		{name: "unknown encoding", conf: &config.WebhookConfig{Provider: "hmac", Encoding: "base32"}, secret: "s"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := NewWebhookVerifier(tt.conf, secrets.NewSecret(tt.secret))
+			assert.Error(t, err)
+		})
+	}
+}
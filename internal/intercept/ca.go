@@ -0,0 +1,152 @@
+// Package intercept issues the certificates peeper presents when it decrypts HTTPS requests in forward proxy mode
+package intercept
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"fmt"
+	"math/big"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/threetoes/peeper/internal/config"
+)
+
+const (
+	defaultCertTTL   = 24 * time.Hour
+	defaultCacheSize = 1000
+	// backdate allows for callers whose clocks are a little behind
+	backdate = time.Hour
+)
+
+type cachedCert struct {
+	cert *tls.Certificate
+	// renew is when the certificate is replaced, well before it expires
+	renew time.Time
+}
+
+// CA issues certificates for hosts on the fly, keeping recently issued ones for reuse
+type CA struct {
+	cert *x509.Certificate
+	key  crypto.Signer
+	// leafKey is shared by every issued certificate, as generating a key per host would only slow handshakes down
+	leafKey *ecdsa.PrivateKey
+	ttl     time.Duration
+	size    int
+
+	lock  sync.Mutex
+	cache map[string]*cachedCert
+	now   func() time.Time
+}
+
+// Certificate returns a certificate for host, which may be a DNS name or an IP address
+func (c *CA) Certificate(host string) (*tls.Certificate, error) {
+	host = strings.TrimSuffix(strings.ToLower(host), ".")
+	if host == "" {
+		return nil, fmt.Errorf("can't issue a certificate without a host")
+	}
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	now := c.now()
+	if cached, ok := c.cache[host]; ok && now.Before(cached.renew) {
+		return cached.cert, nil
+	}
+	cert, err := c.issue(host, now)
+	if err != nil {
+		return nil, err
+	}
+	if _, ok := c.cache[host]; !ok && len(c.cache) >= c.size {
+		c.evict()
+	}
+	c.cache[host] = &cachedCert{cert: cert, renew: now.Add(c.ttl / 2)}
+	return cert, nil
+}
+
+// evict drops the certificate due to be renewed soonest. The caller must hold the lock
+func (c *CA) evict() {
+	var oldest string
+	for host, cached := range c.cache {
+		if oldest == "" || cached.renew.Before(c.cache[oldest].renew) {
+			oldest = host
+		}
+	}
+	delete(c.cache, oldest)
+}
+
+func (c *CA) issue(host string, now time.Time) (*tls.Certificate, error) {
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return nil, err
+	}
+	notAfter := now.Add(c.ttl)
+	if notAfter.After(c.cert.NotAfter) {
+		notAfter = c.cert.NotAfter
+	}
+	template := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: host},
+		NotBefore:    now.Add(-backdate),
+		NotAfter:     notAfter,
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	if ip := net.ParseIP(host); ip != nil {
+		template.IPAddresses = []net.IP{ip}
+	} else {
+		template.DNSNames = []string{host}
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, c.cert, &c.leafKey.PublicKey, c.key)
+	if err != nil {
+		return nil, fmt.Errorf("could not issue a certificate for %s: %v", host, err)
+	}
+	return &tls.Certificate{
+		Certificate: [][]byte{der, c.cert.Raw},
+		PrivateKey:  c.leafKey,
+	}, nil
+}
+
+// NewCA loads the CA in conf
+func NewCA(conf *config.InterceptCAConfig) (*CA, error) {
+	if conf.CertFile == "" || conf.KeyFile == "" {
+		return nil, fmt.Errorf("intercept_ca needs cert_file and key_file to be set")
+	}
+	pair, err := tls.LoadX509KeyPair(conf.CertFile, conf.KeyFile)
+	if err != nil {
+		return nil, fmt.Errorf("could not load intercept CA: %v", err)
+	}
+	cert, err := x509.ParseCertificate(pair.Certificate[0])
+	if err != nil {
+		return nil, fmt.Errorf("could not parse intercept CA certificate: %v", err)
+	}
+	if !cert.IsCA {
+		return nil, fmt.Errorf("intercept CA certificate '%s' is not a CA", cert.Subject)
+	}
+	key, ok := pair.PrivateKey.(crypto.Signer)
+	if !ok {
+		return nil, fmt.Errorf("intercept CA key can't sign certificates")
+	}
+	leafKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	c := &CA{
+		cert:    cert,
+		key:     key,
+		leafKey: leafKey,
+		ttl:     conf.CertTTL.Or(defaultCertTTL),
+		size:    conf.CacheSize,
+		cache:   map[string]*cachedCert{},
+		now:     time.Now,
+	}
+	if c.size <= 0 {
+		c.size = defaultCacheSize
+	}
+	return c, nil
+}
@@ -0,0 +1,100 @@
+package intercept
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/threetoes/peeper/internal/config"
+)
+
+// writeCA writes a CA certificate and key to dir, returning the config for them
+func writeCA(t *testing.T, dir string, isCA bool) *config.InterceptCAConfig {
+	key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "peeper intercept CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(48 * time.Hour),
+		IsCA:                  isCA,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	keyDer, _ := x509.MarshalECPrivateKey(key)
+	conf := &config.InterceptCAConfig{CertFile: filepath.Join(dir, "ca.pem"), KeyFile: filepath.Join(dir, "ca-key.pem")}
+	assert.NoError(t, os.WriteFile(conf.CertFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600))
+	assert.NoError(t, os.WriteFile(conf.KeyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer}), 0600))
+	return conf
+}
+
+func TestNewCA(t *testing.T) {
+	_, err := NewCA(&config.InterceptCAConfig{})
+	assert.Error(t, err)
+	_, err = NewCA(writeCA(t, t.TempDir(), false))
+	assert.Error(t, err, "a certificate that isn't a CA can't issue certificates")
+}
+
+func TestCA_Certificate(t *testing.T) {
+	conf := writeCA(t, t.TempDir(), true)
+	conf.CertTTL = config.Duration(time.Hour)
+	conf.CacheSize = 2
+	ca, err := NewCA(conf)
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	now := time.Now()
+	ca.now = func() time.Time { return now }
+	roots := x509.NewCertPool()
+	roots.AddCert(ca.cert)
+
+	tests := []struct {
+		host    string
+		verify  string
+		wantDNS bool
+	}{
+		{host: "api.vendor.com", verify: "api.vendor.com", wantDNS: true},
+		{host: "API.Vendor.com.", verify: "api.vendor.com", wantDNS: true},
+		{host: "10.0.0.1", verify: "10.0.0.1"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.host, func(t *testing.T) {
+			cert, err := ca.Certificate(tt.host)
+			if !assert.NoError(t, err) {
+				return
+			}
+			leaf, err := x509.ParseCertificate(cert.Certificate[0])
+			if !assert.NoError(t, err) {
+				return
+			}
+			_, err = leaf.Verify(x509.VerifyOptions{DNSName: tt.verify, Roots: roots, CurrentTime: now})
+			assert.NoError(t, err)
+			assert.Equal(t, tt.wantDNS, len(leaf.DNSNames) > 0)
+			assert.Equal(t, now.Add(time.Hour).Unix(), leaf.NotAfter.Unix())
+		})
+	}
+
+	first, _ := ca.Certificate("api.vendor.com")
+	again, _ := ca.Certificate("api.vendor.com")
+	assert.Same(t, first, again, "certificates are reused")
+	assert.Len(t, ca.cache, 2, "the cache doesn't grow past its size")
+
+	now = now.Add(31 * time.Minute)
+	renewed, _ := ca.Certificate("api.vendor.com")
+	assert.NotSame(t, first, renewed, "certificates are renewed half way through their lifetime")
+
+	_, err = ca.Certificate("")
+	assert.Error(t, err)
+}
@@ -0,0 +1,68 @@
+package logging
+
+import (
+	"net/http"
+	"sync"
+
+	"github.com/sirupsen/logrus"
+	"github.com/threetoes/peeper/internal/secrets"
+)
+
+var (
+	redactedLock    sync.RWMutex
+	redactedHeaders = map[string]bool{
+		"Authorization":       true,
+		"Proxy-Authorization": true,
+		"Cookie":              true,
+		"Set-Cookie":          true,
+	}
+)
+
+// AddRedactedHeaders adds to the headers whose values are never logged. Authorization, Proxy-Authorization, Cookie
+// and Set-Cookie are always redacted
+func AddRedactedHeaders(names ...string) {
+	redactedLock.Lock()
+	defer redactedLock.Unlock()
+	for _, name := range names {
+		redactedHeaders[http.CanonicalHeaderKey(name)] = true
+	}
+}
+
+// RedactHeaders returns a copy of h that is safe to log, with the values of sensitive headers replaced
+func RedactHeaders(h http.Header) http.Header {
+	redactedLock.RLock()
+	defer redactedLock.RUnlock()
+	safe := make(http.Header, len(h))
+	for k, v := range h {
+		if redactedHeaders[http.CanonicalHeaderKey(k)] {
+			safe[k] = []string{secrets.Redacted}
+			continue
+		}
+		safe[k] = append([]string(nil), v...)
+	}
+	return safe
+}
+
+// RedactionHook is a logrus hook that makes headers and requests in log fields safe to log. Requests are reduced
+// to their method, path and redacted headers, since their URLs and bodies can also carry credentials
+type RedactionHook struct{}
+
+func (RedactionHook) Levels() []logrus.Level {
+	return logrus.AllLevels
+}
+
+func (RedactionHook) Fire(entry *logrus.Entry) error {
+	for k, v := range entry.Data {
+		switch v := v.(type) {
+		case http.Header:
+			entry.Data[k] = RedactHeaders(v)
+		case *http.Request:
+			entry.Data[k] = map[string]interface{}{
+				"method":  v.Method,
+				"path":    v.URL.Path,
+				"headers": RedactHeaders(v.Header),
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,54 @@
+package logging
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"github.com/threetoes/peeper/internal/secrets"
+)
+
+func TestRedactionHook(t *testing.T) {
+	const secret = "sn@ke3ateR"
+	AddRedactedHeaders("x-api-key")
+
+	headers := http.Header{}
+	headers.Set("Authorization", "Bearer "+secret)
+	headers.Set("Cookie", "session="+secret)
+	headers.Set("X-Api-Key", secret)
+	headers.Set("Accept", "application/json")
+	req := httptest.NewRequest("GET", "/cats", nil)
+	req.Header = headers.Clone()
+	s := secrets.NewSecret(secret)
+
+	formatters := map[string]logrus.Formatter{
+		"text": &logrus.TextFormatter{},
+		"json": &logrus.JSONFormatter{},
+	}
+	for name, formatter := range formatters {
+		t.Run(name, func(t *testing.T) {
+			var buf bytes.Buffer
+			logger := logrus.New()
+			logger.SetOutput(&buf)
+			logger.SetFormatter(formatter)
+			logger.AddHook(RedactionHook{})
+
+			logger.WithField("headers", headers).Info("headers")
+			logger.WithField("request", req).Info("request")
+			logger.WithField("secret", s).Info("secret field")
+			logger.WithField("nested", struct{ Password secrets.Secret }{s}).Info("nested secret")
+			logger.Infof("secret in message %v %s %+v %#v %q", s, s, s, s, s)
+			logger.WithError(fmt.Errorf("wrapped %v", s)).Error("secret in error")
+
+			assert.NotContains(t, buf.String(), secret)
+			assert.Contains(t, buf.String(), secrets.Redacted)
+			assert.Contains(t, buf.String(), "application/json")
+		})
+	}
+	// The hook must not modify the caller's headers
+	assert.Equal(t, "Bearer "+secret, headers.Get("Authorization"))
+}
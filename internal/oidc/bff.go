@@ -0,0 +1,394 @@
+package oidc
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/threetoes/peeper/internal/auth"
+	"github.com/threetoes/peeper/internal/config"
+	"github.com/threetoes/peeper/internal/inbound"
+	"github.com/threetoes/peeper/internal/secrets"
+)
+
+const (
+	defaultLoginPath       = "/auth/login"
+	defaultCallbackPath    = "/auth/callback"
+	defaultLogoutPath      = "/auth/logout"
+	defaultCookieName      = "peeper_session"
+	defaultSessionDuration = 8 * time.Hour
+	loginTimeout           = 10 * time.Minute
+	refreshBefore          = 30 * time.Second
+	// refreshResultTTL is how long a refresh's result is shared, as providers that rotate refresh tokens reject reuse
+	refreshResultTTL = time.Minute
+	// maxCookieSize keeps each cookie's name and value under the 4KB browsers allow, leaving room for attributes
+	maxCookieSize = 3800
+	// maxSessionCookies bounds the cookies a session is split across. Bigger sessions are refused rather than left
+	// for the browser to drop silently
+	maxSessionCookies = 4
+)
+
+type refreshCall struct {
+	done     chan struct{}
+	tok      *tokenResponse
+	err      error
+	finished time.Time
+}
+
+// BFF logs browser users in with an OpenID Connect provider and keeps their tokens in an encrypted session cookie,
+// so that single page apps can call endpoints without handling tokens themselves
+type BFF struct {
+	provider        *provider
+	sealer          *sealer
+	loginPath       string
+	callbackPath    string
+	logoutPath      string
+	postLogout      string
+	cookieName      string
+	secure          bool
+	sessionDuration time.Duration
+	now             func() time.Time
+
+	lock      sync.Mutex
+	refreshes map[[sha256.Size]byte]*refreshCall
+}
+
+// Register adds the login, callback and logout routes to mux
+func (b *BFF) Register(mux *http.ServeMux) {
+	mux.HandleFunc(b.loginPath, b.login)
+	mux.HandleFunc(b.callbackPath, b.callback)
+	mux.HandleFunc(b.logoutPath, b.logout)
+}
+
+func (b *BFF) setCookie(rw http.ResponseWriter, name, value, path string, expires time.Time) {
+	http.SetCookie(rw, &http.Cookie{
+		Name:     name,
+		Value:    value,
+		Path:     path,
+		Expires:  expires,
+		HttpOnly: true,
+		Secure:   b.secure,
+		SameSite: http.SameSiteLaxMode,
+	})
+}
+
+func (b *BFF) clearCookie(rw http.ResponseWriter, name, path string) {
+	http.SetCookie(rw, &http.Cookie{
+		Name:     name,
+		Path:     path,
+		MaxAge:   -1,
+		HttpOnly: true,
+		Secure:   b.secure,
+		SameSite: http.SameSiteLaxMode,
+	})
+}
+
+func (b *BFF) loginCookieName() string {
+	return b.cookieName + "_login"
+}
+
+// localRedirect returns target if it is a path on this host, or `/` otherwise, so logins can't redirect elsewhere
+func localRedirect(target string) string {
+	if !strings.HasPrefix(target, "/") || strings.HasPrefix(target, "//") || strings.HasPrefix(target, "/\\") {
+		return "/"
+	}
+	return target
+}
+
+func (b *BFF) login(rw http.ResponseWriter, req *http.Request) {
+	state, err := randomString(32)
+	if err != nil {
+		rw.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	verifier, err := randomString(32)
+	if err != nil {
+		rw.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	nonce, err := randomString(32)
+	if err != nil {
+		rw.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	expires := b.now().Add(loginTimeout)
+	value, err := b.sealer.seal(b.loginCookieName(), &loginState{
+		State:    state,
+		Verifier: verifier,
+		Nonce:    nonce,
+		Redirect: localRedirect(req.URL.Query().Get("redirect")),
+		Expires:  expires.Unix(),
+	})
+	if err != nil {
+		rw.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	b.setCookie(rw, b.loginCookieName(), value, b.callbackPath, expires)
+	challenge := sha256.Sum256([]byte(verifier))
+	http.Redirect(rw, req, b.provider.authCodeURL(state, base64.RawURLEncoding.EncodeToString(challenge[:]), nonce), http.StatusFound)
+}
+
+func (b *BFF) callback(rw http.ResponseWriter, req *http.Request) {
+	cookie, err := req.Cookie(b.loginCookieName())
+	if err != nil {
+		logrus.Warnf("rejecting login callback: no login in progress")
+		rw.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	b.clearCookie(rw, b.loginCookieName(), b.callbackPath)
+	var login loginState
+	if err := b.sealer.open(b.loginCookieName(), cookie.Value, &login); err != nil || b.now().After(time.Unix(login.Expires, 0)) {
+		logrus.Warnf("rejecting login callback: login state is invalid or has expired")
+		rw.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	query := req.URL.Query()
+	if query.Get("state") != login.State {
+		logrus.Warnf("rejecting login callback: state doesn't match")
+		rw.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	if e := query.Get("error"); e != "" {
+		logrus.Warnf("login failed at the provider: %s", e)
+		rw.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+	tok, err := b.provider.exchange(query.Get("code"), login.Verifier)
+	if err != nil {
+		logrus.Errorf("could not exchange authorization code: %v", err)
+		rw.WriteHeader(http.StatusBadGateway)
+		return
+	}
+	claims, err := b.provider.verifyIDToken(tok.IDToken, login.Nonce)
+	if err != nil {
+		logrus.Warnf("rejecting login callback: %v", err)
+		rw.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+	subject, _ := claims["sub"].(string)
+	now := b.now()
+	s := &session{Subject: subject, Expires: now.Add(b.sessionDuration).Unix()}
+	s.update(tok, now)
+	if err := b.writeSession(rw, req, s); err != nil {
+		logrus.Errorf("could not store the session of user '%s': %v", subject, err)
+		rw.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	logrus.Infof("user '%s' logged in", subject)
+	http.Redirect(rw, req, login.Redirect, http.StatusFound)
+}
+
+func (b *BFF) sessionCookieName(i int) string {
+	if i == 0 {
+		return b.cookieName
+	}
+	return fmt.Sprintf("%s_%d", b.cookieName, i)
+}
+
+func (b *BFF) writeSession(rw http.ResponseWriter, req *http.Request, s *session) error {
+	value, err := b.sealer.seal(b.cookieName, s)
+	if err != nil {
+		return err
+	}
+	chunkSize := maxCookieSize - len(b.sessionCookieName(maxSessionCookies))
+	chunks := (len(value) + chunkSize - 1) / chunkSize
+	if chunks > maxSessionCookies {
+		return fmt.Errorf("session is %d bytes, more than fits in %d cookies", len(value), maxSessionCookies)
+	}
+	for i := 0; i < maxSessionCookies; i++ {
+		if i < chunks {
+			end := (i + 1) * chunkSize
+			if end > len(value) {
+				end = len(value)
+			}
+			b.setCookie(rw, b.sessionCookieName(i), value[i*chunkSize:end], "/", time.Unix(s.Expires, 0))
+		} else if _, err := req.Cookie(b.sessionCookieName(i)); err == nil {
+			b.clearCookie(rw, b.sessionCookieName(i), "/")
+		}
+	}
+	return nil
+}
+
+func (b *BFF) clearSession(rw http.ResponseWriter, req *http.Request) {
+	for i := 0; i < maxSessionCookies; i++ {
+		if _, err := req.Cookie(b.sessionCookieName(i)); err == nil {
+			b.clearCookie(rw, b.sessionCookieName(i), "/")
+		}
+	}
+}
+
+// logout only accepts POST, so other sites can't log users out with a link or an image
+func (b *BFF) logout(rw http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodPost {
+		rw.Header().Set("Allow", http.MethodPost)
+		rw.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	b.clearSession(rw, req)
+	target := b.postLogout
+	if endSession := b.provider.discovery.EndSessionEndpoint; endSession != "" {
+		query := url.Values{}
+		query.Set("client_id", b.provider.clientId)
+		if b.postLogout != "" {
+			query.Set("post_logout_redirect_uri", b.postLogout)
+		}
+		target = endSession + "?" + query.Encode()
+	}
+	if target == "" {
+		target = "/"
+	}
+	http.Redirect(rw, req, target, http.StatusFound)
+}
+
+// refresh shares its result with concurrent and recent refreshes of the same token
+func (b *BFF) refresh(refreshToken string, now time.Time) (*tokenResponse, error) {
+	key := sha256.Sum256([]byte(refreshToken))
+	b.lock.Lock()
+	for k, call := range b.refreshes {
+		if !call.finished.IsZero() && now.Sub(call.finished) > refreshResultTTL {
+			delete(b.refreshes, k)
+		}
+	}
+	call, ok := b.refreshes[key]
+	if !ok {
+		call = &refreshCall{done: make(chan struct{})}
+		b.refreshes[key] = call
+	}
+	b.lock.Unlock()
+
+	if !ok {
+		call.tok, call.err = b.provider.refresh(refreshToken)
+		b.lock.Lock()
+		call.finished = b.now()
+		if call.err != nil {
+			// Failures aren't shared beyond the requests already waiting
+			delete(b.refreshes, key)
+		}
+		b.lock.Unlock()
+		close(call.done)
+	}
+	<-call.done
+	return call.tok, call.err
+}
+
+// session returns nil if the caller isn't logged in
+func (b *BFF) session(rw http.ResponseWriter, req *http.Request) *session {
+	var value strings.Builder
+	for i := 0; i < maxSessionCookies; i++ {
+		cookie, err := req.Cookie(b.sessionCookieName(i))
+		if err != nil {
+			break
+		}
+		value.WriteString(cookie.Value)
+	}
+	if value.Len() == 0 {
+		return nil
+	}
+	var s session
+	if err := b.sealer.open(b.cookieName, value.String(), &s); err != nil {
+		return nil
+	}
+	now := b.now()
+	if now.After(time.Unix(s.Expires, 0)) {
+		return nil
+	}
+	if !s.tokenExpiresBy(now.Add(refreshBefore)) {
+		return &s
+	}
+	if s.RefreshToken == "" {
+		return nil
+	}
+	tok, err := b.refresh(s.RefreshToken, now)
+	if err != nil {
+		logrus.Warnf("could not refresh the access token of user '%s': %v", s.Subject, err)
+		return nil
+	}
+	s.update(tok, now)
+	if err := b.writeSession(rw, req, &s); err != nil {
+		logrus.Errorf("could not store the session of user '%s': %v", s.Subject, err)
+		return nil
+	}
+	return &s
+}
+
+func (b *BFF) removeSession(req *http.Request) {
+	session := map[string]bool{}
+	for i := 0; i < maxSessionCookies; i++ {
+		session[b.sessionCookieName(i)] = true
+	}
+	cookies := req.Cookies()
+	req.Header.Del("Cookie")
+	for _, c := range cookies {
+		if !session[c.Name] {
+			req.AddCookie(c)
+		}
+	}
+}
+
+// Middleware returns middleware that only lets through logged in users, carrying their access token for
+// auth.UserTokenInjector. Other callers get a 401, and should be sent to the login route. The session cookie isn't
+// forwarded, as it holds the user's tokens
+func (b *BFF) Middleware() inbound.Middleware {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+			s := b.session(rw, req)
+			if s == nil {
+				b.clearSession(rw, req)
+				rw.WriteHeader(http.StatusUnauthorized)
+				return
+			}
+			b.removeSession(req)
+			ctx := auth.WithUserToken(req.Context(), s.AccessToken)
+			ctx = inbound.WithIdentity(ctx, &inbound.Identity{Subject: s.Subject, Method: "oidc"})
+			next.ServeHTTP(rw, req.WithContext(ctx))
+		})
+	}
+}
+
+// New returns a BFF for the provider in conf, which is contacted for its discovery document. clientSecret
+// authenticates peeper to the provider and cookieKey encrypts cookies
+func New(conf *config.OIDCConfig, clientSecret, cookieKey secrets.Secret) (*BFF, error) {
+	s, err := newSealer(cookieKey.Reveal())
+	if err != nil {
+		return nil, err
+	}
+	p, err := discover(conf, clientSecret)
+	if err != nil {
+		return nil, err
+	}
+	b := &BFF{
+		provider:        p,
+		sealer:          s,
+		loginPath:       conf.LoginPath,
+		callbackPath:    conf.CallbackPath,
+		logoutPath:      conf.LogoutPath,
+		postLogout:      conf.PostLogoutRedirect,
+		cookieName:      conf.CookieName,
+		secure:          !conf.InsecureCookies,
+		sessionDuration: conf.SessionDuration.Or(defaultSessionDuration),
+		now:             time.Now,
+		refreshes:       map[[sha256.Size]byte]*refreshCall{},
+	}
+	if b.loginPath == "" {
+		b.loginPath = defaultLoginPath
+	}
+	if b.callbackPath == "" {
+		b.callbackPath = defaultCallbackPath
+	}
+	if b.logoutPath == "" {
+		b.logoutPath = defaultLogoutPath
+	}
+	if b.cookieName == "" {
+		b.cookieName = defaultCookieName
+	}
+	if len(p.scopes) == 0 {
+		p.scopes = []string{"openid"}
+	}
+	return b, nil
+}
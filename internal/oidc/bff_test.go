@@ -0,0 +1,381 @@
+package oidc
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/cookiejar"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v4"
+	"github.com/stretchr/testify/assert"
+	"github.com/threetoes/peeper/internal/auth"
+	"github.com/threetoes/peeper/internal/config"
+	"github.com/threetoes/peeper/internal/secrets"
+)
+
+// fakeIdP is a minimal OpenID Connect provider supporting the authorization code flow with PKCE and rotating
+// refresh tokens
+type fakeIdP struct {
+	t   *testing.T
+	svr *httptest.Server
+	key *ecdsa.PrivateKey
+
+	lock      sync.Mutex
+	logins    map[string]url.Values
+	refreshes int
+	// refreshToken is the only refresh token currently valid
+	refreshToken string
+	issued       int
+	// refreshDelay slows refreshes down, to catch concurrent refreshes
+	refreshDelay time.Duration
+	// tokenPadding is added to access tokens, to stand in for the large tokens some providers issue
+	tokenPadding string
+}
+
+func newFakeIdP(t *testing.T) *fakeIdP {
+	key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	idp := &fakeIdP{t: t, key: key, logins: map[string]url.Values{}}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration", func(rw http.ResponseWriter, req *http.Request) {
+		json.NewEncoder(rw).Encode(map[string]string{
+			"issuer":                 idp.svr.URL,
+			"authorization_endpoint": idp.svr.URL + "/authorize",
+			"token_endpoint":         idp.svr.URL + "/token",
+			"jwks_uri":               idp.svr.URL + "/jwks",
+			"end_session_endpoint":   idp.svr.URL + "/logout",
+		})
+	})
+	mux.HandleFunc("/jwks", func(rw http.ResponseWriter, req *http.Request) {
+		json.NewEncoder(rw).Encode(map[string]interface{}{"keys": []map[string]string{{
+			"kid": "idp",
+			"kty": "EC",
+			"crv": "P-256",
+			"x":   base64.RawURLEncoding.EncodeToString(key.X.FillBytes(make([]byte, 32))),
+			"y":   base64.RawURLEncoding.EncodeToString(key.Y.FillBytes(make([]byte, 32))),
+		}}})
+	})
+	mux.HandleFunc("/authorize", idp.authorize)
+	mux.HandleFunc("/token", idp.token)
+	idp.svr = httptest.NewServer(mux)
+	return idp
+}
+
+// authorize logs the user straight in and sends them back with a code
+func (f *fakeIdP) authorize(rw http.ResponseWriter, req *http.Request) {
+	query := req.URL.Query()
+	assert.Equal(f.t, "S256", query.Get("code_challenge_method"))
+	code := fmt.Sprintf("code-%d", time.Now().UnixNano())
+	f.lock.Lock()
+	f.logins[code] = query
+	f.lock.Unlock()
+	http.Redirect(rw, req, query.Get("redirect_uri")+"?code="+code+"&state="+url.QueryEscape(query.Get("state")), http.StatusFound)
+}
+
+func (f *fakeIdP) issue(rw http.ResponseWriter, nonce string) {
+	f.issued++
+	f.refreshToken = fmt.Sprintf("refresh-%d", f.issued)
+	resp := map[string]interface{}{
+		"access_token":  fmt.Sprintf("access-%d", f.issued) + f.tokenPadding,
+		"token_type":    "Bearer",
+		"refresh_token": f.refreshToken,
+		"expires_in":    60,
+	}
+	if nonce != "" {
+		tok := jwt.NewWithClaims(jwt.SigningMethodES256, jwt.MapClaims{
+			"iss":   f.svr.URL,
+			"aud":   "spa",
+			"sub":   "alice",
+			"nonce": nonce,
+			"exp":   time.Now().Add(time.Hour).Unix(),
+		})
+		tok.Header["kid"] = "idp"
+		resp["id_token"], _ = tok.SignedString(f.key)
+	}
+	json.NewEncoder(rw).Encode(resp)
+}
+
+func (f *fakeIdP) token(rw http.ResponseWriter, req *http.Request) {
+	if id, secret, ok := req.BasicAuth(); !ok || id != "spa" || secret != "spa-secret" {
+		rw.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+	switch req.PostFormValue("grant_type") {
+	case "authorization_code":
+		f.lock.Lock()
+		defer f.lock.Unlock()
+		login, ok := f.logins[req.PostFormValue("code")]
+		delete(f.logins, req.PostFormValue("code"))
+		challenge := sha256.Sum256([]byte(req.PostFormValue("code_verifier")))
+		if !ok || base64.RawURLEncoding.EncodeToString(challenge[:]) != login.Get("code_challenge") {
+			rw.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		f.issue(rw, login.Get("nonce"))
+	case "refresh_token":
+		time.Sleep(f.refreshDelay)
+		f.lock.Lock()
+		defer f.lock.Unlock()
+		f.refreshes++
+		if req.PostFormValue("refresh_token") != f.refreshToken {
+			rw.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		f.issue(rw, "")
+	default:
+		rw.WriteHeader(http.StatusBadRequest)
+	}
+}
+
+func (f *fakeIdP) refreshCount() int {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	return f.refreshes
+}
+
+// newTestBFF returns a BFF logging in with idp, served with a protected /api route that echoes the user's token and
+// the cookies it was sent
+func newTestBFF(t *testing.T, idp *fakeIdP) (*BFF, *httptest.Server) {
+	mux := http.NewServeMux()
+	peeper := httptest.NewServer(mux)
+	bff, err := New(&config.OIDCConfig{
+		Issuer:             idp.svr.URL,
+		ClientId:           "spa",
+		RedirectURL:        peeper.URL + "/auth/callback",
+		Scopes:             []string{"openid", "offline_access"},
+		PostLogoutRedirect: peeper.URL + "/",
+		InsecureCookies:    true,
+	}, secrets.NewSecret("spa-secret"), secrets.NewSecret(strings.Repeat("c", 32)))
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	bff.Register(mux)
+	injector := auth.NewUserTokenInjector("")
+	mux.Handle("/api", bff.Middleware()(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		upstream, _ := http.NewRequestWithContext(req.Context(), "GET", "http://upstream/", nil)
+		if err := injector.InjectCredentials(upstream); err != nil {
+			rw.WriteHeader(http.StatusBadGateway)
+			return
+		}
+		rw.Header().Set("X-Cookie", req.Header.Get("Cookie"))
+		rw.Write([]byte(upstream.Header.Get("Authorization")))
+	})))
+	return bff, peeper
+}
+
+func get(t *testing.T, client *http.Client, u string) (int, string) {
+	resp, err := client.Get(u)
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	defer resp.Body.Close()
+	body, _ := ioutil.ReadAll(resp.Body)
+	return resp.StatusCode, string(body)
+}
+
+func TestBFF_LoginFlow(t *testing.T) {
+	idp := newFakeIdP(t)
+	defer idp.svr.Close()
+	bff, peeper := newTestBFF(t, idp)
+	defer peeper.Close()
+
+	jar, _ := cookiejar.New(nil)
+	client := &http.Client{Jar: jar}
+
+	code, _ := get(t, client, peeper.URL+"/api")
+	assert.Equal(t, http.StatusUnauthorized, code, "users have to log in first")
+
+	code, body := get(t, client, peeper.URL+"/auth/login?redirect=/api")
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, "Bearer access-1", body, "the user ends up back at /api with their token injected")
+
+	code, body = get(t, client, peeper.URL+"/api")
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, "Bearer access-1", body)
+	assert.Equal(t, 0, idp.refreshCount())
+
+	// Once the access token is about to expire it is refreshed, and the new tokens are kept in the cookie
+	now := time.Now().Add(45 * time.Second)
+	bff.now = func() time.Time { return now }
+	code, body = get(t, client, peeper.URL+"/api")
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, "Bearer access-2", body)
+	code, body = get(t, client, peeper.URL+"/api")
+	assert.Equal(t, "Bearer access-2", body)
+	assert.Equal(t, 1, idp.refreshCount())
+
+	// Sessions end however often they're refreshed
+	now = time.Now().Add(9 * time.Hour)
+	code, _ = get(t, client, peeper.URL+"/api")
+	assert.Equal(t, http.StatusUnauthorized, code)
+}
+
+func TestBFF_SessionCookieIsNotForwarded(t *testing.T) {
+	idp := newFakeIdP(t)
+	defer idp.svr.Close()
+	_, peeper := newTestBFF(t, idp)
+	defer peeper.Close()
+
+	jar, _ := cookiejar.New(nil)
+	client := &http.Client{Jar: jar}
+	code, _ := get(t, client, peeper.URL+"/auth/login?redirect=/api")
+	assert.Equal(t, http.StatusOK, code)
+	u, _ := url.Parse(peeper.URL)
+	jar.SetCookies(u, []*http.Cookie{{Name: "theme", Value: "dark"}})
+
+	resp, err := client.Get(peeper.URL + "/api")
+	if assert.NoError(t, err) {
+		resp.Body.Close()
+		assert.Equal(t, http.StatusOK, resp.StatusCode)
+		assert.Equal(t, "theme=dark", resp.Header.Get("X-Cookie"))
+	}
+}
+
+func TestBFF_LargeSession(t *testing.T) {
+	idp := newFakeIdP(t)
+	defer idp.svr.Close()
+	idp.tokenPadding = strings.Repeat("x", 6000)
+	bff, peeper := newTestBFF(t, idp)
+	defer peeper.Close()
+
+	jar, _ := cookiejar.New(nil)
+	client := &http.Client{Jar: jar}
+	code, body := get(t, client, peeper.URL+"/auth/login?redirect=/api")
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, "Bearer access-1"+idp.tokenPadding, body)
+	u, _ := url.Parse(peeper.URL)
+	cookies := jar.Cookies(u)
+	assert.Len(t, cookies, 3, "the session is split across cookies that each fit in a browser")
+	for _, c := range cookies {
+		assert.LessOrEqual(t, len(c.Name)+len(c.Value), maxCookieSize)
+	}
+	resp, err := client.Get(peeper.URL + "/api")
+	if assert.NoError(t, err) {
+		resp.Body.Close()
+		assert.Equal(t, http.StatusOK, resp.StatusCode)
+		assert.Empty(t, resp.Header.Get("X-Cookie"))
+	}
+
+	// Once the session shrinks the cookies it no longer needs are cleared
+	idp.lock.Lock()
+	idp.tokenPadding = ""
+	idp.lock.Unlock()
+	now := time.Now().Add(45 * time.Second)
+	bff.now = func() time.Time { return now }
+	code, body = get(t, client, peeper.URL+"/api")
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, "Bearer access-2", body)
+	assert.Len(t, jar.Cookies(u), 1)
+
+	// Sessions too big for the browser to keep are refused rather than silently lost
+	idp.lock.Lock()
+	idp.tokenPadding = strings.Repeat("x", 20000)
+	idp.lock.Unlock()
+	bff.now = time.Now
+	code, _ = get(t, &http.Client{Jar: jar}, peeper.URL+"/auth/login?redirect=/api")
+	assert.Equal(t, http.StatusInternalServerError, code)
+}
+
+func TestBFF_Logout(t *testing.T) {
+	idp := newFakeIdP(t)
+	defer idp.svr.Close()
+	_, peeper := newTestBFF(t, idp)
+	defer peeper.Close()
+
+	jar, _ := cookiejar.New(nil)
+	client := &http.Client{Jar: jar}
+	code, _ := get(t, client, peeper.URL+"/auth/login?redirect=/api")
+	assert.Equal(t, http.StatusOK, code)
+
+	code, _ = get(t, client, peeper.URL+"/auth/logout")
+	assert.Equal(t, http.StatusMethodNotAllowed, code, "links can't log users out")
+	code, _ = get(t, client, peeper.URL+"/api")
+	assert.Equal(t, http.StatusOK, code)
+
+	client.CheckRedirect = func(req *http.Request, via []*http.Request) error {
+		return http.ErrUseLastResponse
+	}
+	resp, err := client.Post(peeper.URL+"/auth/logout", "text/plain", nil)
+	if assert.NoError(t, err) {
+		resp.Body.Close()
+		assert.Equal(t, http.StatusFound, resp.StatusCode)
+		location, _ := url.Parse(resp.Header.Get("Location"))
+		assert.Equal(t, idp.svr.URL+"/logout", location.Scheme+"://"+location.Host+location.Path)
+		assert.Equal(t, peeper.URL+"/", location.Query().Get("post_logout_redirect_uri"))
+	}
+	code, _ = get(t, client, peeper.URL+"/api")
+	assert.Equal(t, http.StatusUnauthorized, code)
+}
+
+func TestBFF_RejectsBadCallbacks(t *testing.T) {
+	idp := newFakeIdP(t)
+	defer idp.svr.Close()
+	_, peeper := newTestBFF(t, idp)
+	defer peeper.Close()
+
+	noRedirects := func(req *http.Request, via []*http.Request) error {
+		return http.ErrUseLastResponse
+	}
+	jar, _ := cookiejar.New(nil)
+	client := &http.Client{Jar: jar, CheckRedirect: noRedirects}
+
+	code, _ := get(t, client, peeper.URL+"/auth/callback?code=anything&state=anything")
+	assert.Equal(t, http.StatusBadRequest, code, "there's no login in progress")
+
+	code, _ = get(t, client, peeper.URL+"/auth/login")
+	assert.Equal(t, http.StatusFound, code)
+	code, _ = get(t, client, peeper.URL+"/auth/callback?code=anything&state=forged")
+	assert.Equal(t, http.StatusBadRequest, code, "the state must match")
+
+	// A session cookie that's been tampered with is ignored
+	u, _ := url.Parse(peeper.URL)
+	jar.SetCookies(u, []*http.Cookie{{Name: defaultCookieName, Value: "forged", Path: "/"}})
+	code, _ = get(t, client, peeper.URL+"/api")
+	assert.Equal(t, http.StatusUnauthorized, code)
+}
+
+func TestBFF_ConcurrentRefreshes(t *testing.T) {
+	idp := newFakeIdP(t)
+	defer idp.svr.Close()
+	idp.refreshToken = "refresh-0"
+	idp.refreshDelay = 50 * time.Millisecond
+	bff, peeper := newTestBFF(t, idp)
+	defer peeper.Close()
+
+	var wg sync.WaitGroup
+	results := make([]string, 5)
+	for i := range results {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			tok, err := bff.refresh("refresh-0", time.Now())
+			if assert.NoError(t, err) {
+				results[i] = tok.AccessToken
+			}
+		}(i)
+	}
+	wg.Wait()
+	assert.Equal(t, 1, idp.refreshCount(), "concurrent refreshes with one refresh token share one call")
+	for _, r := range results {
+		assert.Equal(t, "access-1", r)
+	}
+}
+
+func TestLocalRedirect(t *testing.T) {
+	assert.Equal(t, "/app/orders?id=1", localRedirect("/app/orders?id=1"))
+	assert.Equal(t, "/", localRedirect("https://evil.example"))
+	assert.Equal(t, "/", localRedirect("//evil.example"))
+	assert.Equal(t, "/", localRedirect("/\\evil.example"))
+	assert.Equal(t, "/", localRedirect(""))
+}
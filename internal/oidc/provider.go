@@ -0,0 +1,158 @@
+package oidc
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/golang-jwt/jwt/v4"
+	"github.com/threetoes/peeper/internal/config"
+	"github.com/threetoes/peeper/internal/inbound"
+	"github.com/threetoes/peeper/internal/secrets"
+)
+
+type discoveryDocument struct {
+	Issuer                string `json:"issuer"`
+	AuthorizationEndpoint string `json:"authorization_endpoint"`
+	TokenEndpoint         string `json:"token_endpoint"`
+	JWKSURI               string `json:"jwks_uri"`
+	EndSessionEndpoint    string `json:"end_session_endpoint"`
+}
+
+type tokenResponse struct {
+	AccessToken  string `json:"access_token"`
+	TokenType    string `json:"token_type"`
+	RefreshToken string `json:"refresh_token"`
+	ExpiresIn    int64  `json:"expires_in"`
+	IDToken      string `json:"id_token"`
+}
+
+// provider talks to an OpenID Connect provider as a confidential client
+type provider struct {
+	discovery    discoveryDocument
+	clientId     string
+	clientSecret secrets.Secret
+	redirectURL  string
+	scopes       []string
+	client       *http.Client
+	idTokens     *inbound.JWTValidator
+}
+
+func (p *provider) authCodeURL(state, challenge, nonce string) string {
+	query := url.Values{}
+	query.Set("response_type", "code")
+	query.Set("client_id", p.clientId)
+	query.Set("redirect_uri", p.redirectURL)
+	query.Set("scope", strings.Join(p.scopes, " "))
+	query.Set("state", state)
+	query.Set("nonce", nonce)
+	query.Set("code_challenge", challenge)
+	query.Set("code_challenge_method", "S256")
+	sep := "?"
+	if strings.Contains(p.discovery.AuthorizationEndpoint, "?") {
+		sep = "&"
+	}
+	return p.discovery.AuthorizationEndpoint + sep + query.Encode()
+}
+
+func (p *provider) exchange(code, verifier string) (*tokenResponse, error) {
+	form := url.Values{}
+	form.Set("grant_type", "authorization_code")
+	form.Set("code", code)
+	form.Set("redirect_uri", p.redirectURL)
+	form.Set("code_verifier", verifier)
+	return p.token(form)
+}
+
+func (p *provider) refresh(refreshToken string) (*tokenResponse, error) {
+	form := url.Values{}
+	form.Set("grant_type", "refresh_token")
+	form.Set("refresh_token", refreshToken)
+	return p.token(form)
+}
+
+func (p *provider) token(form url.Values) (*tokenResponse, error) {
+	form.Set("client_id", p.clientId)
+	req, err := http.NewRequest(http.MethodPost, p.discovery.TokenEndpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+	req.SetBasicAuth(url.QueryEscape(p.clientId), url.QueryEscape(p.clientSecret.Reveal()))
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("token endpoint returned status code %d", resp.StatusCode)
+	}
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	var tok tokenResponse
+	if err := json.Unmarshal(body, &tok); err != nil {
+		// Don't wrap the decoder error, which could quote part of the token response
+		return nil, fmt.Errorf("could not decode token response")
+	}
+	if tok.AccessToken == "" {
+		return nil, fmt.Errorf("token response has no access token")
+	}
+	return &tok, nil
+}
+
+func (p *provider) verifyIDToken(idToken, nonce string) (jwt.MapClaims, error) {
+	claims, err := p.idTokens.Validate(idToken)
+	if err != nil {
+		return nil, err
+	}
+	if n, _ := claims["nonce"].(string); n != nonce {
+		return nil, fmt.Errorf("ID token has the wrong nonce")
+	}
+	return claims, nil
+}
+
+func discover(conf *config.OIDCConfig, clientSecret secrets.Secret) (*provider, error) {
+	client := &http.Client{Timeout: 10 * time.Second}
+	resp, err := client.Get(strings.TrimSuffix(conf.Issuer, "/") + "/.well-known/openid-configuration")
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("discovery returned status code %d", resp.StatusCode)
+	}
+	var doc discoveryDocument
+	if err := json.NewDecoder(resp.Body).Decode(&doc); err != nil {
+		return nil, fmt.Errorf("could not decode discovery document: %v", err)
+	}
+	if doc.Issuer != conf.Issuer {
+		return nil, fmt.Errorf("discovery document is for issuer '%s', not '%s'", doc.Issuer, conf.Issuer)
+	}
+	if doc.AuthorizationEndpoint == "" || doc.TokenEndpoint == "" || doc.JWKSURI == "" {
+		return nil, fmt.Errorf("discovery document is missing the authorization, token or JWKS endpoint")
+	}
+	jwks, err := inbound.NewJWKSFromURL(doc.JWKSURI, 0)
+	if err != nil {
+		return nil, err
+	}
+	return &provider{
+		discovery:    doc,
+		clientId:     conf.ClientId,
+		clientSecret: clientSecret,
+		redirectURL:  conf.RedirectURL,
+		scopes:       conf.Scopes,
+		client:       client,
+		idTokens: inbound.NewJWTValidator(jwks, &config.JWTAuthConfig{
+			Issuer:    doc.Issuer,
+			Audiences: []string{conf.ClientId},
+			Leeway:    config.Duration(time.Minute),
+		}),
+	}, nil
+}
@@ -0,0 +1,104 @@
+package oidc
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"time"
+)
+
+const minCookieKeyLength = 32
+
+type session struct {
+	Subject      string `json:"sub"`
+	AccessToken  string `json:"at"`
+	RefreshToken string `json:"rt,omitempty"`
+	// TokenExpiry is when the access token expires, or zero if the provider didn't say
+	TokenExpiry int64 `json:"tex,omitempty"`
+	// Expires is when the session ends and the user has to log in again
+	Expires int64 `json:"exp"`
+}
+
+func (s *session) tokenExpiresBy(t time.Time) bool {
+	return s.TokenExpiry != 0 && !t.Before(time.Unix(s.TokenExpiry, 0))
+}
+
+// update keeps the old refresh token if tok has none, as providers that don't rotate them leave them out
+func (s *session) update(tok *tokenResponse, now time.Time) {
+	s.AccessToken = tok.AccessToken
+	if tok.RefreshToken != "" {
+		s.RefreshToken = tok.RefreshToken
+	}
+	s.TokenExpiry = 0
+	if tok.ExpiresIn > 0 {
+		s.TokenExpiry = now.Add(time.Duration(tok.ExpiresIn) * time.Second).Unix()
+	}
+}
+
+type loginState struct {
+	State    string `json:"state"`
+	Verifier string `json:"verifier"`
+	Nonce    string `json:"nonce"`
+	Redirect string `json:"redirect"`
+	Expires  int64  `json:"exp"`
+}
+
+// sealer encrypts cookie values with AES-GCM, binding the cookie's name so one can't be passed off as another
+type sealer struct {
+	aead cipher.AEAD
+}
+
+func (s *sealer) seal(name string, v interface{}) (string, error) {
+	plaintext, err := json.Marshal(v)
+	if err != nil {
+		return "", err
+	}
+	nonce := make([]byte, s.aead.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return "", err
+	}
+	sealed := s.aead.Seal(nonce, nonce, plaintext, []byte(name))
+	return base64.RawURLEncoding.EncodeToString(sealed), nil
+}
+
+func (s *sealer) open(name, value string, v interface{}) error {
+	sealed, err := base64.RawURLEncoding.DecodeString(value)
+	if err != nil || len(sealed) < s.aead.NonceSize() {
+		return fmt.Errorf("invalid cookie")
+	}
+	nonce, ciphertext := sealed[:s.aead.NonceSize()], sealed[s.aead.NonceSize():]
+	plaintext, err := s.aead.Open(nil, nonce, ciphertext, []byte(name))
+	if err != nil {
+		return fmt.Errorf("invalid cookie")
+	}
+	return json.Unmarshal(plaintext, v)
+}
+
+func newSealer(key string) (*sealer, error) {
+	if len(key) < minCookieKeyLength {
+		return nil, fmt.Errorf("cookie key must be at least %d bytes long", minCookieKeyLength)
+	}
+	aesKey := sha256.Sum256([]byte(key))
+	block, err := aes.NewCipher(aesKey[:])
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	return &sealer{aead: aead}, nil
+}
+
+func randomString(n int) (string, error) {
+	b := make([]byte, n)
+	if _, err := io.ReadFull(rand.Reader, b); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
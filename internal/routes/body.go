@@ -0,0 +1,56 @@
+package routes
+
+import (
+	"errors"
+	"io"
+	"mime"
+	"net/http"
+)
+
+const bodyBufferSize = 32 * 1024
+
+// writeError wraps failures writing to the caller, as opposed to reading from the upstream
+type writeError struct {
+	err error
+}
+
+func (e *writeError) Error() string {
+	return e.err.Error()
+}
+
+// shouldFlush reports whether resp should reach the caller as soon as each part of it arrives. That is the case
+// for server-sent events and other responses of unknown length, which are often streamed
+func shouldFlush(resp *http.Response) bool {
+	if mediaType, _, _ := mime.ParseMediaType(resp.Header.Get("Content-Type")); mediaType == "text/event-stream" {
+		return true
+	}
+	return resp.ContentLength == -1
+}
+
+// copyBody streams src to rw, flushing after every write if flush is set
+func copyBody(rw http.ResponseWriter, src io.Reader, flush bool) error {
+	flusher, ok := rw.(http.Flusher)
+	flush = flush && ok
+	if flush {
+		// Send the headers straight away, as the first part of the body may be a while coming
+		flusher.Flush()
+	}
+	buf := make([]byte, bodyBufferSize)
+	for {
+		n, readErr := src.Read(buf)
+		if n > 0 {
+			if _, err := rw.Write(buf[:n]); err != nil {
+				return &writeError{err: err}
+			}
+			if flush {
+				flusher.Flush()
+			}
+		}
+		if errors.Is(readErr, io.EOF) {
+			return nil
+		}
+		if readErr != nil {
+			return readErr
+		}
+	}
+}
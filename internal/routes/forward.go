@@ -0,0 +1,274 @@
+package routes
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/threetoes/peeper/internal/auth"
+	"github.com/threetoes/peeper/internal/intercept"
+	"github.com/threetoes/peeper/internal/logging"
+)
+
+const connectDialTimeout = 10 * time.Second
+
+// hostPattern matches destination hosts, such as `api.vendor.com`, `*.vendor.com` or `api.vendor.com:8443`
+type hostPattern struct {
+	host string
+	// wildcard matches subdomains of host, but not host itself
+	wildcard bool
+	port     string
+}
+
+func parseHostPattern(pattern string) (hostPattern, error) {
+	var p hostPattern
+	host := pattern
+	if h, port, err := net.SplitHostPort(pattern); err == nil {
+		if _, err := strconv.ParseUint(port, 10, 16); err != nil {
+			return p, fmt.Errorf("invalid port in host pattern '%s'", pattern)
+		}
+		host, p.port = h, port
+	}
+	if strings.HasPrefix(host, "*.") {
+		p.wildcard = true
+		host = host[2:]
+	}
+	if host == "" || strings.Contains(host, "*") {
+		return p, fmt.Errorf("invalid host pattern '%s'", pattern)
+	}
+	p.host = normalizeHost(host)
+	return p, nil
+}
+
+func (p hostPattern) matches(host, port string) bool {
+	if p.port != "" && p.port != port {
+		return false
+	}
+	if p.wildcard {
+		return strings.HasSuffix(host, "."+p.host)
+	}
+	return host == p.host
+}
+
+func normalizeHost(host string) string {
+	return strings.TrimSuffix(strings.ToLower(host), ".")
+}
+
+type forwardRule struct {
+	patterns  []hostPattern
+	injector  auth.CredentialInjector
+	intercept bool
+}
+
+// ForwardProxy serves requests from apps using peeper as their HTTP proxy. Absolute-form requests are forwarded
+// with the credentials of the first rule matching their destination host, and CONNECT requests open a tunnel to a
+// matching host. Requests to other hosts are denied unless unknown hosts are allowed
+type ForwardProxy struct {
+	rules        []*forwardRule
+	allowUnknown bool
+	connectPorts map[string]bool
+	idleTimeout  time.Duration
+	dialer       *net.Dialer
+	client       *http.Client
+	ca           *intercept.CA
+}
+
+// SetInterceptCA sets the CA that certificates for intercepted hosts are issued from. It must be called before
+// any rules intercepting hosts are added
+func (f *ForwardProxy) SetInterceptCA(ca *intercept.CA) {
+	f.ca = ca
+}
+
+// AddRule adds credentials for the hosts matching patterns. injector may be nil to allow the hosts without
+// adding credentials. With interceptTLS set, CONNECT tunnels to the hosts are decrypted to add them there too
+func (f *ForwardProxy) AddRule(patterns []string, injector auth.CredentialInjector, interceptTLS bool) error {
+	if len(patterns) == 0 {
+		return fmt.Errorf("a rule needs at least one host")
+	}
+	if interceptTLS && f.ca == nil {
+		return fmt.Errorf("hosts can't be intercepted without an intercept CA")
+	}
+	rule := &forwardRule{injector: injector, intercept: interceptTLS}
+	for _, pattern := range patterns {
+		p, err := parseHostPattern(pattern)
+		if err != nil {
+			return err
+		}
+		rule.patterns = append(rule.patterns, p)
+	}
+	f.rules = append(f.rules, rule)
+	return nil
+}
+
+func (f *ForwardProxy) match(host, port string) *forwardRule {
+	host = normalizeHost(host)
+	for _, rule := range f.rules {
+		for _, p := range rule.patterns {
+			if p.matches(host, port) {
+				return rule
+			}
+		}
+	}
+	return nil
+}
+
+// IsProxyRequest reports whether req is meant for a forward proxy rather than being a request to peeper itself
+func IsProxyRequest(req *http.Request) bool {
+	return req.Method == http.MethodConnect || req.URL.IsAbs()
+}
+
+func (f *ForwardProxy) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
+	if req.Method == http.MethodConnect {
+		f.tunnel(rw, req)
+		return
+	}
+	if req.URL.Scheme != "http" {
+		logrus.Warnf("rejecting proxy request for %s: only http URLs can be proxied, use CONNECT for https", req.URL.Redacted())
+		rw.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	port := req.URL.Port()
+	if port == "" {
+		port = "80"
+	}
+	rule, ok := f.allowed(rw, req, req.URL.Hostname(), port)
+	if !ok {
+		return
+	}
+	f.forward(rw, req, rule)
+}
+
+func (f *ForwardProxy) forward(rw http.ResponseWriter, req *http.Request, rule *forwardRule) {
+	outReq, err := http.NewRequestWithContext(req.Context(), req.Method, req.URL.String(), ioutil.NopCloser(req.Body))
+	if err != nil {
+		rw.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	outReq.ContentLength = req.ContentLength
+	if req.ContentLength == 0 {
+		outReq.Body = http.NoBody
+	}
+	copyHeaders(outReq.Header, req.Header)
+	removeHopHeaders(outReq.Header)
+	if rule != nil && rule.injector != nil {
+		if err := rule.injector.InjectCredentials(outReq); err != nil {
+			logrus.Errorf("could not inject credentials for %s: %v", req.URL.Host, err)
+			rw.WriteHeader(http.StatusBadGateway)
+			return
+		}
+	}
+	logrus.WithField("headers", logging.RedactHeaders(outReq.Header)).Debugf("proxying %s request to %s", req.Method, req.URL.Redacted())
+
+	resp, err := f.client.Do(outReq)
+	if err != nil {
+		if req.Context().Err() == nil {
+			logrus.Warnf("could not proxy %s %s: %v", req.Method, req.URL.Redacted(), err)
+			rw.WriteHeader(http.StatusBadGateway)
+		}
+		return
+	}
+	defer resp.Body.Close()
+	removeHopHeaders(resp.Header)
+	copyHeaders(rw.Header(), resp.Header)
+	rw.WriteHeader(resp.StatusCode)
+	if err := copyBody(rw, resp.Body, shouldFlush(resp)); err != nil {
+		logrus.Debugf("proxied response from %s ended early: %v", req.URL.Host, err)
+	}
+}
+
+// allowed returns the rule for a request to host and port, answering the request if it is denied
+func (f *ForwardProxy) allowed(rw http.ResponseWriter, req *http.Request, host, port string) (*forwardRule, bool) {
+	rule := f.match(host, port)
+	if rule == nil && !f.allowUnknown {
+		logrus.WithFields(logrus.Fields{
+			"audit":       true,
+			"scope":       "forward_proxy",
+			"method":      req.Method,
+			"host":        net.JoinHostPort(host, port),
+			"remote_addr": req.RemoteAddr,
+		}).Warn("denied proxy request to unknown host")
+		rw.WriteHeader(http.StatusForbidden)
+		return nil, false
+	}
+	return rule, true
+}
+
+func (f *ForwardProxy) tunnel(rw http.ResponseWriter, req *http.Request) {
+	host, port, err := net.SplitHostPort(req.Host)
+	if err != nil {
+		rw.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	if !f.connectPorts[port] {
+		logrus.Warnf("rejecting CONNECT to %s: port %s isn't allowed", req.Host, port)
+		rw.WriteHeader(http.StatusForbidden)
+		return
+	}
+	rule, ok := f.allowed(rw, req, host, port)
+	if !ok {
+		return
+	}
+	hijacker, ok := rw.(http.Hijacker)
+	if !ok {
+		// HTTP/2 callers would need extended CONNECT, which isn't supported
+		rw.WriteHeader(http.StatusHTTPVersionNotSupported)
+		return
+	}
+	intercepting := rule != nil && rule.intercept
+	var backend net.Conn
+	if !intercepting {
+		// Requests in intercepted tunnels are sent on by the client, so only plain tunnels need a connection now
+		backend, err = f.dialer.DialContext(req.Context(), "tcp", req.Host)
+		if err != nil {
+			logrus.Warnf("could not open tunnel to %s: %v", req.Host, err)
+			rw.WriteHeader(http.StatusBadGateway)
+			return
+		}
+		defer backend.Close()
+	}
+	conn, buffered, err := hijacker.Hijack()
+	if err != nil {
+		logrus.Errorf("can't take over the connection for CONNECT %s: %v", req.Host, err)
+		rw.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	defer conn.Close()
+	if _, err := buffered.WriteString("HTTP/1.1 200 Connection Established\r\n\r\n"); err != nil {
+		return
+	}
+	if err := buffered.Flush(); err != nil {
+		return
+	}
+	if intercepting {
+		f.intercept(req, &bufferedConn{Conn: conn, reader: buffered.Reader}, rule)
+		return
+	}
+	relay(req.Context(), conn, buffered.Reader, backend, f.idleTimeout)
+}
+
+// NewForwardProxy returns a ForwardProxy without rules. CONNECT tunnels can only be opened to connectPorts, or
+// 443 if none are given, and are closed once idle for idleTimeout
+func NewForwardProxy(allowUnknown bool, connectPorts []int, idleTimeout time.Duration) *ForwardProxy {
+	f := &ForwardProxy{
+		allowUnknown: allowUnknown,
+		connectPorts: map[string]bool{},
+		idleTimeout:  idleTimeout,
+		dialer:       &net.Dialer{Timeout: connectDialTimeout},
+		client:       upstreamClients[ProtocolHTTP1],
+	}
+	if len(connectPorts) == 0 {
+		connectPorts = []int{443}
+	}
+	for _, port := range connectPorts {
+		f.connectPorts[strconv.Itoa(port)] = true
+	}
+	if f.idleTimeout <= 0 {
+		f.idleTimeout = defaultUpgradeIdleTimeout
+	}
+	return f
+}
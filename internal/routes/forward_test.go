@@ -0,0 +1,226 @@
+package routes
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/threetoes/peeper/internal/auth"
+	"github.com/threetoes/peeper/internal/config"
+	"github.com/threetoes/peeper/internal/intercept"
+)
+
+func TestForwardProxy_Match(t *testing.T) {
+	proxy := NewForwardProxy(false, nil, 0)
+	vendor := auth.NewBasicAuth("vendor", "secret")
+	admin := auth.NewBasicAuth("admin", "secret")
+	assert.NoError(t, proxy.AddRule([]string{"admin.vendor.com:8443"}, admin, false))
+	assert.NoError(t, proxy.AddRule([]string{"api.vendor.com", "*.vendor.com"}, vendor, false))
+	assert.Error(t, proxy.AddRule(nil, vendor, false))
+	assert.Error(t, proxy.AddRule([]string{"api.*.com"}, vendor, false))
+	assert.Error(t, proxy.AddRule([]string{"api.vendor.com:http"}, vendor, false))
+
+	tests := []struct {
+		host string
+		port string
+		want auth.CredentialInjector
+	}{
+		{host: "api.vendor.com", port: "443", want: vendor},
+		{host: "API.Vendor.com.", port: "80", want: vendor},
+		{host: "eu.api.vendor.com", port: "443", want: vendor},
+		{host: "admin.vendor.com", port: "8443", want: admin},
+		{host: "admin.vendor.com", port: "443", want: vendor},
+		{host: "vendor.com", port: "443"},
+		{host: "evilvendor.com", port: "443"},
+		{host: "api.vendor.com.evil.com", port: "443"},
+	}
+	for _, tt := range tests {
+		t.Run(net.JoinHostPort(tt.host, tt.port), func(t *testing.T) {
+			rule := proxy.match(tt.host, tt.port)
+			if tt.want == nil {
+				assert.Nil(t, rule)
+				return
+			}
+			if assert.NotNil(t, rule) {
+				assert.Equal(t, tt.want, rule.injector)
+			}
+		})
+	}
+}
+
+// proxyClient returns a client sending its requests through proxy
+func proxyClient(proxy *httptest.Server, transport *http.Transport) *http.Client {
+	proxyURL, _ := url.Parse(proxy.URL)
+	proxyURL.User = url.UserPassword("app", "proxy-secret")
+	if transport == nil {
+		transport = &http.Transport{}
+	}
+	transport.Proxy = http.ProxyURL(proxyURL)
+	return &http.Client{Transport: transport, Timeout: 5 * time.Second}
+}
+
+func TestForwardProxy_HTTP(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		assert.Empty(t, request.Header.Get("Proxy-Authorization"))
+		username, _, _ := request.BasicAuth()
+		writer.Write([]byte(username + " " + request.URL.RequestURI()))
+	}))
+	defer upstream.Close()
+	upstreamURL, _ := url.Parse(upstream.URL)
+
+	tests := []struct {
+		name         string
+		rules        []string
+		allowUnknown bool
+		wantCode     int
+		wantBody     string
+	}{
+		{name: "matching rule adds credentials", rules: []string{upstreamURL.Hostname()}, wantCode: http.StatusOK, wantBody: "vendor /v1/items?page=2"},
+		{name: "unknown host is denied", rules: []string{"api.vendor.com"}, wantCode: http.StatusForbidden},
+		{name: "unknown host is allowed without credentials", rules: []string{"api.vendor.com"}, allowUnknown: true, wantCode: http.StatusOK, wantBody: " /v1/items?page=2"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			forward := NewForwardProxy(tt.allowUnknown, nil, 0)
+			assert.NoError(t, forward.AddRule(tt.rules, auth.NewBasicAuth("vendor", "secret"), false))
+			proxy := httptest.NewServer(forward)
+			defer proxy.Close()
+
+			resp, err := proxyClient(proxy, nil).Get(upstream.URL + "/v1/items?page=2")
+			if !assert.NoError(t, err) {
+				return
+			}
+			body, _ := ioutil.ReadAll(resp.Body)
+			resp.Body.Close()
+			assert.Equal(t, tt.wantCode, resp.StatusCode)
+			if tt.wantBody != "" {
+				assert.Equal(t, tt.wantBody, string(body))
+			}
+		})
+	}
+}
+
+func TestForwardProxy_Connect(t *testing.T) {
+	upstream := httptest.NewTLSServer(http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		// The tunnel is end to end, so nothing is added to the request
+		_, _, ok := request.BasicAuth()
+		assert.False(t, ok)
+		writer.Write([]byte("tunnelled"))
+	}))
+	defer upstream.Close()
+	upstreamURL, _ := url.Parse(upstream.URL)
+	port, _ := strconv.Atoi(upstreamURL.Port())
+
+	tests := []struct {
+		name      string
+		rules     []string
+		ports     []int
+		wantError bool
+	}{
+		{name: "matching rule opens tunnel", rules: []string{upstreamURL.Hostname()}, ports: []int{port}},
+		{name: "port not allowed", rules: []string{upstreamURL.Hostname()}, wantError: true},
+		{name: "unknown host is denied", rules: []string{"api.vendor.com"}, ports: []int{port}, wantError: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			forward := NewForwardProxy(false, tt.ports, time.Second)
+			assert.NoError(t, forward.AddRule(tt.rules, auth.NewBasicAuth("vendor", "secret"), false))
+			proxy := httptest.NewServer(forward)
+			defer proxy.Close()
+
+			transport := upstream.Client().Transport.(*http.Transport).Clone()
+			resp, err := proxyClient(proxy, transport).Get(upstream.URL)
+			if tt.wantError {
+				// The client reports the proxy's refusal to open the tunnel as an error
+				assert.Error(t, err)
+				return
+			}
+			if !assert.NoError(t, err) {
+				return
+			}
+			body, _ := ioutil.ReadAll(resp.Body)
+			resp.Body.Close()
+			assert.Equal(t, "tunnelled", string(body))
+		})
+	}
+}
+
+// newInterceptCA writes a CA to dir, returning it along with a pool trusting it
+func newInterceptCA(t *testing.T, dir string) (*intercept.CA, *x509.CertPool) {
+	key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "peeper intercept CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}
+	der, _ := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	keyDer, _ := x509.MarshalECPrivateKey(key)
+	conf := &config.InterceptCAConfig{CertFile: filepath.Join(dir, "ca.pem"), KeyFile: filepath.Join(dir, "ca-key.pem")}
+	assert.NoError(t, os.WriteFile(conf.CertFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600))
+	assert.NoError(t, os.WriteFile(conf.KeyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer}), 0600))
+	ca, err := intercept.NewCA(conf)
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	cert, _ := x509.ParseCertificate(der)
+	pool := x509.NewCertPool()
+	pool.AddCert(cert)
+	return ca, pool
+}
+
+func TestForwardProxy_Intercept(t *testing.T) {
+	upstream := httptest.NewTLSServer(http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		username, _, _ := request.BasicAuth()
+		writer.Write([]byte(username + " " + request.URL.RequestURI()))
+	}))
+	defer upstream.Close()
+	upstreamURL, _ := url.Parse(upstream.URL)
+	port, _ := strconv.Atoi(upstreamURL.Port())
+	ca, roots := newInterceptCA(t, t.TempDir())
+
+	forward := NewForwardProxy(false, []int{port}, time.Second)
+	assert.Error(t, forward.AddRule([]string{upstreamURL.Hostname()}, nil, true), "intercepting needs a CA")
+	forward.SetInterceptCA(ca)
+	assert.NoError(t, forward.AddRule([]string{upstreamURL.Hostname()}, auth.NewBasicAuth("vendor", "secret"), true))
+	// The real upstream is verified against the test server's certificate
+	forward.client = upstream.Client()
+	proxy := httptest.NewServer(forward)
+	defer proxy.Close()
+
+	client := proxyClient(proxy, &http.Transport{TLSClientConfig: &tls.Config{RootCAs: roots}})
+	for _, path := range []string{"/v1/items", "/v1/items?page=2"} {
+		resp, err := client.Get(upstream.URL + path)
+		if !assert.NoError(t, err) {
+			return
+		}
+		body, _ := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		assert.Equal(t, http.StatusOK, resp.StatusCode)
+		assert.Equal(t, "vendor "+path, string(body))
+		assert.Equal(t, "peeper intercept CA", resp.TLS.PeerCertificates[0].Issuer.CommonName)
+	}
+
+	// Callers that don't trust the CA can't be intercepted
+	_, err := proxyClient(proxy, nil).Get(upstream.URL)
+	assert.Error(t, err)
+}
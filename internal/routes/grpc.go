@@ -0,0 +1,20 @@
+package routes
+
+import (
+	"net/http"
+	"net/url"
+	"strconv"
+)
+
+// gRPC status codes peeper answers with itself. See https://grpc.github.io/grpc/core/md_doc_statuscodes.html
+const grpcUnavailable = 14
+
+// writeGRPCError answers a gRPC call with status code and message in a trailers-only response, which gRPC clients
+// understand where they would only see an HTTP error otherwise
+func writeGRPCError(rw http.ResponseWriter, code int, message string) {
+	rw.Header().Set("Content-Type", "application/grpc")
+	rw.Header().Set("Grpc-Status", strconv.Itoa(code))
+	// grpc-message is percent-encoded
+	rw.Header().Set("Grpc-Message", url.PathEscape(message))
+	rw.WriteHeader(http.StatusOK)
+}
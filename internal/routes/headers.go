@@ -0,0 +1,126 @@
+package routes
+
+import (
+	"net"
+	"net/http"
+	"net/textproto"
+	"strings"
+)
+
+// hopHeaders only apply to a single connection, so are never forwarded in either direction. See RFC 7230 section
+// 6.1
+var hopHeaders = []string{
+	"Connection",
+	"Proxy-Connection",
+	"Keep-Alive",
+	"Proxy-Authenticate",
+	"Proxy-Authorization",
+	"Te",
+	"Trailer",
+	"Transfer-Encoding",
+	"Upgrade",
+}
+
+// removeHopHeaders removes hop-by-hop headers from h, including any named by its Connection header
+func removeHopHeaders(h http.Header) {
+	for _, value := range h.Values("Connection") {
+		for _, name := range strings.Split(value, ",") {
+			if name = textproto.TrimString(name); name != "" {
+				h.Del(name)
+			}
+		}
+	}
+	for _, name := range hopHeaders {
+		h.Del(name)
+	}
+}
+
+// headerHasToken reports whether the comma separated values of header name in h include token
+func headerHasToken(h http.Header, name, token string) bool {
+	for _, value := range h.Values(name) {
+		for _, t := range strings.Split(value, ",") {
+			// Parameters such as `;q=0.5` don't matter here
+			if i := strings.IndexByte(t, ';'); i >= 0 {
+				t = t[:i]
+			}
+			if strings.EqualFold(textproto.TrimString(t), token) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// copyHeaders adds every value of every header in src to dst
+func copyHeaders(dst, src http.Header) {
+	for name, values := range src {
+		for _, value := range values {
+			dst.Add(name, value)
+		}
+	}
+}
+
+// forwardedHeaders are set by proxies to describe the original request
+var forwardedHeaders = []string{"Forwarded", "X-Forwarded-For", "X-Forwarded-Host", "X-Forwarded-Proto"}
+
+// addForwardingHeaders describes req, as peeper received it, in the X-Forwarded-* and RFC 7239 Forwarded headers
+// of out. Headers set by earlier proxies are extended if req comes from a trusted proxy, and replaced otherwise so
+// that callers can't forge them
+func addForwardingHeaders(out http.Header, req *http.Request, trusted bool) {
+	if !trusted {
+		for _, name := range forwardedHeaders {
+			out.Del(name)
+		}
+	}
+	client, _, err := net.SplitHostPort(req.RemoteAddr)
+	if err != nil {
+		client = req.RemoteAddr
+	}
+	if net.ParseIP(client) == nil {
+		// Callers on a Unix socket have no address to give
+		client = "unknown"
+	}
+	proto := "http"
+	if req.TLS != nil {
+		proto = "https"
+	}
+
+	if prior := strings.Join(out.Values("X-Forwarded-For"), ", "); prior != "" {
+		out.Set("X-Forwarded-For", prior+", "+client)
+	} else {
+		out.Set("X-Forwarded-For", client)
+	}
+	if out.Get("X-Forwarded-Host") == "" {
+		out.Set("X-Forwarded-Host", req.Host)
+	}
+	if out.Get("X-Forwarded-Proto") == "" {
+		out.Set("X-Forwarded-Proto", proto)
+	}
+
+	node := client
+	if ip := net.ParseIP(client); ip != nil && ip.To4() == nil {
+		node = "[" + client + "]"
+	}
+	element := "for=" + forwardedValue(node) + ";host=" + forwardedValue(req.Host) + ";proto=" + proto
+	if prior := strings.Join(out.Values("Forwarded"), ", "); prior != "" {
+		element = prior + ", " + element
+	}
+	out.Set("Forwarded", element)
+}
+
+// forwardedValue returns value as a token if it can be one, and as a quoted string otherwise
+func forwardedValue(value string) string {
+	if value != "" && strings.IndexFunc(value, func(r rune) bool { return !isTokenChar(r) }) < 0 {
+		return value
+	}
+	escaped := strings.NewReplacer(`\`, `\\`, `"`, `\"`).Replace(value)
+	return `"` + escaped + `"`
+}
+
+// isTokenChar reports whether r can appear in an RFC 7230 token
+func isTokenChar(r rune) bool {
+	if r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' {
+		return true
+	}
+	return strings.ContainsRune("!#$%&'*+-.^_`|~", r)
+}
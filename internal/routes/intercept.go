@@ -0,0 +1,96 @@
+package routes
+
+import (
+	"context"
+	"crypto/tls"
+	"io"
+	"net"
+	"net/http"
+	"sync"
+
+	"github.com/sirupsen/logrus"
+)
+
+type bufferedConn struct {
+	net.Conn
+	reader io.Reader
+}
+
+func (b *bufferedConn) Read(p []byte) (int, error) {
+	return b.reader.Read(p)
+}
+
+// connListener is a listener that accepts a single connection, then blocks until it is closed
+type connListener struct {
+	conn   net.Conn
+	once   sync.Once
+	closed chan struct{}
+}
+
+func newConnListener(conn net.Conn) *connListener {
+	return &connListener{conn: conn, closed: make(chan struct{})}
+}
+
+func (l *connListener) Accept() (net.Conn, error) {
+	if conn := l.conn; conn != nil {
+		l.conn = nil
+		return conn, nil
+	}
+	<-l.closed
+	return nil, net.ErrClosed
+}
+
+func (l *connListener) Close() error {
+	l.once.Do(func() { close(l.closed) })
+	return nil
+}
+
+func (l *connListener) Addr() net.Addr {
+	return &net.TCPAddr{}
+}
+
+func (f *ForwardProxy) intercept(req *http.Request, conn net.Conn, rule *forwardRule) {
+	host, _, _ := net.SplitHostPort(req.Host)
+	cert, err := f.ca.Certificate(host)
+	if err != nil {
+		logrus.Errorf("can't intercept CONNECT %s: %v", req.Host, err)
+		return
+	}
+	tlsConn := tls.Server(conn, &tls.Config{
+		Certificates: []tls.Certificate{*cert},
+		NextProtos:   []string{"http/1.1"},
+	})
+	if err := tlsConn.HandshakeContext(req.Context()); err != nil {
+		logrus.Warnf("could not intercept CONNECT %s, the caller may not trust the intercept CA: %v", req.Host, err)
+		return
+	}
+	listener := newConnListener(tlsConn)
+	srv := &http.Server{
+		Handler: http.HandlerFunc(func(rw http.ResponseWriter, inner *http.Request) {
+			// Requests are always sent to the host the tunnel was opened to, whatever their Host header says
+			inner.URL.Scheme = "https"
+			inner.URL.Host = req.Host
+			f.forward(rw, inner, rule)
+		}),
+		IdleTimeout: f.idleTimeout,
+		ConnState: func(_ net.Conn, state http.ConnState) {
+			if state == http.StateClosed || state == http.StateHijacked {
+				listener.Close()
+			}
+		},
+		BaseContext: func(net.Listener) context.Context {
+			return req.Context()
+		},
+	}
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-req.Context().Done():
+			srv.Close()
+		case <-done:
+		}
+	}()
+	logrus.Debugf("intercepting CONNECT %s", req.Host)
+	srv.Serve(listener)
+}
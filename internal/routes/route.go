@@ -1,21 +1,47 @@
 package routes
 
 import (
+	"errors"
 	"fmt"
+	"github.com/sirupsen/logrus"
 	"github.com/threetoes/peeper/internal/auth"
+	"github.com/threetoes/peeper/internal/inbound"
+	"github.com/threetoes/peeper/internal/logging"
+	"github.com/threetoes/peeper/internal/tenant"
 	"io/ioutil"
 	"net/http"
+	"strings"
+	"time"
 )
 
 type Router struct {
-	methodHandlers map[string]func(w http.ResponseWriter, request *http.Request)
-	credentials    map[string]auth.CredentialInjector
+	methodHandlers    map[string]func(w http.ResponseWriter, request *http.Request)
+	credentials       map[string]auth.CredentialInjector
+	tenantResolvers   map[string]tenant.Resolver
+	tenantCredentials map[string]map[string]auth.CredentialInjector
+	assertions        map[string]auth.CredentialInjector
+	middleware        map[string][]inbound.Middleware
+	// protocols are the upstream protocols of methods not using the default
+	protocols map[string]string
+	// sockets are the Unix sockets of methods whose upstream is reached through one
+	sockets map[string]string
+	// grpc holds the methods that proxy gRPC calls
+	grpc map[string]bool
+	// idleTimeouts are how long upgraded connections, such as WebSockets, can be idle before they are closed
+	idleTimeouts map[string]time.Duration
+	// clientIPs decides whether forwarding headers from the caller can be trusted
+	clientIPs *inbound.ClientIPResolver
 }
 
 func (r *Router) ServeHTTP(writer http.ResponseWriter, request *http.Request) {
 	defer request.Body.Close()
 	if handlerFunc, ok := r.methodHandlers[request.Method]; ok {
-		handlerFunc(writer, request)
+		var handler http.Handler = http.HandlerFunc(handlerFunc)
+		middleware := r.middleware[request.Method]
+		for i := len(middleware) - 1; i >= 0; i-- {
+			handler = middleware[i](handler)
+		}
+		handler.ServeHTTP(writer, request)
 	} else {
 		writer.WriteHeader(http.StatusNotFound)
 	}
@@ -25,40 +51,152 @@ func (r *Router) RegisterRoute(localMethod, remotePath, remoteMethod string) err
 	if _, ok := r.methodHandlers[localMethod]; ok {
 		return fmt.Errorf("could not register another handler for method '%s'", localMethod)
 	}
+	remotePath = upstreamURL(remotePath)
+	if strings.HasPrefix(remotePath, unixScheme) {
+		socket, urlPath, err := splitUnixURL(remotePath)
+		if err != nil {
+			return err
+		}
+		r.sockets[localMethod] = socket
+		remotePath = "http://" + unixHost + urlPath
+	}
 	r.methodHandlers[localMethod] = func(rw http.ResponseWriter, req *http.Request) {
-		forwardedReq, err := http.NewRequest(remoteMethod, remotePath, req.Body)
-		for headerKeys, headerVals := range req.Header {
-			for _, val := range headerVals {
-				forwardedReq.Header.Set(headerKeys, val)
-			}
+		credentials, t, err := r.selectCredentials(localMethod, req)
+		if err != nil {
+			logrus.Warnf("rejecting %s %s: %v", req.Method, req.URL.Path, err)
+			rw.WriteHeader(http.StatusForbidden)
+			return
+		}
+		if t != "" {
+			req = req.WithContext(tenant.WithTenant(req.Context(), t))
 		}
+		// The forwarded request shares the inbound request's context, so it is cancelled if the caller goes away
+		// and injectors can see what earlier middleware stored in it
+		target := remotePath
+		if r.grpc[localMethod] {
+			// gRPC calls are routed by their /package.Service/Method path, so it is kept
+			target = strings.TrimSuffix(remotePath, "/") + req.URL.Path
+		}
+		// The inbound body is closed by the server once the handler returns, which ends any read the upstream
+		// transport is still making. The transport closing it as well would race with that for HTTP/2 callers
+		forwardedReq, err := http.NewRequestWithContext(req.Context(), remoteMethod, target, ioutil.NopCloser(req.Body))
 		if err != nil {
 			rw.WriteHeader(http.StatusInternalServerError)
 			return
 		}
-		if credentials, ok := r.credentials[localMethod]; ok {
-			err = credentials.InjectCredentials(forwardedReq)
+		// The body is streamed, keeping its length if the caller gave one. The server always gives a non-nil body,
+		// which would otherwise be sent chunked
+		forwardedReq.ContentLength = req.ContentLength
+		if req.ContentLength == 0 {
+			forwardedReq.Body = http.NoBody
+		}
+		copyHeaders(forwardedReq.Header, req.Header)
+		removeHopHeaders(forwardedReq.Header)
+		// An upgrade is asked for with hop-by-hop headers, but is passed on so the upstream can agree to it
+		upgrade := upgradeType(req.Header)
+		if upgrade != "" {
+			forwardedReq.Header.Set("Connection", "Upgrade")
+			forwardedReq.Header.Set("Upgrade", upgrade)
+		}
+		if headerHasToken(req.Header, "Te", "trailers") {
+			forwardedReq.Header.Set("Te", "trailers")
+		}
+		addForwardingHeaders(forwardedReq.Header, req, r.clientIPs != nil && r.clientIPs.FromTrustedProxy(req))
+		if credentials != nil {
+			if err := credentials.InjectCredentials(forwardedReq); err != nil {
+				logrus.Errorf("could not inject credentials for %s %s: %v", req.Method, req.URL.Path, err)
+				rw.WriteHeader(http.StatusBadGateway)
+				return
+			}
+		}
+		if assertion, ok := r.assertions[localMethod]; ok {
+			if err := assertion.InjectCredentials(forwardedReq); err != nil {
+				logrus.Errorf("could not assert identity for %s %s: %v", req.Method, req.URL.Path, err)
+				rw.WriteHeader(http.StatusInternalServerError)
+				return
+			}
 		}
 
-		client := http.DefaultClient
+		logrus.WithField("headers", logging.RedactHeaders(forwardedReq.Header)).Debugf("forwarding %s request to %s", remoteMethod, target)
 
-		resp, err := client.Do(forwardedReq)
+		resp, err := r.client(localMethod).Do(forwardedReq)
 		if err != nil {
+			if req.Context().Err() != nil {
+				logrus.Debugf("caller went away during %s %s", req.Method, req.URL.Path)
+				return
+			}
+			if r.grpc[localMethod] {
+				logrus.Warnf("could not reach the upstream for %s: %v", req.URL.Path, err)
+				writeGRPCError(rw, grpcUnavailable, "upstream is unavailable")
+				return
+			}
 			rw.WriteHeader(http.StatusInternalServerError)
 			return
 		}
 		defer resp.Body.Close()
-		body, err := ioutil.ReadAll(resp.Body)
-		if err != nil {
-			rw.WriteHeader(http.StatusInternalServerError)
+		if resp.StatusCode == http.StatusSwitchingProtocols && upgrade != "" {
+			idleTimeout, ok := r.idleTimeouts[localMethod]
+			if !ok {
+				idleTimeout = defaultUpgradeIdleTimeout
+			}
+			switchProtocols(req.Context(), rw, req, resp, idleTimeout)
 			return
 		}
+		removeHopHeaders(resp.Header)
+		copyHeaders(rw.Header(), resp.Header)
+		// Trailers the upstream announced are announced to the caller too. Any others are still sent, using
+		// http.TrailerPrefix
+		announced := len(resp.Trailer)
+		if announced > 0 {
+			names := make([]string, 0, announced)
+			for name := range resp.Trailer {
+				names = append(names, name)
+			}
+			rw.Header().Set("Trailer", strings.Join(names, ", "))
+		}
 		rw.WriteHeader(resp.StatusCode)
-		_, err = rw.Write(body)
+		if err := copyBody(rw, resp.Body, shouldFlush(resp)); err != nil {
+			var writeErr *writeError
+			if errors.As(err, &writeErr) || req.Context().Err() != nil {
+				logrus.Debugf("caller went away during %s %s", req.Method, req.URL.Path)
+				return
+			}
+			// The status has been sent, so the only way to tell the caller the body is incomplete is to abort the
+			// response
+			logrus.Warnf("could not forward the response body of %s %s: %v", req.Method, req.URL.Path, err)
+			panic(http.ErrAbortHandler)
+		}
+		if len(resp.Trailer) == announced {
+			copyHeaders(rw.Header(), resp.Trailer)
+			return
+		}
+		for name, values := range resp.Trailer {
+			for _, value := range values {
+				rw.Header().Add(http.TrailerPrefix+name, value)
+			}
+		}
 	}
 	return nil
 }
 
+// selectCredentials picks the injector for a request, and the calling tenant if any. Methods with tenants
+// configured use the calling tenant's credentials, and requests from unknown tenants are rejected
+func (r *Router) selectCredentials(method string, req *http.Request) (auth.CredentialInjector, string, error) {
+	resolver, ok := r.tenantResolvers[method]
+	if !ok {
+		return r.credentials[method], "", nil
+	}
+	t, err := resolver.Tenant(req)
+	if err != nil {
+		return nil, "", err
+	}
+	credentials, ok := r.tenantCredentials[method][t]
+	if !ok {
+		return nil, "", fmt.Errorf("unknown tenant '%s'", t)
+	}
+	return credentials, t, nil
+}
+
 func (r *Router) RegisterCredentials(method string, injector auth.CredentialInjector) error {
 	if _, ok := r.credentials[method]; ok {
 		return fmt.Errorf("method %s already has a credential injector", method)
@@ -67,9 +205,91 @@ func (r *Router) RegisterCredentials(method string, injector auth.CredentialInje
 	return nil
 }
 
+// RegisterTenantResolver makes requests for method use the credentials of the tenant found by resolver
+func (r *Router) RegisterTenantResolver(method string, resolver tenant.Resolver) error {
+	if _, ok := r.tenantResolvers[method]; ok {
+		return fmt.Errorf("method %s already has a tenant resolver", method)
+	}
+	r.tenantResolvers[method] = resolver
+	return nil
+}
+
+// RegisterTenantCredentials registers the credentials injected for tenant's requests to method
+func (r *Router) RegisterTenantCredentials(method, tenant string, injector auth.CredentialInjector) error {
+	if _, ok := r.tenantCredentials[method][tenant]; ok {
+		return fmt.Errorf("tenant %s already has a credential injector for method %s", tenant, method)
+	}
+	if _, ok := r.tenantCredentials[method]; !ok {
+		r.tenantCredentials[method] = map[string]auth.CredentialInjector{}
+	}
+	r.tenantCredentials[method][tenant] = injector
+	return nil
+}
+
+// RegisterIdentityAssertion makes requests for method carry an assertion of the caller's identity, added after
+// any credentials
+func (r *Router) RegisterIdentityAssertion(method string, injector auth.CredentialInjector) error {
+	if _, ok := r.assertions[method]; ok {
+		return fmt.Errorf("method %s already has an identity assertion", method)
+	}
+	r.assertions[method] = injector
+	return nil
+}
+
+// SetClientIPResolver sets the resolver deciding which callers are proxies whose forwarding headers are kept
+func (r *Router) SetClientIPResolver(resolver *inbound.ClientIPResolver) {
+	r.clientIPs = resolver
+}
+
+// SetUpstreamProtocol sets the protocol requests to method are forwarded with, one of the Protocol constants
+func (r *Router) SetUpstreamProtocol(method, protocol string) error {
+	if _, ok := upstreamClients[protocol]; !ok {
+		return fmt.Errorf("unknown upstream protocol '%s'", protocol)
+	}
+	r.protocols[method] = protocol
+	return nil
+}
+
+// client returns the client requests to method are forwarded with
+func (r *Router) client(method string) *http.Client {
+	protocol, ok := r.protocols[method]
+	if !ok {
+		protocol = ProtocolAuto
+	}
+	if socket, ok := r.sockets[method]; ok {
+		return unixClient(socket, protocol)
+	}
+	return upstreamClients[protocol]
+}
+
+// SetGRPC makes method proxy gRPC calls, which are forwarded to the call's path under the remote path
+func (r *Router) SetGRPC(method string) {
+	r.grpc[method] = true
+}
+
+// SetUpgradeIdleTimeout sets how long upgraded connections to method, such as WebSockets, can be idle before they
+// are closed
+func (r *Router) SetUpgradeIdleTimeout(method string, timeout time.Duration) {
+	r.idleTimeouts[method] = timeout
+}
+
+// RegisterMiddleware adds middleware that requests for method pass through, in the order registered, before they
+// are forwarded
+func (r *Router) RegisterMiddleware(method string, middleware inbound.Middleware) {
+	r.middleware[method] = append(r.middleware[method], middleware)
+}
+
 func NewRouter() *Router {
 	return &Router{
-		methodHandlers: map[string]func(w http.ResponseWriter, request *http.Request){},
-		credentials:    map[string]auth.CredentialInjector{},
+		methodHandlers:    map[string]func(w http.ResponseWriter, request *http.Request){},
+		credentials:       map[string]auth.CredentialInjector{},
+		tenantResolvers:   map[string]tenant.Resolver{},
+		tenantCredentials: map[string]map[string]auth.CredentialInjector{},
+		assertions:        map[string]auth.CredentialInjector{},
+		protocols:         map[string]string{},
+		sockets:           map[string]string{},
+		grpc:              map[string]bool{},
+		idleTimeouts:      map[string]time.Duration{},
+		middleware:        map[string][]inbound.Middleware{},
 	}
 }
@@ -1,17 +1,32 @@
 package routes
 
 import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/base64"
 	"fmt"
+	"github.com/sirupsen/logrus"
 	"github.com/threetoes/peeper/internal/auth"
+	"github.com/threetoes/peeper/internal/inbound"
+	"github.com/threetoes/peeper/internal/tenant"
+	"io"
 	"io/ioutil"
 	"net"
 	"net/http"
 	"net/http/httptest"
+	"os"
+	"path/filepath"
 	"reflect"
 	"strings"
+	"sync"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
 )
 
 func TestNewRouter(t *testing.T) {
@@ -22,8 +37,16 @@ func TestNewRouter(t *testing.T) {
 		{
 			name: "create new",
 			want: &Router{
-				methodHandlers: map[string]func(w http.ResponseWriter, request *http.Request){},
-				credentials:    map[string]auth.CredentialInjector{},
+				methodHandlers:    map[string]func(w http.ResponseWriter, request *http.Request){},
+				credentials:       map[string]auth.CredentialInjector{},
+				tenantResolvers:   map[string]tenant.Resolver{},
+				tenantCredentials: map[string]map[string]auth.CredentialInjector{},
+				assertions:        map[string]auth.CredentialInjector{},
+				protocols:         map[string]string{},
+				sockets:           map[string]string{},
+				grpc:              map[string]bool{},
+				idleTimeouts:      map[string]time.Duration{},
+				middleware:        map[string][]inbound.Middleware{},
 			},
 		},
 	}
@@ -270,3 +293,676 @@ func TestRegisteredRoutes(t *testing.T) {
 	body, _ := ioutil.ReadAll(rw.Body)
 	assert.Equal(t, "test success", string(body))
 }
+
+func TestRegisteredRoutes_DebugLogRedactsCredentials(t *testing.T) {
+	var buf bytes.Buffer
+	logrus.SetOutput(&buf)
+	logrus.SetLevel(logrus.DebugLevel)
+	defer func() {
+		logrus.SetOutput(os.Stderr)
+		logrus.SetLevel(logrus.InfoLevel)
+	}()
+
+	testSvc := httptest.NewServer(http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		writer.WriteHeader(http.StatusOK)
+	}))
+	defer testSvc.Close()
+
+	route := NewRouter()
+	assert.NoError(t, route.RegisterRoute(http.MethodGet, testSvc.URL, http.MethodGet))
+	assert.NoError(t, route.RegisterCredentials(http.MethodGet, auth.NewBasicAuth("username", "sn@ke3ateR")))
+	rw := httptest.NewRecorder()
+	route.ServeHTTP(rw, httptest.NewRequest(http.MethodGet, "/test", nil))
+	assert.Equal(t, http.StatusOK, rw.Code)
+
+	assert.Contains(t, buf.String(), "forwarding GET request")
+	assert.NotContains(t, buf.String(), base64.StdEncoding.EncodeToString([]byte("username:sn@ke3ateR")))
+}
+
+func TestRegisteredRoutes_TenantCredentials(t *testing.T) {
+	testSvc := httptest.NewServer(http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		writer.Write([]byte(request.Header.Get("x-api-key")))
+	}))
+	defer testSvc.Close()
+
+	route := NewRouter()
+	assert.NoError(t, route.RegisterRoute(http.MethodGet, testSvc.URL, http.MethodGet))
+	assert.NoError(t, route.RegisterTenantResolver(http.MethodGet, tenant.NewHeaderResolver("X-Tenant")))
+	assert.NoError(t, route.RegisterTenantCredentials(http.MethodGet, "acme", auth.NewStaticKeyInjector(map[string]string{"x-api-key": "acme key"})))
+	assert.NoError(t, route.RegisterTenantCredentials(http.MethodGet, "globex", auth.NewStaticKeyInjector(map[string]string{"x-api-key": "globex key"})))
+	assert.Error(t, route.RegisterTenantCredentials(http.MethodGet, "acme", &auth.BasicAuth{}))
+
+	tests := []struct {
+		name     string
+		tenant   string
+		wantCode int
+		wantBody string
+	}{
+		{name: "acme", tenant: "acme", wantCode: http.StatusOK, wantBody: "acme key"},
+		{name: "globex", tenant: "globex", wantCode: http.StatusOK, wantBody: "globex key"},
+		{name: "unknown tenant", tenant: "initech", wantCode: http.StatusForbidden},
+		{name: "no tenant", wantCode: http.StatusForbidden},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, "/test", nil)
+			if tt.tenant != "" {
+				req.Header.Set("X-Tenant", tt.tenant)
+			}
+			rw := httptest.NewRecorder()
+			route.ServeHTTP(rw, req)
+			assert.Equal(t, tt.wantCode, rw.Code)
+			if tt.wantBody != "" {
+				assert.Equal(t, tt.wantBody, rw.Body.String())
+			}
+		})
+	}
+}
+
+// tenantAsserter asserts the tenant a request was found to belong to
+type tenantAsserter struct{}
+
+func (tenantAsserter) InjectCredentials(req *http.Request) error {
+	req.Header.Set("X-Asserted-Tenant", tenant.From(req.Context()))
+	return nil
+}
+
+func TestRegisteredRoutes_IdentityAssertion(t *testing.T) {
+	testSvc := httptest.NewServer(http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		writer.Write([]byte(request.Header.Get("X-Asserted-Tenant")))
+	}))
+	defer testSvc.Close()
+
+	route := NewRouter()
+	assert.NoError(t, route.RegisterRoute(http.MethodGet, testSvc.URL, http.MethodGet))
+	assert.NoError(t, route.RegisterTenantResolver(http.MethodGet, tenant.NewHeaderResolver("X-Tenant")))
+	assert.NoError(t, route.RegisterTenantCredentials(http.MethodGet, "acme", auth.NewStaticKeyInjector(map[string]string{"x-api-key": "acme key"})))
+	assert.NoError(t, route.RegisterIdentityAssertion(http.MethodGet, tenantAsserter{}))
+	assert.Error(t, route.RegisterIdentityAssertion(http.MethodGet, tenantAsserter{}))
+
+	req := httptest.NewRequest(http.MethodGet, "/test", nil)
+	req.Header.Set("X-Tenant", "acme")
+	req.Header.Set("X-Asserted-Tenant", "globex")
+	rw := httptest.NewRecorder()
+	route.ServeHTTP(rw, req)
+	assert.Equal(t, http.StatusOK, rw.Code)
+	assert.Equal(t, "acme", rw.Body.String())
+}
+
+func TestRegisteredRoutes_RequestHeaders(t *testing.T) {
+	var received http.Header
+	testSvc := httptest.NewServer(http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		received = request.Header.Clone()
+	}))
+	defer testSvc.Close()
+	proxies, err := inbound.NewClientIPResolver([]string{"10.0.0.0/8"})
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+
+	tests := []struct {
+		name       string
+		remoteAddr string
+		tls        bool
+		headers    http.Header
+		want       http.Header
+		wantAbsent []string
+	}{
+		{
+			name:    "multi-valued headers",
+			headers: http.Header{"Accept": {"text/html", "application/json"}, "Cookie": {"a=1", "b=2"}},
+			want:    http.Header{"Accept": {"text/html", "application/json"}, "Cookie": {"a=1", "b=2"}},
+		},
+		{
+			name: "hop-by-hop headers",
+			headers: http.Header{
+				"Connection":          {"keep-alive, X-Hop"},
+				"X-Hop":               {"1"},
+				"Keep-Alive":          {"timeout=5"},
+				"Upgrade":             {"h2c"},
+				"Proxy-Authorization": {"Basic cHJveHk6cHJveHk="},
+				"Te":                  {"gzip"},
+				"X-End-To-End":        {"kept"},
+			},
+			want:       http.Header{"X-End-To-End": {"kept"}},
+			wantAbsent: []string{"Connection", "X-Hop", "Keep-Alive", "Upgrade", "Proxy-Authorization", "Te"},
+		},
+		{
+			name:    "te trailers",
+			headers: http.Header{"Te": {"trailers, deflate;q=0.5"}},
+			want:    http.Header{"Te": {"trailers"}},
+		},
+		{
+			name: "forwarding headers",
+			want: http.Header{
+				"X-Forwarded-For":   {"192.0.2.1"},
+				"X-Forwarded-Host":  {"peeper.internal"},
+				"X-Forwarded-Proto": {"http"},
+				"Forwarded":         {"for=192.0.2.1;host=peeper.internal;proto=http"},
+			},
+		},
+		{
+			name:       "ipv6 over tls",
+			remoteAddr: "[2001:db8::1]:4711",
+			tls:        true,
+			want: http.Header{
+				"X-Forwarded-For":   {"2001:db8::1"},
+				"X-Forwarded-Proto": {"https"},
+				"Forwarded":         {`for="[2001:db8::1]";host=peeper.internal;proto=https`},
+			},
+		},
+		{
+			name: "forged by caller",
+			headers: http.Header{
+				"X-Forwarded-For":   {"203.0.113.7"},
+				"X-Forwarded-Host":  {"evil.example"},
+				"X-Forwarded-Proto": {"https"},
+				"Forwarded":         {"for=203.0.113.7"},
+			},
+			want: http.Header{
+				"X-Forwarded-For":   {"192.0.2.1"},
+				"X-Forwarded-Host":  {"peeper.internal"},
+				"X-Forwarded-Proto": {"http"},
+				"Forwarded":         {"for=192.0.2.1;host=peeper.internal;proto=http"},
+			},
+		},
+		{
+			name:       "from trusted proxy",
+			remoteAddr: "10.1.2.3:4711",
+			headers: http.Header{
+				"X-Forwarded-For":   {"203.0.113.7"},
+				"X-Forwarded-Host":  {"api.example.com"},
+				"X-Forwarded-Proto": {"https"},
+				"Forwarded":         {"for=203.0.113.7;host=api.example.com;proto=https"},
+			},
+			want: http.Header{
+				"X-Forwarded-For":   {"203.0.113.7, 10.1.2.3"},
+				"X-Forwarded-Host":  {"api.example.com"},
+				"X-Forwarded-Proto": {"https"},
+				"Forwarded":         {"for=203.0.113.7;host=api.example.com;proto=https, for=10.1.2.3;host=peeper.internal;proto=http"},
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			route := NewRouter()
+			route.SetClientIPResolver(proxies)
+			assert.NoError(t, route.RegisterRoute(http.MethodGet, testSvc.URL, http.MethodGet))
+			req := httptest.NewRequest(http.MethodGet, "http://peeper.internal/test", nil)
+			if tt.remoteAddr != "" {
+				req.RemoteAddr = tt.remoteAddr
+			}
+			if tt.tls {
+				req.TLS = &tls.ConnectionState{}
+			}
+			for name, values := range tt.headers {
+				req.Header[name] = values
+			}
+			received = nil
+			rw := httptest.NewRecorder()
+			route.ServeHTTP(rw, req)
+			assert.Equal(t, http.StatusOK, rw.Code)
+			for name, values := range tt.want {
+				assert.Equal(t, values, received[name], name)
+			}
+			for _, name := range tt.wantAbsent {
+				assert.NotContains(t, received, name)
+			}
+		})
+	}
+}
+
+func TestRegisteredRoutes_ResponseHeaders(t *testing.T) {
+	tests := []struct {
+		name        string
+		handler     http.HandlerFunc
+		wantCode    int
+		want        http.Header
+		wantAbsent  []string
+		wantTrailer http.Header
+	}{
+		{
+			name: "multi-valued headers",
+			handler: func(rw http.ResponseWriter, req *http.Request) {
+				rw.Header().Set("Content-Type", "application/json")
+				rw.Header().Set("ETag", `"v1"`)
+				rw.Header().Add("Set-Cookie", "a=1")
+				rw.Header().Add("Set-Cookie", "b=2")
+				rw.Write([]byte("{}"))
+			},
+			wantCode: http.StatusOK,
+			want: http.Header{
+				"Content-Type": {"application/json"},
+				"Etag":         {`"v1"`},
+				"Set-Cookie":   {"a=1", "b=2"},
+			},
+		},
+		{
+			name: "redirects are passed back",
+			handler: func(rw http.ResponseWriter, req *http.Request) {
+				http.Redirect(rw, req, "/elsewhere", http.StatusFound)
+			},
+			wantCode: http.StatusFound,
+			want:     http.Header{"Location": {"/elsewhere"}},
+		},
+		{
+			name: "hop-by-hop headers",
+			handler: func(rw http.ResponseWriter, req *http.Request) {
+				rw.Header().Set("Connection", "X-Hop")
+				rw.Header().Set("X-Hop", "1")
+				rw.Header().Set("Proxy-Authenticate", "Basic")
+				rw.Header().Set("X-End-To-End", "kept")
+			},
+			wantCode:   http.StatusOK,
+			want:       http.Header{"X-End-To-End": {"kept"}},
+			wantAbsent: []string{"Connection", "X-Hop", "Proxy-Authenticate"},
+		},
+		{
+			name: "trailers",
+			handler: func(rw http.ResponseWriter, req *http.Request) {
+				rw.Header().Set("Trailer", "X-Checksum")
+				rw.Write([]byte("body"))
+				rw.Header().Set("X-Checksum", "abc")
+				rw.Header().Set(http.TrailerPrefix+"X-Unannounced", "def")
+			},
+			wantCode:    http.StatusOK,
+			wantTrailer: http.Header{"X-Checksum": {"abc"}, "X-Unannounced": {"def"}},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			testSvc := httptest.NewServer(tt.handler)
+			defer testSvc.Close()
+			route := NewRouter()
+			assert.NoError(t, route.RegisterRoute(http.MethodGet, testSvc.URL, http.MethodGet))
+			rw := httptest.NewRecorder()
+			route.ServeHTTP(rw, httptest.NewRequest(http.MethodGet, "/test", nil))
+			resp := rw.Result()
+			assert.Equal(t, tt.wantCode, resp.StatusCode)
+			for name, values := range tt.want {
+				assert.Equal(t, values, resp.Header[name], name)
+			}
+			for _, name := range tt.wantAbsent {
+				assert.NotContains(t, resp.Header, name)
+			}
+			for name, values := range tt.wantTrailer {
+				assert.Equal(t, values, resp.Trailer[name], name)
+			}
+		})
+	}
+}
+
+func TestRegisteredRoutes_StreamsEvents(t *testing.T) {
+	release := make(chan struct{})
+	testSvc := httptest.NewServer(http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		writer.Header().Set("Content-Type", "text/event-stream")
+		writer.Write([]byte("data: first\n\n"))
+		writer.(http.Flusher).Flush()
+		<-release
+		writer.Write([]byte("data: second\n\n"))
+	}))
+	defer testSvc.Close()
+	defer close(release)
+
+	route := NewRouter()
+	assert.NoError(t, route.RegisterRoute(http.MethodGet, testSvc.URL, http.MethodGet))
+	proxy := httptest.NewServer(route)
+	defer proxy.Close()
+
+	resp, err := http.Get(proxy.URL)
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	defer resp.Body.Close()
+	assert.Equal(t, "text/event-stream", resp.Header.Get("Content-Type"))
+	first := make([]byte, len("data: first\n\n"))
+	done := make(chan error, 1)
+	go func() {
+		_, err := io.ReadFull(resp.Body, first)
+		done <- err
+	}()
+	select {
+	case err := <-done:
+		assert.NoError(t, err)
+		assert.Equal(t, "data: first\n\n", string(first))
+	case <-time.After(5 * time.Second):
+		t.Fatal("the first event wasn't flushed to the caller")
+	}
+}
+
+func TestRegisteredRoutes_Bodies(t *testing.T) {
+	content := strings.Repeat("0123456789", 10000)
+	testSvc := httptest.NewServer(http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		switch request.URL.Path {
+		case "/file":
+			http.ServeContent(writer, request, "file.txt", time.Unix(0, 0), strings.NewReader(content))
+		case "/upload":
+			if request.Header.Get("X-Reject") != "" {
+				writer.WriteHeader(http.StatusUnauthorized)
+				return
+			}
+			body, _ := ioutil.ReadAll(request.Body)
+			fmt.Fprintf(writer, "%d %v %d", request.ContentLength, request.TransferEncoding, len(body))
+		}
+	}))
+	defer testSvc.Close()
+
+	route := NewRouter()
+	assert.NoError(t, route.RegisterRoute(http.MethodGet, testSvc.URL+"/file", http.MethodGet))
+	assert.NoError(t, route.RegisterRoute(http.MethodPost, testSvc.URL+"/upload", http.MethodPost))
+	proxy := httptest.NewServer(route)
+	defer proxy.Close()
+	client := &http.Client{Transport: &http.Transport{ExpectContinueTimeout: 5 * time.Second}}
+
+	tests := []struct {
+		name         string
+		method       string
+		headers      http.Header
+		body         string
+		wantCode     int
+		wantBody     string
+		wantHeaders  http.Header
+		wantBodyRead bool
+	}{
+		{name: "whole download", method: http.MethodGet, wantCode: http.StatusOK, wantBody: content},
+		{
+			name:        "range",
+			method:      http.MethodGet,
+			headers:     http.Header{"Range": {"bytes=10-14"}},
+			wantCode:    http.StatusPartialContent,
+			wantBody:    "01234",
+			wantHeaders: http.Header{"Content-Range": {fmt.Sprintf("bytes 10-14/%d", len(content))}},
+		},
+		{name: "upload keeps its length", method: http.MethodPost, body: content, wantCode: http.StatusOK, wantBody: "100000 [] 100000", wantBodyRead: true},
+		{
+			name:         "expect continue",
+			method:       http.MethodPost,
+			headers:      http.Header{"Expect": {"100-continue"}},
+			body:         content,
+			wantCode:     http.StatusOK,
+			wantBody:     "100000 [] 100000",
+			wantBodyRead: true,
+		},
+		{
+			name:     "expect continue rejected",
+			method:   http.MethodPost,
+			headers:  http.Header{"Expect": {"100-continue"}, "X-Reject": {"true"}},
+			body:     content,
+			wantCode: http.StatusUnauthorized,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var body *trackingReader
+			var req *http.Request
+			if tt.body != "" {
+				body = &trackingReader{Reader: strings.NewReader(tt.body)}
+				req, _ = http.NewRequest(tt.method, proxy.URL, body)
+				req.ContentLength = int64(len(tt.body))
+			} else {
+				req, _ = http.NewRequest(tt.method, proxy.URL, nil)
+			}
+			for name, values := range tt.headers {
+				req.Header[name] = values
+			}
+			resp, err := client.Do(req)
+			if !assert.NoError(t, err) {
+				return
+			}
+			defer resp.Body.Close()
+			got, _ := ioutil.ReadAll(resp.Body)
+			assert.Equal(t, tt.wantCode, resp.StatusCode)
+			assert.Equal(t, tt.wantBody, string(got))
+			for name, values := range tt.wantHeaders {
+				assert.Equal(t, values, resp.Header[name], name)
+			}
+			if body != nil {
+				assert.Equal(t, tt.wantBodyRead, body.wasRead(), "the body is only sent once the upstream wants it")
+			}
+		})
+	}
+}
+
+// trackingReader records whether it has been read from
+type trackingReader struct {
+	io.Reader
+	lock sync.Mutex
+	read bool
+}
+
+func (r *trackingReader) Read(p []byte) (int, error) {
+	r.lock.Lock()
+	r.read = true
+	r.lock.Unlock()
+	return r.Reader.Read(p)
+}
+
+func (r *trackingReader) wasRead() bool {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	return r.read
+}
+
+func TestRegisteredRoutes_CallerDisconnects(t *testing.T) {
+	started := make(chan struct{})
+	cancelled := make(chan struct{})
+	testSvc := httptest.NewServer(http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		close(started)
+		select {
+		case <-request.Context().Done():
+			close(cancelled)
+		case <-time.After(10 * time.Second):
+		}
+	}))
+	defer testSvc.Close()
+
+	route := NewRouter()
+	assert.NoError(t, route.RegisterRoute(http.MethodGet, testSvc.URL, http.MethodGet))
+	proxy := httptest.NewServer(route)
+	defer proxy.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	req, _ := http.NewRequestWithContext(ctx, http.MethodGet, proxy.URL, nil)
+	go func() {
+		<-started
+		cancel()
+	}()
+	_, err := http.DefaultClient.Do(req)
+	assert.Error(t, err)
+	select {
+	case <-cancelled:
+	case <-time.After(5 * time.Second):
+		t.Fatal("the upstream request wasn't cancelled")
+	}
+}
+
+// echoUpgrader switches callers with the right key to an `echo` protocol, sending back whatever they send
+func echoUpgrader(t *testing.T) http.HandlerFunc {
+	return func(writer http.ResponseWriter, request *http.Request) {
+		if request.Header.Get("x-api-key") != "vendor key" {
+			writer.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		if upgradeType(request.Header) != "echo" {
+			writer.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		conn, buffered, err := writer.(http.Hijacker).Hijack()
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		defer conn.Close()
+		buffered.WriteString("HTTP/1.1 101 Switching Protocols\r\nConnection: Upgrade\r\nUpgrade: echo\r\nX-Vendor: hello\r\n\r\n")
+		buffered.Flush()
+		line, err := buffered.ReadString('\n')
+		for err == nil && line != "bye\n" {
+			conn.Write([]byte(line))
+			line, err = buffered.ReadString('\n')
+		}
+	}
+}
+
+// dialUpgrade makes an upgrade request to `echo` through proxy, returning the connection and the response
+func dialUpgrade(t *testing.T, proxy *httptest.Server) (net.Conn, *bufio.Reader, *http.Response) {
+	t.Helper()
+	conn, err := net.Dial("tcp", proxy.Listener.Addr().String())
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	t.Cleanup(func() { conn.Close() })
+	conn.Write([]byte("GET /stream HTTP/1.1\r\nHost: peeper.internal\r\nConnection: Upgrade\r\nUpgrade: echo\r\n\r\n"))
+	reader := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(reader, nil)
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	return conn, reader, resp
+}
+
+func TestRegisteredRoutes_Upgrade(t *testing.T) {
+	testSvc := httptest.NewServer(echoUpgrader(t))
+	defer testSvc.Close()
+
+	newProxy := func(key string, idleTimeout time.Duration) *httptest.Server {
+		route := NewRouter()
+		// WebSocket URLs are accepted as the remote path
+		assert.NoError(t, route.RegisterRoute(http.MethodGet, strings.Replace(testSvc.URL, "http://", "ws://", 1), http.MethodGet))
+		assert.NoError(t, route.RegisterCredentials(http.MethodGet, auth.NewStaticKeyInjector(map[string]string{"x-api-key": key})))
+		if idleTimeout > 0 {
+			route.SetUpgradeIdleTimeout(http.MethodGet, idleTimeout)
+		}
+		proxy := httptest.NewServer(route)
+		t.Cleanup(proxy.Close)
+		return proxy
+	}
+
+	t.Run("relays both ways", func(t *testing.T) {
+		conn, reader, resp := dialUpgrade(t, newProxy("vendor key", 0))
+		assert.Equal(t, http.StatusSwitchingProtocols, resp.StatusCode)
+		assert.Equal(t, "echo", resp.Header.Get("Upgrade"))
+		assert.Equal(t, "hello", resp.Header.Get("X-Vendor"))
+		for _, msg := range []string{"one\n", "two\n"} {
+			conn.Write([]byte(msg))
+			conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+			got, err := reader.ReadString('\n')
+			assert.NoError(t, err)
+			assert.Equal(t, msg, got)
+		}
+		// The upstream hanging up closes the caller's connection too
+		conn.Write([]byte("bye\n"))
+		conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+		_, err := reader.ReadByte()
+		assert.Equal(t, io.EOF, err)
+	})
+
+	t.Run("handshake rejected", func(t *testing.T) {
+		_, _, resp := dialUpgrade(t, newProxy("wrong key", 0))
+		assert.Equal(t, http.StatusUnauthorized, resp.StatusCode)
+	})
+
+	t.Run("idle timeout", func(t *testing.T) {
+		conn, reader, resp := dialUpgrade(t, newProxy("vendor key", 100*time.Millisecond))
+		assert.Equal(t, http.StatusSwitchingProtocols, resp.StatusCode)
+		conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+		_, err := reader.ReadByte()
+		assert.Equal(t, io.EOF, err, "idle connections are closed")
+	})
+}
+
+func TestRegisteredRoutes_UpstreamProtocol(t *testing.T) {
+	proto := http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		writer.Write([]byte(request.Proto))
+	})
+	h2cSvc := httptest.NewServer(h2c.NewHandler(proto, &http2.Server{}))
+	defer h2cSvc.Close()
+
+	tests := []struct {
+		name     string
+		protocol string
+		want     string
+	}{
+		{name: "default", want: "HTTP/1.1"},
+		{name: "http1", protocol: ProtocolHTTP1, want: "HTTP/1.1"},
+		{name: "h2c", protocol: ProtocolH2C, want: "HTTP/2.0"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			route := NewRouter()
+			assert.NoError(t, route.RegisterRoute(http.MethodGet, h2cSvc.URL, http.MethodGet))
+			if tt.protocol != "" {
+				assert.NoError(t, route.SetUpstreamProtocol(http.MethodGet, tt.protocol))
+			}
+			rw := httptest.NewRecorder()
+			route.ServeHTTP(rw, httptest.NewRequest(http.MethodGet, "/test", nil))
+			assert.Equal(t, http.StatusOK, rw.Code)
+			assert.Equal(t, tt.want, rw.Body.String())
+		})
+	}
+	assert.Error(t, NewRouter().SetUpstreamProtocol(http.MethodGet, "spdy"))
+}
+
+func TestSplitUnixURL(t *testing.T) {
+	tests := []struct {
+		remotePath string
+		wantSocket string
+		wantPath   string
+		wantErr    bool
+	}{
+		{remotePath: "unix:///var/run/docker.sock", wantSocket: "/var/run/docker.sock", wantPath: "/"},
+		{remotePath: "unix:///var/run/docker.sock:/v1.41/containers", wantSocket: "/var/run/docker.sock", wantPath: "/v1.41/containers"},
+		{remotePath: "unix://docker.sock", wantErr: true},
+		{remotePath: "unix:///var/run/docker.sock:v1.41", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.remotePath, func(t *testing.T) {
+			socket, urlPath, err := splitUnixURL(tt.remotePath)
+			if tt.wantErr {
+				assert.Error(t, err)
+				return
+			}
+			assert.NoError(t, err)
+			assert.Equal(t, tt.wantSocket, socket)
+			assert.Equal(t, tt.wantPath, urlPath)
+		})
+	}
+}
+
+func TestRegisteredRoutes_UnixSocket(t *testing.T) {
+	handler := http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		writer.Write([]byte(request.Proto + " " + request.Host + " " + request.URL.Path))
+	})
+	socket := filepath.Join(t.TempDir(), "upstream.sock")
+	listener, err := net.Listen("unix", socket)
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	upstream := httptest.NewUnstartedServer(h2c.NewHandler(handler, &http2.Server{}))
+	upstream.Listener.Close()
+	upstream.Listener = listener
+	upstream.Start()
+	defer upstream.Close()
+
+	tests := []struct {
+		name     string
+		protocol string
+		want     string
+	}{
+		{name: "default", want: "HTTP/1.1 localhost /api/test"},
+		{name: "h2c", protocol: ProtocolH2C, want: "HTTP/2.0 localhost /api/test"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			route := NewRouter()
+			if tt.protocol != "" {
+				assert.NoError(t, route.SetUpstreamProtocol(http.MethodGet, tt.protocol))
+			}
+			assert.NoError(t, route.RegisterRoute(http.MethodGet, "unix://"+socket+":/api/test", http.MethodGet))
+			rw := httptest.NewRecorder()
+			route.ServeHTTP(rw, httptest.NewRequest(http.MethodGet, "/test", nil))
+			assert.Equal(t, http.StatusOK, rw.Code)
+			assert.Equal(t, tt.want, rw.Body.String())
+		})
+	}
+	assert.Error(t, NewRouter().RegisterRoute(http.MethodGet, "unix://upstream.sock", http.MethodGet))
+}
@@ -0,0 +1,75 @@
+package routes
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/http"
+	"path"
+	"strings"
+	"sync"
+
+	"golang.org/x/net/http2"
+)
+
+const unixScheme = "unix://"
+
+// unixHost is the Host sent to upstreams reached over a Unix socket, which have no host name of their own
+const unixHost = "localhost"
+
+// splitUnixURL splits a `unix:///path/to.sock:/url/path` remote path into the socket's path and the URL path
+// requests are made to, which defaults to `/`
+func splitUnixURL(remotePath string) (string, string, error) {
+	socket := strings.TrimPrefix(remotePath, unixScheme)
+	urlPath := "/"
+	if i := strings.Index(socket, ":"); i >= 0 {
+		socket, urlPath = socket[:i], socket[i+1:]
+	}
+	if !path.IsAbs(socket) {
+		return "", "", fmt.Errorf("remote path '%s' needs an absolute socket path", remotePath)
+	}
+	if !strings.HasPrefix(urlPath, "/") {
+		return "", "", fmt.Errorf("remote path '%s' needs a path starting with / after the socket", remotePath)
+	}
+	return socket, urlPath, nil
+}
+
+// unixClients are the clients for each socket and protocol, shared so connections to a socket are reused
+var unixClients = struct {
+	lock    sync.Mutex
+	clients map[[2]string]*http.Client
+}{clients: map[[2]string]*http.Client{}}
+
+// unixClient returns the client reaching the upstream listening on socket with protocol. Only HTTP/1.1 and h2c can
+// be used, as there's no TLS over Unix sockets
+func unixClient(socket, protocol string) *http.Client {
+	if protocol != ProtocolH2C {
+		protocol = ProtocolHTTP1
+	}
+	unixClients.lock.Lock()
+	defer unixClients.lock.Unlock()
+	key := [2]string{socket, protocol}
+	if client, ok := unixClients.clients[key]; ok {
+		return client
+	}
+	dialer := &net.Dialer{}
+	var client *http.Client
+	if protocol == ProtocolH2C {
+		client = newUpstreamClient(&http2.Transport{
+			DisableCompression: true,
+			AllowHTTP:          true,
+			DialTLS: func(string, string, *tls.Config) (net.Conn, error) {
+				return dialer.Dial("unix", socket)
+			},
+		})
+	} else {
+		transport := newUpstreamTransport(false)
+		transport.DialContext = func(ctx context.Context, _, _ string) (net.Conn, error) {
+			return dialer.DialContext(ctx, "unix", socket)
+		}
+		client = newUpstreamClient(transport)
+	}
+	unixClients.clients[key] = client
+	return client
+}
@@ -0,0 +1,125 @@
+package routes
+
+import (
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+const defaultUpgradeIdleTimeout = 10 * time.Minute
+
+// upgradeType returns the protocol h asks to switch to, such as `websocket`, or an empty string if it doesn't ask
+func upgradeType(h http.Header) string {
+	if !headerHasToken(h, "Connection", "upgrade") {
+		return ""
+	}
+	return h.Get("Upgrade")
+}
+
+// upstreamURL maps WebSocket URLs to the HTTP URLs their handshakes are made to
+func upstreamURL(remotePath string) string {
+	switch {
+	case strings.HasPrefix(remotePath, "ws://"):
+		return "http://" + strings.TrimPrefix(remotePath, "ws://")
+	case strings.HasPrefix(remotePath, "wss://"):
+		return "https://" + strings.TrimPrefix(remotePath, "wss://")
+	}
+	return remotePath
+}
+
+// switchProtocols finishes an upgrade the upstream agreed to with resp, taking over the caller's connection and
+// relaying data both ways until either side closes, the connection is idle for idleTimeout, or ctx is done
+func switchProtocols(ctx context.Context, rw http.ResponseWriter, req *http.Request, resp *http.Response, idleTimeout time.Duration) {
+	requested, got := upgradeType(req.Header), upgradeType(resp.Header)
+	if !strings.EqualFold(requested, got) {
+		logrus.Warnf("upstream switched %s %s to '%s' when '%s' was asked for", req.Method, req.URL.Path, got, requested)
+		rw.WriteHeader(http.StatusBadGateway)
+		return
+	}
+	backend, ok := resp.Body.(io.ReadWriteCloser)
+	if !ok {
+		rw.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	defer backend.Close()
+	hijacker, ok := rw.(http.Hijacker)
+	if !ok {
+		logrus.Errorf("can't take over the connection for %s %s", req.Method, req.URL.Path)
+		rw.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	conn, buffered, err := hijacker.Hijack()
+	if err != nil {
+		logrus.Errorf("can't take over the connection for %s %s: %v", req.Method, req.URL.Path, err)
+		rw.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	defer conn.Close()
+
+	header := http.Header{}
+	copyHeaders(header, resp.Header)
+	removeHopHeaders(header)
+	header.Set("Connection", "Upgrade")
+	header.Set("Upgrade", got)
+	switched := &http.Response{
+		StatusCode: resp.StatusCode,
+		ProtoMajor: 1,
+		ProtoMinor: 1,
+		Header:     header,
+	}
+	if err := switched.Write(buffered); err != nil {
+		return
+	}
+	if err := buffered.Flush(); err != nil {
+		return
+	}
+
+	// Anything the caller sent after the handshake may already be buffered, so it is read through the buffer
+	relay(ctx, conn, buffered.Reader, backend, idleTimeout)
+}
+
+// relay copies data both ways between the caller's conn, which is read through callerReader, and backend until
+// either side closes, nothing is sent for idleTimeout, or ctx is done
+func relay(ctx context.Context, conn net.Conn, callerReader io.Reader, backend io.ReadWriteCloser, idleTimeout time.Duration) {
+	// Whichever side goes first, or the idle timer, closes both, which ends the other copy
+	var once sync.Once
+	closeBoth := func() {
+		once.Do(func() {
+			conn.Close()
+			backend.Close()
+		})
+	}
+	idle := time.AfterFunc(idleTimeout, closeBoth)
+	defer idle.Stop()
+	done := make(chan struct{}, 2)
+	copyAll := func(dst io.Writer, src io.Reader) {
+		buf := make([]byte, bodyBufferSize)
+		for {
+			n, err := src.Read(buf)
+			if n > 0 {
+				idle.Reset(idleTimeout)
+				if _, werr := dst.Write(buf[:n]); werr != nil {
+					break
+				}
+			}
+			if err != nil {
+				break
+			}
+		}
+		done <- struct{}{}
+	}
+	go copyAll(backend, callerReader)
+	go copyAll(conn, backend)
+	select {
+	case <-done:
+	case <-ctx.Done():
+	}
+	closeBoth()
+	<-done
+}
@@ -0,0 +1,81 @@
+package routes
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+
+	"golang.org/x/net/http2"
+)
+
+// Upstream protocols
+const (
+	// ProtocolAuto negotiates HTTP/2 with ALPN over TLS, and uses HTTP/1.1 otherwise
+	ProtocolAuto = "auto"
+	// ProtocolHTTP1 always uses HTTP/1.1
+	ProtocolHTTP1 = "http1"
+	// ProtocolH2 requires HTTP/2 over TLS
+	ProtocolH2 = "h2"
+	// ProtocolH2C uses cleartext HTTP/2 with prior knowledge, for upstreams that only speak h2c
+	ProtocolH2C = "h2c"
+)
+
+// upstreamClients forward requests with each protocol. They are shared by every endpoint so connections to the
+// same upstream are reused
+var upstreamClients = map[string]*http.Client{
+	ProtocolAuto:  newUpstreamClient(newUpstreamTransport(true)),
+	ProtocolHTTP1: newUpstreamClient(newUpstreamTransport(false)),
+	ProtocolH2:    newUpstreamClient(&http2.Transport{DisableCompression: true}),
+	ProtocolH2C: newUpstreamClient(&http2.Transport{
+		DisableCompression: true,
+		AllowHTTP:          true,
+		DialTLS: func(network, addr string, _ *tls.Config) (net.Conn, error) {
+			return net.Dial(network, addr)
+		},
+	}),
+}
+
+// newUpstreamClient returns a client using transport. Redirects are passed back to the caller rather than
+// followed, so that they see the upstream's Location
+func newUpstreamClient(transport http.RoundTripper) *http.Client {
+	return &http.Client{
+		Transport: transport,
+		CheckRedirect: func(*http.Request, []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+}
+
+// newUpstreamTransport returns an HTTP/1.1 transport, which also negotiates HTTP/2 over TLS if h2 is set. Bodies
+// aren't decompressed, so they reach the caller as the upstream sent them
+func newUpstreamTransport(h2 bool) *http.Transport {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.DisableCompression = true
+	if !h2 {
+		transport.ForceAttemptHTTP2 = false
+		// A non-nil map turns off HTTP/2
+		transport.TLSNextProto = map[string]func(string, *tls.Conn) http.RoundTripper{}
+	}
+	return transport
+}
+
+// CheckUpstreamProtocol checks that protocol is known and can be used to reach remotePath
+func CheckUpstreamProtocol(protocol, remotePath string) error {
+	switch protocol {
+	case ProtocolAuto, ProtocolHTTP1:
+		return nil
+	case ProtocolH2:
+		if !strings.HasPrefix(remotePath, "https://") {
+			return fmt.Errorf("upstream protocol h2 needs an https remote path")
+		}
+		return nil
+	case ProtocolH2C:
+		if !strings.HasPrefix(remotePath, "http://") && !strings.HasPrefix(remotePath, unixScheme) {
+			return fmt.Errorf("upstream protocol h2c needs an http or unix remote path")
+		}
+		return nil
+	}
+	return fmt.Errorf("unknown upstream protocol '%s'", protocol)
+}
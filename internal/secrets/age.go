@@ -0,0 +1,88 @@
+package secrets
+
+import (
+	"bytes"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+
+	"filippo.io/age"
+)
+
+// AgePrefix marks a config value as an age encrypted secret. The rest of the value is the base64 encoded ciphertext
+const AgePrefix = "enc:age:"
+
+// AgeIdentityEnv is the environment variable that can hold an age identity instead of an identity file
+const AgeIdentityEnv = "PEEPER_AGE_IDENTITY"
+
+// AgeResolver decrypts `enc:age:` values with a set of age identities
+type AgeResolver struct {
+	identities []age.Identity
+}
+
+func (a *AgeResolver) Resolve(value string) (string, error) {
+	if !strings.HasPrefix(value, AgePrefix) {
+		return value, nil
+	}
+	if len(a.identities) == 0 {
+		return "", fmt.Errorf("found an encrypted value but no age identity is configured")
+	}
+	ciphertext, err := base64.StdEncoding.DecodeString(strings.TrimPrefix(value, AgePrefix))
+	if err != nil {
+		return "", fmt.Errorf("encrypted value is not valid base64: %v", err)
+	}
+	r, err := age.Decrypt(bytes.NewReader(ciphertext), a.identities...)
+	if err != nil {
+		return "", fmt.Errorf("could not decrypt value: %v", err)
+	}
+	plaintext, err := ioutil.ReadAll(r)
+	if err != nil {
+		return "", fmt.Errorf("could not decrypt value: %v", err)
+	}
+	return string(plaintext), nil
+}
+
+// NewAgeResolver loads identities from identityFile, if set, and from the PEEPER_AGE_IDENTITY environment
+// variable. A resolver without any identities is still returned so that configs without encrypted values work
+func NewAgeResolver(identityFile string) (*AgeResolver, error) {
+	var identities []age.Identity
+	if identityFile != "" {
+		f, err := os.Open(identityFile)
+		if err != nil {
+			return nil, fmt.Errorf("could not open age identity file: %v", err)
+		}
+		defer f.Close()
+		fromFile, err := age.ParseIdentities(f)
+		if err != nil {
+			return nil, fmt.Errorf("could not parse age identity file: %v", err)
+		}
+		identities = append(identities, fromFile...)
+	}
+	if env := os.Getenv(AgeIdentityEnv); env != "" {
+		fromEnv, err := age.ParseIdentities(strings.NewReader(env))
+		if err != nil {
+			return nil, fmt.Errorf("could not parse %s: %v", AgeIdentityEnv, err)
+		}
+		identities = append(identities, fromEnv...)
+	}
+	return &AgeResolver{identities: identities}, nil
+}
+
+// EncryptAge encrypts value to recipients and returns it in the `enc:age:` form used in config files
+func EncryptAge(value string, recipients ...age.Recipient) (string, error) {
+	var buf bytes.Buffer
+	w, err := age.Encrypt(&buf, recipients...)
+	if err != nil {
+		return "", err
+	}
+	if _, err := io.WriteString(w, value); err != nil {
+		return "", err
+	}
+	if err := w.Close(); err != nil {
+		return "", err
+	}
+	return AgePrefix + base64.StdEncoding.EncodeToString(buf.Bytes()), nil
+}
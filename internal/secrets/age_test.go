@@ -0,0 +1,77 @@
+package secrets
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"filippo.io/age"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAgeResolver_Resolve(t *testing.T) {
+	identity, err := age.GenerateX25519Identity()
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	other, _ := age.GenerateX25519Identity()
+	encrypted, err := EncryptAge("5n@ke3a7eR", identity.Recipient())
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	identityFile := filepath.Join(t.TempDir(), "key.txt")
+	assert.NoError(t, os.WriteFile(identityFile, []byte(identity.String()+"\n"), 0600))
+
+	t.Run("identity file", func(t *testing.T) {
+		r, err := NewAgeResolver(identityFile)
+		assert.NoError(t, err)
+		got, err := r.Resolve(encrypted)
+		assert.NoError(t, err)
+		assert.Equal(t, "5n@ke3a7eR", got)
+	})
+	t.Run("identity from env", func(t *testing.T) {
+		t.Setenv(AgeIdentityEnv, identity.String())
+		r, err := NewAgeResolver("")
+		assert.NoError(t, err)
+		got, err := r.Resolve(encrypted)
+		assert.NoError(t, err)
+		assert.Equal(t, "5n@ke3a7eR", got)
+	})
+	t.Run("plain values pass through", func(t *testing.T) {
+		r, err := NewAgeResolver("")
+		assert.NoError(t, err)
+		got, err := r.Resolve("not encrypted")
+		assert.NoError(t, err)
+		assert.Equal(t, "not encrypted", got)
+	})
+	t.Run("no identity", func(t *testing.T) {
+		r, err := NewAgeResolver("")
+		assert.NoError(t, err)
+		_, err = r.Resolve(encrypted)
+		assert.Error(t, err)
+	})
+	t.Run("wrong identity", func(t *testing.T) {
+		t.Setenv(AgeIdentityEnv, other.String())
+		r, err := NewAgeResolver("")
+		assert.NoError(t, err)
+		_, err = r.Resolve(encrypted)
+		assert.Error(t, err)
+	})
+	t.Run("chained into another resolver", func(t *testing.T) {
+		ref, _ := EncryptAge("ref:password", identity.Recipient())
+		r, _ := NewAgeResolver(identityFile)
+		chain := Chain{r, mapResolver{"ref:password": "from the store"}}
+		got, err := chain.Resolve(ref)
+		assert.NoError(t, err)
+		assert.Equal(t, "from the store", got)
+	})
+}
+
+type mapResolver map[string]string
+
+func (m mapResolver) Resolve(value string) (string, error) {
+	if v, ok := m[value]; ok {
+		return v, nil
+	}
+	return value, nil
+}
@@ -0,0 +1,28 @@
+package secrets
+
+// Resolver turns secret references found in config values into the secrets themselves. Values that a resolver
+// doesn't recognise as a reference are returned unchanged
+type Resolver interface {
+	Resolve(value string) (string, error)
+}
+
+// Plaintext is a Resolver that treats every value as a literal
+type Plaintext struct{}
+
+func (Plaintext) Resolve(value string) (string, error) {
+	return value, nil
+}
+
+// Chain runs a value through each resolver in turn, so an encrypted value can itself decrypt to a reference that
+// a later resolver understands
+type Chain []Resolver
+
+func (c Chain) Resolve(value string) (string, error) {
+	var err error
+	for _, r := range c {
+		if value, err = r.Resolve(value); err != nil {
+			return "", err
+		}
+	}
+	return value, nil
+}
@@ -0,0 +1,59 @@
+package secrets
+
+import (
+	"fmt"
+	"io"
+)
+
+// Redacted is what a Secret prints as
+const Redacted = "[REDACTED]"
+
+// Secret holds a sensitive value. It prints as [REDACTED] under every fmt verb, in logrus fields and when
+// marshalled to JSON or text, so a Secret accidentally passed to a logger or wrapped into an error can't leak.
+// The underlying buffer can be wiped with Zero once the secret is no longer needed
+type Secret struct {
+	value []byte
+}
+
+// NewSecret copies value into a new Secret
+func NewSecret(value string) Secret {
+	return Secret{value: []byte(value)}
+}
+
+// Reveal returns the secret's plaintext. The returned string is a copy that can't be zeroed, so it should be used
+// straight away rather than stored
+func (s Secret) Reveal() string {
+	return string(s.value)
+}
+
+// Empty reports whether the secret has no value
+func (s Secret) Empty() bool {
+	return len(s.value) == 0
+}
+
+// Zero overwrites the secret's buffer. Every copy of the Secret shares the buffer, so all of them are wiped
+func (s Secret) Zero() {
+	for i := range s.value {
+		s.value[i] = 0
+	}
+}
+
+func (s Secret) String() string {
+	return Redacted
+}
+
+func (s Secret) GoString() string {
+	return Redacted
+}
+
+func (s Secret) Format(f fmt.State, verb rune) {
+	io.WriteString(f, Redacted)
+}
+
+func (s Secret) MarshalJSON() ([]byte, error) {
+	return []byte(`"` + Redacted + `"`), nil
+}
+
+func (s Secret) MarshalText() ([]byte, error) {
+	return []byte(Redacted), nil
+}
@@ -0,0 +1,70 @@
+package service
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/threetoes/peeper/internal/inbound"
+)
+
+// statusRecorder remembers the status code written through it for the access log
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (s *statusRecorder) WriteHeader(status int) {
+	if s.status == 0 {
+		s.status = status
+	}
+	s.ResponseWriter.WriteHeader(status)
+}
+
+func (s *statusRecorder) Write(b []byte) (int, error) {
+	if s.status == 0 {
+		s.status = http.StatusOK
+	}
+	return s.ResponseWriter.Write(b)
+}
+
+func (s *statusRecorder) Flush() {
+	if f, ok := s.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+func (s *statusRecorder) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	if h, ok := s.ResponseWriter.(http.Hijacker); ok {
+		// Connections are only taken over to switch protocols
+		if s.status == 0 {
+			s.status = http.StatusSwitchingProtocols
+		}
+		return h.Hijack()
+	}
+	return nil, nil, fmt.Errorf("response writer can't be hijacked")
+}
+
+// accessLog logs a line for every request the listener called name has served, including the caller's client
+// certificate
+func accessLog(name string, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		start := time.Now()
+		recorder := &statusRecorder{ResponseWriter: rw}
+		next.ServeHTTP(recorder, req)
+		fields := logrus.Fields{
+			"method":      req.Method,
+			"path":        req.URL.Path,
+			"status":      recorder.status,
+			"remote_addr": req.RemoteAddr,
+			"duration_ms": time.Since(start).Milliseconds(),
+		}
+		if cert := inbound.VerifiedCertificate(req); cert != nil {
+			fields["client_cert"] = inbound.CertificateName(cert)
+		}
+		logrus.WithFields(fields).Info("served request")
+	})
+}
@@ -0,0 +1,224 @@
+package service
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/threetoes/peeper/internal/config"
+	"golang.org/x/crypto/ocsp"
+)
+
+const (
+	defaultReloadInterval = 30 * time.Second
+	maxOCSPResponseSize   = 1 << 20
+	// ocspRetry is used when the responder gives no next update
+	ocspRetry = time.Hour
+)
+
+type servedCert struct {
+	certFile    string
+	keyFile     string
+	stamp       string
+	cert        *tls.Certificate
+	ocspRefresh time.Time
+	ocspExpires time.Time
+}
+
+// certStore picks a certificate for each handshake by SNI. Reloads only affect new handshakes
+type certStore struct {
+	lock sync.RWMutex
+	// certs are the certificates matched by SNI, the first being served when nothing else matches
+	certs  []*servedCert
+	ocsp   bool
+	client *http.Client
+	now    func() time.Time
+}
+
+// GetCertificate returns the certificate for the name the caller asked for with SNI, or the default certificate
+func (s *certStore) GetCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	if hello.ServerName != "" {
+		for _, c := range s.certs[1:] {
+			if hello.SupportsCertificate(c.cert) == nil {
+				return c.cert, nil
+			}
+		}
+	}
+	return s.certs[0].cert, nil
+}
+
+// Run checks for changed certificate files and due OCSP responses every interval until ctx is done
+func (s *certStore) Run(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			s.refresh()
+		}
+	}
+}
+
+// refresh leaves certificates that can't be loaded as they were
+func (s *certStore) refresh() {
+	s.lock.RLock()
+	certs := append([]*servedCert{}, s.certs...)
+	s.lock.RUnlock()
+	for i, c := range certs {
+		updated := c
+		stamp, err := fileStamp(c.certFile, c.keyFile)
+		if err != nil {
+			logrus.Warnf("could not check TLS certificate %s for changes: %v", c.certFile, err)
+			continue
+		}
+		if stamp != c.stamp {
+			if updated, err = s.load(c.certFile, c.keyFile); err != nil {
+				logrus.Errorf("could not reload TLS certificate %s, still serving the old one: %v", c.certFile, err)
+				continue
+			}
+			logrus.Infof("reloaded TLS certificate %s", c.certFile)
+		} else if s.ocsp && !s.now().Before(c.ocspRefresh) {
+			copied := *c
+			updated = &copied
+			s.staple(updated)
+		}
+		if updated != c {
+			s.lock.Lock()
+			s.certs[i] = updated
+			s.lock.Unlock()
+		}
+	}
+}
+
+func (s *certStore) load(certFile, keyFile string) (*servedCert, error) {
+	// The files are stamped first, so a change made while they are read is picked up by the next refresh
+	stamp, err := fileStamp(certFile, keyFile)
+	if err != nil {
+		return nil, err
+	}
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return nil, fmt.Errorf("could not load TLS certificate: %v", err)
+	}
+	if cert.Leaf, err = x509.ParseCertificate(cert.Certificate[0]); err != nil {
+		return nil, fmt.Errorf("could not parse TLS certificate: %v", err)
+	}
+	c := &servedCert{certFile: certFile, keyFile: keyFile, stamp: stamp, cert: &cert}
+	if s.ocsp {
+		s.staple(c)
+	}
+	return c, nil
+}
+
+// staple keeps the previous response while it is valid if a new one can't be fetched
+func (s *certStore) staple(c *servedCert) {
+	now := s.now()
+	raw, refresh, expires, err := s.fetchOCSP(c.cert)
+	cert := *c.cert
+	if err != nil {
+		logrus.Warnf("could not fetch OCSP response for TLS certificate %s: %v", c.certFile, err)
+		c.ocspRefresh = now.Add(ocspRetry)
+		if !c.ocspExpires.IsZero() && now.After(c.ocspExpires) {
+			cert.OCSPStaple = nil
+			c.cert = &cert
+		}
+		return
+	}
+	cert.OCSPStaple = raw
+	c.cert, c.ocspRefresh, c.ocspExpires = &cert, refresh, expires
+}
+
+// fetchOCSP needs cert's issuer to follow it in its file. The next fetch is half way through the response's validity
+func (s *certStore) fetchOCSP(cert *tls.Certificate) ([]byte, time.Time, time.Time, error) {
+	var zero time.Time
+	if len(cert.Leaf.OCSPServer) == 0 {
+		return nil, zero, zero, fmt.Errorf("the certificate names no OCSP responder")
+	}
+	if len(cert.Certificate) < 2 {
+		return nil, zero, zero, fmt.Errorf("the certificate's issuer must follow it in cert_file")
+	}
+	issuer, err := x509.ParseCertificate(cert.Certificate[1])
+	if err != nil {
+		return nil, zero, zero, err
+	}
+	req, err := ocsp.CreateRequest(cert.Leaf, issuer, nil)
+	if err != nil {
+		return nil, zero, zero, err
+	}
+	resp, err := s.client.Post(cert.Leaf.OCSPServer[0], "application/ocsp-request", bytes.NewReader(req))
+	if err != nil {
+		return nil, zero, zero, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, zero, zero, fmt.Errorf("OCSP responder returned %d", resp.StatusCode)
+	}
+	raw, err := ioutil.ReadAll(io.LimitReader(resp.Body, maxOCSPResponseSize))
+	if err != nil {
+		return nil, zero, zero, err
+	}
+	parsed, err := ocsp.ParseResponseForCert(raw, cert.Leaf, issuer)
+	if err != nil {
+		return nil, zero, zero, err
+	}
+	if parsed.Status != ocsp.Good {
+		return nil, zero, zero, fmt.Errorf("the certificate's OCSP status isn't good")
+	}
+	if parsed.NextUpdate.IsZero() {
+		return raw, s.now().Add(ocspRetry), zero, nil
+	}
+	refresh := parsed.ThisUpdate.Add(parsed.NextUpdate.Sub(parsed.ThisUpdate) / 2)
+	return raw, refresh, parsed.NextUpdate, nil
+}
+
+func fileStamp(files ...string) (string, error) {
+	var stamp string
+	for _, file := range files {
+		// Stat follows symlinks, so files swapped by updating a symlink, as Kubernetes does, are seen to change
+		info, err := os.Stat(file)
+		if err != nil {
+			return "", err
+		}
+		stamp += fmt.Sprintf("%d:%d;", info.ModTime().UnixNano(), info.Size())
+	}
+	return stamp, nil
+}
+
+func newCertStore(conf *config.TLSConfig) (*certStore, error) {
+	if conf.CertFile == "" || conf.KeyFile == "" {
+		return nil, fmt.Errorf("tls needs cert_file and key_file to be set")
+	}
+	s := &certStore{
+		ocsp:   conf.OCSPStapling,
+		client: &http.Client{Timeout: 10 * time.Second},
+		now:    time.Now,
+	}
+	files := []*config.CertificateConfig{{CertFile: conf.CertFile, KeyFile: conf.KeyFile}}
+	for _, c := range conf.Certificates {
+		if c.CertFile == "" || c.KeyFile == "" {
+			return nil, fmt.Errorf("tls certificates need cert_file and key_file to be set")
+		}
+		files = append(files, c)
+	}
+	for _, f := range files {
+		c, err := s.load(f.CertFile, f.KeyFile)
+		if err != nil {
+			return nil, err
+		}
+		s.certs = append(s.certs, c)
+	}
+	return s, nil
+}
@@ -0,0 +1,59 @@
+package service
+
+import (
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/threetoes/peeper/internal/auth"
+	"github.com/threetoes/peeper/internal/config"
+	"github.com/threetoes/peeper/internal/intercept"
+	"github.com/threetoes/peeper/internal/routes"
+)
+
+const (
+	modeReverseProxy = "reverse_proxy"
+	modeForwardProxy = "forward_proxy"
+)
+
+// newForwardProxy builds the forward proxy in conf, binding each rule's credentials so they are refreshed with
+// the endpoints'
+func (g *NormalService) newForwardProxy(conf *config.ForwardProxyConfig) (*routes.ForwardProxy, error) {
+	proxy := routes.NewForwardProxy(conf.AllowUnknownHosts, conf.ConnectPorts, time.Duration(conf.TunnelIdleTimeout))
+	if conf.InterceptCA != nil {
+		ca, err := intercept.NewCA(conf.InterceptCA)
+		if err != nil {
+			return nil, err
+		}
+		proxy.SetInterceptCA(ca)
+	}
+	for i, rule := range conf.Rules {
+		var injector auth.CredentialInjector
+		if rule.Credentials != nil {
+			if rule.Credentials.UserToken != nil {
+				// There's no browser session behind a proxied request to take the token from
+				return nil, fmt.Errorf("forward proxy rule %d: user_token can't be used by the forward proxy", i+1)
+			}
+			var err error
+			injector, err = g.bindInjector(fmt.Sprintf("forward proxy rule %d", i+1), rule.Credentials)
+			if err != nil {
+				return nil, err
+			}
+		}
+		if err := proxy.AddRule(rule.Hosts, injector, rule.Intercept); err != nil {
+			return nil, fmt.Errorf("forward proxy rule %d: %v", i+1, err)
+		}
+	}
+	return proxy, nil
+}
+
+// forwardProxyHandler sends requests meant for a proxy to proxy, and the rest to next
+func forwardProxyHandler(proxy http.Handler, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		if routes.IsProxyRequest(req) {
+			proxy.ServeHTTP(rw, req)
+			return
+		}
+		next.ServeHTTP(rw, req)
+	})
+}
@@ -0,0 +1,190 @@
+package service
+
+import (
+	"context"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/threetoes/peeper/internal/config"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/health"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/reflection"
+	reflectionpb "google.golang.org/grpc/reflection/grpc_reflection_v1alpha"
+	"google.golang.org/grpc/status"
+)
+
+// grpcUpstream is an in-process gRPC server that only accepts calls with peeper's token in their metadata
+type grpcUpstream struct {
+	lock   sync.Mutex
+	health *health.Server
+	// callers are the authorization metadata of calls
+	callers []string
+}
+
+func (g *grpcUpstream) authorize(ctx context.Context) error {
+	md, _ := metadata.FromIncomingContext(ctx)
+	g.lock.Lock()
+	g.callers = append(g.callers, md.Get("authorization")...)
+	g.lock.Unlock()
+	if len(md.Get("authorization")) != 1 || md.Get("authorization")[0] != "Bearer upstream-token" {
+		return status.Error(codes.Unauthenticated, "bad token")
+	}
+	return nil
+}
+
+func startGRPCUpstream(t *testing.T) (*grpcUpstream, string) {
+	t.Helper()
+	upstream := &grpcUpstream{health: health.NewServer()}
+	server := grpc.NewServer(
+		grpc.UnaryInterceptor(func(ctx context.Context, req interface{}, _ *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+			if err := upstream.authorize(ctx); err != nil {
+				return nil, err
+			}
+			return handler(ctx, req)
+		}),
+		grpc.StreamInterceptor(func(srv interface{}, ss grpc.ServerStream, _ *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+			if err := upstream.authorize(ss.Context()); err != nil {
+				return err
+			}
+			return handler(srv, ss)
+		}),
+	)
+	healthpb.RegisterHealthServer(server, upstream.health)
+	reflection.Register(server)
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	go server.Serve(listener)
+	t.Cleanup(server.Stop)
+	return upstream, listener.Addr().String()
+}
+
+func TestGRPCEndpoint(t *testing.T) {
+	upstream, upstreamAddr := startGRPCUpstream(t)
+	upstream.health.SetServingStatus("orders", healthpb.HealthCheckResponse_SERVING)
+	closed, _ := net.Listen("tcp", "127.0.0.1:0")
+	closedAddr := closed.Addr().String()
+	closed.Close()
+
+	credentials := &config.StaticKeyAuthConfig{Headers: map[string]string{"Authorization": "Bearer upstream-token"}}
+	addr := startService(t, &config.NetworkConfig{HTTP2: &config.HTTP2Config{H2C: true}},
+		&config.Endpoint{
+			LocalPath:     "/grpc.health.v1.Health/",
+			RemotePath:    "http://" + upstreamAddr,
+			LocalMethod:   "POST",
+			RemoteMethod:  "POST",
+			GRPC:          true,
+			StaticKeyAuth: credentials,
+		},
+		&config.Endpoint{
+			LocalPath:     "/grpc.reflection.v1alpha.ServerReflection/",
+			RemotePath:    "http://" + upstreamAddr,
+			LocalMethod:   "POST",
+			RemoteMethod:  "POST",
+			GRPC:          true,
+			StaticKeyAuth: credentials,
+		},
+		&config.Endpoint{
+			LocalPath:    "/down.v1.Service/",
+			RemotePath:   "http://" + closedAddr,
+			LocalMethod:  "POST",
+			RemoteMethod: "POST",
+			GRPC:         true,
+		},
+	)
+	conn, err := grpc.Dial(addr, grpc.WithTransportCredentials(insecure.NewCredentials()))
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	defer conn.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	healthClient := healthpb.NewHealthClient(conn)
+
+	t.Run("unary", func(t *testing.T) {
+		resp, err := healthClient.Check(ctx, &healthpb.HealthCheckRequest{Service: "orders"})
+		if assert.NoError(t, err) {
+			assert.Equal(t, healthpb.HealthCheckResponse_SERVING, resp.Status)
+		}
+		upstream.lock.Lock()
+		assert.Equal(t, "Bearer upstream-token", upstream.callers[len(upstream.callers)-1], "credentials are sent as metadata")
+		upstream.lock.Unlock()
+	})
+
+	t.Run("status from trailers", func(t *testing.T) {
+		_, err := healthClient.Check(ctx, &healthpb.HealthCheckRequest{Service: "unknown"})
+		assert.Equal(t, codes.NotFound, status.Code(err))
+	})
+
+	t.Run("server streaming", func(t *testing.T) {
+		stream, err := healthClient.Watch(ctx, &healthpb.HealthCheckRequest{Service: "orders"})
+		if !assert.NoError(t, err) {
+			return
+		}
+		resp, err := stream.Recv()
+		if assert.NoError(t, err) {
+			assert.Equal(t, healthpb.HealthCheckResponse_SERVING, resp.Status)
+		}
+		upstream.health.SetServingStatus("orders", healthpb.HealthCheckResponse_NOT_SERVING)
+		resp, err = stream.Recv()
+		if assert.NoError(t, err) {
+			assert.Equal(t, healthpb.HealthCheckResponse_NOT_SERVING, resp.Status, "updates arrive while the call is open")
+		}
+	})
+
+	t.Run("bidirectional streaming", func(t *testing.T) {
+		stream, err := reflectionpb.NewServerReflectionClient(conn).ServerReflectionInfo(ctx)
+		if !assert.NoError(t, err) {
+			return
+		}
+		for i := 0; i < 2; i++ {
+			err := stream.Send(&reflectionpb.ServerReflectionRequest{
+				MessageRequest: &reflectionpb.ServerReflectionRequest_ListServices{},
+			})
+			if !assert.NoError(t, err) {
+				return
+			}
+			resp, err := stream.Recv()
+			if !assert.NoError(t, err) {
+				return
+			}
+			var names []string
+			for _, s := range resp.GetListServicesResponse().GetService() {
+				names = append(names, s.Name)
+			}
+			assert.Contains(t, names, "grpc.health.v1.Health")
+		}
+		assert.NoError(t, stream.CloseSend())
+	})
+
+	t.Run("upstream down", func(t *testing.T) {
+		err := conn.Invoke(ctx, "/down.v1.Service/Check", &healthpb.HealthCheckRequest{}, &healthpb.HealthCheckResponse{})
+		assert.Equal(t, codes.Unavailable, status.Code(err))
+	})
+
+	t.Run("unknown service", func(t *testing.T) {
+		err := conn.Invoke(ctx, "/other.v1.Service/Check", &healthpb.HealthCheckRequest{}, &healthpb.HealthCheckResponse{})
+		assert.Equal(t, codes.Unimplemented, status.Code(err))
+	})
+}
+
+func TestGRPCEndpoint_NeedsHTTP2Upstream(t *testing.T) {
+	svc := New(":0")
+	err := svc.RegisterEndpoint(&config.Endpoint{
+		LocalPath:        "/orders.v1.Orders/",
+		RemotePath:       "http://orders.internal:50051",
+		LocalMethod:      "POST",
+		RemoteMethod:     "POST",
+		GRPC:             true,
+		UpstreamProtocol: "http1",
+	})
+	assert.Error(t, err)
+}
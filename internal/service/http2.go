@@ -0,0 +1,37 @@
+package service
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net/http"
+
+	"github.com/threetoes/peeper/internal/config"
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
+)
+
+// configureHTTP2 sets up HTTP/2 on srv as conf says. It must be called once the server's TLS config and handler
+// are in place
+func configureHTTP2(srv *http.Server, conf *config.HTTP2Config) error {
+	if conf == nil {
+		conf = &config.HTTP2Config{}
+	}
+	if conf.Disabled {
+		if conf.H2C {
+			return fmt.Errorf("http2 can't be disabled with h2c set")
+		}
+		// A non-nil map turns off HTTP/2
+		srv.TLSNextProto = map[string]func(*http.Server, *tls.Conn, http.Handler){}
+		return nil
+	}
+	h2s := &http2.Server{MaxConcurrentStreams: conf.MaxConcurrentStreams}
+	if srv.TLSConfig != nil {
+		if err := http2.ConfigureServer(srv, h2s); err != nil {
+			return fmt.Errorf("could not configure HTTP/2: %v", err)
+		}
+	}
+	if conf.H2C {
+		srv.Handler = h2c.NewHandler(srv.Handler, h2s)
+	}
+	return nil
+}
@@ -0,0 +1,124 @@
+package service
+
+import (
+	"crypto/tls"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/threetoes/peeper/internal/config"
+	"golang.org/x/net/http2"
+)
+
+// startService starts a service on a free local port with conf and endpoints, returning its address
+func startService(t *testing.T, conf *config.NetworkConfig, endpoints ...*config.Endpoint) string {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	addr := listener.Addr().String()
+	listener.Close()
+
+	svc := New(addr).(*NormalService)
+	if !assert.NoError(t, svc.Configure(&config.AppOptions{Network: conf})) {
+		t.FailNow()
+	}
+	for _, e := range endpoints {
+		if !assert.NoError(t, svc.RegisterEndpoint(e)) {
+			t.FailNow()
+		}
+	}
+	go svc.Start()
+	t.Cleanup(func() { svc.Stop() })
+	for i := 0; i < 50; i++ {
+		if conn, err := net.Dial("tcp", addr); err == nil {
+			conn.Close()
+			break
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	return addr
+}
+
+func TestHTTP2Listener(t *testing.T) {
+	ca := newTestCA(t)
+	certFile, keyFile := ca.issueServer(t, t.TempDir(), "server", "localhost")
+	tlsConf := &config.TLSConfig{CertFile: certFile, KeyFile: keyFile}
+	upstream := httptest.NewServer(http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		writer.Write([]byte("ok"))
+	}))
+	defer upstream.Close()
+
+	tlsClient := &http.Client{Transport: &http.Transport{
+		TLSClientConfig:   &tls.Config{RootCAs: ca.pool(), ServerName: "localhost"},
+		ForceAttemptHTTP2: true,
+	}}
+	h2cClient := &http.Client{Transport: &http2.Transport{
+		AllowHTTP: true,
+		DialTLS: func(network, addr string, _ *tls.Config) (net.Conn, error) {
+			return net.Dial(network, addr)
+		},
+	}}
+
+	tests := []struct {
+		name      string
+		conf      *config.NetworkConfig
+		scheme    string
+		client    *http.Client
+		wantProto string
+	}{
+		{name: "tls negotiates http2", conf: &config.NetworkConfig{TLS: tlsConf}, scheme: "https", client: tlsClient, wantProto: "HTTP/2.0"},
+		{
+			name:      "stream limit",
+			conf:      &config.NetworkConfig{TLS: tlsConf, HTTP2: &config.HTTP2Config{MaxConcurrentStreams: 10}},
+			scheme:    "https",
+			client:    tlsClient,
+			wantProto: "HTTP/2.0",
+		},
+		{
+			name:      "disabled",
+			conf:      &config.NetworkConfig{TLS: tlsConf, HTTP2: &config.HTTP2Config{Disabled: true}},
+			scheme:    "https",
+			client:    tlsClient,
+			wantProto: "HTTP/1.1",
+		},
+		{name: "h2c", conf: &config.NetworkConfig{HTTP2: &config.HTTP2Config{H2C: true}}, scheme: "http", client: h2cClient, wantProto: "HTTP/2.0"},
+		{name: "h2c keeps http1", conf: &config.NetworkConfig{HTTP2: &config.HTTP2Config{H2C: true}}, scheme: "http", client: http.DefaultClient, wantProto: "HTTP/1.1"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			addr := startService(t, tt.conf, &config.Endpoint{LocalPath: "/proto", RemotePath: upstream.URL, LocalMethod: "GET", RemoteMethod: "GET"})
+			_, port, _ := net.SplitHostPort(addr)
+			resp, err := tt.client.Get(tt.scheme + "://localhost:" + port + "/proto")
+			if !assert.NoError(t, err) {
+				return
+			}
+			body, _ := ioutil.ReadAll(resp.Body)
+			resp.Body.Close()
+			assert.Equal(t, tt.wantProto, resp.Proto)
+			assert.Equal(t, "ok", string(body))
+		})
+	}
+}
+
+func TestHTTP2Listener_DisabledWithH2C(t *testing.T) {
+	svc := New(":0")
+	err := svc.Configure(&config.AppOptions{Network: &config.NetworkConfig{HTTP2: &config.HTTP2Config{Disabled: true, H2C: true}}})
+	assert.Error(t, err)
+}
+
+func TestUpstreamProtocol_Invalid(t *testing.T) {
+	svc := New(":0")
+	for _, e := range []*config.Endpoint{
+		{LocalPath: "/a", RemotePath: "http://upstream.internal", LocalMethod: "GET", RemoteMethod: "GET", UpstreamProtocol: "h2"},
+		{LocalPath: "/b", RemotePath: "https://upstream.internal", LocalMethod: "GET", RemoteMethod: "GET", UpstreamProtocol: "h2c"},
+		{LocalPath: "/c", RemotePath: "https://upstream.internal", LocalMethod: "GET", RemoteMethod: "GET", UpstreamProtocol: "spdy"},
+	} {
+		assert.Error(t, svc.RegisterEndpoint(e), e.LocalPath)
+	}
+}
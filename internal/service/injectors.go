@@ -0,0 +1,62 @@
+package service
+
+import (
+	"github.com/threetoes/peeper/internal/auth"
+	"github.com/threetoes/peeper/internal/config"
+	"github.com/threetoes/peeper/internal/secrets"
+)
+
+// newInjector builds the credential injector configured by e, resolving any secret references with resolver.
+// A nil injector is returned if no credentials are configured
+func newInjector(e *config.Credentials, resolver secrets.Resolver) (auth.CredentialInjector, error) {
+	if e.BasicAuth != nil && e.BasicAuth.Username != "" {
+		username, err := resolver.Resolve(e.BasicAuth.Username)
+		if err != nil {
+			return nil, err
+		}
+		password, err := resolver.Resolve(e.BasicAuth.Password)
+		if err != nil {
+			return nil, err
+		}
+		return auth.NewBasicAuth(username, password), nil
+	} else if e.OAuthConfig != nil {
+		conf := e.OAuthConfig
+		clientId, err := resolver.Resolve(conf.ClientId)
+		if err != nil {
+			return nil, err
+		}
+		clientSecret, err := resolver.Resolve(conf.ClientSecret)
+		if err != nil {
+			return nil, err
+		}
+		extraFormValues, err := resolveMap(conf.ExtraFormValues, resolver)
+		if err != nil {
+			return nil, err
+		}
+		return auth.NewOAuthInjector(conf.TokenEndpoint, clientId, clientSecret, extraFormValues), nil
+	} else if e.StaticKeyAuth != nil {
+		headers, err := resolveMap(e.StaticKeyAuth.Headers, resolver)
+		if err != nil {
+			return nil, err
+		}
+		return auth.NewStaticKeyInjector(headers), nil
+	} else if e.UserToken != nil {
+		return auth.NewUserTokenInjector(e.UserToken.Header), nil
+	}
+	return nil, nil
+}
+
+func resolveMap(values map[string]string, resolver secrets.Resolver) (map[string]string, error) {
+	if values == nil {
+		return nil, nil
+	}
+	resolved := make(map[string]string, len(values))
+	for k, v := range values {
+		r, err := resolver.Resolve(v)
+		if err != nil {
+			return nil, err
+		}
+		resolved[k] = r
+	}
+	return resolved, nil
+}
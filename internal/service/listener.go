@@ -0,0 +1,205 @@
+package service
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"os/user"
+	"strconv"
+	"strings"
+	"syscall"
+
+	"github.com/threetoes/peeper/internal/config"
+	"github.com/threetoes/peeper/internal/inbound"
+	"github.com/threetoes/peeper/internal/routes"
+)
+
+const unixScheme = "unix://"
+
+// unixSocket is how the listener's Unix socket file is set up. A uid or gid of -1 leaves it unchanged
+type unixSocket struct {
+	mode     os.FileMode
+	hasMode  bool
+	uid, gid int
+}
+
+// newUnixSocket checks the socket settings in conf, looking up its owner and group
+func newUnixSocket(conf *config.UnixSocketConfig) (*unixSocket, error) {
+	s := &unixSocket{uid: -1, gid: -1}
+	if conf.Mode != "" {
+		mode, err := strconv.ParseUint(conf.Mode, 8, 32)
+		if err != nil || mode > 0777 {
+			return nil, fmt.Errorf("invalid socket mode '%s'", conf.Mode)
+		}
+		s.mode, s.hasMode = os.FileMode(mode), true
+	}
+	if conf.Owner != "" {
+		id, err := lookupID(conf.Owner, func(name string) (string, error) {
+			u, err := user.Lookup(name)
+			if err != nil {
+				return "", err
+			}
+			return u.Uid, nil
+		})
+		if err != nil {
+			return nil, fmt.Errorf("invalid socket owner: %v", err)
+		}
+		s.uid = id
+	}
+	if conf.Group != "" {
+		id, err := lookupID(conf.Group, func(name string) (string, error) {
+			g, err := user.LookupGroup(name)
+			if err != nil {
+				return "", err
+			}
+			return g.Gid, nil
+		})
+		if err != nil {
+			return nil, fmt.Errorf("invalid socket group: %v", err)
+		}
+		s.gid = id
+	}
+	return s, nil
+}
+
+// lookupID returns name if it is a numeric ID, or looks it up otherwise
+func lookupID(name string, lookup func(string) (string, error)) (int, error) {
+	if id, err := strconv.Atoi(name); err == nil {
+		return id, nil
+	}
+	id, err := lookup(name)
+	if err != nil {
+		return 0, err
+	}
+	return strconv.Atoi(id)
+}
+
+// defaultListener names the listener configured by the network block
+const defaultListener = "default"
+
+// listener is one of the addresses the service is served on, along with the endpoints exposed on it
+type listener struct {
+	name   string
+	mux    *http.ServeMux
+	srv    *http.Server
+	routes map[string]*routes.Router
+	// clientIPs works out callers' IPs from the listener's trusted proxies
+	clientIPs *inbound.ClientIPResolver
+	// socket sets up the socket file when listening on a Unix socket
+	socket *unixSocket
+}
+
+// router returns the router for path, adding one to the listener if there isn't one yet
+func (l *listener) router(path string) *routes.Router {
+	if router, ok := l.routes[path]; ok {
+		return router
+	}
+	router := routes.NewRouter()
+	router.SetClientIPResolver(l.clientIPs)
+	l.routes[path] = router
+	l.mux.HandleFunc(path, router.ServeHTTP)
+	return router
+}
+
+// listen opens the listener's address, which is either a TCP address or a Unix socket
+func (l *listener) listen() (net.Listener, error) {
+	if !strings.HasPrefix(l.srv.Addr, unixScheme) {
+		addr := l.srv.Addr
+		if addr == "" {
+			addr = ":http"
+			if l.srv.TLSConfig != nil {
+				addr = ":https"
+			}
+		}
+		return net.Listen("tcp", addr)
+	}
+	path := strings.TrimPrefix(l.srv.Addr, unixScheme)
+	if err := removeStaleSocket(path); err != nil {
+		return nil, err
+	}
+	// Nothing but peeper's own user can connect until the socket has its mode and owner. The umask is process wide,
+	// but listeners are opened before anything else that creates files is running
+	umask := syscall.Umask(0177)
+	nl, err := net.Listen("unix", path)
+	syscall.Umask(umask)
+	if err != nil {
+		return nil, err
+	}
+	if err := l.socket.apply(path, os.FileMode(0777&^umask)); err != nil {
+		nl.Close()
+		return nil, err
+	}
+	return nl, nil
+}
+
+// serve serves requests on nl until the listener is shut down
+func (l *listener) serve(nl net.Listener) error {
+	if l.srv.TLSConfig != nil {
+		return l.srv.ServeTLS(nl, "", "")
+	}
+	return l.srv.Serve(nl)
+}
+
+// serveMux serves req with the listener's mux, letting the endpoints' middleware find client IPs the way this
+// listener does
+func (l *listener) serveMux(rw http.ResponseWriter, req *http.Request) {
+	l.mux.ServeHTTP(rw, req.WithContext(inbound.WithClientIPResolver(req.Context(), l.clientIPs)))
+}
+
+func newListener(ctx context.Context, name, addr string) *listener {
+	l := &listener{
+		name:      name,
+		mux:       http.NewServeMux(),
+		routes:    map[string]*routes.Router{},
+		clientIPs: &inbound.ClientIPResolver{},
+		srv: &http.Server{
+			Addr: addr,
+			BaseContext: func(net.Listener) context.Context {
+				return ctx
+			},
+		},
+	}
+	l.srv.Handler = accessLog(name, http.HandlerFunc(l.serveMux))
+	return l
+}
+
+// removeStaleSocket removes a socket left behind at path by a previous run, so it can be listened on again. Other
+// files, and sockets something is still listening on, are left alone
+func removeStaleSocket(path string) error {
+	info, err := os.Lstat(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if info.Mode()&os.ModeSocket == 0 {
+		return fmt.Errorf("can't listen on %s: it exists and isn't a socket", path)
+	}
+	if conn, err := net.Dial("unix", path); err == nil {
+		conn.Close()
+		return fmt.Errorf("can't listen on %s: something else is listening on it", path)
+	}
+	return os.Remove(path)
+}
+
+// apply sets the socket file's owner and then its mode, which is defaultMode unless one is configured
+func (s *unixSocket) apply(path string, defaultMode os.FileMode) error {
+	mode := defaultMode
+	if s != nil {
+		if s.uid != -1 || s.gid != -1 {
+			if err := os.Chown(path, s.uid, s.gid); err != nil {
+				return fmt.Errorf("could not set socket owner: %v", err)
+			}
+		}
+		if s.hasMode {
+			mode = s.mode
+		}
+	}
+	if err := os.Chmod(path, mode); err != nil {
+		return fmt.Errorf("could not set socket mode: %v", err)
+	}
+	return nil
+}
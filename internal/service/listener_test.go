@@ -0,0 +1,315 @@
+package service
+
+import (
+	"bufio"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/threetoes/peeper/internal/config"
+)
+
+func TestUnixSocketListener(t *testing.T) {
+	dir := t.TempDir()
+	upstreamSocket := filepath.Join(dir, "upstream.sock")
+	upstreamListener, err := net.Listen("unix", upstreamSocket)
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	upstream := httptest.NewUnstartedServer(http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		writer.Write([]byte(request.URL.Path))
+	}))
+	upstream.Listener.Close()
+	upstream.Listener = upstreamListener
+	upstream.Start()
+	defer upstream.Close()
+
+	// A socket left behind by an earlier run is replaced
+	socket := filepath.Join(dir, "peeper.sock")
+	stale, err := net.ListenUnix("unix", &net.UnixAddr{Name: socket, Net: "unix"})
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	stale.SetUnlinkOnClose(false)
+	stale.Close()
+
+	svc := New("unix://" + socket).(*NormalService)
+	err = svc.Configure(&config.AppOptions{Network: &config.NetworkConfig{Socket: &config.UnixSocketConfig{
+		Mode:  "0600",
+		Owner: strconv.Itoa(os.Getuid()),
+	}}})
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	err = svc.RegisterEndpoint(&config.Endpoint{
+		LocalPath:    "/containers",
+		RemotePath:   "unix://" + upstreamSocket + ":/v1.41/containers/json",
+		LocalMethod:  "GET",
+		RemoteMethod: "GET",
+	})
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	go svc.Start()
+	defer svc.Stop()
+
+	client := &http.Client{Transport: &http.Transport{
+		DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+			return (&net.Dialer{}).DialContext(ctx, "unix", socket)
+		},
+	}}
+	var resp *http.Response
+	for i := 0; i < 50; i++ {
+		if resp, err = client.Get("http://peeper/containers"); err == nil {
+			break
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	if assert.NoError(t, err) {
+		body, _ := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		assert.Equal(t, http.StatusOK, resp.StatusCode)
+		assert.Equal(t, "/v1.41/containers/json", string(body))
+	}
+	info, err := os.Stat(socket)
+	if assert.NoError(t, err) {
+		assert.Equal(t, os.FileMode(0600), info.Mode().Perm())
+	}
+
+	// Nothing else can take over a socket in use
+	assert.Error(t, New("unix://"+socket).Start())
+}
+
+func TestUnixSocketConfig(t *testing.T) {
+	tests := []struct {
+		name    string
+		conf    config.UnixSocketConfig
+		wantErr bool
+	}{
+		{name: "empty", conf: config.UnixSocketConfig{}},
+		{name: "numeric ids", conf: config.UnixSocketConfig{Mode: "660", Owner: "0", Group: "0"}},
+		{name: "bad mode", conf: config.UnixSocketConfig{Mode: "rw-rw----"}, wantErr: true},
+		{name: "mode too big", conf: config.UnixSocketConfig{Mode: "7777"}, wantErr: true},
+		{name: "unknown owner", conf: config.UnixSocketConfig{Owner: "no-such-peeper-user"}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := newUnixSocket(&tt.conf)
+			if tt.wantErr {
+				assert.Error(t, err)
+			} else {
+				assert.NoError(t, err)
+			}
+		})
+	}
+}
+
+// freeAddr returns a local address nothing is listening on
+func freeAddr(t *testing.T) string {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	defer listener.Close()
+	return listener.Addr().String()
+}
+
+func TestNamedListeners(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		writer.Write([]byte(request.URL.Path))
+	}))
+	defer upstream.Close()
+
+	network := func(addr string) *config.NetworkConfig {
+		host, port, _ := net.SplitHostPort(addr)
+		p, _ := strconv.Atoi(port)
+		return &config.NetworkConfig{BindInterface: host, BindPort: uint32(p)}
+	}
+	internalAddr, partnerAddr := freeAddr(t), freeAddr(t)
+	svc := New(internalAddr).(*NormalService)
+	err := svc.Configure(&config.AppOptions{
+		Network:   network(internalAddr),
+		Listeners: map[string]*config.NetworkConfig{"partners": network(partnerAddr)},
+	})
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	for _, e := range []*config.Endpoint{
+		{LocalPath: "/health", RemotePath: upstream.URL + "/health", LocalMethod: "GET", RemoteMethod: "GET", Listeners: []string{"default", "partners"}},
+		{LocalPath: "/admin", RemotePath: upstream.URL + "/admin", LocalMethod: "GET", RemoteMethod: "GET", Listeners: []string{"default"}},
+		{LocalPath: "/orders", RemotePath: upstream.URL + "/orders", LocalMethod: "GET", RemoteMethod: "GET", Listeners: []string{"partners"}},
+	} {
+		if !assert.NoError(t, svc.RegisterEndpoint(e)) {
+			t.FailNow()
+		}
+	}
+	assert.Error(t, svc.RegisterEndpoint(&config.Endpoint{LocalPath: "/x", RemotePath: upstream.URL, LocalMethod: "GET", RemoteMethod: "GET", Listeners: []string{"nope"}}))
+	assert.Error(t, svc.RegisterEndpoint(&config.Endpoint{LocalPath: "/y", RemotePath: upstream.URL, LocalMethod: "GET", RemoteMethod: "GET"}),
+		"endpoints have to name their listeners once there is more than one")
+
+	stopped := make(chan error)
+	go func() { stopped <- svc.Start() }()
+
+	get := func(addr, path string) int {
+		var resp *http.Response
+		var err error
+		for i := 0; i < 50; i++ {
+			if resp, err = http.Get("http://" + addr + path); err == nil {
+				break
+			}
+			time.Sleep(20 * time.Millisecond)
+		}
+		if !assert.NoError(t, err) {
+			return 0
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+	tests := []struct {
+		addr string
+		path string
+		want int
+	}{
+		{addr: internalAddr, path: "/health", want: http.StatusOK},
+		{addr: partnerAddr, path: "/health", want: http.StatusOK},
+		{addr: internalAddr, path: "/admin", want: http.StatusOK},
+		{addr: partnerAddr, path: "/admin", want: http.StatusNotFound},
+		{addr: internalAddr, path: "/orders", want: http.StatusNotFound},
+		{addr: partnerAddr, path: "/orders", want: http.StatusOK},
+	}
+	for _, tt := range tests {
+		t.Run(tt.addr+tt.path, func(t *testing.T) {
+			assert.Equal(t, tt.want, get(tt.addr, tt.path))
+		})
+	}
+
+	assert.NoError(t, svc.Stop())
+	assert.Equal(t, http.ErrServerClosed, <-stopped)
+	for _, addr := range []string{internalAddr, partnerAddr} {
+		_, err := net.Dial("tcp", addr)
+		assert.Error(t, err, "every listener is shut down")
+	}
+}
+
+func TestStop_OpenStream(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		writer.Header().Set("Content-Type", "text/event-stream")
+		writer.Write([]byte("data: hello\n\n"))
+		writer.(http.Flusher).Flush()
+		<-request.Context().Done()
+	}))
+	defer upstream.Close()
+
+	addr := freeAddr(t)
+	svc := New(addr).(*NormalService)
+	svc.shutdownTimeout = 100 * time.Millisecond
+	err := svc.RegisterEndpoint(&config.Endpoint{LocalPath: "/events", RemotePath: upstream.URL, LocalMethod: "GET", RemoteMethod: "GET"})
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	go svc.Start()
+
+	var resp *http.Response
+	for i := 0; i < 50; i++ {
+		if resp, err = http.Get("http://" + addr + "/events"); err == nil {
+			break
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	defer resp.Body.Close()
+	line, err := bufio.NewReader(resp.Body).ReadString('\n')
+	assert.NoError(t, err)
+	assert.Equal(t, "data: hello\n", line)
+
+	stopped := make(chan error)
+	go func() { stopped <- svc.Stop() }()
+	select {
+	case err := <-stopped:
+		assert.NoError(t, err)
+	case <-time.After(5 * time.Second):
+		t.Fatal("Stop waited for the stream to end")
+	}
+	_, err = ioutil.ReadAll(resp.Body)
+	assert.Error(t, err, "the stream is cut off")
+}
+
+func TestNamedListeners_SharedMiddleware(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {}))
+	defer upstream.Close()
+
+	svc := New(":0").(*NormalService)
+	err := svc.Configure(&config.AppOptions{
+		Network:   &config.NetworkConfig{TrustedProxies: []string{"10.0.0.1"}},
+		Listeners: map[string]*config.NetworkConfig{"partners": {}},
+	})
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	for _, e := range []*config.Endpoint{
+		{LocalPath: "/hooks", RemotePath: upstream.URL, LocalMethod: "POST", RemoteMethod: "POST", Listeners: []string{"default", "partners"},
+			Webhook: &config.WebhookConfig{Provider: "github", Secret: "whsec_test"}},
+		{LocalPath: "/office", RemotePath: upstream.URL, LocalMethod: "GET", RemoteMethod: "GET", Listeners: []string{"default", "partners"},
+			AllowCIDRs: []string{"192.168.0.0/16"}},
+	} {
+		if !assert.NoError(t, svc.RegisterEndpoint(e)) {
+			t.FailNow()
+		}
+	}
+	serve := func(l *listener, req *http.Request) int {
+		rw := httptest.NewRecorder()
+		l.srv.Handler.ServeHTTP(rw, req)
+		return rw.Code
+	}
+	defaultListener, partners := svc.listeners[0], svc.listeners[1]
+
+	const body = `{"action":"opened"}`
+	mac := hmac.New(sha256.New, []byte("whsec_test"))
+	mac.Write([]byte(body))
+	delivery := func() *http.Request {
+		req := httptest.NewRequest("POST", "/hooks", strings.NewReader(body))
+		req.Header.Set("X-Hub-Signature-256", "sha256="+hex.EncodeToString(mac.Sum(nil)))
+		return req
+	}
+	assert.Equal(t, http.StatusOK, serve(defaultListener, delivery()))
+	assert.Equal(t, http.StatusUnauthorized, serve(partners, delivery()), "replays are caught on every listener")
+
+	// Each listener still trusts only its own proxies
+	office := func() *http.Request {
+		req := httptest.NewRequest("GET", "/office", nil)
+		req.RemoteAddr = "10.0.0.1:1234"
+		req.Header.Set("X-Forwarded-For", "192.168.1.5")
+		return req
+	}
+	assert.Equal(t, http.StatusOK, serve(defaultListener, office()))
+	assert.Equal(t, http.StatusForbidden, serve(partners, office()))
+}
+
+func TestNamedListeners_Config(t *testing.T) {
+	err := New(":0").Configure(&config.AppOptions{Listeners: map[string]*config.NetworkConfig{"default": {}}})
+	assert.Error(t, err, "the network block's name can't be reused")
+	err = New(":0").Configure(&config.AppOptions{Listeners: map[string]*config.NetworkConfig{"partners": {Mode: "sideways"}}})
+	assert.Error(t, err)
+
+	// Without a network block only the named listeners are served, so endpoints don't need to name the only one
+	svc := New("").(*NormalService)
+	err = svc.Configure(&config.AppOptions{Listeners: map[string]*config.NetworkConfig{"partners": {BindPort: 9443}}})
+	if assert.NoError(t, err) && assert.Len(t, svc.listeners, 1) {
+		assert.Equal(t, "partners", svc.listeners[0].name)
+		assert.NoError(t, svc.RegisterEndpoint(&config.Endpoint{LocalPath: "/x", RemotePath: "http://upstream", LocalMethod: "GET", RemoteMethod: "GET"}))
+	}
+}
@@ -0,0 +1,141 @@
+package service
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/threetoes/peeper/internal/config"
+	"github.com/threetoes/peeper/internal/inbound"
+	"github.com/threetoes/peeper/internal/secrets"
+)
+
+// middlewareFor returns the middleware requests to e pass through before being forwarded, in the order they run.
+// Client IPs are found with the resolver of the listener each request arrives on. A signed URL stands in for the
+// caller's other credentials, but not for the IP lists, policy or ext_authz
+func (g *NormalService) middlewareFor(e *config.Endpoint) ([]inbound.Middleware, error) {
+	var middleware []inbound.Middleware
+	filter, err := inbound.NewIPFilter(e.AllowCIDRs, e.DenyCIDRs, nil)
+	if err != nil {
+		return nil, err
+	}
+	if filter != nil {
+		middleware = append(middleware, filter.Middleware(e.LocalPath))
+	}
+	// credentials check who the caller is, and can be skipped by callers with a signed URL
+	var credentials []inbound.Middleware
+	if e.ClientCert != nil {
+		credentials = append(credentials, inbound.ClientCertAuth(e.ClientCert))
+	}
+	if e.Webhook != nil {
+		secret, err := g.resolver.Resolve(e.Webhook.Secret)
+		if err != nil {
+			return nil, err
+		}
+		verifier, err := inbound.NewWebhookVerifier(e.Webhook, secrets.NewSecret(secret))
+		if err != nil {
+			return nil, fmt.Errorf("endpoint %s: %v", e.LocalPath, err)
+		}
+		credentials = append(credentials, verifier.Middleware())
+	}
+	// A signed URL stands in for the user session, leaving a user token injector with nothing to inject
+	if e.SignedURL && (e.UserSession || usesUserToken(e)) {
+		return nil, fmt.Errorf("endpoint %s needs a user session, which signed URLs don't carry", e.LocalPath)
+	}
+	if e.UserToken != nil && !e.UserSession {
+		return nil, fmt.Errorf("endpoint %s injects the user's token so needs user_session set", e.LocalPath)
+	}
+	if e.UserSession {
+		if g.bff == nil {
+			return nil, fmt.Errorf("endpoint %s requires a user session but oidc is not configured", e.LocalPath)
+		}
+		credentials = append(credentials, g.bff.Middleware())
+	}
+	if e.APIKeyAuth != nil {
+		if g.apiKeys == nil {
+			return nil, fmt.Errorf("endpoint %s requires API keys but api_keys is not configured", e.LocalPath)
+		}
+		credentials = append(credentials, inbound.APIKeyAuth(g.apiKeys, e.APIKeyAuth.Header, e.LocalPath, e.LocalMethod))
+	}
+	if e.JWTAuth != nil {
+		jwks, err := g.jwksFor(e.JWTAuth)
+		if err != nil {
+			return nil, err
+		}
+		validator := inbound.NewJWTValidator(jwks, e.JWTAuth)
+		credentials = append(credentials, inbound.JWTAuth(validator, e.JWTAuth.ForwardToken))
+	}
+	if e.Introspection != nil {
+		clientSecret, err := g.resolver.Resolve(e.Introspection.ClientSecret)
+		if err != nil {
+			return nil, err
+		}
+		introspector, err := inbound.NewIntrospector(e.Introspection, secrets.NewSecret(clientSecret))
+		if err != nil {
+			return nil, fmt.Errorf("endpoint %s: %v", e.LocalPath, err)
+		}
+		credentials = append(credentials, inbound.IntrospectionAuth(introspector, e.Introspection))
+	}
+	if e.SignedURL {
+		if g.urlSigner == nil {
+			return nil, fmt.Errorf("endpoint %s accepts signed URLs but signed_urls is not configured", e.LocalPath)
+		}
+		middleware = append(middleware, g.urlSigner.Middleware(credentials...))
+	} else {
+		middleware = append(middleware, credentials...)
+	}
+	if e.Policy != nil {
+		policy, err := inbound.NewPolicy(e.Policy, nil)
+		if err != nil {
+			return nil, fmt.Errorf("endpoint %s: %v", e.LocalPath, err)
+		}
+		middleware = append(middleware, policy.Middleware(e.LocalPath))
+	}
+	if e.ExtAuthz != nil {
+		authz, err := inbound.NewExtAuthz(e.ExtAuthz, nil)
+		if err != nil {
+			return nil, fmt.Errorf("endpoint %s: %v", e.LocalPath, err)
+		}
+		middleware = append(middleware, authz.Middleware(e.LocalPath))
+	}
+	return middleware, nil
+}
+
+func usesUserToken(e *config.Endpoint) bool {
+	if e.UserToken != nil {
+		return true
+	}
+	if e.Tenants != nil {
+		for _, c := range e.Tenants.Credentials {
+			if c != nil && c.UserToken != nil {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// jwksFor returns the JWKS for conf, sharing one cache between endpoints using the same JWKS
+func (g *NormalService) jwksFor(conf *config.JWTAuthConfig) (*inbound.JWKS, error) {
+	source := conf.JWKSURL
+	if source == "" {
+		source = conf.JWKSFile
+	}
+	if jwks, ok := g.jwks[source]; ok {
+		return jwks, nil
+	}
+	var jwks *inbound.JWKS
+	var err error
+	switch {
+	case conf.JWKSURL != "":
+		jwks, err = inbound.NewJWKSFromURL(conf.JWKSURL, time.Duration(conf.JWKSCacheDuration))
+	case conf.JWKSFile != "":
+		jwks, err = inbound.NewJWKSFromFile(conf.JWKSFile)
+	default:
+		return nil, fmt.Errorf("jwt needs one of jwks_url or jwks_file to be set")
+	}
+	if err != nil {
+		return nil, err
+	}
+	g.jwks[source] = jwks
+	return jwks, nil
+}
@@ -2,69 +2,447 @@ package service
 
 import (
 	"context"
+	"fmt"
+	"github.com/sirupsen/logrus"
+	"github.com/threetoes/peeper/internal/assertion"
 	"github.com/threetoes/peeper/internal/auth"
 	"github.com/threetoes/peeper/internal/config"
+	"github.com/threetoes/peeper/internal/inbound"
+	"github.com/threetoes/peeper/internal/logging"
+	"github.com/threetoes/peeper/internal/oidc"
 	"github.com/threetoes/peeper/internal/routes"
+	"github.com/threetoes/peeper/internal/secrets"
+	"github.com/threetoes/peeper/internal/tenant"
+	"net"
 	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
 )
 
+// defaultShutdownTimeout is how long Stop waits for requests in flight before cutting them off
+const defaultShutdownTimeout = 30 * time.Second
+
 type Service interface {
+	// Configure sets up the service-wide features in conf. It must be called before any endpoints are registered
+	Configure(conf *config.AppOptions) error
 	RegisterEndpoint(e *config.Endpoint) error
+	// SetSecretResolver sets the resolver used for secret references in endpoints registered after the call
+	SetSecretResolver(r secrets.Resolver)
+	// RefreshCredentials rebuilds every endpoint's credential injector from freshly resolved secrets
+	RefreshCredentials() error
 	Start() error
 	Stop() error
 }
 
+type boundInjector struct {
+	// name identifies the injector in errors
+	name        string
+	credentials *config.Credentials
+	injector    *auth.SwappableInjector
+}
+
 type NormalService struct {
-	routes  map[string]*routes.Router
-	mux     *http.ServeMux
-	httpSrv *http.Server
+	// listeners serve the endpoints, the first being the one the service was created with
+	listeners []*listener
+	resolver  secrets.Resolver
+	apiKeys   *inbound.APIKeyStore
+	jwks      map[string]*inbound.JWKS
+	urlSigner *inbound.URLSigner
+	bff       *oidc.BFF
+	asserter  *assertion.Signer
+	// injectorsLock guards injectors, which RefreshCredentials reads from whichever goroutine reports a secret change
+	injectorsLock sync.Mutex
+	injectors     []boundInjector
+	// ctx is cancelled when the service stops, ending any background work and requests still in flight
+	ctx    context.Context
+	cancel context.CancelFunc
+	// shutdownTimeout is how long Stop waits for requests in flight, such as event streams, to finish
+	shutdownTimeout time.Duration
 }
 
-func (g *NormalService) RegisterEndpoint(e *config.Endpoint) error {
-	if _, ok := g.routes[e.LocalPath]; !ok {
-		router := routes.NewRouter()
-		g.routes[e.LocalPath] = router
-		g.mux.HandleFunc(e.LocalPath, router.ServeHTTP)
+func (g *NormalService) Configure(conf *config.AppOptions) error {
+	if conf.Network != nil {
+		if err := g.configureListener(g.listeners[0], conf.Network, conf); err != nil {
+			return err
+		}
+	} else if len(conf.Listeners) > 0 {
+		// Only the named listeners are served
+		g.listeners = nil
+	}
+	names := make([]string, 0, len(conf.Listeners))
+	for name := range conf.Listeners {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		if name == defaultListener || g.listener(name) != nil {
+			return fmt.Errorf("listener name '%s' is already taken", name)
+		}
+		network := conf.Listeners[name]
+		l := newListener(g.ctx, name, network.Address())
+		if err := g.configureListener(l, network, conf); err != nil {
+			return fmt.Errorf("listener %s: %v", name, err)
+		}
+		g.listeners = append(g.listeners, l)
+	}
+	if conf.APIKeys != nil {
+		store, err := inbound.NewAPIKeyStore(conf.APIKeys)
+		if err != nil {
+			return err
+		}
+		g.apiKeys = store
+		go store.Run(g.ctx)
+	}
+	if conf.SignedURLs != nil {
+		key, err := g.resolver.Resolve(conf.SignedURLs.Key)
+		if err != nil {
+			return err
+		}
+		signer, err := inbound.NewURLSigner(conf.SignedURLs, secrets.NewSecret(key))
+		if err != nil {
+			return err
+		}
+		g.urlSigner = signer
+	}
+	if conf.OIDC != nil {
+		clientSecret, err := g.resolver.Resolve(conf.OIDC.ClientSecret)
+		if err != nil {
+			return err
+		}
+		cookieKey, err := g.resolver.Resolve(conf.OIDC.CookieKey)
+		if err != nil {
+			return err
+		}
+		bff, err := oidc.New(conf.OIDC, secrets.NewSecret(clientSecret), secrets.NewSecret(cookieKey))
+		if err != nil {
+			return fmt.Errorf("could not configure oidc: %v", err)
+		}
+		listeners, err := g.listenersNamed("oidc", conf.OIDC.Listeners)
+		if err != nil {
+			return err
+		}
+		for _, l := range listeners {
+			bff.Register(l.mux)
+		}
+		g.bff = bff
+	}
+	if conf.IdentityAssertions != nil {
+		signer, err := assertion.NewSigner(conf.IdentityAssertions)
+		if err != nil {
+			return err
+		}
+		listeners, err := g.listenersNamed("identity_assertions", conf.IdentityAssertions.Listeners)
+		if err != nil {
+			return err
+		}
+		for _, l := range listeners {
+			signer.Register(l.mux)
+		}
+		g.asserter = signer
 	}
-	if e.BasicAuth != nil && e.BasicAuth.Username != "" {
-		err := g.routes[e.LocalPath].RegisterCredentials(e.LocalMethod, auth.NewBasicAuth(e.BasicAuth.Username, e.BasicAuth.Password))
+	return nil
+}
+
+// configureListener sets up the listener l as network says
+func (g *NormalService) configureListener(l *listener, network *config.NetworkConfig, conf *config.AppOptions) error {
+	if network.TLS != nil {
+		certs, err := newCertStore(network.TLS)
 		if err != nil {
 			return err
 		}
-	} else if e.OAuthConfig != nil {
-		conf := e.OAuthConfig
-		injector := auth.NewOAuthInjector(conf.TokenEndpoint, conf.ClientId, conf.ClientSecret, conf.ExtraFormValues)
-		err := g.routes[e.LocalPath].RegisterCredentials(e.LocalMethod, injector)
+		tlsConf, err := newTLSConfig(network.TLS, certs)
 		if err != nil {
 			return err
 		}
-	} else if e.StaticKeyAuth != nil {
-		conf := e.StaticKeyAuth
-		injector := auth.NewStaticKeyInjector(conf.Headers)
-		if err := g.routes[e.LocalPath].RegisterCredentials(e.LocalMethod, injector); err != nil {
+		l.srv.TLSConfig = tlsConf
+		go certs.Run(g.ctx, network.TLS.ReloadInterval.Or(defaultReloadInterval))
+	}
+	if network.Socket != nil {
+		socket, err := newUnixSocket(network.Socket)
+		if err != nil {
 			return err
 		}
+		l.socket = socket
+	}
+	clientIPs, err := inbound.NewClientIPResolver(network.TrustedProxies)
+	if err != nil {
+		return err
 	}
-	return g.routes[e.LocalPath].RegisterRoute(e.LocalMethod, e.RemotePath, e.RemoteMethod)
+	l.clientIPs = clientIPs
+	var handler http.Handler = http.HandlerFunc(l.serveMux)
+	switch network.Mode {
+	case "", modeReverseProxy:
+	case modeForwardProxy:
+		if conf.ForwardProxy == nil {
+			return fmt.Errorf("the %s mode needs forward_proxy to be configured", modeForwardProxy)
+		}
+		proxy, err := g.newForwardProxy(conf.ForwardProxy)
+		if err != nil {
+			return err
+		}
+		handler = forwardProxyHandler(proxy, handler)
+	default:
+		return fmt.Errorf("unknown network mode '%s'", network.Mode)
+	}
+	filter, err := inbound.NewIPFilter(network.AllowCIDRs, network.DenyCIDRs, clientIPs)
+	if err != nil {
+		return err
+	}
+	if filter != nil {
+		handler = filter.Middleware("network")(handler)
+	}
+	l.srv.Handler = accessLog(l.name, handler)
+	return configureHTTP2(l.srv, network.HTTP2)
+}
+
+// listener returns the listener called name, or nil if there isn't one
+func (g *NormalService) listener(name string) *listener {
+	for _, l := range g.listeners {
+		if l.name == name {
+			return l
+		}
+	}
+	return nil
+}
+
+// listenersNamed returns the listeners called names, for what. Leaving names empty means every listener, which is
+// only allowed while there is just the one so that nothing is exposed on a listener by accident
+func (g *NormalService) listenersNamed(what string, names []string) ([]*listener, error) {
+	if len(names) == 0 {
+		if len(g.listeners) > 1 {
+			return nil, fmt.Errorf("%s needs listeners to be set as there is more than one listener", what)
+		}
+		return g.listeners, nil
+	}
+	var listeners []*listener
+	for _, name := range names {
+		l := g.listener(name)
+		if l == nil {
+			return nil, fmt.Errorf("%s: unknown listener '%s'", what, name)
+		}
+		listeners = append(listeners, l)
+	}
+	return listeners, nil
+}
+
+// sharedEndpoint is the part of an endpoint built once and shared by every listener it is exposed on, so state such
+// as webhook nonces and authorization caches is the same whichever listener a request arrives on
+type sharedEndpoint struct {
+	middleware      []inbound.Middleware
+	injector        auth.CredentialInjector
+	tenants         tenant.Resolver
+	tenantInjectors map[string]auth.CredentialInjector
+	protocol        string
+}
+
+func (g *NormalService) RegisterEndpoint(e *config.Endpoint) error {
+	listeners, err := g.listenersNamed("endpoint "+e.LocalPath, e.Listeners)
+	if err != nil {
+		return err
+	}
+	name := fmt.Sprintf("%s %s", e.LocalMethod, e.LocalPath)
+	shared := &sharedEndpoint{tenantInjectors: map[string]auth.CredentialInjector{}}
+	if e.Tenants != nil {
+		if !e.Credentials().IsEmpty() {
+			return fmt.Errorf("endpoint %s has tenants so its credentials belong under tenants.credentials", e.LocalPath)
+		}
+		if e.Tenants.Source == "jwt_claim" && e.JWTAuth == nil {
+			return fmt.Errorf("endpoint %s reads tenants from a JWT claim so needs jwt auth to verify the token", e.LocalPath)
+		}
+		if shared.tenants, err = tenant.New(e.Tenants); err != nil {
+			return err
+		}
+		for t, credentials := range e.Tenants.Credentials {
+			if credentials == nil {
+				credentials = &config.Credentials{}
+			}
+			injector, err := g.bindInjector(fmt.Sprintf("%s tenant %s", name, t), credentials)
+			if err != nil {
+				return err
+			}
+			// Tenants without credentials are still known, their requests are forwarded without any injected
+			shared.tenantInjectors[t] = injector
+		}
+	} else if shared.injector, err = g.bindInjector(name, e.Credentials()); err != nil {
+		return err
+	}
+	shared.protocol = e.UpstreamProtocol
+	if e.GRPC {
+		switch {
+		case shared.protocol == routes.ProtocolAuto || shared.protocol == routes.ProtocolHTTP1:
+			return fmt.Errorf("endpoint %s: gRPC needs the h2 or h2c upstream protocol", e.LocalPath)
+		case shared.protocol == "" && (strings.HasPrefix(e.RemotePath, "http://") || strings.HasPrefix(e.RemotePath, "unix://")):
+			shared.protocol = routes.ProtocolH2C
+		case shared.protocol == "":
+			shared.protocol = routes.ProtocolH2
+		}
+	}
+	if shared.protocol != "" {
+		if err := routes.CheckUpstreamProtocol(shared.protocol, e.RemotePath); err != nil {
+			return fmt.Errorf("endpoint %s: %v", e.LocalPath, err)
+		}
+	}
+	if e.IdentityAssertion != nil && g.asserter == nil {
+		return fmt.Errorf("endpoint %s asserts identities but identity_assertions is not configured", e.LocalPath)
+	}
+	if shared.middleware, err = g.middlewareFor(e); err != nil {
+		return err
+	}
+	for _, l := range listeners {
+		if err := g.registerOn(l, e, shared); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// registerOn exposes e on the listener l
+func (g *NormalService) registerOn(l *listener, e *config.Endpoint, shared *sharedEndpoint) error {
+	router := l.router(e.LocalPath)
+	for _, m := range shared.middleware {
+		router.RegisterMiddleware(e.LocalMethod, m)
+	}
+	if shared.tenants != nil {
+		if err := router.RegisterTenantResolver(e.LocalMethod, shared.tenants); err != nil {
+			return err
+		}
+		for t, injector := range shared.tenantInjectors {
+			if err := router.RegisterTenantCredentials(e.LocalMethod, t, injector); err != nil {
+				return err
+			}
+		}
+	} else if shared.injector != nil {
+		if err := router.RegisterCredentials(e.LocalMethod, shared.injector); err != nil {
+			return err
+		}
+	}
+	if e.GRPC {
+		router.SetGRPC(e.LocalMethod)
+	}
+	if shared.protocol != "" {
+		if err := router.SetUpstreamProtocol(e.LocalMethod, shared.protocol); err != nil {
+			return err
+		}
+	}
+	if e.UpgradeIdleTimeout > 0 {
+		router.SetUpgradeIdleTimeout(e.LocalMethod, time.Duration(e.UpgradeIdleTimeout))
+	}
+	if e.IdentityAssertion != nil {
+		if err := router.RegisterIdentityAssertion(e.LocalMethod, g.asserter.Injector(e.IdentityAssertion)); err != nil {
+			return err
+		}
+	}
+	return router.RegisterRoute(e.LocalMethod, e.RemotePath, e.RemoteMethod)
+}
+
+// bindInjector builds the injector for credentials and keeps track of it so it can be rebuilt when secrets change
+func (g *NormalService) bindInjector(name string, credentials *config.Credentials) (auth.CredentialInjector, error) {
+	if credentials.StaticKeyAuth != nil {
+		for header := range credentials.StaticKeyAuth.Headers {
+			logging.AddRedactedHeaders(header)
+		}
+	}
+	injector, err := newInjector(credentials, g.resolver)
+	if err != nil || injector == nil {
+		return nil, err
+	}
+	swappable := auth.NewSwappableInjector(injector)
+	g.injectorsLock.Lock()
+	g.injectors = append(g.injectors, boundInjector{name: name, credentials: credentials, injector: swappable})
+	g.injectorsLock.Unlock()
+	return swappable, nil
+}
+
+func (g *NormalService) SetSecretResolver(r secrets.Resolver) {
+	g.resolver = r
+}
+
+func (g *NormalService) RefreshCredentials() error {
+	g.injectorsLock.Lock()
+	injectors := append([]boundInjector{}, g.injectors...)
+	g.injectorsLock.Unlock()
+	var errs []string
+	for _, b := range injectors {
+		injector, err := newInjector(b.credentials, g.resolver)
+		if err != nil {
+			// Leave the old credentials in place rather than breaking the endpoint
+			errs = append(errs, fmt.Sprintf("%s: %v", b.name, err))
+			continue
+		}
+		b.injector.Swap(injector)
+	}
+	if len(errs) > 0 {
+		return fmt.Errorf("could not refresh credentials: %s", strings.Join(errs, "; "))
+	}
+	return nil
 }
 
 func (g *NormalService) Start() error {
-	return g.httpSrv.ListenAndServe()
+	// Every listener is opened before any serves, so a bad address stops the service before it is half up
+	var listeners []net.Listener
+	for _, l := range g.listeners {
+		nl, err := l.listen()
+		if err != nil {
+			for _, opened := range listeners {
+				opened.Close()
+			}
+			return fmt.Errorf("listener %s: %v", l.name, err)
+		}
+		listeners = append(listeners, nl)
+	}
+	errs := make(chan error, len(g.listeners))
+	for i, l := range g.listeners {
+		logrus.Infof("listener %s serving on %s", l.name, listeners[i].Addr())
+		go func(l *listener, nl net.Listener) {
+			errs <- l.serve(nl)
+		}(l, listeners[i])
+	}
+	err := <-errs
+	if err != http.ErrServerClosed {
+		// One listener failing takes the others down with it
+		g.Stop()
+	}
+	return err
 }
 
+// Stop shuts down every listener. Requests in flight get up to the shutdown timeout to finish, after which they are
+// cancelled, as streams may never end on their own. Upgraded connections aren't waited for at all
 func (g *NormalService) Stop() error {
-	return g.httpSrv.Shutdown(context.Background())
+	ctx, cancel := context.WithTimeout(context.Background(), g.shutdownTimeout)
+	defer cancel()
+	errs := make(chan error, len(g.listeners))
+	for _, l := range g.listeners {
+		go func(l *listener) {
+			err := l.srv.Shutdown(ctx)
+			if err == context.DeadlineExceeded {
+				logrus.Warnf("listener %s: cancelling requests still in flight after %s", l.name, g.shutdownTimeout)
+				g.cancel()
+				err = l.srv.Close()
+			}
+			errs <- err
+		}(l)
+	}
+	var err error
+	for range g.listeners {
+		if shutdownErr := <-errs; shutdownErr != nil && err == nil {
+			err = shutdownErr
+		}
+	}
+	g.cancel()
+	return err
 }
 
 func New(addr string) Service {
-	mux := http.NewServeMux()
+	ctx, cancel := context.WithCancel(context.Background())
 	g := &NormalService{
-		mux:    mux,
-		routes: map[string]*routes.Router{},
-		httpSrv: &http.Server{
-			Addr:    addr,
-			Handler: mux,
-		},
+		ctx:             ctx,
+		cancel:          cancel,
+		shutdownTimeout: defaultShutdownTimeout,
+		listeners:       []*listener{newListener(ctx, defaultListener, addr)},
+		jwks:            map[string]*inbound.JWKS{},
+		resolver:        secrets.Plaintext{},
 	}
 
 	return g
@@ -1,12 +1,17 @@
 package service
 
 import (
+	"crypto/sha256"
+	"fmt"
 	"github.com/stretchr/testify/assert"
 	"github.com/threetoes/peeper/internal/config"
 	"io/ioutil"
 	"net"
 	"net/http"
 	"net/http/httptest"
+	"net/url"
+	"path/filepath"
+	"strings"
 	"testing"
 	"time"
 )
@@ -135,3 +140,278 @@ func TestBasicAuthEndpoint(t *testing.T) {
 	assert.Equal(t, "test success I guess", string(body))
 	svc.Stop()
 }
+
+type mapResolver map[string]string
+
+func (m mapResolver) Resolve(value string) (string, error) {
+	if v, ok := m[value]; ok {
+		return v, nil
+	}
+	return value, nil
+}
+
+func TestRefreshCredentials(t *testing.T) {
+	testSvc := httptest.NewServer(http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		writer.Write([]byte(request.Header.Get("x-api-key")))
+	}))
+	defer testSvc.Close()
+
+	resolver := mapResolver{"ref:key": "first"}
+	svc := New(":0")
+	svc.SetSecretResolver(resolver)
+	err := svc.RegisterEndpoint(&config.Endpoint{
+		LocalPath:     "/testpath",
+		RemotePath:    testSvc.URL,
+		LocalMethod:   "GET",
+		RemoteMethod:  "GET",
+		StaticKeyAuth: &config.StaticKeyAuthConfig{Headers: map[string]string{"x-api-key": "ref:key"}},
+	})
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	mux := svc.(*NormalService).listeners[0].mux
+
+	rw := httptest.NewRecorder()
+	mux.ServeHTTP(rw, httptest.NewRequest("GET", "/testpath", nil))
+	assert.Equal(t, "first", rw.Body.String())
+
+	resolver["ref:key"] = "second"
+	assert.NoError(t, svc.RefreshCredentials())
+	rw = httptest.NewRecorder()
+	mux.ServeHTTP(rw, httptest.NewRequest("GET", "/testpath", nil))
+	assert.Equal(t, "second", rw.Body.String())
+}
+
+func TestRefreshCredentials_WhileRegistering(t *testing.T) {
+	svc := New(":0")
+	svc.SetSecretResolver(mapResolver{"ref:key": "first"})
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 50; i++ {
+			svc.RefreshCredentials()
+		}
+	}()
+	for i := 0; i < 50; i++ {
+		err := svc.RegisterEndpoint(&config.Endpoint{
+			LocalPath:     fmt.Sprintf("/path%d", i),
+			RemotePath:    "http://upstream",
+			LocalMethod:   "GET",
+			RemoteMethod:  "GET",
+			StaticKeyAuth: &config.StaticKeyAuthConfig{Headers: map[string]string{"x-api-key": "ref:key"}},
+		})
+		assert.NoError(t, err)
+	}
+	<-done
+}
+
+func TestTenantEndpoints(t *testing.T) {
+	testSvc := httptest.NewServer(http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		writer.Write([]byte(request.Header.Get("x-api-key")))
+	}))
+	defer testSvc.Close()
+
+	svc := New(":0").(*NormalService)
+	tenants := &config.TenantsConfig{Source: "header", Header: "X-Tenant", Credentials: map[string]*config.Credentials{
+		"acme":   {StaticKeyAuth: &config.StaticKeyAuthConfig{Headers: map[string]string{"x-api-key": "acme key"}}},
+		"globex": {},
+	}}
+	err := svc.RegisterEndpoint(&config.Endpoint{LocalPath: "/vendor", RemotePath: testSvc.URL, LocalMethod: "GET", RemoteMethod: "GET", Tenants: tenants})
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	tests := []struct {
+		tenant   string
+		wantCode int
+		wantBody string
+	}{
+		{tenant: "acme", wantCode: http.StatusOK, wantBody: "acme key"},
+		{tenant: "globex", wantCode: http.StatusOK, wantBody: ""},
+		{tenant: "initech", wantCode: http.StatusForbidden},
+	}
+	for _, tt := range tests {
+		t.Run(tt.tenant, func(t *testing.T) {
+			req := httptest.NewRequest("GET", "/vendor", nil)
+			req.Header.Set("X-Tenant", tt.tenant)
+			rw := httptest.NewRecorder()
+			svc.listeners[0].srv.Handler.ServeHTTP(rw, req)
+			assert.Equal(t, tt.wantCode, rw.Code)
+			assert.Equal(t, tt.wantBody, rw.Body.String())
+		})
+	}
+
+	err = svc.RegisterEndpoint(&config.Endpoint{LocalPath: "/both", RemotePath: testSvc.URL, LocalMethod: "GET", RemoteMethod: "GET", Tenants: tenants,
+		BasicAuth: &config.BasicAuthConfig{Username: "ignored", Password: "ignored"}})
+	assert.Error(t, err, "endpoint credentials would be ignored")
+	err = svc.RegisterEndpoint(&config.Endpoint{LocalPath: "/claims", RemotePath: testSvc.URL, LocalMethod: "GET", RemoteMethod: "GET",
+		Tenants: &config.TenantsConfig{Source: "jwt_claim", Claim: "tenant"}})
+	assert.Error(t, err, "claims are only read from tokens verified by jwt auth")
+}
+
+func TestCIDRFiltering(t *testing.T) {
+	testSvc := httptest.NewServer(http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		writer.WriteHeader(http.StatusOK)
+	}))
+	defer testSvc.Close()
+
+	svc := New(":0").(*NormalService)
+	err := svc.Configure(&config.AppOptions{Network: &config.NetworkConfig{
+		AllowCIDRs:     []string{"10.0.0.0/8"},
+		TrustedProxies: []string{"10.0.0.1"},
+	}})
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	for _, e := range []*config.Endpoint{
+		{LocalPath: "/cats", RemotePath: testSvc.URL, LocalMethod: "GET", RemoteMethod: "GET"},
+		{LocalPath: "/payroll", RemotePath: testSvc.URL, LocalMethod: "GET", RemoteMethod: "GET", AllowCIDRs: []string{"10.20.0.0/16"}},
+	} {
+		if !assert.NoError(t, svc.RegisterEndpoint(e)) {
+			t.FailNow()
+		}
+	}
+
+	tests := []struct {
+		name         string
+		path         string
+		remoteAddr   string
+		forwardedFor string
+		wantCode     int
+	}{
+		{name: "network allows", path: "/cats", remoteAddr: "10.1.1.1:1000", wantCode: http.StatusOK},
+		{name: "network denies", path: "/cats", remoteAddr: "203.0.113.1:1000", wantCode: http.StatusForbidden},
+		{name: "endpoint allows", path: "/payroll", remoteAddr: "10.20.1.1:1000", wantCode: http.StatusOK},
+		{name: "endpoint denies", path: "/payroll", remoteAddr: "10.1.1.1:1000", wantCode: http.StatusForbidden},
+		{name: "real client IP behind proxy", path: "/payroll", remoteAddr: "10.0.0.1:1000", forwardedFor: "10.20.5.5", wantCode: http.StatusOK},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest("GET", tt.path, nil)
+			req.RemoteAddr = tt.remoteAddr
+			if tt.forwardedFor != "" {
+				req.Header.Set("X-Forwarded-For", tt.forwardedFor)
+			}
+			rw := httptest.NewRecorder()
+			svc.listeners[0].srv.Handler.ServeHTTP(rw, req)
+			assert.Equal(t, tt.wantCode, rw.Code)
+		})
+	}
+}
+
+func TestSignedURLWithUserSession(t *testing.T) {
+	svc := New(":0").(*NormalService)
+	err := svc.Configure(&config.AppOptions{SignedURLs: &config.SignedURLsConfig{Key: strings.Repeat("k", 32)}})
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	tests := []struct {
+		name     string
+		endpoint *config.Endpoint
+	}{
+		{name: "user session", endpoint: &config.Endpoint{UserSession: true}},
+		{name: "user token", endpoint: &config.Endpoint{UserSession: true, UserToken: &config.UserTokenConfig{}}},
+		{name: "tenant user token", endpoint: &config.Endpoint{Tenants: &config.TenantsConfig{
+			Source:      "header",
+			Header:      "X-Tenant",
+			Credentials: map[string]*config.Credentials{"acme": {UserToken: &config.UserTokenConfig{}}},
+		}}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.endpoint.LocalPath = "/me"
+			tt.endpoint.RemotePath = "http://upstream/me"
+			tt.endpoint.SignedURL = true
+			err := svc.RegisterEndpoint(tt.endpoint)
+			if assert.Error(t, err) {
+				assert.Contains(t, err.Error(), "signed URLs")
+			}
+		})
+	}
+}
+
+func TestSignedURLWithAPIKey(t *testing.T) {
+	testSvc := httptest.NewServer(http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		writer.WriteHeader(http.StatusOK)
+	}))
+	defer testSvc.Close()
+
+	keyFile := filepath.Join(t.TempDir(), "keys.toml")
+	contents := fmt.Sprintf("[keys.reports]\nhash = \"sha256:%x\"\n", sha256.Sum256([]byte("reports-key")))
+	if !assert.NoError(t, ioutil.WriteFile(keyFile, []byte(contents), 0600)) {
+		t.FailNow()
+	}
+	svc := New(":0").(*NormalService)
+	err := svc.Configure(&config.AppOptions{
+		APIKeys:    &config.APIKeysConfig{KeyFile: keyFile},
+		SignedURLs: &config.SignedURLsConfig{Key: strings.Repeat("k", 32)},
+	})
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	err = svc.RegisterEndpoint(&config.Endpoint{LocalPath: "/reports", RemotePath: testSvc.URL, LocalMethod: "GET", RemoteMethod: "GET",
+		APIKeyAuth: &config.APIKeyAuthConfig{Header: "X-API-Key"}, SignedURL: true})
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	u, _ := url.Parse("http://peeper/reports?quarter=q3")
+	signed, err := svc.urlSigner.Sign(u, "GET", time.Now().Add(time.Hour))
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+
+	tests := []struct {
+		name     string
+		url      string
+		apiKey   string
+		wantCode int
+	}{
+		{name: "signed URL without an API key", url: signed.String(), wantCode: http.StatusOK},
+		{name: "API key without a signed URL", url: u.String(), apiKey: "reports-key", wantCode: http.StatusOK},
+		{name: "neither", url: u.String(), wantCode: http.StatusUnauthorized},
+		{name: "bad signature with an API key", url: strings.Replace(signed.String(), "q3", "q4", 1), apiKey: "reports-key", wantCode: http.StatusUnauthorized},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest("GET", tt.url, nil)
+			if tt.apiKey != "" {
+				req.Header.Set("X-API-Key", tt.apiKey)
+			}
+			rw := httptest.NewRecorder()
+			svc.listeners[0].srv.Handler.ServeHTTP(rw, req)
+			assert.Equal(t, tt.wantCode, rw.Code)
+		})
+	}
+}
+
+func TestForwardProxyMode(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		writer.Write([]byte(request.Header.Get("x-api-key")))
+	}))
+	defer upstream.Close()
+	upstreamURL, _ := url.Parse(upstream.URL)
+
+	assert.Error(t, New(":0").Configure(&config.AppOptions{Network: &config.NetworkConfig{Mode: "forward_proxy"}}))
+	assert.Error(t, New(":0").Configure(&config.AppOptions{Network: &config.NetworkConfig{Mode: "sideways"}}))
+
+	svc := New(":0").(*NormalService)
+	err := svc.Configure(&config.AppOptions{
+		Network: &config.NetworkConfig{Mode: "forward_proxy"},
+		ForwardProxy: &config.ForwardProxyConfig{Rules: []*config.ForwardProxyRule{{
+			Hosts:       []string{upstreamURL.Hostname()},
+			Credentials: &config.Credentials{StaticKeyAuth: &config.StaticKeyAuthConfig{Headers: map[string]string{"x-api-key": "vendor-key"}}},
+		}}},
+	})
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	assert.NoError(t, svc.RegisterEndpoint(&config.Endpoint{LocalPath: "/cats", RemotePath: upstream.URL, LocalMethod: "GET", RemoteMethod: "GET"}))
+
+	// Absolute-form requests go to the forward proxy, and the rest to the endpoints
+	rw := httptest.NewRecorder()
+	svc.listeners[0].srv.Handler.ServeHTTP(rw, httptest.NewRequest("GET", upstream.URL+"/anything", nil))
+	assert.Equal(t, "vendor-key", rw.Body.String())
+	rw = httptest.NewRecorder()
+	svc.listeners[0].srv.Handler.ServeHTTP(rw, httptest.NewRequest("GET", "/cats", nil))
+	assert.Equal(t, http.StatusOK, rw.Code)
+	assert.Empty(t, rw.Body.String())
+}
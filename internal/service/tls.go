@@ -0,0 +1,68 @@
+package service
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+
+	"github.com/threetoes/peeper/internal/config"
+)
+
+// tlsVersions are the minimum TLS versions that can be configured
+var tlsVersions = map[string]uint16{
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+// cipherSuite returns the ID of the secure TLS 1.2 cipher suite called name
+func cipherSuite(name string) (uint16, error) {
+	for _, suite := range tls.CipherSuites() {
+		if suite.Name == name {
+			return suite.ID, nil
+		}
+	}
+	return 0, fmt.Errorf("unknown or insecure cipher suite '%s'", name)
+}
+
+// newTLSConfig builds the listener's TLS config from conf, serving the certificates in certs
+func newTLSConfig(conf *config.TLSConfig, certs *certStore) (*tls.Config, error) {
+	tlsConf := &tls.Config{
+		GetCertificate: certs.GetCertificate,
+		MinVersion:     tls.VersionTLS12,
+	}
+	if conf.MinVersion != "" {
+		version, ok := tlsVersions[conf.MinVersion]
+		if !ok {
+			return nil, fmt.Errorf("unsupported min_version '%s', it must be 1.2 or 1.3", conf.MinVersion)
+		}
+		tlsConf.MinVersion = version
+	}
+	for _, name := range conf.CipherSuites {
+		id, err := cipherSuite(name)
+		if err != nil {
+			return nil, err
+		}
+		tlsConf.CipherSuites = append(tlsConf.CipherSuites, id)
+	}
+	if conf.ClientCAFile != "" {
+		pem, err := ioutil.ReadFile(conf.ClientCAFile)
+		if err != nil {
+			return nil, fmt.Errorf("could not read client CA file: %v", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("client CA file has no certificates")
+		}
+		tlsConf.ClientCAs = pool
+		switch conf.ClientAuth {
+		case "", "require":
+			tlsConf.ClientAuth = tls.RequireAndVerifyClientCert
+		case "optional":
+			tlsConf.ClientAuth = tls.VerifyClientCertIfGiven
+		default:
+			return nil, fmt.Errorf("unknown client_auth '%s'", conf.ClientAuth)
+		}
+	}
+	return tlsConf, nil
+}
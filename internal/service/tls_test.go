@@ -0,0 +1,365 @@
+package service
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/threetoes/peeper/internal/config"
+	"golang.org/x/crypto/ocsp"
+)
+
+type testCA struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+	pem  []byte
+}
+
+func newTestCA(t *testing.T) *testCA {
+	key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "peeper test CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	cert, _ := x509.ParseCertificate(der)
+	return &testCA{cert: cert, key: key, pem: pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})}
+}
+
+// issue returns a PEM encoded certificate and key signed by the CA
+func (c *testCA) issue(t *testing.T, template *x509.Certificate) ([]byte, []byte) {
+	key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	serial, _ := rand.Int(rand.Reader, big.NewInt(1<<62))
+	template.SerialNumber = serial
+	template.NotBefore = time.Now().Add(-time.Hour)
+	template.NotAfter = time.Now().Add(time.Hour)
+	template.KeyUsage = x509.KeyUsageDigitalSignature
+	der, err := x509.CreateCertificate(rand.Reader, template, c.cert, &key.PublicKey, c.key)
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	keyDer, _ := x509.MarshalECPrivateKey(key)
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer})
+}
+
+func (c *testCA) issueServer(t *testing.T, dir, name string, dnsNames ...string) (string, string) {
+	certPEM, keyPEM := c.issue(t, &x509.Certificate{
+		Subject:     pkix.Name{CommonName: dnsNames[0]},
+		DNSNames:    dnsNames,
+		IPAddresses: []net.IP{net.ParseIP("127.0.0.1")},
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	})
+	certFile, keyFile := filepath.Join(dir, name+".pem"), filepath.Join(dir, name+"-key.pem")
+	assert.NoError(t, os.WriteFile(certFile, certPEM, 0600))
+	assert.NoError(t, os.WriteFile(keyFile, keyPEM, 0600))
+	return certFile, keyFile
+}
+
+func (c *testCA) issueClient(t *testing.T, commonName string) tls.Certificate {
+	certPEM, keyPEM := c.issue(t, &x509.Certificate{
+		Subject:     pkix.Name{CommonName: commonName},
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	})
+	cert, err := tls.X509KeyPair(certPEM, keyPEM)
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	return cert
+}
+
+func (c *testCA) pool() *x509.CertPool {
+	pool := x509.NewCertPool()
+	pool.AddCert(c.cert)
+	return pool
+}
+
+func TestMutualTLSEndpoint(t *testing.T) {
+	ca := newTestCA(t)
+	dir := t.TempDir()
+	certFile, keyFile := ca.issueServer(t, dir, "server", "localhost")
+	caFile := filepath.Join(dir, "ca.pem")
+	assert.NoError(t, os.WriteFile(caFile, ca.pem, 0600))
+
+	upstream := httptest.NewServer(http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		writer.Write([]byte("payroll"))
+	}))
+	defer upstream.Close()
+
+	svc := New(":0").(*NormalService)
+	err := svc.Configure(&config.AppOptions{Network: &config.NetworkConfig{TLS: &config.TLSConfig{
+		CertFile:     certFile,
+		KeyFile:      keyFile,
+		ClientCAFile: caFile,
+	}}})
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	err = svc.RegisterEndpoint(&config.Endpoint{
+		LocalPath:    "/payroll",
+		RemotePath:   upstream.URL,
+		LocalMethod:  "GET",
+		RemoteMethod: "GET",
+		ClientCert:   &config.ClientCertConfig{AllowedSubjects: []string{"CN=payroll-app"}},
+	})
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+
+	listener := httptest.NewUnstartedServer(svc.listeners[0].srv.Handler)
+	listener.TLS = svc.listeners[0].srv.TLSConfig
+	listener.StartTLS()
+	defer listener.Close()
+
+	get := func(clientCert *tls.Certificate) (*http.Response, error) {
+		tlsConf := &tls.Config{RootCAs: ca.pool(), ServerName: "localhost"}
+		if clientCert != nil {
+			tlsConf.Certificates = []tls.Certificate{*clientCert}
+		}
+		client := &http.Client{Transport: &http.Transport{TLSClientConfig: tlsConf}}
+		return client.Get(listener.URL + "/payroll")
+	}
+
+	allowed := ca.issueClient(t, "payroll-app")
+	resp, err := get(&allowed)
+	if assert.NoError(t, err) {
+		body, _ := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		assert.Equal(t, http.StatusOK, resp.StatusCode)
+		assert.Equal(t, "payroll", string(body))
+	}
+
+	denied := ca.issueClient(t, "reports-app")
+	resp, err = get(&denied)
+	if assert.NoError(t, err) {
+		resp.Body.Close()
+		assert.Equal(t, http.StatusForbidden, resp.StatusCode)
+	}
+
+	_, err = get(nil)
+	assert.Error(t, err, "the handshake must fail without a client certificate")
+
+	untrusted := newTestCA(t).issueClient(t, "payroll-app")
+	_, err = get(&untrusted)
+	assert.Error(t, err, "the handshake must fail with a certificate from another CA")
+}
+
+// serveTLS accepts TLS connections with conf, completing their handshakes and echoing what they send
+func serveTLS(t *testing.T, conf *tls.Config) string {
+	listener, err := tls.Listen("tcp", "127.0.0.1:0", conf)
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	t.Cleanup(func() { listener.Close() })
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				io.Copy(conn, conn)
+			}()
+		}
+	}()
+	return listener.Addr().String()
+}
+
+func TestListenerCertificates(t *testing.T) {
+	ca := newTestCA(t)
+	dir := t.TempDir()
+	certFile, keyFile := ca.issueServer(t, dir, "default", "localhost")
+	apiCertFile, apiKeyFile := ca.issueServer(t, dir, "api", "api.example.com")
+	conf := &config.TLSConfig{
+		CertFile:     certFile,
+		KeyFile:      keyFile,
+		Certificates: []*config.CertificateConfig{{CertFile: apiCertFile, KeyFile: apiKeyFile}},
+	}
+	certs, err := newCertStore(conf)
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	tlsConf, err := newTLSConfig(conf, certs)
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	addr := serveTLS(t, tlsConf)
+
+	dial := func(serverName string) (*tls.Conn, error) {
+		return tls.Dial("tcp", addr, &tls.Config{RootCAs: ca.pool(), ServerName: serverName, InsecureSkipVerify: serverName == ""})
+	}
+	served := func(serverName string) *x509.Certificate {
+		conn, err := dial(serverName)
+		if !assert.NoError(t, err) {
+			t.FailNow()
+		}
+		defer conn.Close()
+		return conn.ConnectionState().PeerCertificates[0]
+	}
+
+	tests := []struct {
+		serverName string
+		want       string
+	}{
+		{serverName: "api.example.com", want: "api.example.com"},
+		{serverName: "localhost", want: "localhost"},
+		{serverName: "", want: "localhost"},
+	}
+	for _, tt := range tests {
+		t.Run("sni "+tt.serverName, func(t *testing.T) {
+			assert.Equal(t, tt.want, served(tt.serverName).Subject.CommonName)
+		})
+	}
+
+	// A connection made before the certificate is rotated carries on afterwards
+	open, err := dial("api.example.com")
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	defer open.Close()
+	before := served("api.example.com")
+
+	certs.refresh()
+	assert.Equal(t, before.SerialNumber, served("api.example.com").SerialNumber, "unchanged files aren't reloaded")
+
+	ca.issueServer(t, dir, "api", "api.example.com")
+	later := time.Now().Add(time.Minute)
+	assert.NoError(t, os.Chtimes(apiCertFile, later, later))
+	certs.refresh()
+	assert.NotEqual(t, before.SerialNumber, served("api.example.com").SerialNumber, "the rotated certificate is served")
+
+	_, err = open.Write([]byte("ping"))
+	assert.NoError(t, err)
+	reply := make([]byte, 4)
+	_, err = io.ReadFull(open, reply)
+	assert.NoError(t, err)
+	assert.Equal(t, "ping", string(reply))
+
+	// A broken file leaves the last good certificate in place
+	assert.NoError(t, os.WriteFile(apiCertFile, []byte("not a certificate"), 0600))
+	assert.NoError(t, os.Chtimes(apiCertFile, later.Add(time.Minute), later.Add(time.Minute)))
+	rotated := served("api.example.com")
+	certs.refresh()
+	assert.Equal(t, rotated.SerialNumber, served("api.example.com").SerialNumber)
+}
+
+func TestListenerTLSOptions(t *testing.T) {
+	ca := newTestCA(t)
+	certFile, keyFile := ca.issueServer(t, t.TempDir(), "server", "localhost")
+	newConf := func(conf *config.TLSConfig) (*tls.Config, error) {
+		conf.CertFile, conf.KeyFile = certFile, keyFile
+		certs, err := newCertStore(conf)
+		if err != nil {
+			return nil, err
+		}
+		return newTLSConfig(conf, certs)
+	}
+
+	tlsConf, err := newConf(&config.TLSConfig{MinVersion: "1.3"})
+	if assert.NoError(t, err) {
+		addr := serveTLS(t, tlsConf)
+		_, err := tls.Dial("tcp", addr, &tls.Config{RootCAs: ca.pool(), ServerName: "localhost", MaxVersion: tls.VersionTLS12})
+		assert.Error(t, err, "TLS 1.2 callers are turned away")
+	}
+
+	tlsConf, err = newConf(&config.TLSConfig{CipherSuites: []string{"TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384"}})
+	if assert.NoError(t, err) {
+		addr := serveTLS(t, tlsConf)
+		conn, err := tls.Dial("tcp", addr, &tls.Config{RootCAs: ca.pool(), ServerName: "localhost", MaxVersion: tls.VersionTLS12})
+		if assert.NoError(t, err) {
+			assert.Equal(t, tls.TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384, conn.ConnectionState().CipherSuite)
+			conn.Close()
+		}
+	}
+
+	_, err = newConf(&config.TLSConfig{MinVersion: "1.0"})
+	assert.Error(t, err)
+	_, err = newConf(&config.TLSConfig{CipherSuites: []string{"TLS_RSA_WITH_RC4_128_SHA"}})
+	assert.Error(t, err, "insecure suites can't be used")
+	_, err = newConf(&config.TLSConfig{Certificates: []*config.CertificateConfig{{CertFile: certFile}}})
+	assert.Error(t, err)
+}
+
+func TestListenerOCSPStapling(t *testing.T) {
+	ca := newTestCA(t)
+	var responses int
+	responder := httptest.NewServer(http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		body, _ := ioutil.ReadAll(request.Body)
+		req, err := ocsp.ParseRequest(body)
+		if !assert.NoError(t, err) {
+			writer.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		responses++
+		resp, err := ocsp.CreateResponse(ca.cert, ca.cert, ocsp.Response{
+			Status:       ocsp.Good,
+			SerialNumber: req.SerialNumber,
+			ThisUpdate:   time.Now().Add(-time.Minute),
+			NextUpdate:   time.Now().Add(time.Hour),
+		}, ca.key)
+		assert.NoError(t, err)
+		writer.Write(resp)
+	}))
+	defer responder.Close()
+
+	dir := t.TempDir()
+	certPEM, keyPEM := ca.issue(t, &x509.Certificate{
+		Subject:     pkix.Name{CommonName: "localhost"},
+		DNSNames:    []string{"localhost"},
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		OCSPServer:  []string{responder.URL},
+	})
+	certFile, keyFile := filepath.Join(dir, "server.pem"), filepath.Join(dir, "server-key.pem")
+	assert.NoError(t, os.WriteFile(certFile, append(certPEM, ca.pem...), 0600))
+	assert.NoError(t, os.WriteFile(keyFile, keyPEM, 0600))
+
+	conf := &config.TLSConfig{CertFile: certFile, KeyFile: keyFile, OCSPStapling: true}
+	certs, err := newCertStore(conf)
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	tlsConf, err := newTLSConfig(conf, certs)
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	conn, err := tls.Dial("tcp", serveTLS(t, tlsConf), &tls.Config{RootCAs: ca.pool(), ServerName: "localhost"})
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	defer conn.Close()
+	state := conn.ConnectionState()
+	stapled, err := ocsp.ParseResponseForCert(state.OCSPResponse, state.PeerCertificates[0], ca.cert)
+	if assert.NoError(t, err) {
+		assert.Equal(t, ocsp.Good, stapled.Status)
+	}
+
+	// Responses are refetched half way through their validity
+	certs.refresh()
+	assert.Equal(t, 1, responses)
+	certs.now = func() time.Time { return time.Now().Add(31 * time.Minute) }
+	certs.refresh()
+	assert.Equal(t, 2, responses)
+}
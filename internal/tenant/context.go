@@ -0,0 +1,16 @@
+package tenant
+
+import "context"
+
+type tenantKey struct{}
+
+// WithTenant returns a copy of ctx carrying the tenant a request belongs to
+func WithTenant(ctx context.Context, tenant string) context.Context {
+	return context.WithValue(ctx, tenantKey{}, tenant)
+}
+
+// From returns the tenant stored in ctx, or an empty string if the request's endpoint has no tenants
+func From(ctx context.Context) string {
+	tenant, _ := ctx.Value(tenantKey{}).(string)
+	return tenant
+}
@@ -0,0 +1,106 @@
+package tenant
+
+import (
+	"fmt"
+	"net/http"
+
+	"github.com/threetoes/peeper/internal/config"
+	"github.com/threetoes/peeper/internal/inbound"
+)
+
+// Resolver works out which tenant an inbound request belongs to
+type Resolver interface {
+	Tenant(req *http.Request) (string, error)
+}
+
+// HeaderResolver reads the tenant from an inbound header. Callers can set the header to anything, so it should
+// only be relied on when callers are trusted or authenticated some other way
+type HeaderResolver struct {
+	header string
+}
+
+func (h *HeaderResolver) Tenant(req *http.Request) (string, error) {
+	tenant := req.Header.Get(h.header)
+	if tenant == "" {
+		return "", fmt.Errorf("request has no %s header", h.header)
+	}
+	return tenant, nil
+}
+
+func NewHeaderResolver(header string) *HeaderResolver {
+	return &HeaderResolver{header: header}
+}
+
+// CertificateResolver reads the tenant from a field in the subject of the verified client certificate
+type CertificateResolver struct {
+	field string
+}
+
+func (c *CertificateResolver) Tenant(req *http.Request) (string, error) {
+	if req.TLS == nil || len(req.TLS.VerifiedChains) == 0 || len(req.TLS.VerifiedChains[0]) == 0 {
+		return "", fmt.Errorf("request has no verified client certificate")
+	}
+	subject := req.TLS.VerifiedChains[0][0].Subject
+	var values []string
+	switch c.field {
+	case "", "cn":
+		values = []string{subject.CommonName}
+	case "o":
+		values = subject.Organization
+	case "ou":
+		values = subject.OrganizationalUnit
+	}
+	if len(values) == 0 || values[0] == "" {
+		return "", fmt.Errorf("client certificate subject has no %s", c.field)
+	}
+	return values[0], nil
+}
+
+func NewCertificateResolver(field string) (*CertificateResolver, error) {
+	switch field {
+	case "", "cn", "o", "ou":
+		return &CertificateResolver{field: field}, nil
+	}
+	return nil, fmt.Errorf("unknown client certificate subject field '%s'", field)
+}
+
+// JWTClaimResolver reads the tenant from a claim of the caller's token. Only tokens the endpoint's jwt auth has
+// verified are read, so the endpoint must have jwt auth, which runs before the tenant is resolved
+type JWTClaimResolver struct {
+	claim string
+}
+
+func (j *JWTClaimResolver) Tenant(req *http.Request) (string, error) {
+	identity := inbound.IdentityFrom(req.Context())
+	if identity == nil || identity.Method != "jwt" {
+		return "", fmt.Errorf("request has no verified token")
+	}
+	tenant, ok := identity.Claims[j.claim].(string)
+	if !ok || tenant == "" {
+		return "", fmt.Errorf("token has no '%s' claim", j.claim)
+	}
+	return tenant, nil
+}
+
+func NewJWTClaimResolver(claim string) *JWTClaimResolver {
+	return &JWTClaimResolver{claim: claim}
+}
+
+// New builds the Resolver described by conf
+func New(conf *config.TenantsConfig) (Resolver, error) {
+	switch conf.Source {
+	case "header":
+		if conf.Header == "" {
+			return nil, fmt.Errorf("tenant source 'header' needs header to be set")
+		}
+		return NewHeaderResolver(conf.Header), nil
+	case "client_cert":
+		return NewCertificateResolver(conf.SubjectField)
+	case "jwt_claim":
+		if conf.Claim == "" {
+			return nil, fmt.Errorf("tenant source 'jwt_claim' needs claim to be set")
+		}
+		return NewJWTClaimResolver(conf.Claim), nil
+	}
+	return nil, fmt.Errorf("unknown tenant source '%s'", conf.Source)
+}
@@ -0,0 +1,96 @@
+package tenant
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/threetoes/peeper/internal/config"
+	"github.com/threetoes/peeper/internal/inbound"
+)
+
+func TestHeaderResolver_Tenant(t *testing.T) {
+	r, err := New(&config.TenantsConfig{Source: "header", Header: "X-Tenant"})
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	req := httptest.NewRequest("GET", "/", nil)
+	_, err = r.Tenant(req)
+	assert.Error(t, err)
+	req.Header.Set("X-Tenant", "acme")
+	got, err := r.Tenant(req)
+	assert.NoError(t, err)
+	assert.Equal(t, "acme", got)
+}
+
+func TestCertificateResolver_Tenant(t *testing.T) {
+	cert := &x509.Certificate{Subject: pkix.Name{
+		CommonName:         "svc.acme.internal",
+		Organization:       []string{"acme"},
+		OrganizationalUnit: []string{"billing"},
+	}}
+	tests := []struct {
+		field string
+		want  string
+	}{
+		{field: "", want: "svc.acme.internal"},
+		{field: "cn", want: "svc.acme.internal"},
+		{field: "o", want: "acme"},
+		{field: "ou", want: "billing"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.field, func(t *testing.T) {
+			r, err := NewCertificateResolver(tt.field)
+			if !assert.NoError(t, err) {
+				t.FailNow()
+			}
+			req := httptest.NewRequest("GET", "/", nil)
+			_, err = r.Tenant(req)
+			assert.Error(t, err, "requests without a verified certificate have no tenant")
+			req.TLS = &tls.ConnectionState{VerifiedChains: [][]*x509.Certificate{{cert}}}
+			got, err := r.Tenant(req)
+			assert.NoError(t, err)
+			assert.Equal(t, tt.want, got)
+		})
+	}
+	_, err := NewCertificateResolver("serial")
+	assert.Error(t, err)
+}
+
+func TestJWTClaimResolver_Tenant(t *testing.T) {
+	r, err := New(&config.TenantsConfig{Source: "jwt_claim", Claim: "tenant"})
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	tests := []struct {
+		name     string
+		identity *inbound.Identity
+		want     string
+		wantErr  bool
+	}{
+		{name: "verified token", identity: &inbound.Identity{Method: "jwt", Claims: map[string]interface{}{"tenant": "acme"}}, want: "acme"},
+		{name: "no claim", identity: &inbound.Identity{Method: "jwt", Claims: map[string]interface{}{"sub": "someone"}}, wantErr: true},
+		{name: "other method", identity: &inbound.Identity{Method: "api_key", Claims: map[string]interface{}{"tenant": "acme"}}, wantErr: true},
+		{name: "not authenticated", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest("GET", "/", nil)
+			if tt.identity != nil {
+				req = req.WithContext(inbound.WithIdentity(req.Context(), tt.identity))
+			}
+			got, err := r.Tenant(req)
+			if tt.wantErr {
+				assert.Error(t, err)
+				return
+			}
+			assert.NoError(t, err)
+			assert.Equal(t, tt.want, got)
+		})
+	}
+	_, err = New(&config.TenantsConfig{Source: "jwt_claim"})
+	assert.Error(t, err)
+}
@@ -0,0 +1,163 @@
+package vault
+
+// Referred to here for the API https://developer.hashicorp.com/vault/api-docs
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"sync"
+)
+
+// Secret is the response body Vault returns for secret reads, renewals and logins
+type Secret struct {
+	LeaseId       string                 `json:"lease_id"`
+	LeaseDuration int                    `json:"lease_duration"`
+	Renewable     bool                   `json:"renewable"`
+	Data          map[string]interface{} `json:"data"`
+	Auth          *SecretAuth            `json:"auth"`
+}
+
+// SecretAuth is the auth block returned by logins and token renewals
+type SecretAuth struct {
+	ClientToken   string `json:"client_token"`
+	LeaseDuration int    `json:"lease_duration"`
+	Renewable     bool   `json:"renewable"`
+}
+
+// Fields returns the secret's values. KV v2 nests them a level deeper than other engines, so that is unwrapped
+func (s *Secret) Fields() map[string]interface{} {
+	if nested, ok := s.Data["data"].(map[string]interface{}); ok {
+		if _, ok := s.Data["metadata"]; ok {
+			return nested
+		}
+	}
+	return s.Data
+}
+
+// Client is a minimal Vault HTTP API client
+type Client struct {
+	address   string
+	namespace string
+	client    *http.Client
+
+	lock  sync.RWMutex
+	token string
+}
+
+// SetToken sets the token used to authenticate requests
+func (c *Client) SetToken(token string) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.token = token
+}
+
+func (c *Client) getToken() string {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+	return c.token
+}
+
+// Read reads the secret at path, for example `secret/data/cats` or `database/creds/readonly`
+func (c *Client) Read(path string) (*Secret, error) {
+	return c.do(http.MethodGet, path, nil)
+}
+
+// LoginAppRole logs in with the AppRole auth method mounted at mountPath and returns the auth block
+func (c *Client) LoginAppRole(mountPath, roleId, secretId string) (*SecretAuth, error) {
+	secret, err := c.do(http.MethodPost, fmt.Sprintf("auth/%s/login", mountPath), map[string]interface{}{
+		"role_id":   roleId,
+		"secret_id": secretId,
+	})
+	if err != nil {
+		return nil, err
+	}
+	if secret.Auth == nil {
+		return nil, fmt.Errorf("approle login returned no auth block")
+	}
+	return secret.Auth, nil
+}
+
+// RenewSelf renews the client's own token
+func (c *Client) RenewSelf() (*SecretAuth, error) {
+	secret, err := c.do(http.MethodPost, "auth/token/renew-self", map[string]interface{}{})
+	if err != nil {
+		return nil, err
+	}
+	if secret.Auth == nil {
+		return nil, fmt.Errorf("token renewal returned no auth block")
+	}
+	return secret.Auth, nil
+}
+
+// RenewLease extends the lease leaseId by increment seconds
+func (c *Client) RenewLease(leaseId string, increment int) (*Secret, error) {
+	return c.do(http.MethodPut, "sys/leases/renew", map[string]interface{}{
+		"lease_id":  leaseId,
+		"increment": increment,
+	})
+}
+
+// RevokeLease revokes the lease leaseId, so the secret behind it stops working
+func (c *Client) RevokeLease(leaseId string) error {
+	_, err := c.do(http.MethodPut, "sys/leases/revoke", map[string]interface{}{
+		"lease_id": leaseId,
+	})
+	return err
+}
+
+func (c *Client) do(method, path string, body map[string]interface{}) (*Secret, error) {
+	var reqBody []byte
+	if body != nil {
+		var err error
+		if reqBody, err = json.Marshal(body); err != nil {
+			return nil, err
+		}
+	}
+	req, err := http.NewRequest(method, fmt.Sprintf("%s/v1/%s", c.address, strings.TrimPrefix(path, "/")), bytes.NewReader(reqBody))
+	if err != nil {
+		return nil, err
+	}
+	if token := c.getToken(); token != "" {
+		req.Header.Set("X-Vault-Token", token)
+	}
+	if c.namespace != "" {
+		req.Header.Set("X-Vault-Namespace", c.namespace)
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNoContent {
+		return &Secret{}, nil
+	}
+	if resp.StatusCode != http.StatusOK {
+		// Vault error bodies can echo request details, so they are deliberately left out of the error
+		return nil, fmt.Errorf("vault returned status code %d for %s %s", resp.StatusCode, method, path)
+	}
+	respBody, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	var secret Secret
+	if err := json.Unmarshal(respBody, &secret); err != nil {
+		return nil, err
+	}
+	return &secret, nil
+}
+
+// NewClient returns a Client for the Vault server at address
+func NewClient(address, namespace string) *Client {
+	return &Client{
+		address:   strings.TrimSuffix(address, "/"),
+		namespace: namespace,
+		client:    http.DefaultClient,
+	}
+}
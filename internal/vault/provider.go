@@ -0,0 +1,323 @@
+package vault
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"reflect"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/threetoes/peeper/internal/config"
+)
+
+// ReferencePrefix marks a config value as a Vault secret reference, for example `vault:secret/data/cats#api_key`
+const ReferencePrefix = "vault:"
+
+const (
+	defaultKVRefreshInterval = 5 * time.Minute
+	defaultCheckInterval     = time.Second
+	defaultAppRoleMount      = "approle"
+)
+
+type cachedSecret struct {
+	fields        map[string]interface{}
+	leaseId       string
+	leaseDuration int
+	renewable     bool
+	refreshAt     time.Time
+}
+
+// Provider resolves `vault:` references in config values and keeps the secrets behind them fresh. Leases are
+// renewed before they expire, and secrets that can't be renewed any further are re-read. Listeners registered with
+// OnChange are told whenever a secret's value changes so they can rebuild anything using it. Once they all have, the
+// leases of the replaced secrets are revoked
+type Provider struct {
+	client        *Client
+	conf          *config.VaultConfig
+	kvRefresh     time.Duration
+	checkInterval time.Duration
+
+	// refreshLock keeps refreshes from overlapping. lock only guards the fields below it and is never held while
+	// talking to Vault, so lookups of cached secrets aren't held up by a slow Vault
+	refreshLock    sync.Mutex
+	lock           sync.Mutex
+	secrets        map[string]*cachedSecret
+	tokenRefreshAt time.Time
+	tokenRenewable bool
+	listeners      []func() error
+}
+
+// Login authenticates with Vault using the configured AppRole or token file
+func (p *Provider) Login() error {
+	return p.login(time.Now())
+}
+
+func (p *Provider) login(now time.Time) error {
+	if p.conf.AppRole != nil {
+		role := p.conf.AppRole
+		secretId := role.SecretId
+		if role.SecretIdFile != "" {
+			contents, err := ioutil.ReadFile(role.SecretIdFile)
+			if err != nil {
+				return fmt.Errorf("could not read approle secret ID file: %v", err)
+			}
+			secretId = strings.TrimSpace(string(contents))
+		}
+		mount := role.MountPath
+		if mount == "" {
+			mount = defaultAppRoleMount
+		}
+		auth, err := p.client.LoginAppRole(mount, role.RoleId, secretId)
+		if err != nil {
+			return fmt.Errorf("approle login failed: %v", err)
+		}
+		p.client.SetToken(auth.ClientToken)
+		p.lock.Lock()
+		p.scheduleToken(now, auth)
+		p.lock.Unlock()
+		return nil
+	}
+	if p.conf.TokenFile != "" {
+		contents, err := ioutil.ReadFile(p.conf.TokenFile)
+		if err != nil {
+			return fmt.Errorf("could not read vault token file: %v", err)
+		}
+		p.client.SetToken(strings.TrimSpace(string(contents)))
+		p.lock.Lock()
+		p.tokenRenewable = false
+		p.tokenRefreshAt = now.Add(p.kvRefresh)
+		p.lock.Unlock()
+		return nil
+	}
+	return fmt.Errorf("vault config needs either approle or token_file set")
+}
+
+func (p *Provider) scheduleToken(now time.Time, auth *SecretAuth) {
+	p.tokenRenewable = auth.Renewable
+	if auth.LeaseDuration <= 0 {
+		// Tokens without a TTL never need refreshing
+		p.tokenRefreshAt = time.Time{}
+		return
+	}
+	p.tokenRefreshAt = now.Add(renewAfter(auth.LeaseDuration))
+}
+
+// Resolve implements secrets.Resolver. Values without the `vault:` prefix are returned as they are
+func (p *Provider) Resolve(value string) (string, error) {
+	if !strings.HasPrefix(value, ReferencePrefix) {
+		return value, nil
+	}
+	ref := strings.TrimPrefix(value, ReferencePrefix)
+	idx := strings.LastIndex(ref, "#")
+	if idx <= 0 || idx == len(ref)-1 {
+		return "", fmt.Errorf("vault reference '%s' must be of the form vault:<path>#<field>", value)
+	}
+	path, field := ref[:idx], ref[idx+1:]
+
+	p.lock.Lock()
+	secret, ok := p.secrets[path]
+	p.lock.Unlock()
+	if !ok {
+		fresh, err := p.read(time.Now(), path)
+		if err != nil {
+			return "", err
+		}
+		p.lock.Lock()
+		if secret, ok = p.secrets[path]; !ok {
+			secret = fresh
+			p.secrets[path] = fresh
+		}
+		p.lock.Unlock()
+		if ok && fresh.leaseId != "" {
+			// Another lookup read the secret first, and every field of a dynamic secret must come from the one lease
+			p.revoke(fresh.leaseId)
+		}
+	}
+	raw, ok := secret.fields[field]
+	if !ok {
+		return "", fmt.Errorf("vault secret '%s' has no field '%s'", path, field)
+	}
+	switch v := raw.(type) {
+	case string:
+		return v, nil
+	case nil:
+		return "", fmt.Errorf("vault secret '%s' field '%s' is empty", path, field)
+	default:
+		return fmt.Sprint(v), nil
+	}
+}
+
+func (p *Provider) read(now time.Time, path string) (*cachedSecret, error) {
+	resp, err := p.client.Read(path)
+	if err != nil {
+		return nil, fmt.Errorf("could not read vault secret '%s': %v", path, err)
+	}
+	secret := &cachedSecret{
+		fields:        resp.Fields(),
+		leaseId:       resp.LeaseId,
+		leaseDuration: resp.LeaseDuration,
+		renewable:     resp.Renewable,
+	}
+	if secret.leaseId != "" && secret.leaseDuration > 0 {
+		secret.refreshAt = now.Add(renewAfter(secret.leaseDuration))
+	} else {
+		secret.refreshAt = now.Add(p.kvRefresh)
+	}
+	return secret, nil
+}
+
+// OnChange registers f to be called after any cached secret changes value. f returns an error if anything is still
+// using the old secrets, in which case their leases aren't revoked
+func (p *Provider) OnChange(f func() error) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	p.listeners = append(p.listeners, f)
+}
+
+// Refresh renews or re-reads anything due at now, and notifies listeners if a secret changed
+func (p *Provider) Refresh(now time.Time) error {
+	p.refreshLock.Lock()
+	defer p.refreshLock.Unlock()
+
+	p.lock.Lock()
+	tokenDue := !p.tokenRefreshAt.IsZero() && !now.Before(p.tokenRefreshAt)
+	tokenRenewable := p.tokenRenewable
+	due := map[string]*cachedSecret{}
+	for path, secret := range p.secrets {
+		if !now.Before(secret.refreshAt) {
+			due[path] = secret
+		}
+	}
+	listeners := append([]func() error{}, p.listeners...)
+	p.lock.Unlock()
+
+	var errs []string
+	if tokenDue {
+		if err := p.refreshToken(now, tokenRenewable); err != nil {
+			errs = append(errs, err.Error())
+		}
+	}
+	changed := false
+	updated := map[string]*cachedSecret{}
+	// replaced are the leases of secrets that have been read again, revoked once listeners have stopped using them
+	var replaced []string
+	for path, secret := range due {
+		if secret.leaseId != "" && secret.renewable {
+			if refreshAt, ok := p.renewLease(now, secret); ok {
+				renewed := *secret
+				renewed.refreshAt = refreshAt
+				updated[path] = &renewed
+				continue
+			}
+		}
+		fresh, err := p.read(now, path)
+		if err != nil {
+			// Keep serving the old value and try again on the next check
+			errs = append(errs, err.Error())
+			continue
+		}
+		if !reflect.DeepEqual(fresh.fields, secret.fields) {
+			changed = true
+		}
+		if secret.leaseId != "" && secret.leaseId != fresh.leaseId {
+			replaced = append(replaced, secret.leaseId)
+		}
+		updated[path] = fresh
+	}
+	p.lock.Lock()
+	for path, secret := range updated {
+		p.secrets[path] = secret
+	}
+	p.lock.Unlock()
+
+	if changed {
+		for _, l := range listeners {
+			if err := l(); err != nil {
+				// The old secrets are still in use, so their leases are left to run out on their own
+				errs = append(errs, err.Error())
+				replaced = nil
+			}
+		}
+	}
+	for _, leaseId := range replaced {
+		p.revoke(leaseId)
+	}
+	if len(errs) > 0 {
+		return fmt.Errorf("vault refresh failed: %s", strings.Join(errs, "; "))
+	}
+	return nil
+}
+
+func (p *Provider) revoke(leaseId string) {
+	if err := p.client.RevokeLease(leaseId); err != nil {
+		// The lease runs out on its own eventually
+		logrus.Warnf("could not revoke vault lease: %v", err)
+	}
+}
+
+func (p *Provider) refreshToken(now time.Time, renewable bool) error {
+	if renewable {
+		if auth, err := p.client.RenewSelf(); err == nil {
+			p.lock.Lock()
+			p.scheduleToken(now, auth)
+			p.lock.Unlock()
+			return nil
+		} else {
+			logrus.Warnf("could not renew vault token, logging in again: %v", err)
+		}
+	}
+	return p.login(now)
+}
+
+// renewLease tries to extend secret's lease, returning when it is next due, or false if the secret should be re-read
+// instead. Once a lease approaches its max TTL Vault hands back ever shorter renewals, so at that point the secret is
+// rotated
+func (p *Provider) renewLease(now time.Time, secret *cachedSecret) (time.Time, bool) {
+	resp, err := p.client.RenewLease(secret.leaseId, secret.leaseDuration)
+	if err != nil {
+		logrus.Warnf("could not renew vault lease, reading a new secret: %v", err)
+		return time.Time{}, false
+	}
+	if resp.LeaseDuration*2 < secret.leaseDuration {
+		return time.Time{}, false
+	}
+	return now.Add(renewAfter(resp.LeaseDuration)), true
+}
+
+// Run refreshes secrets until ctx is cancelled
+func (p *Provider) Run(ctx context.Context) {
+	ticker := time.NewTicker(p.checkInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			if err := p.Refresh(now); err != nil {
+				logrus.Errorf("%v", err)
+			}
+		}
+	}
+}
+
+// renewAfter returns how long to wait before renewing a lease of leaseSeconds, leaving a third of it spare
+func renewAfter(leaseSeconds int) time.Duration {
+	return time.Duration(leaseSeconds) * time.Second * 2 / 3
+}
+
+// NewProvider returns a Provider for the given config. Login must be called before secrets can be resolved
+func NewProvider(conf *config.VaultConfig) (*Provider, error) {
+	if conf.Address == "" {
+		return nil, fmt.Errorf("vault address must be set")
+	}
+	return &Provider{
+		client:        NewClient(conf.Address, conf.Namespace),
+		conf:          conf,
+		kvRefresh:     conf.KVRefreshInterval.Or(defaultKVRefreshInterval),
+		checkInterval: defaultCheckInterval,
+		secrets:       map[string]*cachedSecret{},
+	}, nil
+}
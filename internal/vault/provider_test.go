@@ -0,0 +1,266 @@
+package vault
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/threetoes/peeper/internal/config"
+)
+
+// fakeVault is just enough of the Vault HTTP API to exercise the provider
+type fakeVault struct {
+	lock         sync.Mutex
+	kvPassword   string
+	dbGeneration int
+	renewals     int
+	maxedOut     bool
+	logins       int
+	revoked      []string
+	// requests, if set, is sent each request's path before it is served
+	requests chan string
+}
+
+func (f *fakeVault) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
+	if f.requests != nil {
+		f.requests <- req.URL.Path
+	}
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	if req.URL.Path != "/v1/auth/approle/login" && req.Header.Get("X-Vault-Token") != "test-token" {
+		rw.WriteHeader(http.StatusForbidden)
+		return
+	}
+	var resp interface{}
+	switch req.URL.Path {
+	case "/v1/auth/approle/login":
+		var body map[string]string
+		json.NewDecoder(req.Body).Decode(&body)
+		if body["role_id"] != "role" || body["secret_id"] != "secret" {
+			rw.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		f.logins++
+		resp = map[string]interface{}{
+			"auth": map[string]interface{}{"client_token": "test-token", "lease_duration": 3600, "renewable": true},
+		}
+	case "/v1/secret/data/cats":
+		resp = map[string]interface{}{
+			"data": map[string]interface{}{
+				"data":     map[string]interface{}{"username": "bigboss", "password": f.kvPassword},
+				"metadata": map[string]interface{}{"version": 1},
+			},
+		}
+	case "/v1/database/creds/readonly":
+		f.dbGeneration++
+		resp = map[string]interface{}{
+			"lease_id":       fmt.Sprintf("database/creds/readonly/%d", f.dbGeneration),
+			"lease_duration": 3,
+			"renewable":      true,
+			"data": map[string]interface{}{
+				"username": "v-user-" + string(rune('0'+f.dbGeneration)),
+				"password": "pw",
+			},
+		}
+	case "/v1/sys/leases/renew":
+		f.renewals++
+		duration := 3
+		if f.maxedOut {
+			duration = 1
+		}
+		resp = map[string]interface{}{"lease_id": fmt.Sprintf("database/creds/readonly/%d", f.dbGeneration), "lease_duration": duration, "renewable": true}
+	case "/v1/sys/leases/revoke":
+		var body map[string]string
+		json.NewDecoder(req.Body).Decode(&body)
+		f.revoked = append(f.revoked, body["lease_id"])
+		rw.WriteHeader(http.StatusNoContent)
+		return
+	default:
+		rw.WriteHeader(http.StatusNotFound)
+		return
+	}
+	json.NewEncoder(rw).Encode(resp)
+}
+
+func newTestProvider(t *testing.T, fake *fakeVault) (*Provider, func()) {
+	svr := httptest.NewServer(fake)
+	p, err := NewProvider(&config.VaultConfig{
+		Address: svr.URL,
+		AppRole: &config.VaultAppRoleConfig{RoleId: "role", SecretId: "secret"},
+	})
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	if !assert.NoError(t, p.Login()) {
+		t.FailNow()
+	}
+	return p, svr.Close
+}
+
+func TestProvider_Resolve(t *testing.T) {
+	fake := &fakeVault{kvPassword: "5n@ke3a7eR"}
+	p, stop := newTestProvider(t, fake)
+	defer stop()
+
+	tests := []struct {
+		name    string
+		value   string
+		want    string
+		wantErr bool
+	}{
+		{name: "plain value", value: "not a secret", want: "not a secret"},
+		{name: "kv v2 field", value: "vault:secret/data/cats#password", want: "5n@ke3a7eR"},
+		{name: "dynamic secret field", value: "vault:database/creds/readonly#password", want: "pw"},
+		{name: "missing field", value: "vault:secret/data/cats#nope", wantErr: true},
+		{name: "missing path", value: "vault:secret/data/dogs#password", wantErr: true},
+		{name: "malformed reference", value: "vault:secret/data/cats", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := p.Resolve(tt.value)
+			if tt.wantErr {
+				assert.Error(t, err)
+				return
+			}
+			assert.NoError(t, err)
+			assert.Equal(t, tt.want, got)
+		})
+	}
+
+	// Fields from the same dynamic secret must come from a single lease
+	_, err := p.Resolve("vault:database/creds/readonly#username")
+	assert.NoError(t, err)
+	assert.Equal(t, 1, fake.dbGeneration)
+}
+
+func TestProvider_Refresh(t *testing.T) {
+	t.Run("renews leases before expiry", func(t *testing.T) {
+		fake := &fakeVault{}
+		p, stop := newTestProvider(t, fake)
+		defer stop()
+		changes := 0
+		p.OnChange(func() error {
+			changes++
+			return nil
+		})
+
+		user, err := p.Resolve("vault:database/creds/readonly#username")
+		assert.NoError(t, err)
+		assert.NoError(t, p.Refresh(time.Now().Add(2500*time.Millisecond)))
+		assert.Equal(t, 1, fake.renewals)
+		assert.Equal(t, 0, changes)
+		again, _ := p.Resolve("vault:database/creds/readonly#username")
+		assert.Equal(t, user, again)
+	})
+	t.Run("rotates leases that can no longer be renewed", func(t *testing.T) {
+		fake := &fakeVault{maxedOut: true}
+		p, stop := newTestProvider(t, fake)
+		defer stop()
+		changes := 0
+		p.OnChange(func() error {
+			changes++
+			fake.lock.Lock()
+			defer fake.lock.Unlock()
+			assert.Empty(t, fake.revoked, "the old lease is kept until the new secret is in use")
+			return nil
+		})
+
+		user, err := p.Resolve("vault:database/creds/readonly#username")
+		assert.NoError(t, err)
+		assert.NoError(t, p.Refresh(time.Now().Add(2500*time.Millisecond)))
+		assert.Equal(t, 1, changes)
+		rotated, _ := p.Resolve("vault:database/creds/readonly#username")
+		assert.NotEqual(t, user, rotated)
+		assert.Equal(t, []string{"database/creds/readonly/1"}, fake.revoked)
+	})
+	t.Run("keeps the old lease when a listener fails", func(t *testing.T) {
+		fake := &fakeVault{maxedOut: true}
+		p, stop := newTestProvider(t, fake)
+		defer stop()
+		p.OnChange(func() error {
+			return fmt.Errorf("could not refresh credentials")
+		})
+
+		_, err := p.Resolve("vault:database/creds/readonly#username")
+		assert.NoError(t, err)
+		assert.Error(t, p.Refresh(time.Now().Add(2500*time.Millisecond)))
+		assert.Empty(t, fake.revoked)
+	})
+	t.Run("picks up new kv versions", func(t *testing.T) {
+		fake := &fakeVault{kvPassword: "old"}
+		p, stop := newTestProvider(t, fake)
+		defer stop()
+		changes := 0
+		p.OnChange(func() error {
+			changes++
+			return nil
+		})
+
+		_, err := p.Resolve("vault:secret/data/cats#password")
+		assert.NoError(t, err)
+		assert.NoError(t, p.Refresh(time.Now()))
+		assert.Equal(t, 0, changes)
+
+		fake.lock.Lock()
+		fake.kvPassword = "new"
+		fake.lock.Unlock()
+		assert.NoError(t, p.Refresh(time.Now().Add(defaultKVRefreshInterval)))
+		assert.Equal(t, 1, changes)
+		got, _ := p.Resolve("vault:secret/data/cats#password")
+		assert.Equal(t, "new", got)
+	})
+}
+
+func TestProvider_SlowRefresh(t *testing.T) {
+	fake := &fakeVault{}
+	p, stop := newTestProvider(t, fake)
+	defer stop()
+	_, err := p.Resolve("vault:database/creds/readonly#username")
+	assert.NoError(t, err)
+
+	fake.lock.Lock()
+	fake.requests = make(chan string, 1)
+	refreshed := make(chan error)
+	go func() {
+		refreshed <- p.Refresh(time.Now().Add(2500 * time.Millisecond))
+	}()
+	assert.Equal(t, "/v1/sys/leases/renew", <-fake.requests)
+	// The refresh is stuck waiting on vault, which mustn't hold up lookups of secrets that are already cached
+	resolved := make(chan error)
+	go func() {
+		_, err := p.Resolve("vault:database/creds/readonly#password")
+		resolved <- err
+	}()
+	select {
+	case err := <-resolved:
+		assert.NoError(t, err)
+	case <-time.After(time.Second):
+		t.Error("lookup blocked behind the refresh")
+	}
+	fake.lock.Unlock()
+	assert.NoError(t, <-refreshed)
+	if t.Failed() {
+		<-resolved
+	}
+}
+
+func TestProvider_TokenFile(t *testing.T) {
+	svr := httptest.NewServer(&fakeVault{kvPassword: "pw"})
+	defer svr.Close()
+	tokenFile := filepath.Join(t.TempDir(), "token")
+	assert.NoError(t, os.WriteFile(tokenFile, []byte("test-token\n"), 0600))
+
+	p, err := NewProvider(&config.VaultConfig{Address: svr.URL, TokenFile: tokenFile})
+	assert.NoError(t, err)
+	assert.NoError(t, p.Login())
+	got, err := p.Resolve("vault:secret/data/cats#password")
+	assert.NoError(t, err)
+	assert.Equal(t, "pw", got)
+}